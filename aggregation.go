@@ -0,0 +1,396 @@
+package gorrion
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// aggregation methods, min, max, avg and sum of the numbers among the values,
+// count, first and last of all of them
+const (
+	AggrMin   = "min"
+	AggrMax   = "max"
+	AggrAvg   = "avg"
+	AggrSum   = "sum"
+	AggrCount = "count"
+	AggrFirst = "first"
+	AggrLast  = "last"
+)
+
+// periods the values are aggregated by
+const (
+	PeriodSecond = "second"
+	PeriodMinute = "minute"
+	PeriodHour   = "hour"
+	PeriodDay    = "day"
+	PeriodMonth  = "month"
+)
+
+// startField is the start of the period of a rollup
+const startField = "start"
+
+// periodParts are the date parts starting a period, from the coarsest, and
+// the operators taking them from a date
+var periodParts = []struct{ period, part, operator string }{
+	{PeriodMonth, "month", "$month"},
+	{PeriodDay, "day", "$dayOfMonth"},
+	{PeriodHour, "hour", "$hour"},
+	{PeriodMinute, "minute", "$minute"},
+	{PeriodSecond, "second", "$second"},
+}
+
+// rollupPeriods are the periods the history is added up by as it is written,
+// kept for longer than the points, from the coarsest
+var rollupPeriods = []struct {
+	period string
+	d      time.Duration
+}{
+	{PeriodHour, time.Hour},
+	{PeriodMinute, time.Minute},
+}
+
+// HistoryAggregation selects the points of an attribute to aggregate by
+// Period, in Location, UTC if nil, with the methods in Methods. The bounds of
+// HistoryQuery apply to the points and its page to the periods. Periods of a
+// minute or longer are aggregated from the rollups of the history, whole, so
+// then the lower bound is rounded down to the start of the rollup it is in and
+// the upper bound up to the end of its rollup: the points after it in that
+// rollup are counted as well.
+type HistoryAggregation struct {
+	HistoryQuery
+	Methods  []string
+	Period   string
+	Location *time.Location
+}
+
+// HistoryBucket is the aggregation of the values of an attribute in the
+// period starting at Start
+type HistoryBucket struct {
+	Start time.Time   `bson:"_id" json:"start"`
+	Min   interface{} `bson:"min" json:"min"`
+	Max   interface{} `bson:"max" json:"max"`
+	Avg   interface{} `bson:"avg" json:"avg"`
+	Sum   float64     `bson:"sum" json:"sum"`
+	Count int         `bson:"count" json:"count"`
+	First interface{} `bson:"first" json:"first"`
+	Last  interface{} `bson:"last" json:"last"`
+}
+
+// value returns the aggregation of b with method
+func (b *HistoryBucket) value(method string) interface{} {
+	switch method {
+	case AggrMin:
+		return b.Min
+	case AggrMax:
+		return b.Max
+	case AggrAvg:
+		return b.Avg
+	case AggrSum:
+		return b.Sum
+	case AggrCount:
+		return b.Count
+	case AggrFirst:
+		return b.First
+	}
+	return b.Last
+}
+
+func (ha *HistoryAggregation) validate() error {
+	if len(ha.Methods) == 0 {
+		return ErrInvalidAggrMethod
+	}
+	for _, m := range ha.Methods {
+		switch m {
+		case AggrMin, AggrMax, AggrAvg, AggrSum, AggrCount, AggrFirst, AggrLast:
+		default:
+			return ErrInvalidAggrMethod
+		}
+	}
+	switch ha.Period {
+	case PeriodSecond, PeriodMinute, PeriodHour, PeriodDay, PeriodMonth:
+	default:
+		return ErrInvalidAggrPeriod
+	}
+	if ha.Location != nil && ha.Location.String() == "Local" {
+		// only the server knows which one it is
+		return ErrInvalidTimezone
+	}
+	return nil
+}
+
+// rollupColl is the name of the collection of the rollups of the history by
+// period
+func (st *Store) rollupColl(period string) string {
+	return st.config.HistoryColl + "_" + period
+}
+
+// numericValue returns v as a float64, if it is a number
+func numericValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// rollupUpdate is the update adding p to the rollup of its period
+func rollupUpdate(p *HistoryPoint) bson.M {
+	inc := bson.M{"count": 1}
+	update := bson.M{
+		"$inc":         inc,
+		"$setOnInsert": bson.M{"first": p.Value},
+		"$set":         bson.M{"last": p.Value},
+	}
+	if v, ok := numericValue(p.Value); ok {
+		inc["nums"] = 1
+		inc["sum"] = v
+		update["$min"] = bson.M{"min": v}
+		update["$max"] = bson.M{"max": v}
+	}
+	return update
+}
+
+// rollUp adds points, *HistoryPoint, to the rollups of the history
+func (st *Store) rollUp(ctx context.Context, points []interface{}) error {
+	for _, r := range rollupPeriods {
+		err := st.runCol(ctx, func() string { return st.rollupColl(r.period) }, false, func(col *mgo.Collection) error {
+			for _, p := range points {
+				p := p.(*HistoryPoint)
+				selector := bson.M{"entity": p.Entity, "attr": p.Attr, startField: p.RecvTime.Truncate(r.d)}
+				update := rollupUpdate(p)
+				_, err := col.Upsert(selector, update)
+				if mgo.IsDup(err) {
+					// created by someone else in the meantime, updated now
+					_, err = col.Upsert(selector, update)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollupFor returns the period of the rollups the periods of ha can be
+// aggregated from, between from and to, none if the offsets of its location
+// are not in whole rollup periods then
+func rollupFor(ha *HistoryAggregation, loc *time.Location, from, to time.Time) string {
+	if ha.Period == PeriodSecond {
+		return ""
+	}
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	for _, r := range rollupPeriods {
+		if r.d == time.Hour && ha.Period == PeriodMinute {
+			continue
+		}
+		fits := true
+		for t := from.In(loc); fits && t.Before(to); {
+			_, offset := t.Zone()
+			fits = time.Duration(offset)*time.Second%r.d == 0
+			_, end := t.ZoneBounds()
+			if end.IsZero() {
+				break
+			}
+			t = end
+		}
+		if fits {
+			return r.period
+		}
+	}
+	return ""
+}
+
+// bucketExpr is the start of the period, in the time zone tz, of the date in
+// field
+func bucketExpr(field, period, tz string) bson.M {
+	date := bson.M{"date": field, "timezone": tz}
+	parts := bson.M{"year": bson.M{"$year": date}, "timezone": tz}
+	for _, p := range periodParts {
+		parts[p.part] = bson.M{p.operator: date}
+		if p.period == period {
+			break
+		}
+	}
+	return bson.M{"$dateFromParts": parts}
+}
+
+// pointsGroup aggregates the points of the history in the periods of key
+func pointsGroup(key bson.M) bson.M {
+	isNumber := bson.M{"$in": []interface{}{bson.M{"$type": "$value"}, []string{"double", "int", "long", "decimal"}}}
+	number := bson.M{"$cond": []interface{}{isNumber, "$value", nil}}
+	return bson.M{
+		"_id":   key,
+		"count": bson.M{"$sum": 1},
+		"nums":  bson.M{"$sum": bson.M{"$cond": []interface{}{isNumber, 1, 0}}},
+		"sum":   bson.M{"$sum": number},
+		"min":   bson.M{"$min": number},
+		"max":   bson.M{"$max": number},
+		"first": bson.M{"$first": "$value"},
+		"last":  bson.M{"$last": "$value"},
+	}
+}
+
+// rollupsGroup aggregates the rollups of the history in the periods of key
+func rollupsGroup(key bson.M) bson.M {
+	return bson.M{
+		"_id":   key,
+		"count": bson.M{"$sum": "$count"},
+		"nums":  bson.M{"$sum": "$nums"},
+		"sum":   bson.M{"$sum": "$sum"},
+		"min":   bson.M{"$min": "$min"},
+		"max":   bson.M{"$max": "$max"},
+		"first": bson.M{"$first": "$first"},
+		"last":  bson.M{"$last": "$last"},
+	}
+}
+
+// AggregateHistory returns the aggregation of the values of the attribute
+// name of the entity ei, by the periods of ha, oldest first. The periods
+// without values are left out.
+func (st *Store) AggregateHistory(ctx context.Context, ei EntityID, name string, ha *HistoryAggregation) (buckets []HistoryBucket, err error) {
+	ctx, op := st.startOp(ctx, "AggregateHistory", ei)
+	defer op.end(&err)
+	if err = ha.validate(); err != nil {
+		return nil, err
+	}
+	loc := ha.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	source, timeField, group := st.config.HistoryColl, recvTimeField, pointsGroup
+	from, to := ha.From, ha.To
+	if period := rollupFor(ha, loc, from, to); period != "" {
+		source, timeField, group = st.rollupColl(period), startField, rollupsGroup
+		for _, r := range rollupPeriods {
+			if r.period == period {
+				// the rollups from and to are in, to included whole
+				from, to = from.Truncate(r.d), to.Truncate(r.d)
+			}
+		}
+	}
+	op.setCollection(source)
+
+	match := bson.M{"entity": ei, "attr": name}
+	bounds := bson.M{}
+	if !from.IsZero() {
+		bounds["$gte"] = from
+	}
+	if !to.IsZero() {
+		bounds["$lte"] = to
+	}
+	if len(bounds) > 0 {
+		match[timeField] = bounds
+	}
+	order := 1
+	if ha.LastN > 0 {
+		order = -1
+	}
+	pipeline := []bson.M{
+		{"$match": match},
+		// for first and last
+		{"$sort": bson.D{{Name: timeField, Value: 1}, {Name: "_id", Value: 1}}},
+		{"$group": group(bucketExpr("$"+timeField, ha.Period, loc.String()))},
+		{"$sort": bson.M{"_id": order}},
+	}
+	if ha.LastN > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": ha.LastN})
+	} else {
+		pipeline = append(pipeline, bson.M{"$skip": ha.Offset}, bson.M{"$limit": ha.Limit})
+	}
+	pipeline = append(pipeline, bson.M{"$addFields": bson.M{
+		"avg": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{"$nums", 0}}, bson.M{"$divide": []interface{}{"$sum", "$nums"}}, nil}},
+	}})
+
+	buckets = []HistoryBucket{}
+	err = st.runCol(ctx, func() string { return source }, true, func(col *mgo.Collection) error {
+		// the pipeline takes no server time limit, the socket one applies
+		return col.Pipe(pipeline).AllowDiskUse().All(&buckets)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i := range buckets {
+		buckets[i].Start = buckets[i].Start.In(loc)
+	}
+	if ha.LastN > 0 {
+		// taken newest first
+		for i, j := 0, len(buckets)-1; i < j; i, j = i+1, j-1 {
+			buckets[i], buckets[j] = buckets[j], buckets[i]
+		}
+	}
+	op.setResultSize(len(buckets))
+	return buckets, nil
+}
+
+// historyAggregationFromRequest takes the aggregation from the URL parameters,
+// with the time zone by its IANA name
+func historyAggregationFromRequest(req *http.Request, hq *HistoryQuery) (*HistoryAggregation, error) {
+	ha := &HistoryAggregation{
+		HistoryQuery: *hq,
+		Methods:      splitParam(req, paramAggrMethod),
+		Period:       req.FormValue(paramAggrPeriod),
+	}
+	if tz := req.FormValue(paramTimezone); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil || strings.EqualFold(tz, "Local") {
+			return nil, ErrInvalidTimezone
+		}
+		ha.Location = loc
+	}
+	return ha, ha.validate()
+}
+
+// aggregatedHistory is the series of aggregations of the values of an
+// attribute
+type aggregatedHistory struct {
+	EntityID   string   `json:"entityId"`
+	EntityType string   `json:"entityType"`
+	AttrName   string   `json:"attrName"`
+	AggrPeriod string   `json:"aggrPeriod"`
+	Values     []object `json:"values"`
+}
+
+func aggregateAttrHistory(ctx context.Context, args handlerArgs, hq *HistoryQuery) (interface{}, error) {
+	ha, err := historyAggregationFromRequest(args.req, hq)
+	if err != nil {
+		return nil, err
+	}
+	name := args.vars["name"]
+	buckets, err := args.store.AggregateHistory(ctx, args.ID, name, ha)
+	if err != nil {
+		return nil, err
+	}
+	values := []object{}
+	for i := range buckets {
+		v := object{"start": buckets[i].Start}
+		for _, m := range ha.Methods {
+			v[m] = buckets[i].value(m)
+		}
+		values = append(values, v)
+	}
+	return aggregatedHistory{EntityID: args.ID.ID, EntityType: args.ID.Type, AttrName: name,
+		AggrPeriod: ha.Period, Values: values}, nil
+}
@@ -0,0 +1,206 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBucketExpr(t *testing.T) {
+	var cases = map[string][]string{
+		PeriodMonth:  {"year", "month"},
+		PeriodDay:    {"year", "month", "day"},
+		PeriodSecond: {"year", "month", "day", "hour", "minute", "second"},
+	}
+	for period, parts := range cases {
+		expr := bucketExpr("$recvTime", period, "Europe/Madrid")["$dateFromParts"].(bson.M)
+		if len(expr) != len(parts)+1 || expr["timezone"] != "Europe/Madrid" {
+			t.Errorf("%s: %s", period, gotWanted(expr, parts))
+		}
+		for _, p := range parts {
+			if _, ok := expr[p]; !ok {
+				t.Errorf("%s: %s", period, gotWanted(expr, p))
+			}
+		}
+	}
+}
+
+func TestRollupFor(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		period string
+		loc    *time.Location
+		wanted string
+	}{
+		{PeriodSecond, time.UTC, ""},
+		{PeriodMinute, time.UTC, PeriodMinute},
+		{PeriodHour, time.UTC, PeriodHour},
+		{PeriodDay, madrid, PeriodHour},
+		{PeriodMonth, kolkata, PeriodMinute},
+		{PeriodHour, time.FixedZone("odd", 90), ""},
+	}
+	for _, c := range cases {
+		ha := &HistoryAggregation{Period: c.period}
+		if got := rollupFor(ha, c.loc, from, to); got != c.wanted {
+			t.Errorf("%s %s: %s", c.period, c.loc, gotWanted(got, c.wanted))
+		}
+	}
+}
+
+func TestRollupUpdate(t *testing.T) {
+	update := rollupUpdate(&HistoryPoint{Value: 21})
+	if inc := update["$inc"].(bson.M); inc["sum"] != 21.0 || inc["nums"] != 1 || update["$min"] == nil {
+		t.Error(gotWanted(update, "a number added up"))
+	}
+	update = rollupUpdate(&HistoryPoint{Value: "ON"})
+	if inc := update["$inc"].(bson.M); inc["sum"] != nil || update["$max"] != nil || inc["count"] != 1 {
+		t.Error(gotWanted(update, "a text counted"))
+	}
+}
+
+func TestHistoryAggregationFromRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?aggrMethod=min,max&aggrPeriod=day&timezone=UTC", nil)
+	ha, err := historyAggregationFromRequest(req, &HistoryQuery{Limit: 5})
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(ha.Methods) != 2 || ha.Period != PeriodDay || ha.Location != time.UTC || ha.Limit != 5 {
+		t.Error(gotWanted(ha, "min and max by day"))
+	}
+
+	var invalid = map[string]error{
+		"aggrPeriod=day":                                      ErrInvalidAggrMethod,
+		"aggrMethod=median&aggrPeriod=day":                    ErrInvalidAggrMethod,
+		"aggrMethod=min":                                      ErrInvalidAggrPeriod,
+		"aggrMethod=min&aggrPeriod=week":                      ErrInvalidAggrPeriod,
+		"aggrMethod=min&aggrPeriod=day&timezone=Mars/Olympus": ErrInvalidTimezone,
+		"aggrMethod=min&aggrPeriod=day&timezone=Local":        ErrInvalidTimezone,
+	}
+	for params, wanted := range invalid {
+		_, err := historyAggregationFromRequest(httptest.NewRequest("GET", "/?"+params, nil), &HistoryQuery{})
+		if err != wanted {
+			t.Errorf("%s: %s", params, gotWanted(err, wanted))
+		}
+	}
+}
+
+func TestAggregateHistory(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.Store.HistoryTypes = []string{"Room"}
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	st := srv.Store()
+	dropTestCollection(t, st)
+
+	room := EntityID{ID: "Room1", Type: "Room", Service: "S"}
+	// from 23:00 in UTC it is the next day in Madrid
+	base := time.Date(2024, 1, 1, 22, 40, 0, 0, time.UTC)
+	for i, v := range []interface{}{10.0, 20.0, "OFF", 30.0, 60.0} {
+		at := base.Add(time.Duration(i) * 20 * time.Minute)
+		if err = st.insertHistory(testCtx, room, map[string]Attribute{"temperature": {Value: v}}, at); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+
+	type bucket struct {
+		start               time.Time
+		min, max, avg, last interface{}
+		count               int
+	}
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	if err != nil {
+		t.Skip(err)
+	}
+	var cases = []struct {
+		period string
+		loc    *time.Location
+		wanted []bucket
+	}{
+		{PeriodDay, time.UTC, []bucket{
+			{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 10.0, 30.0, 20.0, 30.0, 4},
+			{time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 60.0, 60.0, 60.0, 60.0, 1},
+		}},
+		{PeriodDay, madrid, []bucket{
+			{time.Date(2024, 1, 1, 0, 0, 0, 0, madrid), 10.0, 10.0, 10.0, 10.0, 1},
+			{time.Date(2024, 1, 2, 0, 0, 0, 0, madrid), 20.0, 60.0, 110.0 / 3, 60.0, 4},
+		}},
+		// from the points themselves
+		{PeriodSecond, time.UTC, []bucket{
+			{base, 10.0, 10.0, 10.0, 10.0, 1},
+			{base.Add(20 * time.Minute), 20.0, 20.0, 20.0, 20.0, 1},
+			{base.Add(40 * time.Minute), nil, nil, nil, "OFF", 1},
+			{base.Add(60 * time.Minute), 30.0, 30.0, 30.0, 30.0, 1},
+			{base.Add(80 * time.Minute), 60.0, 60.0, 60.0, 60.0, 1},
+		}},
+	}
+	for _, cs := range cases {
+		ha := &HistoryAggregation{HistoryQuery: HistoryQuery{Limit: 10}, Methods: []string{AggrMin},
+			Period: cs.period, Location: cs.loc}
+		buckets, err := st.AggregateHistory(testCtx, room, "temperature", ha)
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if len(buckets) != len(cs.wanted) {
+			t.Errorf("%s %s: %s", cs.period, cs.loc, gotWanted(buckets, cs.wanted))
+			continue
+		}
+		for i, w := range cs.wanted {
+			b := buckets[i]
+			if !b.Start.Equal(w.start) || b.Min != w.min || b.Max != w.max || b.Avg != w.avg ||
+				b.Last != w.last || b.Count != w.count {
+				t.Errorf("%s %s: %s", cs.period, cs.loc, gotWanted(b, w))
+			}
+		}
+	}
+
+	// from the rollups, whole: the upper bound is rounded up to the end of the
+	// hour, which takes the point at 23:40 as well
+	ha := &HistoryAggregation{HistoryQuery: HistoryQuery{To: base.Add(50 * time.Minute), Limit: 10},
+		Methods: []string{AggrCount}, Period: PeriodHour}
+	buckets, err := st.AggregateHistory(testCtx, room, "temperature", ha)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(buckets) != 2 || buckets[1].Count != 3 {
+		t.Error(gotWanted(buckets, "3 points from 23:00"))
+	}
+
+	// through the API, the last period only
+	req := httptest.NewRequest("GET",
+		"/v2/history/entities/Room1/attrs/temperature?type=Room&aggrMethod=sum,count&aggrPeriod=hour&lastN=1", nil)
+	req.Header.Set(headerService, "S")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal(gotWanted(w.Code, http.StatusOK), w.Body.String())
+	}
+	var h struct {
+		AggrPeriod string                   `json:"aggrPeriod"`
+		Values     []map[string]interface{} `json:"values"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &h)
+	wanted := []map[string]interface{}{{"start": "2024-01-02T00:00:00Z", "sum": 60.0, "count": 1.0}}
+	if h.AggrPeriod != PeriodHour || !equalObjects(h.Values, wanted) {
+		t.Error(gotWanted(h.Values, wanted))
+	}
+}
@@ -0,0 +1,484 @@
+package gorrion
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v2"
+)
+
+// operations granted by the policies of the auth file
+const (
+	opRead   = "read"
+	opCreate = "create"
+	opUpdate = "update"
+	opDelete = "delete"
+	opAdmin  = "admin"
+	// any of them but admin, which must be granted by name
+	opAll = "*"
+)
+
+// serverRoutes act on the whole server, not on a service, and only grants
+// for every service, "*", allow them
+var serverRoutes = map[string]bool{
+	RouteGetLogLevel: true,
+	RouteSetLogLevel: true,
+	RouteGetUsage:    true,
+	RouteMetrics:     true,
+}
+
+// routeOperations is the operation of every route that needs credentials. The
+// rest, as the health checks, are open.
+var routeOperations = map[string]string{
+	RouteListEntities:   opRead,
+	RouteGetEntity:      opRead,
+	RouteGetAttrs:       opRead,
+	RouteGetAttr:        opRead,
+	RouteGetAttrHistory: opRead,
+	RouteGetAttrValue:   opRead,
+	RouteCreateEntity:   opCreate,
+	RouteUpdateEntities: opUpdate,
+	RoutePatchEntity:    opUpdate,
+	RouteAppendAttrs:    opUpdate,
+	RouteUpdateAttrs:    opUpdate,
+	RouteReplaceAttrs:   opUpdate,
+	RouteSetAttr:        opUpdate,
+	RouteSetAttrValue:   opUpdate,
+	RouteDeleteEntities: opDelete,
+	RouteDeleteEntity:   opDelete,
+	RouteDeleteAttr:     opDelete,
+	RouteGetLogLevel:    opAdmin,
+	RouteSetLogLevel:    opAdmin,
+	RouteGetUsage:       opAdmin,
+	RouteMetrics:        opAdmin,
+
+	RouteListEntityVersions:   opRead,
+	RouteGetEntityVersion:     opRead,
+	RouteRestoreEntityVersion: opUpdate,
+
+	RouteListRegistrations:  opRead,
+	RouteGetRegistration:    opRead,
+	RouteCreateRegistration: opAdmin,
+	RouteDeleteRegistration: opAdmin,
+
+	RouteLDListEntities: opRead,
+	RouteLDGetEntity:    opRead,
+	RouteLDCreateEntity: opCreate,
+	RouteLDAppendAttrs:  opUpdate,
+	RouteLDUpdateAttrs:  opUpdate,
+	RouteLDUpdateAttr:   opUpdate,
+	RouteLDDeleteEntity: opDelete,
+	RouteLDDeleteAttr:   opDelete,
+
+	// creating and deleting through updateContext are checked by action
+	RouteV1UpdateContext:       opUpdate,
+	RouteV1QueryContext:        opRead,
+	RouteV1GetContextEntity:    opRead,
+	RouteV1AppendContextEntity: opUpdate,
+	RouteV1UpdateContextEntity: opUpdate,
+	RouteV1DeleteContextEntity: opDelete,
+}
+
+// authFile is the file with the keys and the policies, in YAML or JSON:
+//
+//	jwt:
+//	  issuer: https://idm.example.com
+//	  audience: gorrion
+//	  rolesClaim: roles
+//	  keys:
+//	    - id: idm
+//	      algorithm: RS256
+//	      publicKeyFile: idm.pem
+//	apiKeys:
+//	  - name: gateway
+//	    key: 6f1ed002ab5595859014ebf0951522d9
+//	    roles: [operator]
+//	clientCerts:
+//	  - commonName: parking-sensors
+//	    roles: [operator]
+//	roles:
+//	  operator:
+//	    - service: smartcity
+//	      servicePath: /parking
+//	      operations: [read, update]
+//
+// A role is granted the operations over the service paths in a subtree, "/"
+// for all of them, of a service, "*" for any of them. Client certificates,
+// verified against the CA bundle of the TLS configuration, are matched by the
+// common name or a DNS name of their subject.
+type authFile struct {
+	JWT struct {
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+		// claim with the role, or list of roles, of the caller
+		RolesClaim string `yaml:"rolesClaim"`
+		// roles of the values of the claim, the value itself if missing
+		RoleMap map[string][]string `yaml:"roleMap"`
+		// clock skew allowed when checking the times in the claims
+		Leeway string `yaml:"leeway"`
+		Keys   []struct {
+			// kid of the tokens signed with it, any if empty
+			ID        string `yaml:"id"`
+			Algorithm string `yaml:"algorithm"`
+			// for HMAC
+			Secret string `yaml:"secret"`
+			// PEM, relative to the auth file, for RSA, ECDSA and EdDSA
+			PublicKeyFile string `yaml:"publicKeyFile"`
+		} `yaml:"keys"`
+	} `yaml:"jwt"`
+	APIKeys []struct {
+		Name  string   `yaml:"name"`
+		Key   string   `yaml:"key"`
+		Roles []string `yaml:"roles"`
+	} `yaml:"apiKeys"`
+	ClientCerts []struct {
+		CommonName string   `yaml:"commonName"`
+		DNSName    string   `yaml:"dnsName"`
+		Roles      []string `yaml:"roles"`
+	} `yaml:"clientCerts"`
+	Roles map[string][]grant `yaml:"roles"`
+}
+
+type grant struct {
+	Service     string   `yaml:"service"`
+	ServicePath string   `yaml:"servicePath"`
+	Operations  []string `yaml:"operations"`
+}
+
+// allows tells whether g covers op over servicePath in service
+func (g grant) allows(op, service, servicePath string) bool {
+	if g.Service != "*" && g.Service != service {
+		return false
+	}
+	if g.ServicePath != "/" && servicePath != g.ServicePath &&
+		!strings.HasPrefix(servicePath, g.ServicePath+"/") {
+		return false
+	}
+	for _, o := range g.Operations {
+		if o == op || o == opAll && op != opAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// principal is the caller of a request, as told by its credentials
+type principal struct {
+	name  string
+	roles []string
+}
+
+type jwtKey struct {
+	id        string
+	algorithm string
+	key       interface{}
+}
+
+// authorizer checks the credentials of the requests and what they are allowed
+// to do
+type authorizer struct {
+	keys       []jwtKey
+	parserOpts []jwt.ParserOption
+	rolesClaim string
+	roleMap    map[string][]string
+	// by the hash of the key, not to compare the keys themselves
+	apiKeys map[[sha256.Size]byte]principal
+	// roles of the client certificates, by common name and by DNS name
+	certNames    map[string][]string
+	certDNSNames map[string][]string
+	roles        map[string][]grant
+}
+
+// loadAuthorizer reads the keys and policies in the file name
+func loadAuthorizer(name string) (*authorizer, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var f authFile
+	if err = yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	a, err := newAuthorizer(f, filepath.Dir(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return a, nil
+}
+
+// newAuthorizer builds the authorizer of f, with the files in it relative to
+// dir
+func newAuthorizer(f authFile, dir string) (*authorizer, error) {
+	a := &authorizer{
+		rolesClaim:   f.JWT.RolesClaim,
+		roleMap:      f.JWT.RoleMap,
+		apiKeys:      map[[sha256.Size]byte]principal{},
+		certNames:    map[string][]string{},
+		certDNSNames: map[string][]string{},
+		roles:        f.Roles,
+	}
+	if a.rolesClaim == "" {
+		a.rolesClaim = "roles"
+	}
+
+	for role, grants := range f.Roles {
+		for _, g := range grants {
+			if g.Service == "" {
+				return nil, fmt.Errorf("role %q: missing service", role)
+			}
+			if !strings.HasPrefix(g.ServicePath, "/") {
+				return nil, fmt.Errorf("role %q: service path %q does not start with /", role, g.ServicePath)
+			}
+			for _, op := range g.Operations {
+				switch op {
+				case opRead, opCreate, opUpdate, opDelete, opAdmin, opAll:
+				default:
+					return nil, fmt.Errorf("role %q: unknown operation %q", role, op)
+				}
+			}
+		}
+	}
+
+	for _, k := range f.APIKeys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key %q: empty key", k.Name)
+		}
+		for _, role := range k.Roles {
+			if _, ok := f.Roles[role]; !ok {
+				return nil, fmt.Errorf("API key %q: unknown role %q", k.Name, role)
+			}
+		}
+		a.apiKeys[sha256.Sum256([]byte(k.Key))] = principal{name: k.Name, roles: k.Roles}
+	}
+
+	for _, c := range f.ClientCerts {
+		name := c.CommonName
+		if name == "" {
+			name = c.DNSName
+		}
+		if (c.CommonName == "") == (c.DNSName == "") {
+			return nil, fmt.Errorf("client certificate %q: needs either a common name or a DNS name", name)
+		}
+		for _, role := range c.Roles {
+			if _, ok := f.Roles[role]; !ok {
+				return nil, fmt.Errorf("client certificate %q: unknown role %q", name, role)
+			}
+		}
+		if c.CommonName != "" {
+			a.certNames[c.CommonName] = c.Roles
+		} else {
+			a.certDNSNames[c.DNSName] = c.Roles
+		}
+	}
+
+	var methods []string
+	for _, k := range f.JWT.Keys {
+		key, err := parseJWTKey(k.Algorithm, k.Secret, k.PublicKeyFile, dir)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q: %v", k.ID, err)
+		}
+		a.keys = append(a.keys, jwtKey{id: k.ID, algorithm: k.Algorithm, key: key})
+		methods = append(methods, k.Algorithm)
+	}
+	a.parserOpts = []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired()}
+	if f.JWT.Issuer != "" {
+		a.parserOpts = append(a.parserOpts, jwt.WithIssuer(f.JWT.Issuer))
+	}
+	if f.JWT.Audience != "" {
+		a.parserOpts = append(a.parserOpts, jwt.WithAudience(f.JWT.Audience))
+	}
+	if f.JWT.Leeway != "" {
+		d, err := time.ParseDuration(f.JWT.Leeway)
+		if err != nil {
+			return nil, fmt.Errorf("JWT leeway: %v", err)
+		}
+		a.parserOpts = append(a.parserOpts, jwt.WithLeeway(d))
+	}
+	return a, nil
+}
+
+// parseJWTKey returns the key to verify the tokens signed with algorithm
+func parseJWTKey(algorithm, secret, publicKeyFile, dir string) (interface{}, error) {
+	method := jwt.GetSigningMethod(algorithm)
+	if method == nil || method == jwt.SigningMethodNone {
+		return nil, fmt.Errorf("unknown algorithm %q", algorithm)
+	}
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		if secret == "" {
+			return nil, errors.New("missing secret")
+		}
+		return []byte(secret), nil
+	}
+	if publicKeyFile == "" {
+		return nil, errors.New("missing public key file")
+	}
+	if !filepath.IsAbs(publicKeyFile) {
+		publicKeyFile = filepath.Join(dir, publicKeyFile)
+	}
+	pem, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		return jwt.ParseRSAPublicKeyFromPEM(pem)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPublicKeyFromPEM(pem)
+	case *jwt.SigningMethodEd25519:
+		return jwt.ParseEdPublicKeyFromPEM(pem)
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+}
+
+// keyFunc returns the keys that may have signed t, those for its algorithm
+// and, if it tells, with its kid
+func (a *authorizer) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	var set jwt.VerificationKeySet
+	for _, k := range a.keys {
+		if k.algorithm == t.Method.Alg() && (kid == "" || k.id == "" || k.id == kid) {
+			set.Keys = append(set.Keys, k.key)
+		}
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("no key for the token")
+	}
+	return set, nil
+}
+
+// authenticate returns the caller of req, from the bearer token in its
+// Authorization header, an API key or a JWT, or else from its verified client
+// certificate
+func (a *authorizer) authenticate(req *http.Request) (principal, error) {
+	const bearer = "bearer "
+	h := req.Header.Get("Authorization")
+	if h == "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		return a.certPrincipal(req.TLS.VerifiedChains[0][0])
+	}
+	if len(h) <= len(bearer) || !strings.EqualFold(h[:len(bearer)], bearer) {
+		return principal{}, ErrUnauthorized
+	}
+	token := strings.TrimSpace(h[len(bearer):])
+	if p, ok := a.apiKeys[sha256.Sum256([]byte(token))]; ok {
+		return p, nil
+	}
+	if len(a.keys) == 0 {
+		return principal{}, ErrUnauthorized
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(token, claims, a.keyFunc, a.parserOpts...); err != nil {
+		return principal{}, ErrUnauthorized
+	}
+	p := principal{}
+	p.name, _ = claims.GetSubject()
+	var values []string
+	switch v := claims[a.rolesClaim].(type) {
+	case string:
+		values = []string{v}
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, v := range values {
+		if roles, ok := a.roleMap[v]; ok {
+			p.roles = append(p.roles, roles...)
+		} else {
+			p.roles = append(p.roles, v)
+		}
+	}
+	return p, nil
+}
+
+// certPrincipal returns the caller with the verified client certificate cert,
+// named after its subject
+func (a *authorizer) certPrincipal(cert *x509.Certificate) (principal, error) {
+	if roles, ok := a.certNames[cert.Subject.CommonName]; ok {
+		return principal{name: cert.Subject.CommonName, roles: roles}, nil
+	}
+	for _, name := range cert.DNSNames {
+		if roles, ok := a.certDNSNames[name]; ok {
+			return principal{name: name, roles: roles}, nil
+		}
+	}
+	return principal{}, ErrUnauthorized
+}
+
+// authorize checks p is allowed op over every service path in service
+func (a *authorizer) authorize(p principal, op, service string, servicePaths []string) error {
+	for _, sp := range servicePaths {
+		if !a.allows(p, op, service, sp) {
+			return ErrForbidden
+		}
+	}
+	return nil
+}
+
+func (a *authorizer) allows(p principal, op, service, servicePath string) bool {
+	for _, role := range p.roles {
+		for _, g := range a.roles[role] {
+			if g.allows(op, service, servicePath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestServicePaths returns the service paths of req, a list of them in
+// queries, with "/" if it has none. A trailing "/#", for the subtree in
+// queries, needs the same grants as the path itself.
+func requestServicePaths(req *http.Request) []string {
+	h := req.Header.Get(headerServicePath)
+	if strings.TrimSpace(h) == "" {
+		return []string{"/"}
+	}
+	var paths []string
+	for _, sp := range strings.Split(h, ",") {
+		sp = strings.TrimSpace(sp)
+		sp = strings.TrimSuffix(sp, "/#")
+		if sp == "" {
+			sp = "/"
+		}
+		paths = append(paths, sp)
+	}
+	return paths
+}
+
+// authorizeAlso checks the caller of a request, to a route that may do more
+// than its operation, can also do op
+func (srv *Server) authorizeAlso(args handlerArgs, op string) error {
+	if srv.auth == nil {
+		return nil
+	}
+	return srv.auth.authorize(args.caller, op, args.req.Header.Get(headerService), requestServicePaths(args.req))
+}
+
+// checkAuth returns the caller of req to route, if the route needs
+// credentials, after checking it is allowed to use it
+func (srv *Server) checkAuth(w http.ResponseWriter, req *http.Request, route string) (principal, error) {
+	op, ok := routeOperations[route]
+	if srv.auth == nil || !ok {
+		return principal{}, nil
+	}
+	p, err := srv.auth.authenticate(req)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gorrion"`)
+		return p, err
+	}
+	service, paths := req.Header.Get(headerService), requestServicePaths(req)
+	if serverRoutes[route] {
+		service, paths = "*", []string{"/"}
+	}
+	return p, srv.auth.authorize(p, op, service, paths)
+}
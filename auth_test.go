@@ -0,0 +1,353 @@
+package gorrion
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testAuthorizer(t *testing.T) *authorizer {
+	a, err := loadAuthorizer("testdata/auth.yaml")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return a
+}
+
+func bearer(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func hs256(t *testing.T, claims jwt.MapClaims, secret string) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return token
+}
+
+func TestLoadAuthorizer_Invalid(t *testing.T) {
+	var cases = []struct {
+		file, wanted string
+	}{
+		{"roles: {r: [{service: s, servicePath: /, operations: [write]}]}", `unknown operation "write"`},
+		{"roles: {r: [{service: s, servicePath: p, operations: [read]}]}", "does not start with /"},
+		{"apiKeys: [{name: k, key: x, roles: [r]}]", `unknown role "r"`},
+		{"jwt: {keys: [{id: k, algorithm: HS256}]}", "missing secret"},
+		{"jwt: {keys: [{id: k, algorithm: none}]}", "unknown algorithm"},
+		{"jwt: {keys: [{id: k, algorithm: RS256, publicKeyFile: missing.pem}]}", "missing.pem"},
+		{"clientCerts: [{roles: []}]", "needs either a common name or a DNS name"},
+		{"clientCerts: [{commonName: c, roles: [r]}]", `unknown role "r"`},
+		{"apikeys: []", "apikeys"},
+	}
+	dir := t.TempDir()
+	for _, c := range cases {
+		name := filepath.Join(dir, "auth.yaml")
+		if err := os.WriteFile(name, []byte(c.file), 0600); err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if _, err := loadAuthorizer(name); err == nil || !strings.Contains(err.Error(), c.wanted) {
+			t.Errorf("%s: %s", c.file, gotWanted(err, c.wanted))
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := testAuthorizer(t)
+	valid := jwt.MapClaims{
+		"sub":    "alice",
+		"iss":    "https://idm.example.com",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"groups": []string{"city-ops", "admin"},
+	}
+
+	p, err := a.authenticate(bearer(hs256(t, valid, "not-so-secret")))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if p.name != "alice" || strings.Join(p.roles, ",") != "operator,admin" {
+		t.Errorf("unexpected principal %+v", p)
+	}
+
+	p, err = a.authenticate(bearer("gateway-key"))
+	if err != nil || p.name != "gateway" {
+		t.Errorf("unexpected principal %+v, %v", p, err)
+	}
+
+	expired := jwt.MapClaims{"sub": "alice", "iss": "https://idm.example.com", "exp": time.Now().Add(-time.Hour).Unix()}
+	otherIssuer := jwt.MapClaims{"sub": "alice", "iss": "https://evil.example.com", "exp": time.Now().Add(time.Hour).Unix()}
+	noExpiry := jwt.MapClaims{"sub": "alice", "iss": "https://idm.example.com"}
+	for name, req := range map[string]*http.Request{
+		"no header":    httptest.NewRequest("GET", "/", nil),
+		"unknown key":  bearer("other-key"),
+		"wrong secret": bearer(hs256(t, valid, "guessed")),
+		"expired":      bearer(hs256(t, expired, "not-so-secret")),
+		"other issuer": bearer(hs256(t, otherIssuer, "not-so-secret")),
+		"no expiry":    bearer(hs256(t, noExpiry, "not-so-secret")),
+		"basic":        {Header: http.Header{"Authorization": {"Basic Z2F0ZXdheS1rZXk6"}}},
+	} {
+		if _, err := a.authenticate(req); err != ErrUnauthorized {
+			t.Error(gotWanted(err, ErrUnauthorized) + " (" + name + ")")
+		}
+	}
+}
+
+func TestAuthenticate_RS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "idm.pem"), pub, 0600); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	file := "jwt: {keys: [{id: idm, algorithm: RS256, publicKeyFile: idm.pem}]}"
+	if err = os.WriteFile(filepath.Join(dir, "auth.yaml"), []byte(file), 0600); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	a, err := loadAuthorizer(filepath.Join(dir, "auth.yaml"))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	claims := jwt.MapClaims{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix(), "roles": "admin"}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idm"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if p, err := a.authenticate(bearer(signed)); err != nil || p.name != "bob" || len(p.roles) != 1 {
+		t.Errorf("unexpected principal %+v, %v", p, err)
+	}
+
+	// the public key taken as an HMAC secret
+	if _, err := a.authenticate(bearer(hs256(t, claims, string(pub)))); err != ErrUnauthorized {
+		t.Error(gotWanted(err, ErrUnauthorized))
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := testAuthorizer(t)
+	operator := principal{name: "gateway", roles: []string{"operator"}}
+	var cases = []struct {
+		op, service string
+		paths       []string
+		wanted      error
+	}{
+		{opRead, "smartcity", []string{"/"}, nil},
+		{opRead, "smartcity", []string{"/lighting/zone1"}, nil},
+		{opUpdate, "smartcity", []string{"/parking"}, nil},
+		{opUpdate, "smartcity", []string{"/parking/north"}, nil},
+		{opUpdate, "smartcity", []string{"/parkings"}, ErrForbidden},
+		{opUpdate, "smartcity", []string{"/parking", "/lighting"}, ErrForbidden},
+		{opDelete, "smartcity", []string{"/parking"}, ErrForbidden},
+		{opRead, "othercity", []string{"/"}, ErrForbidden},
+		{opAdmin, "", []string{"/"}, ErrForbidden},
+	}
+	for _, c := range cases {
+		if got := a.authorize(operator, c.op, c.service, c.paths); got != c.wanted {
+			t.Errorf("%s %s %v: %s", c.op, c.service, c.paths, gotWanted(got, c.wanted))
+		}
+	}
+	admin := principal{name: "root", roles: []string{"admin"}}
+	if err := a.authorize(admin, opDelete, "any", []string{"/a/b"}); err != nil {
+		t.Error(unexpected(err))
+	}
+	// "*" does not grant admin
+	all := principal{name: "all", roles: []string{"smartcity-all"}}
+	if err := a.authorize(all, opDelete, "smartcity", []string{"/"}); err != nil {
+		t.Error(unexpected(err))
+	}
+	if err := a.authorize(all, opAdmin, "smartcity", []string{"/"}); err != ErrForbidden {
+		t.Error(gotWanted(err, ErrForbidden))
+	}
+	if err := a.authorize(principal{}, opRead, "smartcity", []string{"/"}); err != ErrForbidden {
+		t.Error(gotWanted(err, ErrForbidden))
+	}
+}
+
+func TestRequestServicePaths(t *testing.T) {
+	var cases = map[string]string{
+		"":                    "/",
+		"/parking":            "/parking",
+		"/parking/#":          "/parking",
+		"/parking, /lighting": "/parking,/lighting",
+	}
+	for h, wanted := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(headerServicePath, h)
+		if got := strings.Join(requestServicePaths(req), ","); got != wanted {
+			t.Error(gotWanted(got, wanted))
+		}
+	}
+}
+
+func TestParseServicePath(t *testing.T) {
+	var cases = []struct {
+		h      string
+		query  bool
+		wanted string
+	}{
+		{"", false, ""},
+		{"/", false, ""},
+		{"/parking/", false, "/parking"},
+		{"/parking/north", false, "/parking/north"},
+		{"/parking, /lighting", true, "/parking,/lighting"},
+		{"/parking/#", true, "/parking/#"},
+		{"/#", true, "/#"},
+	}
+	for _, c := range cases {
+		if got, err := parseServicePath(c.h, c.query); err != nil || got != c.wanted {
+			t.Error(gotWanted(got, c.wanted), unexpected(err))
+		}
+	}
+	for _, h := range []string{"parking", "/parking//north", "/park#ing", "/parking,/lighting", "/parking/#"} {
+		if _, err := parseServicePath(h, false); err != ErrInvalidServicePath {
+			t.Error(h, gotWanted(err, ErrInvalidServicePath))
+		}
+	}
+}
+
+func TestAuth_Routes(t *testing.T) {
+	c := DefaultConfig()
+	c.AuthFile = "testdata/auth.yaml"
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var cases = []struct {
+		method, path, key string
+		wanted            int
+	}{
+		{"GET", "/health/live", "", http.StatusOK},
+		{"GET", "/admin/log", "", http.StatusUnauthorized},
+		{"GET", "/admin/log", "wrong-key", http.StatusUnauthorized},
+		{"GET", "/admin/log", "gateway-key", http.StatusForbidden},
+		{"GET", "/admin/log", "root-key", http.StatusOK},
+		// admin of a service only, the server is everyone's
+		{"GET", "/admin/log", "smartcity-admin-key", http.StatusForbidden},
+		{"GET", "/admin/usage", "smartcity-admin-key", http.StatusForbidden},
+		{"POST", "/v2/registrations/", "smartcity-all-key", http.StatusForbidden},
+		{"DELETE", "/v2/entities/E1", "gateway-key", http.StatusForbidden},
+		{"GET", "/metrics", "", http.StatusUnauthorized},
+		{"GET", "/metrics", "smartcity-admin-key", http.StatusForbidden},
+		{"GET", "/metrics", "root-key", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set(headerService, "smartcity")
+		if c.key != "" {
+			req.Header.Set("Authorization", "Bearer "+c.key)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != c.wanted {
+			t.Error(gotWanted(w.Code, c.wanted) + " (" + c.method + " " + c.path + " " + c.key + ")")
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Error("missing WWW-Authenticate")
+		}
+	}
+}
+
+func TestAuth_ServicePath(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.AuthFile = "testdata/auth.yaml"
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	dropTestCollection(t, srv.Store())
+
+	do := func(method, path, key, servicePath, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(headerService, "smartcity")
+		req.Header.Set(headerServicePath, servicePath)
+		req.Header.Set("Authorization", "Bearer "+key)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := do("POST", "/v2/entities", "root-key", "/lighting", `{"id": "L1", "type": "Light"}`); code != http.StatusCreated {
+		t.Fatal(gotWanted(code, http.StatusCreated))
+	}
+	if code := do("POST", "/v2/entities", "parking-key", "/parking", `{"id": "P1", "type": "Spot"}`); code != http.StatusCreated {
+		t.Fatal(gotWanted(code, http.StatusCreated))
+	}
+	// creating is not updating the entity already there
+	if code := do("POST", "/v2/entities?options=upsert", "parking-key", "/parking", `{"id": "P1", "type": "Spot", "free": {"value": true}}`); code != http.StatusForbidden {
+		t.Error(gotWanted(code, http.StatusForbidden))
+	}
+	if e, err := srv.Store().GetEntity(testCtx, EntityID{ID: "P1", Type: "Spot", Service: "smartcity", ServicePath: "/parking"}); err != nil || len(e.Attrs) != 0 {
+		t.Error(gotWanted(e, "P1 unchanged"), unexpected(err))
+	}
+	if code := do("POST", "/v2/entities?options=upsert", "root-key", "/parking", `{"id": "P1", "type": "Spot", "free": {"value": true}}`); code != http.StatusNoContent {
+		t.Error(gotWanted(code, http.StatusNoContent))
+	}
+	var cases = []struct {
+		method, path, key, servicePath string
+		wanted                         int
+	}{
+		// the grant for /parking does not reach the entities under /lighting
+		{"GET", "/v2/entities/L1", "parking-key", "/parking", http.StatusNotFound},
+		{"GET", "/v2/entities/L1", "parking-key", "/lighting", http.StatusForbidden},
+		{"GET", "/v2/entities/L1", "parking-key", "/parking/#", http.StatusBadRequest},
+		{"GET", "/v2/entities/P1", "parking-key", "/parking", http.StatusOK},
+		{"GET", "/v2/entities/L1", "root-key", "/lighting", http.StatusOK},
+		{"GET", "/v2/entities/L1", "root-key", "/", http.StatusNotFound},
+		{"DELETE", "/v2/entities/L1", "root-key", "/parking", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		if code := do(c.method, c.path, c.key, c.servicePath, ""); code != c.wanted {
+			t.Error(gotWanted(code, c.wanted) + " (" + c.method + " " + c.path + " " + c.key + " " + c.servicePath + ")")
+		}
+	}
+	var lists = map[string]int{"/parking": 1, "/lighting": 1, "/": 0, "/#": 2, "/parking/#,/lighting": 2}
+	for servicePath, wanted := range lists {
+		eIter, err := srv.Store().GetEntities(testCtx, &Query{}, "smartcity", mustServicePath(t, servicePath))
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		var n int
+		for eIter.Next(&Entity{}) {
+			n++
+		}
+		if err = eIter.Close(); err != nil || n != wanted {
+			t.Error(servicePath, gotWanted(n, wanted), unexpected(err))
+		}
+	}
+}
+
+func mustServicePath(t *testing.T, h string) string {
+	sp, err := parseServicePath(h, true)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return sp
+}
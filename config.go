@@ -0,0 +1,534 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of a gorrion server
+type Config struct {
+	// address to listen on, as in ":9090"
+	Listen string
+	Store  StoreConfig
+	// prepended to the name of every collection, to share a database
+	CollectionPrefix string
+	// one of debug, info, warn or error
+	LogLevel string
+	// text or json
+	LogFormat string
+	// deadline for the work of a request, zero for none
+	RequestTimeout time.Duration
+	// deadline for listings and bulk operations, zero for none
+	BulkTimeout time.Duration
+	// largest request body, in bytes, zero for no limit
+	MaxBodySize int
+	// deepest nesting of objects and arrays in a request body, zero for no limit
+	MaxJSONDepth int
+	// most attributes in an entity, and metadata in an attribute, sent in a
+	// request, zero for no limit
+	MaxAttrs    int
+	MaxMetadata int
+	// time between failing the readiness check and stopping the server
+	DrainPeriod time.Duration
+	// most time to wait for the requests in flight when stopping
+	ShutdownTimeout time.Duration
+	// both set to serve HTTPS
+	TLSCertFile string
+	TLSKeyFile  string
+	// CA bundle to verify the certificates of the clients, none asked if empty
+	TLSClientCAFile string
+	// whether clients must send a certificate, require, or may, optional
+	TLSClientAuth string
+	// requests per second of each tenant and each client, zero for no limit,
+	// with bursts of up to the burst, the rate if zero
+	TenantRate  int
+	TenantBurst int
+	ClientRate  int
+	ClientBurst int
+	// most entities of a service, attributes of an entity and bytes of the
+	// document of an entity, zero for no quota
+	QuotaEntities     int
+	QuotaAttrs        int
+	QuotaDocumentSize int
+	// keys and policies of the callers, anyone can do anything if empty
+	AuthFile string
+	// where spans are exported: none, stdout or otlp
+	TraceExporter string
+	// URL of the OTLP collector, as in http://localhost:4318
+	TraceEndpoint string
+	// origins of the browser clients allowed to call the server, "*" for any,
+	// none if empty, and further ones allowed for each tenant
+	CORSOrigins       []string
+	CORSTenantOrigins map[string][]string
+	// methods and headers allowed in the requests, and headers of the
+	// responses the clients can read
+	CORSMethods        []string
+	CORSHeaders        []string
+	CORSExposedHeaders []string
+	// how long clients can keep the answer to a preflight request
+	CORSMaxAge time.Duration
+	// deadline for the requests to the context providers, zero for none
+	ForwardTimeout time.Duration
+	// local copy of the JSON-LD @context the NGSI-LD names are stored with,
+	// the core context alone if empty, and the URL clients know it by
+	NGSILDContextFile string
+	NGSILDContextURL  string
+}
+
+// DefaultConfig returns the configuration used for anything not set otherwise
+func DefaultConfig() Config {
+	return Config{
+		Listen:          ":9090",
+		Store:           DefaultStoreConfig(),
+		LogLevel:        "info",
+		LogFormat:       logFormatText,
+		RequestTimeout:  DefaultTimeout,
+		BulkTimeout:     5 * time.Minute,
+		MaxBodySize:     1 << 20,
+		MaxJSONDepth:    32,
+		MaxAttrs:        512,
+		MaxMetadata:     64,
+		DrainPeriod:     5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		TLSClientAuth:   tlsClientAuthRequire,
+		TraceExporter:   traceExporterNone,
+		CORSMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		CORSHeaders: []string{"Authorization", "Content-Type", headerService, headerServicePath,
+			headerCorrelator, "traceparent"},
+		CORSExposedHeaders: []string{headerTotalCount, headerNextPage, headerCorrelator, "Retry-After"},
+		CORSMaxAge:         10 * time.Minute,
+		ForwardTimeout:     10 * time.Second,
+	}
+}
+
+// Validate checks the configuration is complete and consistent
+func (c Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("missing listen address")
+	}
+	if err := c.Store.Validate(); err != nil {
+		return err
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		return fmt.Errorf("unknown log format %q", c.LogFormat)
+	}
+	if c.RequestTimeout < 0 || c.BulkTimeout < 0 || c.DrainPeriod < 0 || c.ShutdownTimeout < 0 ||
+		c.CORSMaxAge < 0 || c.ForwardTimeout < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+	switch c.TraceExporter {
+	case traceExporterNone, traceExporterStdout, traceExporterOTLP:
+	default:
+		return fmt.Errorf("unknown trace exporter %q", c.TraceExporter)
+	}
+	for _, n := range []int{c.MaxBodySize, c.MaxJSONDepth, c.MaxAttrs, c.MaxMetadata,
+		c.TenantRate, c.TenantBurst, c.ClientRate, c.ClientBurst,
+		c.QuotaEntities, c.QuotaAttrs, c.QuotaDocumentSize} {
+		if n < 0 {
+			return errors.New("limits cannot be negative")
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return errors.New("client certificates need TLS")
+	}
+	if c.TLSClientAuth != tlsClientAuthRequire && c.TLSClientAuth != tlsClientAuthOptional {
+		return fmt.Errorf("unknown TLS client auth %q", c.TLSClientAuth)
+	}
+	if err := validateOrigins(c.CORSOrigins); err != nil {
+		return err
+	}
+	for _, origins := range c.CORSTenantOrigins {
+		if err := validateOrigins(origins); err != nil {
+			return err
+		}
+	}
+	if c.NGSILDContextURL != "" && c.NGSILDContextFile == "" {
+		return errors.New("the NGSI-LD context URL needs a context file")
+	}
+	for _, f := range []string{c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile, c.AuthFile, c.NGSILDContextFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setting is a configuration value, with the same key in config files, as
+// nested objects, in environment variables and in flags
+type setting struct {
+	key   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+func stringSetting(key, usage string, field func(c *Config) *string) setting {
+	return setting{key, usage, func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(key, usage string, field func(c *Config) *int) setting {
+	return setting{key, usage, func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func boolSetting(key, usage string, field func(c *Config) *bool) setting {
+	return setting{key, usage, func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+func durationSetting(key, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{key, usage, func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+// listSetting is a comma separated list, or a list in config files
+func listSetting(key, usage string, field func(c *Config) *[]string) setting {
+	return setting{key, usage, func(c *Config, v string) error {
+		*field(c) = splitList(v)
+		return nil
+	}}
+}
+
+// splitList returns the items of a comma separated list, without blanks
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var settings = []setting{
+	stringSetting("listen", "address to listen on", func(c *Config) *string { return &c.Listen }),
+	stringSetting("mongo.url", "MongoDB URL", func(c *Config) *string { return &c.Store.URL }),
+	stringSetting("mongo.db", "MongoDB database", func(c *Config) *string { return &c.Store.DB }),
+	stringSetting("mongo.collectionPrefix", "prefix for the names of the collections",
+		func(c *Config) *string { return &c.CollectionPrefix }),
+	intSetting("mongo.poolLimit", "most sockets open to each MongoDB server, 0 for the driver default",
+		func(c *Config) *int { return &c.Store.PoolLimit }),
+	durationSetting("mongo.dialTimeout", "timeout connecting to MongoDB",
+		func(c *Config) *time.Duration { return &c.Store.DialTimeout }),
+	durationSetting("mongo.socketTimeout", "timeout for every round trip to MongoDB",
+		func(c *Config) *time.Duration { return &c.Store.SocketTimeout }),
+	intSetting("mongo.w", "write concern, servers acknowledging a write", func(c *Config) *int { return &c.Store.W }),
+	stringSetting("mongo.wMode", "write concern mode, as majority, instead of w",
+		func(c *Config) *string { return &c.Store.WMode }),
+	boolSetting("mongo.j", "write concern, wait for the journal", func(c *Config) *bool { return &c.Store.J }),
+	durationSetting("mongo.wTimeout", "write concern timeout",
+		func(c *Config) *time.Duration { return &c.Store.WTimeout }),
+	stringSetting("mongo.readMode", "read preference", func(c *Config) *string { return &c.Store.ReadMode }),
+	stringSetting("mongo.listingReadMode", "read preference for listings",
+		func(c *Config) *string { return &c.Store.ListingReadMode }),
+	listSetting("history.types", "entity types whose attribute values are all recorded",
+		func(c *Config) *[]string { return &c.Store.HistoryTypes }),
+	listSetting("history.attrs", "attributes whose values are recorded, for any entity type",
+		func(c *Config) *[]string { return &c.Store.HistoryAttrs }),
+	durationSetting("history.retention", "how long recorded values are kept, 0 for ever",
+		func(c *Config) *time.Duration { return &c.Store.HistoryRetention }),
+	durationSetting("history.rollupRetention", "how long values added up by minute and hour are kept, 0 for ever",
+		func(c *Config) *time.Duration { return &c.Store.HistoryRollupRetention }),
+	listSetting("versions.types", "entity types whose prior versions are kept",
+		func(c *Config) *[]string { return &c.Store.VersionTypes }),
+	stringSetting("log.level", "log level: debug, info, warn or error", func(c *Config) *string { return &c.LogLevel }),
+	stringSetting("log.format", "log format: text or json", func(c *Config) *string { return &c.LogFormat }),
+	durationSetting("limits.requestTimeout", "deadline for a request, 0 for none",
+		func(c *Config) *time.Duration { return &c.RequestTimeout }),
+	durationSetting("limits.bulkTimeout", "deadline for listings and bulk operations, 0 for none",
+		func(c *Config) *time.Duration { return &c.BulkTimeout }),
+	intSetting("limits.maxBodySize", "largest request body, in bytes, 0 for no limit",
+		func(c *Config) *int { return &c.MaxBodySize }),
+	intSetting("limits.maxJSONDepth", "deepest nesting in a request body, 0 for no limit",
+		func(c *Config) *int { return &c.MaxJSONDepth }),
+	intSetting("limits.maxAttrs", "most attributes of an entity in a request, 0 for no limit",
+		func(c *Config) *int { return &c.MaxAttrs }),
+	intSetting("limits.maxMetadata", "most metadata of an attribute in a request, 0 for no limit",
+		func(c *Config) *int { return &c.MaxMetadata }),
+	intSetting("rate.tenant", "requests per second of each tenant, 0 for no limit",
+		func(c *Config) *int { return &c.TenantRate }),
+	intSetting("rate.tenantBurst", "burst of requests of each tenant, 0 for its rate",
+		func(c *Config) *int { return &c.TenantBurst }),
+	intSetting("rate.client", "requests per second of each client, 0 for no limit",
+		func(c *Config) *int { return &c.ClientRate }),
+	intSetting("rate.clientBurst", "burst of requests of each client, 0 for its rate",
+		func(c *Config) *int { return &c.ClientBurst }),
+	intSetting("quota.maxEntities", "most entities of a service, 0 for no quota",
+		func(c *Config) *int { return &c.QuotaEntities }),
+	intSetting("quota.maxAttrs", "most attributes of an entity, 0 for no quota",
+		func(c *Config) *int { return &c.QuotaAttrs }),
+	intSetting("quota.maxDocumentSize", "largest document of an entity, in bytes, 0 for no quota",
+		func(c *Config) *int { return &c.QuotaDocumentSize }),
+	durationSetting("shutdown.drainPeriod", "time between failing the readiness check and stopping",
+		func(c *Config) *time.Duration { return &c.DrainPeriod }),
+	durationSetting("shutdown.timeout", "most time to wait for the requests in flight when stopping",
+		func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+	stringSetting("tls.certFile", "TLS certificate file, to serve HTTPS",
+		func(c *Config) *string { return &c.TLSCertFile }),
+	stringSetting("tls.keyFile", "TLS key file, to serve HTTPS", func(c *Config) *string { return &c.TLSKeyFile }),
+	stringSetting("tls.clientCaFile", "CA bundle to verify client certificates, none asked if empty",
+		func(c *Config) *string { return &c.TLSClientCAFile }),
+	stringSetting("tls.clientAuth", "client certificates: require or optional",
+		func(c *Config) *string { return &c.TLSClientAuth }),
+	stringSetting("auth.file", "file with the keys and policies of the callers, none for no auth",
+		func(c *Config) *string { return &c.AuthFile }),
+	stringSetting("trace.exporter", "where spans are exported: none, stdout or otlp",
+		func(c *Config) *string { return &c.TraceExporter }),
+	stringSetting("trace.endpoint", "URL of the OTLP collector, by default from OTEL_EXPORTER_OTLP_ENDPOINT",
+		func(c *Config) *string { return &c.TraceEndpoint }),
+	listSetting("cors.origins", "origins allowed to call from browsers, * for any, none if empty",
+		func(c *Config) *[]string { return &c.CORSOrigins }),
+	setting{"cors.tenantOrigins", "origins allowed for a tenant, as tenant=origin, besides cors.origins",
+		func(c *Config, v string) error {
+			c.CORSTenantOrigins = map[string][]string{}
+			for _, item := range splitList(v) {
+				i := strings.Index(item, "=")
+				if i <= 0 {
+					return fmt.Errorf("%q is not tenant=origin", item)
+				}
+				tenant := item[:i]
+				c.CORSTenantOrigins[tenant] = append(c.CORSTenantOrigins[tenant], item[i+1:])
+			}
+			return nil
+		}},
+	listSetting("cors.methods", "methods allowed from browsers", func(c *Config) *[]string { return &c.CORSMethods }),
+	listSetting("cors.headers", "request headers allowed from browsers",
+		func(c *Config) *[]string { return &c.CORSHeaders }),
+	listSetting("cors.exposedHeaders", "response headers browsers can read",
+		func(c *Config) *[]string { return &c.CORSExposedHeaders }),
+	durationSetting("cors.maxAge", "how long browsers can cache the answer to a preflight request",
+		func(c *Config) *time.Duration { return &c.CORSMaxAge }),
+	durationSetting("forward.timeout", "deadline for the requests to the context providers, 0 for none",
+		func(c *Config) *time.Duration { return &c.ForwardTimeout }),
+	stringSetting("ngsild.contextFile", "local copy of the JSON-LD context NGSI-LD names are stored with",
+		func(c *Config) *string { return &c.NGSILDContextFile }),
+	stringSetting("ngsild.contextUrl", "URL clients refer to the context in ngsild.contextFile by",
+		func(c *Config) *string { return &c.NGSILDContextURL }),
+}
+
+// envPrefix starts the environment variables of the settings, as in
+// GORRION_MONGO_URL for mongo.url
+const envPrefix = "GORRION_"
+
+// envName returns the environment variable for a setting key
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(splitWords(key, '_'), ".", "_", -1))
+}
+
+// flagName returns the flag for a setting key, as in -mongo-url for mongo.url
+func flagName(key string) string {
+	return strings.Replace(splitWords(key, '-'), ".", "-", -1)
+}
+
+// splitWords separates the words of camel case identifiers with sep
+func splitWords(s string, sep rune) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			b.WriteRune(sep)
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// LoadConfig builds the configuration from, by increasing precedence, the
+// defaults, a config file, environment variables and command line flags. The
+// file is given by the -config flag or the GORRION_CONFIG variable, and is read
+// as JSON if its name ends in .json, as YAML otherwise. The configuration
+// returned is validated.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	c := DefaultConfig()
+
+	// flags are applied last, but they say which file to read
+	fs := flag.NewFlagSet("gorrion", flag.ContinueOnError)
+	configFile := fs.String("config", "", "config file, YAML or JSON")
+	flagValues := map[string]string{}
+	for _, s := range settings {
+		key := s.key
+		fs.Func(flagName(key), s.usage, func(v string) error {
+			flagValues[key] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	if *configFile == "" {
+		*configFile, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return c, err
+		}
+		if err = applySettings(&c, values, *configFile+": "); err != nil {
+			return c, err
+		}
+	}
+
+	envValues := map[string]string{}
+	for _, s := range settings {
+		if v, ok := lookupEnv(envName(s.key)); ok {
+			envValues[s.key] = v
+		}
+	}
+	if err := applySettings(&c, envValues, "environment: "); err != nil {
+		return c, err
+	}
+	if err := applySettings(&c, flagValues, "flags: "); err != nil {
+		return c, err
+	}
+
+	c.Store.EntitiesColl = c.CollectionPrefix + c.Store.EntitiesColl
+	c.Store.RegistrationsColl = c.CollectionPrefix + c.Store.RegistrationsColl
+	c.Store.HistoryColl = c.CollectionPrefix + c.Store.HistoryColl
+	c.Store.VersionsColl = c.CollectionPrefix + c.Store.VersionsColl
+	return c, c.Validate()
+}
+
+// applySettings sets the values, by key, in c
+func applySettings(c *Config, values map[string]string, source string) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s, ok := findSetting(k)
+		if !ok {
+			return fmt.Errorf("%sunknown setting %q", source, k)
+		}
+		if err := s.set(c, values[k]); err != nil {
+			return fmt.Errorf("%sinvalid %s: %v", source, k, err)
+		}
+	}
+	return nil
+}
+
+func findSetting(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// readConfigFile returns the values in a config file by setting key. Nested
+// objects make the keys, as in {"mongo": {"url": "..."}} for mongo.url.
+func readConfigFile(name string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if strings.EqualFold(filepath.Ext(name), ".json") {
+		err = json.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	values := map[string]string{}
+	if doc == nil {
+		// empty file
+		return values, nil
+	}
+	if err = flattenConfig("", doc, values); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, v interface{}, values map[string]string) error {
+	var obj map[string]interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		obj = v
+	case map[interface{}]interface{}:
+		// as decoded from YAML
+		obj = map[string]interface{}{}
+		for k, e := range v {
+			obj[fmt.Sprint(k)] = e
+		}
+	case []interface{}:
+		// for the list settings
+		items := make([]string, len(v))
+		for i, e := range v {
+			switch e.(type) {
+			case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+				return fmt.Errorf("unexpected object in list %q", prefix)
+			}
+			items[i] = fmt.Sprint(e)
+		}
+		values[prefix] = strings.Join(items, ",")
+		return nil
+	case nil:
+		// as if missing
+		return nil
+	default:
+		if prefix == "" {
+			return errors.New("not an object")
+		}
+		values[prefix] = fmt.Sprint(v)
+		return nil
+	}
+	for k, e := range obj {
+		key := k
+		if prefix != "" {
+			key = prefix + "." + k
+		}
+		if err := flattenConfig(key, e, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package gorrion
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a lookup function over vars, in place of os.LookupEnv
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	c, err := LoadConfig(nil, env(nil))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if wanted := DefaultConfig(); !reflect.DeepEqual(c, wanted) {
+		t.Error(gotWanted(c, wanted))
+	}
+}
+
+func TestLoadConfig_File(t *testing.T) {
+	for _, file := range []string{"testdata/config.yaml", "testdata/config.json"} {
+		c, err := LoadConfig([]string{"-config", file}, env(nil))
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		wanted := DefaultConfig()
+		wanted.Listen = ":8080"
+		wanted.Store.URL = "mongodb://db1,db2/?replicaSet=rs0"
+		wanted.Store.DB = "broker"
+		wanted.CollectionPrefix = "t1_"
+		wanted.Store.EntitiesColl = "t1_" + wanted.Store.EntitiesColl
+		wanted.Store.RegistrationsColl = "t1_" + wanted.Store.RegistrationsColl
+		wanted.Store.HistoryColl = "t1_" + wanted.Store.HistoryColl
+		wanted.Store.VersionsColl = "t1_" + wanted.Store.VersionsColl
+		wanted.Store.PoolLimit = 64
+		wanted.Store.WMode = "majority"
+		wanted.Store.J = true
+		wanted.Store.WTimeout = 5 * time.Second
+		wanted.Store.ListingReadMode = "secondaryPreferred"
+		wanted.LogLevel = "debug"
+		wanted.RequestTimeout = 10 * time.Second
+		if !reflect.DeepEqual(c, wanted) {
+			t.Error(gotWanted(c, wanted) + " (" + file + ")")
+		}
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	vars := map[string]string{
+		"GORRION_CONFIG":       "testdata/config.yaml",
+		"GORRION_MONGO_DB":     "fromenv",
+		"GORRION_LOG_LEVEL":    "warn",
+		"GORRION_MONGO_W_MODE": "",
+	}
+	c, err := LoadConfig([]string{"-log-level", "error"}, env(vars))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	// file over defaults
+	if c.Listen != ":8080" {
+		t.Error(gotWanted(c.Listen, ":8080"))
+	}
+	// environment over file
+	if c.Store.DB != "fromenv" {
+		t.Error(gotWanted(c.Store.DB, "fromenv"))
+	}
+	if c.Store.WMode != "" {
+		t.Error(gotWanted(c.Store.WMode, ""))
+	}
+	// flags over environment
+	if c.LogLevel != "error" {
+		t.Error(gotWanted(c.LogLevel, "error"))
+	}
+}
+
+func TestLoadConfig_Lists(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	file := `cors:
+  origins: [https://dash.example.com, "https://ops.example.com:8443"]
+  tenantOrigins:
+    - smartcity=https://city.example.com
+    - smartcity=https://parking.example.com
+`
+	if err := os.WriteFile(name, []byte(file), 0600); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	c, err := LoadConfig([]string{"-config", name, "-cors-methods", "GET, POST"}, env(nil))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if wanted := []string{"https://dash.example.com", "https://ops.example.com:8443"}; !reflect.DeepEqual(c.CORSOrigins, wanted) {
+		t.Error(gotWanted(c.CORSOrigins, wanted))
+	}
+	wanted := map[string][]string{"smartcity": {"https://city.example.com", "https://parking.example.com"}}
+	if !reflect.DeepEqual(c.CORSTenantOrigins, wanted) {
+		t.Error(gotWanted(c.CORSTenantOrigins, wanted))
+	}
+	if wanted := []string{"GET", "POST"}; !reflect.DeepEqual(c.CORSMethods, wanted) {
+		t.Error(gotWanted(c.CORSMethods, wanted))
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	var cases = []struct {
+		args   []string
+		vars   map[string]string
+		wanted string
+	}{
+		{[]string{"-config", "testdata/config_unknown.yaml"}, nil, `unknown setting "mongo.uri"`},
+		{[]string{"-config", "testdata/missing.yaml"}, nil, "missing.yaml"},
+		{nil, map[string]string{"GORRION_MONGO_POOL_LIMIT": "many"}, "invalid mongo.poolLimit"},
+		{[]string{"-limits-request-timeout", "10"}, nil, "invalid limits.requestTimeout"},
+		{[]string{"-mongo-read-mode", "any"}, nil, "unknown read preference"},
+		{[]string{"-log-level", "verbose"}, nil, "unknown log level"},
+		{nil, map[string]string{"GORRION_TRACE_EXPORTER": "jaeger"}, "unknown trace exporter"},
+		{[]string{"-limits-max-body-size", "-1"}, nil, "limits cannot be negative"},
+		{[]string{"-tls-cert-file", "testdata/config.yaml"}, nil, "TLS"},
+		{[]string{"-tls-cert-file", "testdata/cert.pem", "-tls-key-file", "testdata/key.pem"}, nil, "cert.pem"},
+		{[]string{"-tls-client-ca-file", "testdata/config.yaml"}, nil, "client certificates need TLS"},
+		{nil, map[string]string{"GORRION_TLS_CLIENT_AUTH": "request"}, "unknown TLS client auth"},
+		{[]string{"-cors-origins", "dash.example.com"}, nil, "invalid CORS origin"},
+		{[]string{"-cors-tenant-origins", "https://dash.example.com"}, nil, "is not tenant=origin"},
+		{[]string{"-ngsild-context-url", "https://example.com/context.jsonld"}, nil, "needs a context file"},
+		{[]string{"extra"}, nil, "unexpected arguments"},
+	}
+	for _, c := range cases {
+		_, err := LoadConfig(c.args, env(c.vars))
+		if err == nil || !strings.Contains(err.Error(), c.wanted) {
+			t.Errorf("%v %v: %s", c.args, c.vars, gotWanted(err, c.wanted))
+		}
+	}
+}
+
+func TestSettingNames(t *testing.T) {
+	var cases = []struct{ key, env, flag string }{
+		{"listen", "GORRION_LISTEN", "listen"},
+		{"mongo.url", "GORRION_MONGO_URL", "mongo-url"},
+		{"mongo.collectionPrefix", "GORRION_MONGO_COLLECTION_PREFIX", "mongo-collection-prefix"},
+		{"tls.certFile", "GORRION_TLS_CERT_FILE", "tls-cert-file"},
+		{"ngsild.contextUrl", "GORRION_NGSILD_CONTEXT_URL", "ngsild-context-url"},
+		{"history.retention", "GORRION_HISTORY_RETENTION", "history-retention"},
+	}
+	for _, c := range cases {
+		if got := envName(c.key); got != c.env {
+			t.Error(gotWanted(got, c.env))
+		}
+		if got := flagName(c.key); got != c.flag {
+			t.Error(gotWanted(got, c.flag))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package gorrion
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// corsAny allows any origin
+const corsAny = "*"
+
+// validateOrigins checks origins are "*" or a scheme and a host, with no path,
+// as browsers send them
+func validateOrigins(origins []string) error {
+	for _, o := range origins {
+		if o == corsAny {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" ||
+			u.Fragment != "" || u.User != nil {
+			return fmt.Errorf("invalid CORS origin %q", o)
+		}
+	}
+	return nil
+}
+
+// corsPolicy tells which browser clients can call the server
+type corsPolicy struct {
+	any     bool
+	origins map[string]bool
+	tenants map[string]map[string]bool
+
+	methods, headers, exposedHeaders, maxAge string
+}
+
+// newCORSPolicy returns the policy of c, nil if no origin is allowed
+func newCORSPolicy(c Config) *corsPolicy {
+	if len(c.CORSOrigins) == 0 && len(c.CORSTenantOrigins) == 0 {
+		return nil
+	}
+	set := func(origins []string) map[string]bool {
+		m := map[string]bool{}
+		for _, o := range origins {
+			m[strings.ToLower(o)] = true
+		}
+		return m
+	}
+	p := &corsPolicy{
+		origins:        set(c.CORSOrigins),
+		tenants:        map[string]map[string]bool{},
+		methods:        strings.Join(c.CORSMethods, ", "),
+		headers:        strings.Join(c.CORSHeaders, ", "),
+		exposedHeaders: strings.Join(c.CORSExposedHeaders, ", "),
+		maxAge:         strconv.Itoa(int(c.CORSMaxAge.Seconds())),
+	}
+	p.any = p.origins[corsAny]
+	for tenant, origins := range c.CORSTenantOrigins {
+		p.tenants[tenant] = set(origins)
+	}
+	return p
+}
+
+// allows tells whether origin can call the server for tenant
+func (p *corsPolicy) allows(origin, tenant string) bool {
+	origin = strings.ToLower(origin)
+	return p.any || p.origins[origin] || p.tenants[tenant][origin]
+}
+
+// allowsAnyTenant tells whether origin can call the server for some tenant.
+// Preflight requests do not carry the headers of the request they ask for, so
+// they cannot tell the tenant; the request itself is checked for it.
+func (p *corsPolicy) allowsAnyTenant(origin string) bool {
+	if p.allows(origin, "") {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, origins := range p.tenants {
+		if origins[origin] {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin answers origin is allowed, with the origin itself unless any is
+func (p *corsPolicy) allowOrigin(h http.Header, origin string) {
+	if p.any {
+		h.Set("Access-Control-Allow-Origin", corsAny)
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// withCORS answers the preflight requests for the routes of r, and tells
+// browsers which responses they can read, as set in the configuration
+func (srv *Server) withCORS(r *mux.Router) http.Handler {
+	p := srv.cors
+	if p == nil {
+		return r
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			r.ServeHTTP(w, req)
+			return
+		}
+		method := req.Header.Get("Access-Control-Request-Method")
+		if req.Method != http.MethodOptions || method == "" {
+			if !p.any {
+				w.Header().Add("Vary", "Origin")
+			}
+			if p.allows(origin, req.Header.Get(headerService)) {
+				p.allowOrigin(w.Header(), origin)
+				if p.exposedHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", p.exposedHeaders)
+				}
+			}
+			r.ServeHTTP(w, req)
+			return
+		}
+
+		// preflight, for a route of the request it asks for
+		asked := req.Clone(req.Context())
+		asked.Method = method
+		if !r.Match(asked, &mux.RouteMatch{}) {
+			r.ServeHTTP(w, req)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if p.allowsAnyTenant(origin) {
+			p.allowOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", p.methods)
+			h.Set("Access-Control-Allow-Headers", p.headers)
+			h.Set("Access-Control-Max-Age", p.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,124 @@
+package gorrion
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func corsServer(t *testing.T, origins ...string) *Server {
+	c := DefaultConfig()
+	c.CORSOrigins = origins
+	c.CORSTenantOrigins = map[string][]string{"smartcity": {"https://city.example.com"}}
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return srv
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	srv := corsServer(t, "https://dash.example.com")
+	var cases = []struct {
+		path, origin, method string
+		wanted               int
+		allowed              bool
+	}{
+		{"/v2/entities/E1", "https://dash.example.com", "PATCH", http.StatusNoContent, true},
+		{"/v2/entities/E1/attrs/a/value", "https://DASH.example.com", "PUT", http.StatusNoContent, true},
+		{"/admin/log", "https://city.example.com", "GET", http.StatusNoContent, true},
+		{"/v2/entities/E1", "https://evil.example.com", "GET", http.StatusNoContent, false},
+		{"/version", "https://dash.example.com", "POST", http.StatusMethodNotAllowed, false},
+		{"/nowhere", "https://dash.example.com", "GET", http.StatusNotFound, false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("OPTIONS", c.path, nil)
+		req.Header.Set("Origin", c.origin)
+		req.Header.Set("Access-Control-Request-Method", c.method)
+		req.Header.Set("Access-Control-Request-Headers", "fiware-service, fiware-servicepath")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != c.wanted {
+			t.Errorf("%s %s: %s", c.method, c.path, gotWanted(w.Code, c.wanted))
+		}
+		h := w.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); (got == c.origin) != c.allowed {
+			t.Errorf("%s %s from %s: allowed origin %q", c.method, c.path, c.origin, got)
+		}
+		if !c.allowed {
+			continue
+		}
+		if got := h.Get("Access-Control-Allow-Headers"); !strings.Contains(got, headerServicePath) {
+			t.Error(gotWanted(got, headerServicePath))
+		}
+		if got := h.Get("Access-Control-Allow-Methods"); !strings.Contains(got, c.method) {
+			t.Error(gotWanted(got, c.method))
+		}
+		if got := h.Get("Access-Control-Max-Age"); got != "600" {
+			t.Error(gotWanted(got, "600"))
+		}
+	}
+}
+
+func TestCORS_Requests(t *testing.T) {
+	srv := corsServer(t, "https://dash.example.com")
+	var cases = []struct {
+		origin, tenant string
+		allowed        bool
+	}{
+		{"", "", false},
+		{"https://dash.example.com", "", true},
+		{"https://dash.example.com", "smartcity", true},
+		{"https://city.example.com", "smartcity", true},
+		{"https://city.example.com", "other", false},
+		{"https://evil.example.com", "smartcity", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/health/live", nil)
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		req.Header.Set(headerService, c.tenant)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Error(gotWanted(w.Code, http.StatusOK))
+		}
+		h := w.Header()
+		if got := h.Get("Access-Control-Allow-Origin"); (got == c.origin && got != "") != c.allowed {
+			t.Errorf("%s for %q: allowed origin %q", c.origin, c.tenant, got)
+		}
+		if got := h.Get("Access-Control-Expose-Headers"); c.allowed && !strings.Contains(got, headerTotalCount) {
+			t.Error(gotWanted(got, headerTotalCount))
+		}
+		if c.origin != "" && h.Get("Vary") != "Origin" {
+			t.Error(gotWanted(h.Get("Vary"), "Origin"))
+		}
+	}
+}
+
+func TestCORS_AnyOrigin(t *testing.T) {
+	srv := corsServer(t, "*")
+	req := httptest.NewRequest("GET", "/version", nil)
+	req.Header.Set("Origin", "https://anywhere.example.com")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Error(gotWanted(got, "*"))
+	}
+}
+
+func TestCORS_Disabled(t *testing.T) {
+	srv := corsServer(t)
+	srv.cors = nil
+	srv.handler = srv.routes()
+	req := httptest.NewRequest("OPTIONS", "/version", nil)
+	req.Header.Set("Origin", "https://dash.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Error(gotWanted(w.Code, http.StatusMethodNotAllowed))
+	}
+}
@@ -0,0 +1,214 @@
+package gorrion
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sortKey is a field the results are sorted by, in the stored document
+type sortKey struct {
+	field string
+	desc  bool
+}
+
+func (k sortKey) String() string {
+	if k.desc {
+		return "-" + k.field
+	}
+	return k.field
+}
+
+// attrName returns the attribute the key sorts by, if any
+func (k sortKey) attrName() (string, bool) {
+	if !strings.HasPrefix(k.field, "attrs.") {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(k.field, "attrs."), "."+attrValueField), true
+}
+
+// value returns the value of the key in e, as stored
+func (k sortKey) value(e *Entity) interface{} {
+	switch k.field {
+	case "_id":
+		return e.ID
+	case "_id.id":
+		return e.ID.ID
+	case "_id.type":
+		return e.ID.Type
+	case dateCreatedField:
+		return timeOrNil(e.DateCreated)
+	case dateModifiedField:
+		return timeOrNil(e.DateModified)
+	}
+	if name, ok := k.attrName(); ok {
+		return e.Attrs[name].Value
+	}
+	return nil
+}
+
+// timeOrNil keeps missing dates, as in entities stored before having them,
+// as missing, which sorts as null
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// cursor is the position of the last entity of a page, by the keys the
+// listing is sorted by. _id is always the last key, so it is unique.
+type cursor struct {
+	Sort []string      `bson:"s"`
+	Keys []interface{} `bson:"k"`
+	ID   EntityID      `bson:"i"`
+}
+
+func newCursor(keys []sortKey, e *Entity) *cursor {
+	c := &cursor{ID: e.ID}
+	for _, k := range keys {
+		c.Sort = append(c.Sort, k.String())
+		if k.field != "_id" {
+			c.Keys = append(c.Keys, k.value(e))
+		}
+	}
+	return c
+}
+
+// Token returns the cursor as an opaque string, safe to use in URLs
+func (c *cursor) Token() (string, error) {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func parseCursor(token string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err = bson.Unmarshal(data, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// condition selects the entities after the cursor, for the given sort keys. For
+// keys k1, k2 and _id, ascending, that is
+//
+//	k1 > v1 || (k1 == v1 && k2 > v2) || (k1 == v1 && k2 == v2 && _id > id)
+func (c *cursor) condition(keys []sortKey) (bson.M, error) {
+	if len(c.Sort) != len(keys) || len(c.Keys) != len(keys)-1 {
+		return nil, ErrInvalidCursor
+	}
+	for i, k := range keys {
+		if c.Sort[i] != k.String() {
+			// a token from a listing sorted in another way
+			return nil, ErrInvalidCursor
+		}
+	}
+	values := append(append([]interface{}{}, c.Keys...), c.ID)
+
+	var or []bson.M
+	for i, k := range keys {
+		for _, after := range afterConditions(k, values[i]) {
+			alt := bson.M{}
+			for j := 0; j < i; j++ {
+				alt[keys[j].field] = values[j]
+			}
+			for f, cond := range after {
+				alt[f] = cond
+			}
+			or = append(or, alt)
+		}
+	}
+	return bson.M{"$or": or}, nil
+}
+
+// bsonTypes are the BSON types, by the order MongoDB sorts them when a field
+// has values of different types. A missing field sorts as null.
+var bsonTypes = [][]string{
+	{"null"},
+	{"double", "int", "long", "decimal"},
+	{"string", "symbol"},
+	{"object"},
+	{"array"},
+	{"binData"},
+	{"objectId"},
+	{"bool"},
+	{"date"},
+	{"timestamp"},
+	{"regex"},
+}
+
+// typeRank returns the position in bsonTypes of a value read from MongoDB
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int, int32, int64, float64:
+		return 1
+	case string, bson.Symbol:
+		return 2
+	case []interface{}:
+		return 4
+	case []byte, bson.Binary:
+		return 5
+	case bson.ObjectId:
+		return 6
+	case bool:
+		return 7
+	case time.Time:
+		return 8
+	case bson.MongoTimestamp:
+		return 9
+	case bson.RegEx:
+		return 10
+	default: // documents
+		return 3
+	}
+}
+
+// afterConditions select the values of k sorted after v. Comparison operators
+// only match values of the same type, so the values of the types sorted after
+// the type of v are selected apart.
+func afterConditions(k sortKey, v interface{}) []bson.M {
+	if k.field == "_id" {
+		// always a document, and unique
+		return []bson.M{{k.field: bson.M{"$gt": v}}}
+	}
+	var (
+		rank  = typeRank(v)
+		conds []bson.M
+		types []string
+	)
+	if k.desc {
+		if rank > 0 {
+			// null and missing
+			conds = append(conds, bson.M{k.field: nil})
+		}
+		for i := 1; i < rank; i++ {
+			types = append(types, bsonTypes[i]...)
+		}
+	} else {
+		for _, t := range bsonTypes[rank+1:] {
+			types = append(types, t...)
+		}
+	}
+	if rank > 0 {
+		op := "$gt"
+		if k.desc {
+			op = "$lt"
+		}
+		conds = append(conds, bson.M{k.field: bson.M{op: v}})
+	}
+	if len(types) > 0 {
+		conds = append(conds, bson.M{k.field: bson.M{"$type": types}})
+	}
+	return conds
+}
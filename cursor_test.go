@@ -0,0 +1,116 @@
+package gorrion
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCursor_Token(t *testing.T) {
+	var (
+		keys = []sortKey{{field: "attrs.temperature.value", desc: true}, {field: "_id"}}
+		e    = NewEntity(EntityID{ID: "I1", Type: "T1", Service: "S", ServicePath: "SP"})
+	)
+	e.Attrs["temperature"] = Attribute{Value: 12.3}
+
+	c := newCursor(keys, e)
+	token, err := c.Token()
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	got, err := parseCursor(token)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !equalObjects(got, c) {
+		t.Error(gotWanted(got, c))
+	}
+}
+
+func TestCursor_TokenError(t *testing.T) {
+	// not a value read from MongoDB
+	c := &cursor{Sort: []string{"attrs.x.value", "_id"}, Keys: []interface{}{make(chan int)}}
+	if _, err := c.Token(); err == nil {
+		t.Error(gotWanted(err, "an error"))
+	}
+}
+
+func TestCursor_Condition(t *testing.T) {
+	var (
+		keys = []sortKey{{field: "attrs.temperature.value", desc: true}, {field: "attrs.status.value"}, {field: "_id"}}
+		id   = EntityID{ID: "I1", Type: "T1", Service: "S", ServicePath: "SP"}
+		e    = NewEntity(id)
+	)
+	e.Attrs["temperature"] = Attribute{Value: 12.3}
+	e.Attrs["status"] = Attribute{Value: "ON"}
+
+	got, err := newCursor(keys, e).condition(keys)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := bson.M{"$or": []bson.M{
+		{"attrs.temperature.value": nil},
+		{"attrs.temperature.value": bson.M{"$lt": 12.3}},
+		{"attrs.temperature.value": 12.3, "attrs.status.value": bson.M{"$gt": "ON"}},
+		{"attrs.temperature.value": 12.3, "attrs.status.value": bson.M{"$type": []string{
+			"object", "array", "binData", "objectId", "bool", "date", "timestamp", "regex"}}},
+		{"attrs.temperature.value": 12.3, "attrs.status.value": "ON", "_id": bson.M{"$gt": id}},
+	}}
+	if !equalObjects(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+}
+
+func TestAfterConditions(t *testing.T) {
+	var cases = []struct {
+		key    sortKey
+		value  interface{}
+		wanted []bson.M
+	}{
+		// missing or null sort first
+		{sortKey{field: "a"}, nil, []bson.M{{"a": bson.M{"$type": []string{
+			"double", "int", "long", "decimal", "string", "symbol", "object", "array",
+			"binData", "objectId", "bool", "date", "timestamp", "regex"}}}}},
+		{sortKey{field: "a", desc: true}, nil, nil},
+		{sortKey{field: "a", desc: true}, "x", []bson.M{
+			{"a": nil},
+			{"a": bson.M{"$lt": "x"}},
+			{"a": bson.M{"$type": []string{"double", "int", "long", "decimal"}}}}},
+		{sortKey{field: "a", desc: true}, 1.0, []bson.M{
+			{"a": nil},
+			{"a": bson.M{"$lt": 1.0}}}},
+		{sortKey{field: "a"}, true, []bson.M{
+			{"a": bson.M{"$gt": true}},
+			{"a": bson.M{"$type": []string{"date", "timestamp", "regex"}}}}},
+	}
+	for i, c := range cases {
+		if got := afterConditions(c.key, c.value); !equalObjects(got, c.wanted) {
+			t.Error(gotWanted(got, c.wanted) + fmt.Sprintf(" (%d)", i))
+		}
+	}
+}
+
+func TestCursor_OtherSort(t *testing.T) {
+	var (
+		keys = []sortKey{{field: "attrs.temperature.value"}, {field: "_id"}}
+		e    = NewEntity(EntityID{ID: "I1", Type: "T1"})
+	)
+	c := newCursor(keys, e)
+
+	other := []sortKey{{field: "attrs.temperature.value", desc: true}, {field: "_id"}}
+	if _, err := c.condition(other); err != ErrInvalidCursor {
+		t.Error(gotWanted(err, ErrInvalidCursor))
+	}
+	if _, err := c.condition(keys[1:]); err != ErrInvalidCursor {
+		t.Error(gotWanted(err, ErrInvalidCursor))
+	}
+}
+
+func TestParseCursor_Invalid(t *testing.T) {
+	for _, token := range []string{"!!!", "bm90IGJzb24"} {
+		if _, err := parseCursor(token); err != ErrInvalidCursor {
+			t.Error(gotWanted(err, ErrInvalidCursor))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package gorrion
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// The top-level functions work on a default store, connected by StartStore,
+// and on a default server, the one behind AddHandlers. A program with more
+// than one broker uses OpenStore and NewServer instead.
+var (
+	defaultStore  *Store
+	defaultServer = newServer()
+)
+
+// StartStore connects the default store to MongoDB at localhost, with the
+// default settings
+func StartStore() error {
+	return StartStoreConfig(DefaultStoreConfig())
+}
+
+// StartStoreConfig connects the default store to MongoDB with the settings in c
+func StartStoreConfig(c StoreConfig) error {
+	st, err := OpenStore(c)
+	if err != nil {
+		return err
+	}
+	defaultStore = st
+	return nil
+}
+
+func StopStore() (err error) {
+	defaultStore.Close()
+	defaultStore = nil
+	return nil
+}
+
+// PingStore checks the default store answers
+func PingStore(ctx context.Context) error {
+	return defaultStore.Ping(ctx)
+}
+
+// AddHandlers returns the handler of the default server, over the default
+// store and with the deadlines in DefaultTimeout and RouteTimeouts
+func AddHandlers() http.Handler {
+	defaultServer.store = defaultStore
+	defaultServer.metrics.registerStore(defaultStore)
+	defaultServer.defaultTimeout = DefaultTimeout
+	defaultServer.routeTimeouts = RouteTimeouts
+	return defaultServer.routes()
+}
+
+// Drain makes the readiness check of the default server fail
+func Drain() {
+	defaultServer.Drain()
+}
+
+// EnableFeature adds name to the features reported by the default server
+func EnableFeature(name string) {
+	defaultServer.EnableFeature(name)
+}
+
+// Features returns the features enabled in the default server
+func Features() []string {
+	return defaultServer.Features()
+}
+
+func GetEntity(ctx context.Context, ei EntityID) (e *Entity, err error) {
+	return defaultStore.GetEntity(ctx, ei)
+}
+
+func GetEntityAttrs(ctx context.Context, ei EntityID, attrs []string) (e *Entity, err error) {
+	return defaultStore.GetEntityAttrs(ctx, ei, attrs)
+}
+
+func DeleteEntity(ctx context.Context, ei EntityID) error {
+	return defaultStore.DeleteEntity(ctx, ei)
+}
+
+func CreateEntity(ctx context.Context, e *Entity) error {
+	return defaultStore.CreateEntity(ctx, e)
+}
+
+func UpsertEntity(ctx context.Context, e *Entity) (created bool, err error) {
+	return defaultStore.UpsertEntity(ctx, e)
+}
+
+func DeleteAttr(ctx context.Context, ei EntityID, name string) (old *Entity, err error) {
+	return defaultStore.DeleteAttr(ctx, ei, name)
+}
+
+func SetAttr(ctx context.Context, ei EntityID, name string, attr *Attribute) (old *Entity, err error) {
+	return defaultStore.SetAttr(ctx, ei, name, attr)
+}
+
+func GetAttr(ctx context.Context, ei EntityID, name string) (attr Attribute, err error) {
+	return defaultStore.GetAttr(ctx, ei, name)
+}
+
+func SetAllAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	return defaultStore.SetAllAttrs(ctx, ei, attrs)
+}
+
+func GetAllAttrs(ctx context.Context, ei EntityID) (attrs map[string]Attribute, err error) {
+	return defaultStore.GetAllAttrs(ctx, ei)
+}
+
+func AddAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	return defaultStore.AddAttrs(ctx, ei, attrs)
+}
+
+func UpdateAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	return defaultStore.UpdateAttrs(ctx, ei, attrs)
+}
+
+func AddOrUpdateAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	return defaultStore.AddOrUpdateAttrs(ctx, ei, attrs)
+}
+
+func PatchEntity(ctx context.Context, ei EntityID, patch func(e *Entity) error) (old *Entity, err error) {
+	return defaultStore.PatchEntity(ctx, ei, patch)
+}
+
+func GetHistory(ctx context.Context, ei EntityID, name string, hq *HistoryQuery) (points []HistoryPoint, err error) {
+	return defaultStore.GetHistory(ctx, ei, name, hq)
+}
+
+func AggregateHistory(ctx context.Context, ei EntityID, name string, ha *HistoryAggregation) (buckets []HistoryBucket, err error) {
+	return defaultStore.AggregateHistory(ctx, ei, name, ha)
+}
+
+func GetEntityVersions(ctx context.Context, ei EntityID, limit, offset int) (versions []EntityVersion, err error) {
+	return defaultStore.GetEntityVersions(ctx, ei, limit, offset)
+}
+
+func GetEntityVersion(ctx context.Context, ei EntityID, version int) (e *Entity, err error) {
+	return defaultStore.GetEntityVersion(ctx, ei, version)
+}
+
+func RestoreEntity(ctx context.Context, v *Entity, recreate bool) (err error) {
+	return defaultStore.RestoreEntity(ctx, v, recreate)
+}
+
+func GetEntityAsOf(ctx context.Context, ei EntityID, asOf time.Time) (e *Entity, err error) {
+	return defaultStore.GetEntityAsOf(ctx, ei, asOf)
+}
+
+func GetEntitiesAsOf(ctx context.Context, q *Query, service, servicepath string, asOf time.Time) (entities []Entity, err error) {
+	return defaultStore.GetEntitiesAsOf(ctx, q, service, servicepath, asOf)
+}
+
+func CountServiceEntities(ctx context.Context, service string) (n int, err error) {
+	return defaultStore.CountServiceEntities(ctx, service)
+}
+
+func EntitiesPerService(ctx context.Context) (counts map[string]int, err error) {
+	return defaultStore.EntitiesPerService(ctx)
+}
+
+func CreateRegistration(ctx context.Context, r *Registration) error {
+	return defaultStore.CreateRegistration(ctx, r)
+}
+
+func GetRegistration(ctx context.Context, service, id string) (r *Registration, err error) {
+	return defaultStore.GetRegistration(ctx, service, id)
+}
+
+func ListRegistrations(ctx context.Context, service string, limit, offset int) (regs []Registration, err error) {
+	return defaultStore.ListRegistrations(ctx, service, limit, offset)
+}
+
+func CountRegistrations(ctx context.Context, service string) (n int, err error) {
+	return defaultStore.CountRegistrations(ctx, service)
+}
+
+func DeleteRegistration(ctx context.Context, service, id string) error {
+	return defaultStore.DeleteRegistration(ctx, service, id)
+}
+
+func RegistrationsFor(ctx context.Context, ei EntityID) (regs []Registration, err error) {
+	return defaultStore.RegistrationsFor(ctx, ei)
+}
+
+// Get runs the query in the default store, as Store.GetEntities
+func (q *Query) Get(ctx context.Context, service, servicepath string) (*EntityIter, error) {
+	return defaultStore.GetEntities(ctx, q, service, servicepath)
+}
+
+// Count runs the query in the default store, as Store.CountEntities
+func (q *Query) Count(ctx context.Context, service, servicepath string) (int, error) {
+	return defaultStore.CountEntities(ctx, q, service, servicepath)
+}
+
+// Delete runs the query in the default store, as Store.DeleteEntities
+func (q *Query) Delete(ctx context.Context, service, servicepath string, dryRun bool) (int, error) {
+	return defaultStore.DeleteEntities(ctx, q, service, servicepath, dryRun)
+}
+
+// Update runs the query in the default store, as Store.UpdateEntities
+func (q *Query) Update(ctx context.Context, service, servicepath string, attrs map[string]Attribute, dryRun bool) (int, error) {
+	return defaultStore.UpdateEntities(ctx, q, service, servicepath, attrs, dryRun)
+}
@@ -1,6 +1,11 @@
 // models.go
 package gorrion
 
+import (
+	"encoding/json"
+	"time"
+)
+
 const (
 	idField           = "id"
 	typeField         = "type"
@@ -8,11 +13,21 @@ const (
 	attrValueField    = "value"
 	attrTypeField     = "type"
 	attrMDField       = "metadata"
+
+	dateCreatedField  = "dateCreated"
+	dateModifiedField = "dateModified"
+	locationField     = "location"
 )
 
 type Entity struct {
 	ID    EntityID             `bson:"_id"`
 	Attrs map[string]Attribute `bson:"attrs"`
+	// Kept by the store, not part of the representations of the entity
+	DateCreated  time.Time   `bson:"dateCreated,omitempty" json:"-"`
+	DateModified time.Time   `bson:"dateModified,omitempty" json:"-"`
+	Location     interface{} `bson:"location,omitempty" json:"-"` // GeoJSON, for geo queries
+	// one more on every change, see GetEntityVersion
+	Version int `bson:"version,omitempty" json:"-"`
 }
 
 type EntityID struct {
@@ -246,6 +261,33 @@ func AttrValueFromObject(m interface{}) (a *Attribute, err error) {
 	return a, nil
 }
 
+// normalizedAttrs returns attrs as a client would see them, round trip
+// through JSON, whatever the store decoded them into
+func normalizedAttrs(attrs map[string]Attribute) (map[string]Attribute, error) {
+	raw, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	var normalized map[string]Attribute
+	if err = json.Unmarshal(raw, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+// mdAttribute returns the metadata md of a normalized attribute as an
+// attribute, from its type and value, or its bare value
+func mdAttribute(md interface{}) Attribute {
+	a := Attribute{Value: md}
+	if o, ok := md.(map[string]interface{}); ok {
+		if value, ok := o[attrValueField]; ok {
+			a.Value = value
+			a.Type, _ = o[attrTypeField].(string)
+		}
+	}
+	return a
+}
+
 func ValidateEntity(e *Entity) error {
 	if len(e.ID.ID) == 0 {
 		return ErrEmptyEntityID
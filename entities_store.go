@@ -1,128 +1,318 @@
 package gorrion
 
 import (
+	"context"
+	"time"
+
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-var (
-	url          = "localhost"
-	db           = "gorrion"
-	entitiesColl = "ent"
-)
+func (st *Store) ensureIndexes() error {
+	sess := st.session.Copy()
+	defer sess.Close()
+	col := sess.DB(st.config.DB).C(st.config.EntitiesColl)
+	// needed by $nearSphere
+	err := col.EnsureIndex(mgo.Index{Key: []string{"$2dsphere:" + locationField}, Sparse: true})
+	if err != nil {
+		return err
+	}
+	if err = st.ensureHistoryIndexes(sess); err != nil {
+		return err
+	}
+	return st.ensureVersionIndexes(sess)
+}
 
-var (
-	initialSession *mgo.Session
-)
+// setAttrsUpdate is the update setting attrs, one by one, in an entity, modified
+// at now. The time is taken by the broker, as the times of the versions and the
+// history of the entity, not by MongoDB, so they all come from the same clock.
+func setAttrsUpdate(attrs map[string]Attribute, now time.Time) bson.M {
+	set := bson.M{dateModifiedField: now}
+	for name, attr := range attrs {
+		set["attrs."+name] = attr
+	}
+	if loc := locationOf(attrs); loc != nil {
+		set[locationField] = loc
+	}
+	return bson.M{"$set": set, "$inc": bson.M{versionField: 1}}
+}
+
+// replaceAttrsUpdate is the update replacing all the attributes of an entity,
+// modified at now, as setAttrsUpdate
+func replaceAttrsUpdate(attrs map[string]Attribute, now time.Time) bson.M {
+	update := bson.M{
+		"$set": bson.M{"attrs": attrs, dateModifiedField: now},
+		"$inc": bson.M{versionField: 1},
+	}
+	if loc := locationOf(attrs); loc != nil {
+		update["$set"].(bson.M)[locationField] = loc
+	} else {
+		update["$unset"] = bson.M{locationField: true}
+	}
+	return update
+}
 
-func StartStore() (err error) {
-	initialSession, err = mgo.Dial(url)
+func (st *Store) getCol(ei EntityID) string {
+	return st.config.EntitiesColl
+}
+
+// withCol runs f over the collection for ei, in the session of the request
+// bound to ctx. Nothing is done if ctx is already done, and its deadline limits
+// every round trip to MongoDB, on the socket and, for queries, on the server.
+// MongoDB has no way of canceling a write, so an operation already sent goes on
+// until it is finished or the deadline expires.
+func (st *Store) withCol(ctx context.Context, ei EntityID, f func(col *mgo.Collection) error) error {
+	return st.runCol(ctx, func() string { return st.getCol(ei) }, false, f)
+}
+
+// withColRead is withCol for operations that can be repeated, which are retried
+// once if the connection was lost, as when the primary steps down
+func (st *Store) withColRead(ctx context.Context, ei EntityID, f func(col *mgo.Collection) error) error {
+	return st.runCol(ctx, func() string { return st.getCol(ei) }, true, f)
+}
+
+// runCol runs f over the collection colName returns, as withCol and
+// withColRead
+func (st *Store) runCol(ctx context.Context, colName func() string, retry bool, f func(col *mgo.Collection) error) error {
+	if err := ctx.Err(); err != nil {
+		return contextErr(err)
+	}
+	name := colName()
+	sess, release := st.sessionFor(ctx)
+	defer release()
+	if d, ok := ctx.Deadline(); ok {
+		sess.SetSocketTimeout(time.Until(d))
+	}
+	err := f(sess.DB(st.config.DB).C(name))
+	if ctx.Err() != nil {
+		// a socket timeout, most likely
+		return contextErr(ctx.Err())
+	}
+	if isConnErr(err) {
+		// drop the dead socket, the next operation gets one to the new primary
+		sess.Refresh()
+		if retry {
+			err = f(sess.DB(st.config.DB).C(name))
+			if ctx.Err() != nil {
+				return contextErr(ctx.Err())
+			}
+		}
+	}
+	if isDocTooLarge(err) {
+		return ErrDocumentTooLarge
+	}
 	return err
 }
 
-func StopStore() (err error) {
-	initialSession.Close()
-	return nil
+// withMaxTime makes the server give up on q when ctx expires
+func withMaxTime(ctx context.Context, q *mgo.Query) *mgo.Query {
+	if d, ok := ctx.Deadline(); ok {
+		return q.SetMaxTime(time.Until(d))
+	}
+	return q
+}
+
+func contextErr(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ErrCanceled
 }
 
-func getCol(ei EntityID) string {
-	return entitiesColl
+func (st *Store) GetEntity(ctx context.Context, ei EntityID) (e *Entity, err error) {
+	ctx, op := st.startOp(ctx, "GetEntity", ei)
+	defer op.end(&err)
+	return st.getEntityAttrs(ctx, ei, nil)
 }
 
-func GetEntity(ei EntityID) (e *Entity, err error) {
-	return GetEntityAttrs(ei, nil)
+func (st *Store) GetEntityAttrs(ctx context.Context, ei EntityID, attrs []string) (e *Entity, err error) {
+	ctx, op := st.startOp(ctx, "GetEntityAttrs", ei)
+	defer op.end(&err)
+	return st.getEntityAttrs(ctx, ei, attrs)
 }
 
-func GetEntityAttrs(ei EntityID, attrs []string) (e *Entity, err error) {
+// getEntityAttrs reads the entity ei, with only attrs if any, for the
+// operations that read it
+func (st *Store) getEntityAttrs(ctx context.Context, ei EntityID, attrs []string) (e *Entity, err error) {
 	e = &Entity{}
-	query := initialSession.DB(db).C(getCol(ei)).FindId(ei)
-	if len(attrs) != 0 {
-		attrsFilter := bson.M{}
-		for _, a := range attrs {
-			attrsFilter["attrs."+a] = true
+	err = st.withColRead(ctx, ei, func(col *mgo.Collection) error {
+		query := withMaxTime(ctx, col.FindId(ei))
+		if len(attrs) != 0 {
+			attrsFilter := bson.M{}
+			for _, a := range attrs {
+				attrsFilter["attrs."+a] = true
+			}
+			query = query.Select(attrsFilter)
 		}
-		query = query.Select(attrsFilter)
-	}
-	err = query.One(&e)
+		return query.One(&e)
+	})
 	if err == mgo.ErrNotFound {
 		return nil, ErrNotFoundEntity
 	}
-	return e, err
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
-func DeleteEntity(ei EntityID) error {
-	err := initialSession.DB(db).C(getCol(ei)).RemoveId(ei)
+func (st *Store) DeleteEntity(ctx context.Context, ei EntityID) (err error) {
+	ctx, op := st.startOp(ctx, "DeleteEntity", ei)
+	defer op.end(&err)
+	old := &Entity{}
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		_, err := col.FindId(ei).Apply(mgo.Change{Remove: true}, old)
+		return err
+	})
 	if err == mgo.ErrNotFound {
 		return ErrNotFoundEntity
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	st.recordVersion(ctx, old, time.Now(), true)
+	return nil
+}
+
+func (st *Store) CreateEntity(ctx context.Context, e *Entity) (err error) {
+	ctx, op := st.startOp(ctx, "CreateEntity", e.ID)
+	defer op.end(&err)
+	op.setAttrCount(len(e.Attrs))
+	return st.createEntity(ctx, e)
 }
 
-func CreateEntity(e *Entity) error {
-	err := ValidateEntity(e)
+func (st *Store) createEntity(ctx context.Context, e *Entity) (err error) {
+	err = ValidateEntity(e)
 	if err != nil {
 		return err
 	}
-	err = initialSession.DB(db).C(getCol(e.ID)).Insert(e)
+	if e.Version, err = st.firstVersion(ctx, e.ID); err != nil {
+		return err
+	}
+	e.DateCreated = time.Now()
+	e.DateModified = e.DateCreated
+	e.Location = locationOf(e.Attrs)
+	err = st.withCol(ctx, e.ID, func(col *mgo.Collection) error {
+		return col.Insert(e)
+	})
 	if mgo.IsDup(err) {
 		return ErrExistentEntity
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	st.recordHistory(ctx, e.ID, e.Attrs, e.DateCreated)
+	return nil
+}
+
+// UpsertEntity creates the entity or, if it already exists, adds or updates its
+// attributes with the ones in e, all in a single operation. It returns true when
+// the entity has been created.
+func (st *Store) UpsertEntity(ctx context.Context, e *Entity) (created bool, err error) {
+	ctx, op := st.startOp(ctx, "UpsertEntity", e.ID)
+	defer op.end(&err)
+	op.setAttrCount(len(e.Attrs))
+	err = ValidateEntity(e)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	update := setAttrsUpdate(e.Attrs, now)
+	onInsert := bson.M{dateCreatedField: now}
+	if len(e.Attrs) == 0 {
+		// nothing to merge, but a new entity still needs its attrs
+		onInsert["attrs"] = e.Attrs
+	}
+	update["$setOnInsert"] = onInsert
+	first, err := st.firstVersion(ctx, e.ID)
+	if err != nil {
+		return false, err
+	}
+	old := &Entity{}
+	change := mgo.Change{Update: update, Upsert: true, ReturnNew: false}
+	err = st.withCol(ctx, e.ID, func(col *mgo.Collection) error {
+		info, err := col.FindId(e.ID).Apply(change, old)
+		if err != nil {
+			return err
+		}
+		created = info.UpsertedId != nil
+		if created && first > 1 {
+			// numbered after the versions of a former entity with its id
+			return col.UpdateId(e.ID, bson.M{"$inc": bson.M{versionField: first - 1}})
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if created {
+		old = nil
+	}
+	st.recordWrite(ctx, e.ID, old, e.Attrs, now)
+	return created, nil
 }
 
-func DeleteAttr(ei EntityID, name string) (old *Entity, err error) {
+func (st *Store) DeleteAttr(ctx context.Context, ei EntityID, name string) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "DeleteAttr", ei)
+	defer op.end(&err)
 	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$unset": bson.M{"attrs." + name: true}},
+		Update: bson.M{
+			"$unset": bson.M{"attrs." + name: true},
+			"$set":   bson.M{dateModifiedField: now},
+			"$inc":   bson.M{versionField: 1},
+		},
 		ReturnNew: false,
 	}
-	_, err = col.Find(bson.M{"_id": ei}).Apply(change, old)
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		_, err := col.Find(bson.M{"_id": ei}).Apply(change, old)
+		if t := old.Attrs[name].Type; err != nil || t != attrTypeGeoPoint && t != attrTypeGeoJSON {
+			return err
+		}
+		// the location may come from the removed attribute
+		rest := map[string]Attribute{}
+		for n, a := range old.Attrs {
+			if n != name {
+				rest[n] = a
+			}
+		}
+		update := bson.M{"$unset": bson.M{locationField: true}}
+		if loc := locationOf(rest); loc != nil {
+			update = bson.M{"$set": bson.M{locationField: loc}}
+		}
+		return col.UpdateId(ei, update)
+	})
 	if err == mgo.ErrNotFound {
 		return nil, ErrNotFoundEntity
 	}
-
-	return old, err
+	if err != nil {
+		return nil, err
+	}
+	st.recordVersion(ctx, old, now, false)
+	return old, nil
 }
 
-func SetAttr(ei EntityID, name string, attr *Attribute) (old *Entity, err error) {
+func (st *Store) SetAttr(ctx context.Context, ei EntityID, name string, attr *Attribute) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "SetAttr", ei)
+	defer op.end(&err)
+	op.setAttrCount(1)
 	err = ValidateAttribute(name, attr)
 	if err != nil {
 		return nil, err
 	}
-	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	attrs := map[string]Attribute{name: *attr}
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$set": bson.M{"attrs." + name: attr}},
+		Update:    setAttrsUpdate(attrs, now),
 		ReturnNew: false,
 	}
-	_, err = col.Find(bson.M{"_id": ei}).Apply(change, old)
-	if err == mgo.ErrNotFound {
-		return nil, ErrNotFoundEntity
-	}
-	return old, err
+	return st.applyChangeRecorded(ctx, ei, change, attrs, now)
 }
 
-func GetAttr(ei EntityID, name string) (attr Attribute, err error) {
-
-	/*
-		var result struct {
-			A Attribute `bson:"A"`
-		}
-
-
-		col := initialSession.DB(db).C(getCol(ei))
-
-		err = col.Pipe([]bson.M{
-			{"$match": bson.M{"_id": ei}},
-			{"$project": bson.M{"A": "$attrs." + name, "_id": false}},
-		}).One(&result)
-		if err == mgo.ErrNotFound {
-			err = ErrNotFoundEntity
-		}
-	*/
-
-	e, err := GetEntityAttrs(ei, []string{name})
+func (st *Store) GetAttr(ctx context.Context, ei EntityID, name string) (attr Attribute, err error) {
+	ctx, op := st.startOp(ctx, "GetAttr", ei)
+	defer op.end(&err)
+	e, err := st.getEntityAttrs(ctx, ei, []string{name})
 	if err != nil {
 		return attr, err
 	}
@@ -131,37 +321,43 @@ func GetAttr(ei EntityID, name string) (attr Attribute, err error) {
 		return attr, ErrNotFoundAttr
 	}
 	return e.Attrs[name], err
+}
 
+func (st *Store) SetAllAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "SetAllAttrs", ei)
+	defer op.end(&err)
+	op.setAttrCount(len(attrs))
+	return st.setAllAttrs(ctx, ei, attrs)
 }
 
-func SetAllAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+func (st *Store) setAllAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
 	err = ValidateAttrsMap(attrs)
 	if err != nil {
 		return nil, err
 	}
-	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$set": bson.M{"attrs": attrs}},
+		Update:    replaceAttrsUpdate(attrs, now),
 		ReturnNew: false,
 	}
-	_, err = col.Find(bson.M{"_id": ei}).Apply(change, old)
-	if err == mgo.ErrNotFound {
-		return nil, ErrNotFoundEntity
-	}
-	return old, err
+	return st.applyChangeRecorded(ctx, ei, change, attrs, now)
 }
 
-func GetAllAttrs(ei EntityID) (attrs map[string]Attribute, err error) {
-	e, err := GetEntity(ei)
-	// GetEntity returns ErrNotFoundEntity already, not check is necessary
+func (st *Store) GetAllAttrs(ctx context.Context, ei EntityID) (attrs map[string]Attribute, err error) {
+	ctx, op := st.startOp(ctx, "GetAllAttrs", ei)
+	defer op.end(&err)
+	e, err := st.getEntityAttrs(ctx, ei, nil)
+	// getEntityAttrs returns ErrNotFoundEntity already, not check is necessary
 	if err != nil {
 		return nil, err
 	}
 	return e.Attrs, err
 }
 
-func AddAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+func (st *Store) AddAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "AddAttrs", ei)
+	defer op.end(&err)
+	op.setAttrCount(len(attrs))
 	err = ValidateAttrsMap(attrs)
 	if err != nil {
 		return nil, err
@@ -172,33 +368,38 @@ func AddAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err error)
 		condition["attrs."+name] = bson.M{"$exists": false}
 	}
 
-	update := bson.M{}
-	for name, attr := range attrs {
-		update["attrs."+name] = attr
-	}
-
 	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$set": update},
+		Update:    setAttrsUpdate(attrs, now),
 		ReturnNew: false,
 	}
-	_, err = col.Find(condition).Apply(change, old)
-
-	if err == mgo.ErrNotFound {
-		err = col.FindId(ei).One(nil)
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		_, err := col.Find(condition).Apply(change, old)
 		if err == mgo.ErrNotFound {
-			// the entity does not exist
-			return nil, ErrNotFoundEntity
+			err = col.FindId(ei).One(nil)
+			if err == mgo.ErrNotFound {
+				// the entity does not exist
+				return ErrNotFoundEntity
+			}
+			if err == nil {
+				// some attr is in the entity already ...
+				return ErrExistentAttr
+			}
 		}
-		// some attr is in the entity already ...
-		return nil, ErrExistentAttr
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return old, err
+	st.recordWrite(ctx, ei, old, attrs, now)
+	return old, nil
 }
 
-func UpdateAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+func (st *Store) UpdateAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "UpdateAttrs", ei)
+	defer op.end(&err)
+	op.setAttrCount(len(attrs))
 	err = ValidateAttrsMap(attrs)
 	if err != nil {
 		return nil, err
@@ -209,54 +410,143 @@ func UpdateAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err erro
 		condition["attrs."+name] = bson.M{"$exists": true}
 	}
 
-	update := bson.M{}
-	for name, attr := range attrs {
-		update["attrs."+name] = attr
-	}
-
 	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$set": update},
+		Update:    setAttrsUpdate(attrs, now),
 		ReturnNew: false,
 	}
-	_, err = col.Find(condition).Apply(change, old)
-
-	if err == mgo.ErrNotFound {
-		err = col.FindId(ei).One(nil)
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		_, err := col.Find(condition).Apply(change, old)
 		if err == mgo.ErrNotFound {
-			// the entity does not exist
-			return nil, ErrNotFoundEntity
+			err = col.FindId(ei).One(nil)
+			if err == mgo.ErrNotFound {
+				// the entity does not exist
+				return ErrNotFoundEntity
+			}
+			if err == nil {
+				// the entity does not have the attribute
+				return ErrNotFoundAttr
+			}
 		}
-		// the entity does not have the attribute
-		return nil, ErrNotFoundAttr
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	st.recordWrite(ctx, ei, old, attrs, now)
+	return old, nil
+}
 
-	return old, err
+// applyChange applies change to the entity ei, returning it as it was before
+func (st *Store) applyChange(ctx context.Context, ei EntityID, change mgo.Change) (old *Entity, err error) {
+	old = &Entity{}
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		_, err := col.Find(bson.M{"_id": ei}).Apply(change, old)
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFoundEntity
+	}
+	if err != nil {
+		return nil, err
+	}
+	return old, nil
 }
 
-func AddOrUpdateAttrs(ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+// applyChangeRecorded is applyChange for a change writing attrs at now, which
+// are recorded in their history, as the entity before it in its versions
+func (st *Store) applyChangeRecorded(ctx context.Context, ei EntityID, change mgo.Change, attrs map[string]Attribute, now time.Time) (old *Entity, err error) {
+	old, err = st.applyChange(ctx, ei, change)
+	if err != nil {
+		return nil, err
+	}
+	st.recordWrite(ctx, ei, old, attrs, now)
+	return old, nil
+}
+
+func (st *Store) AddOrUpdateAttrs(ctx context.Context, ei EntityID, attrs map[string]Attribute) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "AddOrUpdateAttrs", ei)
+	defer op.end(&err)
+	op.setAttrCount(len(attrs))
 	// might make SetAttr redundant ...
 	err = ValidateAttrsMap(attrs)
 	if err != nil {
 		return nil, err
 	}
 	// attributes may exist or not
-	condition := bson.M{"_id": ei}
-	update := bson.M{}
-	for name, attr := range attrs {
-		update["attrs."+name] = attr
-	}
-
-	old = &Entity{}
-	col := initialSession.DB(db).C(getCol(ei))
+	now := time.Now()
 	change := mgo.Change{
-		Update:    bson.M{"$set": update},
+		Update:    setAttrsUpdate(attrs, now),
 		ReturnNew: false,
 	}
-	_, err = col.Find(condition).Apply(change, old)
-	if err == mgo.ErrNotFound {
-		err = ErrNotFoundEntity
+	return st.applyChangeRecorded(ctx, ei, change, attrs, now)
+}
+
+// patchRetries is how many times PatchEntity tries again when the entity is
+// modified by someone else between reading and writing it
+const patchRetries = 5
+
+// PatchEntity reads the entity, lets patch modify its attributes and saves them
+// only if the stored ones have not changed in the meantime. Nothing is written if
+// patch returns an error, so it can be used as a precondition.
+func (st *Store) PatchEntity(ctx context.Context, ei EntityID, patch func(e *Entity) error) (old *Entity, err error) {
+	ctx, op := st.startOp(ctx, "PatchEntity", ei)
+	defer op.end(&err)
+	var (
+		patched *Entity
+		now     time.Time
+	)
+	err = st.withCol(ctx, ei, func(col *mgo.Collection) error {
+		for i := 0; i < patchRetries; i++ {
+			// keep the raw attrs, comparing them byte by byte is the
+			// only reliable way of matching a subdocument with maps
+			var stored struct {
+				Attrs bson.Raw `bson:"attrs"`
+			}
+			err := withMaxTime(ctx, col.FindId(ei)).One(&stored)
+			if err == mgo.ErrNotFound {
+				return ErrNotFoundEntity
+			}
+			if err != nil {
+				return err
+			}
+			e := NewEntity(ei)
+			if err = stored.Attrs.Unmarshal(&e.Attrs); err != nil {
+				return err
+			}
+			if err = patch(e); err != nil {
+				return err
+			}
+			if err = ValidateAttrsMap(e.Attrs); err != nil {
+				return err
+			}
+			old = &Entity{}
+			now = time.Now()
+			change := mgo.Change{
+				Update:    replaceAttrsUpdate(e.Attrs, now),
+				ReturnNew: false,
+			}
+			_, err = col.Find(bson.M{"_id": ei, "attrs": stored.Attrs}).Apply(change, old)
+			if err != mgo.ErrNotFound {
+				patched = e
+				return err
+			}
+			// changed (or removed) after being read, start again
+		}
+		return ErrConcurrentModification
+	})
+	if err != nil {
+		return nil, err
 	}
-	return old, err
+	st.recordVersion(ctx, old, now, false)
+	st.recordChanges(ctx, old, patched, now)
+	return old, nil
+}
+
+// recordWrite keeps old, the entity ei before attrs were written to it at now,
+// in its versions, and attrs in their history. old is nil for a new entity.
+func (st *Store) recordWrite(ctx context.Context, ei EntityID, old *Entity, attrs map[string]Attribute, now time.Time) {
+	st.recordVersion(ctx, old, now, false)
+	st.recordHistory(ctx, ei, attrs, now)
 }
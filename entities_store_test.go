@@ -1,7 +1,11 @@
 package gorrion
 
 import (
+	"context"
 	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestCreateEntity(t *testing.T) {
@@ -16,11 +20,11 @@ func TestCreateEntity(t *testing.T) {
 	defer teardownTestDB(t)
 
 	e.Attrs["temperature"] = Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
-	e2, err = GetEntity(id)
+	e2, err = GetEntity(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -39,7 +43,7 @@ func TestCreateEntity_Dup(t *testing.T) {
 	// An already existent entity should be I1/T1/S/SP
 	e := NewEntity(EntityID{ID: "I1", Type: "T1", Service: "S", ServicePath: "SP"})
 	e.Attrs["x"] = Attribute{Value: 12.34, Type: "float"}
-	err := CreateEntity(e)
+	err := CreateEntity(testCtx, e)
 	if err != ErrExistentEntity {
 		t.Error(gotWanted(err, ErrExistentEntity))
 	}
@@ -52,7 +56,7 @@ func TestCreateEntity_EmptyID(t *testing.T) {
 
 	e := NewEntity(EntityID{ID: "", Type: "T1", Service: "S", ServicePath: "SP"})
 	e.Attrs["x"] = Attribute{Value: 12.34, Type: "float"}
-	err := CreateEntity(e)
+	err := CreateEntity(testCtx, e)
 	if err != ErrEmptyEntityID {
 		t.Error(gotWanted(err, ErrEmptyEntityID))
 	}
@@ -64,7 +68,7 @@ func TestCreateEntity_IDAsAttr(t *testing.T) {
 
 	e := NewEntity(EntityID{ID: "id", Type: "t", Service: "S", ServicePath: "SP"})
 	e.Attrs[idField] = Attribute{Value: 12.34, Type: "float"}
-	err := CreateEntity(e)
+	err := CreateEntity(testCtx, e)
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
 	}
@@ -76,7 +80,7 @@ func TestCreateEntity_TypeAsAttr(t *testing.T) {
 
 	e := NewEntity(EntityID{ID: "id", Type: "t", Service: "S", ServicePath: "SP"})
 	e.Attrs[typeField] = Attribute{Value: 12.34, Type: "float"}
-	err := CreateEntity(e)
+	err := CreateEntity(testCtx, e)
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
 	}
@@ -88,12 +92,102 @@ func TestCreateEntity_EmptyType(t *testing.T) {
 
 	e := NewEntity(EntityID{ID: "id", Type: "", Service: "S", ServicePath: "SP"})
 	e.Attrs["x"] = Attribute{Value: 12.34, Type: "float"}
-	err := CreateEntity(e)
+	err := CreateEntity(testCtx, e)
 	if err != ErrEmptyEntityType {
 		t.Error(gotWanted(err, ErrEmptyEntityType))
 	}
 }
 
+func TestUpsertEntity_Create(t *testing.T) {
+	var (
+		id = EntityID{ID: "ID", Type: "Type"}
+		e  = NewEntity(id)
+	)
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	e.Attrs["temperature"] = Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
+	created, err := UpsertEntity(testCtx, e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !created {
+		t.Error(gotWanted(created, true))
+	}
+	e2, err := GetEntity(testCtx, id)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !equalObjects(e, e2) {
+		t.Error(gotWanted(e2, e))
+	}
+}
+
+func TestUpsertEntity_Update(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	var emptyMap = map[string]interface{}{}
+	e := NewEntity(population[0].ID)
+	e.Attrs["status"] = Attribute{Value: "OFF", Md: emptyMap}
+	e.Attrs["humidity"] = Attribute{Value: 60.0, Md: emptyMap}
+	created, err := UpsertEntity(testCtx, e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if created {
+		t.Error(gotWanted(created, false))
+	}
+	e2, err := GetEntity(testCtx, e.ID)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := map[string]Attribute{
+		"temperature": population[0].Attrs["temperature"],
+		"status":      {Value: "OFF", Md: emptyMap},
+		"humidity":    {Value: 60.0, Md: emptyMap},
+	}
+	if !equalObjects(e2.Attrs, wanted) {
+		t.Error(gotWanted(e2.Attrs, wanted))
+	}
+}
+
+func TestUpsertEntity_NoAttrs(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	e := NewEntity(EntityID{ID: "ID", Type: "Type"})
+	created, err := UpsertEntity(testCtx, e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !created {
+		t.Error(gotWanted(created, true))
+	}
+	created, err = UpsertEntity(testCtx, e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if created {
+		t.Error(gotWanted(created, false))
+	}
+}
+
+func TestUpsertEntity_IDAsAttr(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	e := NewEntity(EntityID{ID: "ID", Type: "T1"})
+	e.Attrs[idField] = Attribute{Value: 12.34, Type: "float"}
+	_, err := UpsertEntity(testCtx, e)
+	if err != ErrInvalidAttrID {
+		t.Error(gotWanted(err, ErrInvalidAttrID))
+	}
+}
+
 func TestFetchEntityNoEntity(t *testing.T) {
 	var (
 		id  = EntityID{ID: "ID", Type: "Type"}
@@ -103,7 +197,7 @@ func TestFetchEntityNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = GetEntity(id)
+	_, err = GetEntity(testCtx, id)
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
@@ -119,15 +213,15 @@ func TestDeleteEntity(t *testing.T) {
 	defer teardownTestDB(t)
 
 	e.Attrs["temperature"] = Attribute{Value: 32.0, Type: "celsius", Md: nil}
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
-	err = DeleteEntity(e.ID)
+	err = DeleteEntity(testCtx, e.ID)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
-	e, err = GetEntity(e.ID)
+	e, err = GetEntity(testCtx, e.ID)
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
@@ -142,7 +236,7 @@ func TestDeleteEntityNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = DeleteEntity(id)
+	err = DeleteEntity(testCtx, id)
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(ErrNotFoundEntity, err))
 	}
@@ -162,11 +256,11 @@ func TestDeleteAttr(t *testing.T) {
 
 	e.Attrs["temperature"] = Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["pressure"] = Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
-	old, err = DeleteAttr(id, "temperature")
+	old, err = DeleteAttr(testCtx, id, "temperature")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -175,7 +269,7 @@ func TestDeleteAttr(t *testing.T) {
 	}
 
 	// And check if we removed it really
-	e2, err = GetEntity(id)
+	e2, err = GetEntity(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -187,7 +281,7 @@ func TestDeleteAttr(t *testing.T) {
 	}
 
 	// delete a nonexistent attribute
-	old, err = DeleteAttr(id, "speed")
+	old, err = DeleteAttr(testCtx, id, "speed")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -195,7 +289,7 @@ func TestDeleteAttr(t *testing.T) {
 		t.Error(gotWanted(old, e))
 	}
 	// And check the entity is the same in DB
-	e3, err := GetEntity(id)
+	e3, err := GetEntity(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -213,12 +307,40 @@ func TestDeleteAttrNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = DeleteAttr(id, "temperature")
+	_, err = DeleteAttr(testCtx, id, "temperature")
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
 }
 
+func TestDeleteAttr_Location(t *testing.T) {
+	var (
+		id = EntityID{ID: "ID_DeleteAttr_Location", Type: "Type"}
+		e  = NewEntity(id)
+	)
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	e.Attrs["position"] = Attribute{Type: attrTypeGeoJSON,
+		Value: map[string]interface{}{"type": "Point", "coordinates": []interface{}{2.18, 41.37}}}
+	err := CreateEntity(testCtx, e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if _, err = DeleteAttr(testCtx, id, "position"); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	// the location came from the attribute removed
+	e, err = GetEntity(testCtx, id)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if e.Location != nil {
+		t.Error(gotWanted(e.Location, nil))
+	}
+}
+
 func TestGetAttr(t *testing.T) {
 	var (
 		id   = EntityID{ID: "ID_GetAttrr", Type: "Type"}
@@ -234,12 +356,12 @@ func TestGetAttr(t *testing.T) {
 	e.Attrs["temperature"] = temperature
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	e.Attrs["pressure"] = pressure
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	attr, err = GetAttr(id, "temperature")
+	attr, err = GetAttr(testCtx, id, "temperature")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -247,7 +369,7 @@ func TestGetAttr(t *testing.T) {
 		t.Error(gotWanted(attr, temperature))
 	}
 
-	attr, err = GetAttr(id, "pressure")
+	attr, err = GetAttr(testCtx, id, "pressure")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -265,7 +387,7 @@ func TestGetAttrNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = GetAttr(id, "temperature")
+	_, err = GetAttr(testCtx, id, "temperature")
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
@@ -286,12 +408,12 @@ func TestGetAttrNoAttr(t *testing.T) {
 	e.Attrs["temperature"] = temperature
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	e.Attrs["pressure"] = pressure
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	_, err = GetAttr(id, "inexistent_attribute")
+	_, err = GetAttr(testCtx, id, "inexistent_attribute")
 	if err != ErrNotFoundAttr {
 		t.Error(gotWanted(err, ErrNotFoundAttr))
 	}
@@ -312,19 +434,19 @@ func TestSetAttr(t *testing.T) {
 	temperature := Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["temperature"] = temperature
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
-	old, err := SetAttr(id, "pressure", &pressure)
+	old, err := SetAttr(testCtx, id, "pressure", &pressure)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	// temperature remains the same
-	attr, err = GetAttr(id, "temperature")
+	attr, err = GetAttr(testCtx, id, "temperature")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -333,12 +455,12 @@ func TestSetAttr(t *testing.T) {
 	}
 
 	// pressure is stored properly
-	attr, err = GetAttr(id, "pressure")
+	attr, err = GetAttr(testCtx, id, "pressure")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 	if !equalObjects(attr, pressure) {
-		t.Errorf(gotWanted(attr, pressure))
+		t.Error(gotWanted(attr, pressure))
 	}
 }
 
@@ -352,12 +474,12 @@ func TestSetAttrIDAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	_, err = SetAttr(id, idField, &Attribute{})
+	_, err = SetAttr(testCtx, id, idField, &Attribute{})
 
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
@@ -374,12 +496,12 @@ func TestSetAttrTypeAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	_, err = SetAttr(id, typeField, &Attribute{})
+	_, err = SetAttr(testCtx, id, typeField, &Attribute{})
 
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
@@ -395,9 +517,9 @@ func TestSetAttrNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = SetAttr(id, "temperature", &Attribute{})
+	_, err = SetAttr(testCtx, id, "temperature", &Attribute{})
 	if err != ErrNotFoundEntity {
-		t.Errorf(gotWanted(err, ErrNotFoundEntity))
+		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
 }
 
@@ -414,19 +536,19 @@ func TestAddAttrs(t *testing.T) {
 	temperature := Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["temperature"] = temperature
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	attrs := map[string]Attribute{"pressure": pressure}
-	_, err = AddAttrs(id, attrs)
+	_, err = AddAttrs(testCtx, id, attrs)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	newAttrs, err := GetAllAttrs(id)
+	newAttrs, err := GetAllAttrs(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -436,7 +558,7 @@ func TestAddAttrs(t *testing.T) {
 		"pressure":    pressure,
 	}
 	if !equalObjects(newAttrs, both) {
-		t.Errorf(gotWanted(newAttrs, both))
+		t.Error(gotWanted(newAttrs, both))
 	}
 }
 
@@ -453,7 +575,7 @@ func TestAddAttrsExistent(t *testing.T) {
 	temperature := Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["temperature"] = temperature
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -461,7 +583,7 @@ func TestAddAttrsExistent(t *testing.T) {
 	temperature.Value = 1945
 	attrs := map[string]Attribute{"temperature": temperature}
 
-	_, err = AddAttrs(id, attrs)
+	_, err = AddAttrs(testCtx, id, attrs)
 	if err != ErrExistentAttr {
 		t.Error(gotWanted(err, ErrExistentAttr))
 	}
@@ -477,7 +599,7 @@ func TestAddAttrsNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = AddAttrs(id, map[string]Attribute{"x": {}})
+	_, err = AddAttrs(testCtx, id, map[string]Attribute{"x": {}})
 	if err != ErrNotFoundEntity {
 		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
@@ -493,14 +615,14 @@ func TestAddAttrsIDAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"id": {}}
 
-	_, err = AddAttrs(id, attrs)
+	_, err = AddAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
 	}
@@ -516,14 +638,14 @@ func TestAddAttrsTypeAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"type": {}}
 
-	_, err = AddAttrs(id, attrs)
+	_, err = AddAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
 	}
@@ -542,19 +664,19 @@ func TestUpdateAttrs(t *testing.T) {
 	temperature := Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["temperature"] = temperature
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	temperature.Value = 1921
 	attrs := map[string]Attribute{"temperature": temperature}
-	_, err = UpdateAttrs(id, attrs)
+	_, err = UpdateAttrs(testCtx, id, attrs)
 	if err != nil {
 		t.Fatalf(unexpected(err), err)
 	}
 
-	newAttrs, err := GetAllAttrs(id)
+	newAttrs, err := GetAllAttrs(testCtx, id)
 	if err != nil {
 		t.Fatalf(unexpected(err), err)
 	}
@@ -577,14 +699,14 @@ func TestUpdateAttrsNotExist(t *testing.T) {
 	temperature := Attribute{Value: 32.0, Type: "celsius", Md: map[string]interface{}{}}
 	e.Attrs["temperature"] = temperature
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatalf(unexpected(err), err)
 	}
 
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	attrs := map[string]Attribute{"pressure": pressure}
-	_, err = UpdateAttrs(id, attrs)
+	_, err = UpdateAttrs(testCtx, id, attrs)
 	if err != ErrNotFoundAttr {
 		t.Errorf("wanted %#v, got %#v", ErrNotFoundAttr, err)
 	}
@@ -599,7 +721,7 @@ func TestUpdateAttrsNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = UpdateAttrs(id, map[string]Attribute{"x": {}})
+	_, err = UpdateAttrs(testCtx, id, map[string]Attribute{"x": {}})
 	if err != ErrNotFoundEntity {
 		t.Errorf("wanted %#v, got %#v", ErrNotFoundEntity, err)
 	}
@@ -618,14 +740,14 @@ func TestUpdateAttrsIDAsAttr(t *testing.T) {
 	// This test works because the attr name is checked before trying to perform the
 	// database action, so it's not necessary that the attr exists before the update
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"id": {}}
 
-	_, err = UpdateAttrs(id, attrs)
+	_, err = UpdateAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
 	}
@@ -644,14 +766,14 @@ func TestUpdateAttrsTypeAsAttr(t *testing.T) {
 	// This test works because the attr name is checked before trying to perform the
 	// database action, so it's not necessary that the attr exists before the update
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"type": {}}
 
-	_, err = UpdateAttrs(id, attrs)
+	_, err = UpdateAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
 	}
@@ -671,7 +793,7 @@ func TestAddOrUpdateAttrs(t *testing.T) {
 	e.Attrs["temperature"] = temperature
 	open := Attribute{Value: true, Type: "alarm", Md: map[string]interface{}{}}
 	e.Attrs["open"] = open
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -679,12 +801,12 @@ func TestAddOrUpdateAttrs(t *testing.T) {
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	temperature.Value = -10
 	attrs := map[string]Attribute{"pressure": pressure, "temperature": temperature}
-	_, err = AddOrUpdateAttrs(id, attrs)
+	_, err = AddOrUpdateAttrs(testCtx, id, attrs)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	newAttrs, err := GetAllAttrs(id)
+	newAttrs, err := GetAllAttrs(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -710,7 +832,7 @@ func TestAddOrUpdateAttrsNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = AddOrUpdateAttrs(id, map[string]Attribute{"x": {}})
+	_, err = AddOrUpdateAttrs(testCtx, id, map[string]Attribute{"x": {}})
 	if err != ErrNotFoundEntity {
 		t.Errorf("wanted %#v, got %#v", ErrNotFoundEntity, err)
 	}
@@ -726,14 +848,14 @@ func TestAddOrUpdateAttrsIDAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"id": {}}
 
-	_, err = AddOrUpdateAttrs(id, attrs)
+	_, err = AddOrUpdateAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
 	}
@@ -749,14 +871,14 @@ func TestAddOrUpdateAttrsTypeAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"type": {}}
 
-	_, err = AddAttrs(id, attrs)
+	_, err = AddAttrs(testCtx, id, attrs)
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
 	}
@@ -776,7 +898,7 @@ func TestSetAllAttrs(t *testing.T) {
 	e.Attrs["temperature"] = temperature
 	pressure := Attribute{Value: 10022, Type: "millibar", Md: map[string]interface{}{}}
 	e.Attrs["pressure"] = pressure
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -784,18 +906,18 @@ func TestSetAllAttrs(t *testing.T) {
 	lon := Attribute{Value: -2.4360722, Type: "Number", Md: map[string]interface{}{}}
 	lat := Attribute{Value: 39.4314637, Type: "Number", Md: map[string]interface{}{}}
 	attrs := map[string]Attribute{"lon": lon, "lat": lat}
-	_, err = SetAllAttrs(id, attrs)
+	_, err = SetAllAttrs(testCtx, id, attrs)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
-	newAttrs, err := GetAllAttrs(id)
+	newAttrs, err := GetAllAttrs(testCtx, id)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	if !equalObjects(newAttrs, attrs) {
-		t.Errorf(gotWanted(newAttrs, attrs))
+		t.Error(gotWanted(newAttrs, attrs))
 	}
 }
 
@@ -808,9 +930,9 @@ func TestSetAllAttrsNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = SetAllAttrs(id, map[string]Attribute{"x": {}})
+	_, err = SetAllAttrs(testCtx, id, map[string]Attribute{"x": {}})
 	if err != ErrNotFoundEntity {
-		t.Errorf(gotWanted(err, ErrNotFoundEntity))
+		t.Error(gotWanted(err, ErrNotFoundEntity))
 	}
 }
 
@@ -824,13 +946,13 @@ func TestSetAllAttrsIDAsAttr(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"id": {}, "another": {}}
-	_, err = SetAllAttrs(id, attrs)
+	_, err = SetAllAttrs(testCtx, id, attrs)
 
 	if err != ErrInvalidAttrID {
 		t.Error(gotWanted(err, ErrInvalidAttrID))
@@ -847,13 +969,13 @@ func TestSetAllAttrsIDAsType(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	err = CreateEntity(e)
+	err = CreateEntity(testCtx, e)
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
 
 	attrs := map[string]Attribute{"type": {}, "another": {}}
-	_, err = SetAllAttrs(id, attrs)
+	_, err = SetAllAttrs(testCtx, id, attrs)
 
 	if err != ErrInvalidAttrType {
 		t.Error(gotWanted(err, ErrInvalidAttrType))
@@ -869,8 +991,111 @@ func TestGetAllAttrsNoEntity(t *testing.T) {
 	setupTestDB(t)
 	defer teardownTestDB(t)
 
-	_, err = GetAllAttrs(id)
+	_, err = GetAllAttrs(testCtx, id)
 	if err != ErrNotFoundEntity {
-		t.Errorf(gotWanted(err, ErrNotFoundEntity))
+		t.Error(gotWanted(err, ErrNotFoundEntity))
+	}
+}
+
+func TestPatchEntity(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	id := population[0].ID
+	old, err := PatchEntity(testCtx, id, func(e *Entity) error {
+		delete(e.Attrs, "status")
+		e.Attrs["humidity"] = Attribute{Value: 60.0, Md: map[string]interface{}{}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !equalObjects(old, population[0]) {
+		t.Error(gotWanted(old, population[0]))
+	}
+	e, err := GetEntity(testCtx, id)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := map[string]Attribute{
+		"temperature": population[0].Attrs["temperature"],
+		"humidity":    {Value: 60.0, Md: map[string]interface{}{}},
+	}
+	if !equalObjects(e.Attrs, wanted) {
+		t.Error(gotWanted(e.Attrs, wanted))
+	}
+}
+
+func TestPatchEntity_Precondition(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	id := population[0].ID
+	_, err := PatchEntity(testCtx, id, func(e *Entity) error {
+		delete(e.Attrs, "status")
+		return ErrPatchTestFailed
+	})
+	if err != ErrPatchTestFailed {
+		t.Error(gotWanted(err, ErrPatchTestFailed))
+	}
+	e, err := GetEntity(testCtx, id)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !equalObjects(e, population[0]) {
+		t.Error(gotWanted(e, population[0]))
+	}
+}
+
+func TestPatchEntityNoEntity(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	_, err := PatchEntity(testCtx, EntityID{ID: "ID_Not_Exist", Type: "T"}, func(e *Entity) error { return nil })
+	if err != ErrNotFoundEntity {
+		t.Error(gotWanted(err, ErrNotFoundEntity))
+	}
+}
+
+func TestStoreContextDone(t *testing.T) {
+	var id = EntityID{ID: "ID", Type: "T"}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	for ctx, wanted := range map[context.Context]error{canceled: ErrCanceled, expired: ErrTimeout} {
+		// nothing should reach the store, not even started here
+		if _, err := GetEntity(ctx, id); err != wanted {
+			t.Error(gotWanted(err, wanted))
+		}
+		if err := CreateEntity(ctx, NewEntity(id)); err != wanted {
+			t.Error(gotWanted(err, wanted))
+		}
+		if _, err := UpdateAttrs(ctx, id, map[string]Attribute{"a": {Value: 1}}); err != wanted {
+			t.Error(gotWanted(err, wanted))
+		}
+		if _, err := (&Query{}).Get(ctx, "S", "SP"); err != wanted {
+			t.Error(gotWanted(err, wanted))
+		}
+	}
+}
+
+func TestAttrsUpdate_DateModified(t *testing.T) {
+	now := time.Now()
+	attrs := map[string]Attribute{"temperature": {Value: 20.0}}
+	for _, update := range []bson.M{setAttrsUpdate(attrs, now), replaceAttrsUpdate(attrs, now)} {
+		// the time of the write, from the clock of the versions and the history
+		if got := update["$set"].(bson.M)[dateModifiedField]; got != now {
+			t.Error(gotWanted(got, now))
+		}
+		if _, ok := update["$currentDate"]; ok {
+			t.Error("unexpected $currentDate")
+		}
 	}
 }
@@ -1,6 +1,12 @@
 package gorrion
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 type gorrionErr string
 
@@ -10,6 +16,8 @@ const (
 	ErrExistentAttr   gorrionErr = "existent attribute"
 	ErrExistentEntity gorrionErr = "existent entity"
 	ErrNotFoundEntity gorrionErr = "not found entity"
+	// never was, or not kept
+	ErrNotFoundVersion gorrionErr = "not found version"
 )
 
 // invalid object as an entity
@@ -41,19 +49,237 @@ const (
 	ErrParsingJSON        gorrionErr = "error parsing JSON"
 )
 
+// invalid query
+const (
+	ErrInvalidQuery    gorrionErr = "invalid query"
+	ErrInvalidLimit    gorrionErr = "invalid limit"
+	ErrInvalidOffset   gorrionErr = "invalid offset"
+	ErrInvalidCursor   gorrionErr = "invalid cursor"
+	ErrInvalidOrderBy  gorrionErr = "invalid orderBy"
+	ErrInvalidGeoQuery gorrionErr = "invalid geo query"
+	// a list of paths or a subtree only for queries
+	ErrInvalidServicePath gorrionErr = "invalid service path"
+	// a page is taken either by offset or after a cursor
+	ErrCursorAndOffset gorrionErr = "cursor and offset cannot be used together"
+	// bulk operations over every entity must be confirmed
+	ErrMissingConfirmation gorrionErr = "no filter given, confirmation required"
+)
+
+// invalid patch
+const (
+	ErrContentTypeNotPatch gorrionErr = "content-type is not a JSON patch format"
+	ErrPatchNotAnArray     gorrionErr = "JSON patch is not an array"
+	ErrInvalidPatchOp      gorrionErr = "invalid JSON patch operation"
+	ErrInvalidPatchPath    gorrionErr = "invalid JSON pointer"
+	ErrPatchPathNotFound   gorrionErr = "JSON pointer not found"
+	ErrPatchNotAnObject    gorrionErr = "patched entity is not an object"
+	ErrPatchEntityID       gorrionErr = "patch cannot change entity id or type"
+	// a "test" operation did not match
+	ErrPatchTestFailed gorrionErr = "JSON patch test failed"
+	// the entity kept changing while it was being patched
+	ErrConcurrentModification gorrionErr = "concurrent modification"
+)
+
+// the caller is not allowed
+const (
+	ErrUnauthorized gorrionErr = "missing or invalid credentials"
+	ErrForbidden    gorrionErr = "operation not allowed"
+)
+
+// the request is beyond the limits of the server
+const (
+	ErrBodyTooLarge    gorrionErr = "request body too large"
+	ErrJSONTooDeep     gorrionErr = "JSON nested too deep"
+	ErrTooManyAttrs    gorrionErr = "too many attributes"
+	ErrTooManyMetadata gorrionErr = "too many metadata in attribute"
+	ErrTooManyRequests gorrionErr = "too many requests"
+)
+
+// the stored entities would go beyond the quotas of their service
+const (
+	ErrEntitiesQuota    gorrionErr = "entities quota exceeded"
+	ErrAttrsQuota       gorrionErr = "attributes quota exceeded"
+	ErrDocumentTooLarge gorrionErr = "entity document too large"
+)
+
+// registrations and forwarding to context providers
+const (
+	ErrNotFoundRegistration gorrionErr = "not found registration"
+	ErrInvalidRegistration  gorrionErr = "invalid registration"
+	// no provider of the data asked for answered
+	ErrProviderUnavailable gorrionErr = "context provider unavailable"
+	// some attributes were not updated by their providers
+	ErrPartialUpdate gorrionErr = "partial update"
+)
+
+// NGSI-LD requests
+const (
+	ErrInvalidLDID   gorrionErr = "entity id is not a URI"
+	ErrInvalidLDAttr gorrionErr = "invalid NGSI-LD attribute"
+	// the server context has no term for a name sent
+	ErrUnknownLDTerm         gorrionErr = "term not in the context of the server"
+	ErrInvalidLDContext      gorrionErr = "invalid JSON-LD context"
+	ErrLDContextNotAvailable gorrionErr = "JSON-LD context not available"
+)
+
+// NGSIv1 requests
+const (
+	ErrInvalidV1Request    gorrionErr = "invalid NGSIv1 request"
+	ErrInvalidUpdateAction gorrionErr = "invalid updateAction"
+	// only the entities given by their id can be updated
+	ErrPatternUpdate gorrionErr = "entity patterns cannot be updated"
+)
+
+// invalid history query
+const (
+	ErrInvalidDate  gorrionErr = "invalid date"
+	ErrInvalidLastN gorrionErr = "invalid lastN"
+
+	ErrInvalidAggrMethod gorrionErr = "invalid aggrMethod"
+	ErrInvalidAggrPeriod gorrionErr = "invalid aggrPeriod"
+	ErrInvalidTimezone   gorrionErr = "invalid timezone"
+)
+
+// invalid versions request
+const (
+	ErrVersionsNotKept  gorrionErr = "versions of entities of this type are not kept"
+	ErrInvalidVersion   gorrionErr = "invalid version"
+	ErrInvalidAsOf      gorrionErr = "invalid asOf"
+	ErrInvalidAsOfQuery gorrionErr = "asOf cannot be used with orderBy, cursor or count"
+)
+
+// the context of the operation is done
+const (
+	ErrTimeout  gorrionErr = "operation timed out"
+	ErrCanceled gorrionErr = "operation canceled"
+)
+
+// administration
+const (
+	ErrInvalidLogLevel gorrionErr = "invalid log level"
+)
+
+// the server cannot take requests
+const (
+	ErrStoreUnavailable gorrionErr = "store unavailable"
+	ErrShuttingDown     gorrionErr = "server shutting down"
+)
+
 func (e gorrionErr) Error() string {
 	return string(e)
 }
 
+// partialError is an error for some attributes of a request only, the rest
+// of them done, which are told in the response
+type partialError struct {
+	err   gorrionErr
+	attrs []string
+}
+
+func (e *partialError) Error() string {
+	return e.err.Error() + ": " + strings.Join(e.attrs, ", ")
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+// ldError is an error of the NGSI-LD API, answered as problem details
+type ldError struct {
+	err error
+}
+
+func (e *ldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ldError) Unwrap() error {
+	return e.err
+}
+
+// Status is the one of the error, except for those NGSI-LD answers otherwise
+func (e *ldError) Status() int {
+	if gErr, ok := asGorrionErr(e.err); ok && (gErr == ErrExistentEntity || gErr == ErrExistentAttr) {
+		return 409
+	}
+	return errStatus(e.err)
+}
+
+// ldErrorsBase starts the types of the NGSI-LD problem details
+const ldErrorsBase = "https://uri.etsi.org/ngsi-ld/errors/"
+
+// problemType returns the NGSI-LD type of the error e is
+func (e *ldError) problemType() string {
+	gErr, _ := asGorrionErr(e.err)
+	switch gErr {
+	case ErrContentTypeNotJSON, ErrParsingJSON, ErrInvalidJSON:
+		return ldErrorsBase + "InvalidRequest"
+	case ErrLDContextNotAvailable:
+		return ldErrorsBase + "LdContextNotAvailable"
+	}
+	switch s := e.Status(); {
+	case s == 404:
+		return ldErrorsBase + "ResourceNotFound"
+	case s == 409:
+		return ldErrorsBase + "AlreadyExists"
+	case s >= 400 && s < 500:
+		return ldErrorsBase + "BadRequestData"
+	}
+	return ldErrorsBase + "InternalError"
+}
+
+// v1Error is an error of the NGSIv1 API, answered as an errorCode
+type v1Error struct {
+	err error
+}
+
+func (e *v1Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *v1Error) Unwrap() error {
+	return e.err
+}
+
 func ErrToJSON(err error) string {
+	if ve, ok := err.(*v1Error); ok {
+		status := errStatus(ve.err)
+		return fmt.Sprintf(`{"errorCode":{"code":"%d","reasonPhrase":%q,"details":%q}}`,
+			status, http.StatusText(status), ve.Error())
+	}
+	if le, ok := err.(*ldError); ok {
+		return fmt.Sprintf(`{"type":%q,"title":%q}`, le.problemType(), le.Error())
+	}
+	if pe, ok := err.(*partialError); ok {
+		attrs, _ := json.Marshal(pe.attrs)
+		return fmt.Sprintf(`{"error":%q,"attrs":%s}`, pe.err.Error(), attrs)
+	}
 	return fmt.Sprintf(`{"error":%q}`, err.Error())
 }
 
+// asGorrionErr returns the error of the API err is, if any
+func asGorrionErr(err error) (gorrionErr, bool) {
+	var gErr gorrionErr
+	ok := errors.As(err, &gErr)
+	return gErr, ok
+}
+
+// errStatus returns the HTTP status err is answered with
+func errStatus(err error) int {
+	var s interface{ Status() int }
+	if errors.As(err, &s) {
+		return s.Status()
+	}
+	return 500
+}
+
 func (e gorrionErr) Status() int {
 	var code = 500
 	switch e {
 	case ErrNotFoundAttr,
-		ErrNotFoundEntity:
+		ErrNotFoundEntity,
+		ErrNotFoundVersion,
+		ErrNotFoundRegistration:
 		code = 404
 	case
 		ErrExistentAttr,
@@ -72,8 +298,72 @@ func (e gorrionErr) Status() int {
 		ErrEmptyEntityID,
 		ErrEmptyEntityType,
 		ErrContentTypeNotJSON,
-		ErrParsingJSON:
+		ErrParsingJSON,
+		ErrInvalidQuery,
+		ErrInvalidLimit,
+		ErrInvalidOffset,
+		ErrInvalidCursor,
+		ErrInvalidOrderBy,
+		ErrInvalidGeoQuery,
+		ErrInvalidServicePath,
+		ErrCursorAndOffset,
+		ErrMissingConfirmation,
+		ErrContentTypeNotPatch,
+		ErrPatchNotAnArray,
+		ErrInvalidPatchOp,
+		ErrInvalidPatchPath,
+		ErrPatchPathNotFound,
+		ErrPatchNotAnObject,
+		ErrPatchEntityID,
+		ErrInvalidLogLevel,
+		ErrJSONTooDeep,
+		ErrTooManyAttrs,
+		ErrTooManyMetadata,
+		ErrInvalidRegistration,
+		ErrInvalidLDID,
+		ErrInvalidLDAttr,
+		ErrUnknownLDTerm,
+		ErrInvalidLDContext,
+		ErrInvalidV1Request,
+		ErrInvalidUpdateAction,
+		ErrPatternUpdate,
+		ErrInvalidDate,
+		ErrInvalidLastN,
+		ErrInvalidAggrMethod,
+		ErrInvalidAggrPeriod,
+		ErrInvalidTimezone,
+		ErrVersionsNotKept,
+		ErrInvalidVersion,
+		ErrInvalidAsOf,
+		ErrInvalidAsOfQuery:
 		code = 400
+	case ErrConcurrentModification:
+		code = 409
+	case ErrUnauthorized:
+		code = 401
+	case ErrForbidden:
+		code = 403
+	case ErrEntitiesQuota,
+		ErrAttrsQuota:
+		code = 403
+	case ErrBodyTooLarge,
+		ErrDocumentTooLarge:
+		code = 413
+	case ErrTooManyRequests:
+		code = 429
+	case ErrPartialUpdate:
+		code = 422
+	case ErrProviderUnavailable:
+		code = 502
+	case ErrCanceled,
+		ErrLDContextNotAvailable,
+		ErrStoreUnavailable,
+		ErrShuttingDown:
+		code = 503
+	case ErrTimeout:
+		code = 504
+	case ErrPatchTestFailed:
+		code = 412
 	default:
 		code = 500
 	}
@@ -23,6 +23,61 @@ func testGetErrorCases() map[gorrionErr]int {
 		ErrInvalidJSON:                  400,
 		ErrContentTypeNotJSON:           400,
 		ErrParsingJSON:                  400,
+		ErrInvalidQuery:                 400,
+		ErrInvalidLimit:                 400,
+		ErrInvalidOffset:                400,
+		ErrInvalidCursor:                400,
+		ErrInvalidOrderBy:               400,
+		ErrInvalidGeoQuery:              400,
+		ErrInvalidServicePath:           400,
+		ErrCursorAndOffset:              400,
+		ErrMissingConfirmation:          400,
+		ErrContentTypeNotPatch:          400,
+		ErrPatchNotAnArray:              400,
+		ErrInvalidPatchOp:               400,
+		ErrInvalidPatchPath:             400,
+		ErrPatchPathNotFound:            400,
+		ErrPatchNotAnObject:             400,
+		ErrPatchEntityID:                400,
+		ErrPatchTestFailed:              412,
+		ErrConcurrentModification:       409,
+		ErrCanceled:                     503,
+		ErrTimeout:                      504,
+		ErrStoreUnavailable:             503,
+		ErrInvalidLogLevel:              400,
+		ErrShuttingDown:                 503,
+		ErrUnauthorized:                 401,
+		ErrForbidden:                    403,
+		ErrBodyTooLarge:                 413,
+		ErrJSONTooDeep:                  400,
+		ErrTooManyAttrs:                 400,
+		ErrTooManyMetadata:              400,
+		ErrTooManyRequests:              429,
+		ErrEntitiesQuota:                403,
+		ErrAttrsQuota:                   403,
+		ErrDocumentTooLarge:             413,
+		ErrNotFoundRegistration:         404,
+		ErrInvalidRegistration:          400,
+		ErrProviderUnavailable:          502,
+		ErrPartialUpdate:                422,
+		ErrInvalidLDID:                  400,
+		ErrInvalidLDAttr:                400,
+		ErrUnknownLDTerm:                400,
+		ErrInvalidLDContext:             400,
+		ErrLDContextNotAvailable:        503,
+		ErrInvalidV1Request:             400,
+		ErrInvalidUpdateAction:          400,
+		ErrPatternUpdate:                400,
+		ErrInvalidDate:                  400,
+		ErrInvalidLastN:                 400,
+		ErrInvalidAggrMethod:            400,
+		ErrInvalidAggrPeriod:            400,
+		ErrInvalidTimezone:              400,
+		ErrNotFoundVersion:              404,
+		ErrVersionsNotKept:              400,
+		ErrInvalidVersion:               400,
+		ErrInvalidAsOf:                  400,
+		ErrInvalidAsOfQuery:             400,
 		gorrionErr("[NOT ERRROR CODE]"): 500,
 	}
 }
@@ -55,3 +110,50 @@ func TestErrToJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestErrToJSON_Partial(t *testing.T) {
+	err := error(&partialError{ErrPartialUpdate, []string{"pressure", "temperature"}})
+	wanted := `{"error":"partial update","attrs":["pressure","temperature"]}`
+	if got := ErrToJSON(err); got != wanted {
+		t.Error(gotWanted(got, wanted))
+	}
+	if gErr, ok := asGorrionErr(err); !ok || gErr.Status() != 422 {
+		t.Error(gotWanted(gErr, ErrPartialUpdate))
+	}
+}
+
+func TestErrToJSON_LD(t *testing.T) {
+	var cases = []struct {
+		err    gorrionErr
+		status int
+		wanted string
+	}{
+		{ErrNotFoundEntity, 404, "ResourceNotFound"},
+		{ErrExistentEntity, 409, "AlreadyExists"},
+		{ErrParsingJSON, 400, "InvalidRequest"},
+		{ErrInvalidLDID, 400, "BadRequestData"},
+		{ErrLDContextNotAvailable, 503, "LdContextNotAvailable"},
+		{ErrStoreUnavailable, 503, "InternalError"},
+	}
+	for _, c := range cases {
+		err := error(&ldError{c.err})
+		if got := errStatus(err); got != c.status {
+			t.Error(gotWanted(got, c.status) + fmt.Sprintf("(%s)", c.err))
+		}
+		wanted := fmt.Sprintf(`{"type":"%s%s","title":%q}`, ldErrorsBase, c.wanted, c.err.Error())
+		if got := ErrToJSON(err); got != wanted {
+			t.Error(gotWanted(got, wanted))
+		}
+	}
+}
+
+func TestErrToJSON_V1(t *testing.T) {
+	err := error(&v1Error{ErrNotFoundEntity})
+	wanted := `{"errorCode":{"code":"404","reasonPhrase":"Not Found","details":"not found entity"}}`
+	if got := ErrToJSON(err); got != wanted {
+		t.Error(gotWanted(got, wanted))
+	}
+	if got := errStatus(err); got != 404 {
+		t.Error(gotWanted(got, 404))
+	}
+}
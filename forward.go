@@ -0,0 +1,332 @@
+package gorrion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// forwarded update actions, as in the body of /v2/op/update
+const (
+	actionUpdate       = "update"
+	actionAppend       = "append"
+	actionAppendStrict = "appendStrict"
+)
+
+// providerCall is a request to a context provider of the entity ei, for the
+// request of req, with the correlator corr
+type providerCall struct {
+	srv  *Server
+	req  *http.Request
+	corr string
+	ei   EntityID
+}
+
+func newProviderCall(args handlerArgs) providerCall {
+	return providerCall{
+		srv:  args.srv,
+		req:  args.req,
+		corr: args.w.Header().Get(headerCorrelator),
+		ei:   args.ID,
+	}
+}
+
+// post sends body to path of the provider at base, decoding the response into
+// result if not nil. The tenant, the service path and the correlator of the
+// request go along, and the trace it belongs to.
+func (pc providerCall) post(ctx context.Context, base, path string, body, result interface{}) (err error) {
+	ctx, span := pc.srv.tracer.Start(ctx, "forward "+path, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(base, "/") + path
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set("Accept", contentTypeJSON)
+	for _, h := range []string{headerService, headerServicePath} {
+		if v := pc.req.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if pc.corr != "" {
+		req.Header.Set(headerCorrelator, pc.corr)
+	}
+	pc.srv.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := pc.srv.forwardClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r io.Reader = resp.Body
+	if max := pc.srv.config.MaxBodySize; max > 0 {
+		r = io.LimitReader(r, int64(max))
+	}
+	if resp.StatusCode/100 != 2 {
+		io.Copy(io.Discard, r)
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(r).Decode(result); err != nil {
+		return fmt.Errorf("%s: %v", url, err)
+	}
+	return nil
+}
+
+// query asks the provider of reg for the attrs of the entity, all it has if
+// empty
+func (pc providerCall) query(ctx context.Context, reg *Registration, attrs []string) (map[string]Attribute, error) {
+	body := object{
+		"entities": []object{{idField: pc.ei.ID, typeField: pc.ei.Type}},
+	}
+	if len(attrs) > 0 {
+		body["attrs"] = attrs
+	}
+	var entities []object
+	if err := pc.post(ctx, reg.Provider.HTTP.URL, "/op/query", body, &entities); err != nil {
+		return nil, err
+	}
+	for _, o := range entities {
+		if o[idField] != pc.ei.ID {
+			continue
+		}
+		e, err := FromObject(o)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", reg.Provider.HTTP.URL, err)
+		}
+		return e.Attrs, nil
+	}
+	return nil, nil
+}
+
+// update sends attrs of the entity to the provider of reg
+func (pc providerCall) update(ctx context.Context, reg *Registration, action string, attrs map[string]Attribute) error {
+	e := object{idField: pc.ei.ID, typeField: pc.ei.Type}
+	for name, a := range attrs {
+		e[name] = a
+	}
+	body := object{"actionType": action, "entities": []object{e}}
+	return pc.post(ctx, reg.Provider.HTTP.URL, "/op/update", body, nil)
+}
+
+// forwardedAttrs are the attributes asked of a provider, all it has if
+// all is set
+type forwardedAttrs struct {
+	names []string
+	all   bool
+}
+
+// queryAttrs returns what to ask the provider of reg for, out of the attrs
+// of a request, all if empty, once the stored ones are known. It returns
+// false when there is nothing to ask.
+func queryAttrs(reg *Registration, stored *Entity, attrs []string) (forwardedAttrs, bool) {
+	has := func(name string) bool {
+		if stored == nil {
+			return false
+		}
+		_, ok := stored.Attrs[name]
+		return ok
+	}
+	if len(attrs) == 0 && len(reg.DataProvided.Attrs) == 0 {
+		return forwardedAttrs{all: true}, true
+	}
+	candidates := attrs
+	if len(candidates) == 0 {
+		candidates = reg.DataProvided.Attrs
+	}
+	var fa forwardedAttrs
+	for _, name := range candidates {
+		if reg.provides(name) && !has(name) {
+			fa.names = append(fa.names, name)
+		}
+	}
+	return fa, len(fa.names) > 0
+}
+
+// providerFailure is a provider failing to answer for some attributes, "*"
+// for all of them, with the warning telling it
+type providerFailure struct {
+	warning string
+	attrs   []string
+}
+
+// queryProviders adds to stored, which may be nil, the attributes of the
+// entity asked for, all if attrs is empty, owned by the providers of regs
+// and not stored locally. It returns the entity, nil if nothing was found,
+// and the providers that failed.
+func queryProviders(ctx context.Context, pc providerCall, stored *Entity, regs []Registration, attrs []string) (*Entity, []providerFailure) {
+	e := stored
+	var failed []providerFailure
+	for i := range regs {
+		reg := &regs[i]
+		if !reg.forwards(ForwardQuery) {
+			continue
+		}
+		fa, ok := queryAttrs(reg, stored, attrs)
+		if !ok {
+			continue
+		}
+		found, err := pc.query(ctx, reg, fa.names)
+		if err != nil {
+			names := fa.names
+			if fa.all {
+				names = []string{"*"}
+			}
+			failed = append(failed, providerFailure{warning(reg, err), names})
+			continue
+		}
+		for name, a := range found {
+			if !reg.provides(name) {
+				continue
+			}
+			if e == nil {
+				e = NewEntity(pc.ei)
+			}
+			if _, ok := e.Attrs[name]; !ok {
+				e.Attrs[name] = a
+			}
+		}
+	}
+	return e, failed
+}
+
+// warning is the Warning header telling the provider of reg failed with err
+func warning(reg *Registration, err error) string {
+	return "199 gorrion " + strconv.Quote(fmt.Sprintf("registration %s: %v", reg.ID, err))
+}
+
+// withForwarded adds to stored, the entity of the request as stored or nil if
+// it is not, the attributes in attrs, all if empty, that its context
+// providers own. The attributes not had from a failing provider are told in
+// Warning headers, the rest are returned. It returns the attributes that
+// could not be had as well, "*" for all of them.
+func (srv *Server) withForwarded(ctx context.Context, args handlerArgs, stored *Entity, attrs []string) (*Entity, []string, error) {
+	regs, err := args.store.RegistrationsFor(ctx, args.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(regs) == 0 {
+		if stored == nil {
+			return nil, nil, ErrNotFoundEntity
+		}
+		return stored, nil, nil
+	}
+	pc := newProviderCall(args)
+	e, failures := queryProviders(ctx, pc, stored, regs, attrs)
+	var failed []string
+	for _, f := range failures {
+		args.w.Header().Add("Warning", f.warning)
+		args.log.Warn("context provider failed", "warning", f.warning)
+		failed = append(failed, f.attrs...)
+	}
+	if e == nil {
+		if len(failed) > 0 {
+			return nil, failed, ErrProviderUnavailable
+		}
+		return nil, nil, ErrNotFoundEntity
+	}
+	return e, failed, nil
+}
+
+// forwardUpdate sends the attributes in attrs owned by context providers, as
+// registered for the entity of the request and not stored locally, to them. It
+// returns the attributes left to write locally and those not updated because
+// their provider failed.
+func (srv *Server) forwardUpdate(ctx context.Context, args handlerArgs, action string, attrs map[string]Attribute) (local map[string]Attribute, failed []string, err error) {
+	regs, err := args.store.RegistrationsFor(ctx, args.ID)
+	if err != nil || len(regs) == 0 {
+		return attrs, nil, err
+	}
+	stored, err := args.store.GetEntity(ctx, args.ID)
+	if err == ErrNotFoundEntity {
+		stored, err = nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local, byReg := splitAttrs(regs, stored, attrs)
+	pc := newProviderCall(args)
+	for i := range regs {
+		forwarded, ok := byReg[i]
+		if !ok {
+			continue
+		}
+		if err := pc.update(ctx, &regs[i], action, forwarded); err != nil {
+			w := warning(&regs[i], err)
+			args.w.Header().Add("Warning", w)
+			args.log.Warn("context provider failed", "warning", w)
+			for name := range forwarded {
+				failed = append(failed, name)
+			}
+		}
+	}
+	sort.Strings(failed)
+	return local, failed, nil
+}
+
+// splitAttrs separates the attributes in attrs to be written locally, those
+// stored already or not owned by a provider, from the ones to send to the
+// providers of regs, by their index in regs. An attribute is sent to the
+// first provider that owns it.
+func splitAttrs(regs []Registration, stored *Entity, attrs map[string]Attribute) (map[string]Attribute, map[int]map[string]Attribute) {
+	local := map[string]Attribute{}
+	byReg := map[int]map[string]Attribute{}
+	for name, a := range attrs {
+		if stored != nil {
+			if _, ok := stored.Attrs[name]; ok {
+				local[name] = a
+				continue
+			}
+		}
+		owner := -1
+		for i := range regs {
+			if regs[i].forwards(ForwardUpdate) && regs[i].provides(name) {
+				owner = i
+				break
+			}
+		}
+		if owner < 0 {
+			local[name] = a
+			continue
+		}
+		if byReg[owner] == nil {
+			byReg[owner] = map[string]Attribute{}
+		}
+		byReg[owner][name] = a
+	}
+	return local, byReg
+}
+
+// partialUpdate is the outcome of an update with the attributes in failed
+// not updated by their providers
+func partialUpdate(failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return &partialError{ErrPartialUpdate, failed}
+}
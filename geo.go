@@ -0,0 +1,168 @@
+package gorrion
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	attrTypeGeoPoint = "geo:point"
+	attrTypeGeoJSON  = "geo:json"
+	// the equatorial Earth radius MongoDB measures $nearSphere distances with,
+	// to turn meters into radians for $centerSphere so that both agree
+	earthRadius = 6378100.0
+)
+
+// geoPoint returns the GeoJSON point for a "lat, lon" value
+func geoPoint(value interface{}) (bson.M, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, false
+	}
+	lat, lon, err := parseCoords(s)
+	if err != nil {
+		return nil, false
+	}
+	return bson.M{"type": "Point", "coordinates": []float64{lon, lat}}, true
+}
+
+func parseCoords(s string) (lat, lon float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, ErrInvalidGeoQuery
+	}
+	lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return 0, 0, ErrInvalidGeoQuery
+	}
+	lon, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return 0, 0, ErrInvalidGeoQuery
+	}
+	return lat, lon, nil
+}
+
+// geoJSONPoint returns the GeoJSON point value is, if it is a valid one
+func geoJSONPoint(value interface{}) (bson.M, bool) {
+	var o map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		o = v
+	case bson.M:
+		o = v
+	default:
+		return nil, false
+	}
+	coords, ok := o["coordinates"].([]interface{})
+	if o["type"] != "Point" || !ok || len(coords) != 2 {
+		return nil, false
+	}
+	lon, ok1 := coords[0].(float64)
+	lat, ok2 := coords[1].(float64)
+	if !ok1 || !ok2 || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, false
+	}
+	return bson.M{"type": "Point", "coordinates": []float64{lon, lat}}, true
+}
+
+// locationOf returns the location of an entity with attrs, taken from its
+// first geo:point, or geo:json point, attribute by name, or nil if it has none
+func locationOf(attrs map[string]Attribute) interface{} {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch attr := attrs[name]; attr.Type {
+		case attrTypeGeoPoint:
+			if p, ok := geoPoint(attr.Value); ok {
+				return p
+			}
+		case attrTypeGeoJSON:
+			if p, ok := geoJSONPoint(attr.Value); ok {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// Near selects the entities around a point. A zero distance means no limit.
+type Near struct {
+	Lat, Lon    float64
+	MaxDistance float64 // meters
+	MinDistance float64 // meters
+}
+
+// ParseNear builds a Near from the georel, geometry and coords parameters of
+// a listing, as in georel=near;maxDistance:1000&geometry=point&coords=41.3,2.1
+func ParseNear(georel, geometry, coords string) (*Near, error) {
+	if geometry != "point" {
+		return nil, ErrInvalidGeoQuery
+	}
+	parts := strings.Split(georel, ";")
+	if parts[0] != "near" {
+		return nil, ErrInvalidGeoQuery
+	}
+	n := &Near{}
+	var err error
+	if n.Lat, n.Lon, err = parseCoords(coords); err != nil {
+		return nil, err
+	}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 {
+			return nil, ErrInvalidGeoQuery
+		}
+		d, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || d < 0 {
+			return nil, ErrInvalidGeoQuery
+		}
+		switch kv[0] {
+		case "maxDistance":
+			n.MaxDistance = d
+		case "minDistance":
+			n.MinDistance = d
+		default:
+			return nil, ErrInvalidGeoQuery
+		}
+	}
+	return n, nil
+}
+
+func (n *Near) point() bson.M {
+	return bson.M{"type": "Point", "coordinates": []float64{n.Lon, n.Lat}}
+}
+
+// sortedCondition finds the entities near the point, nearest first. It cannot
+// be combined with other sort orders nor used to count.
+func (n *Near) sortedCondition() bson.M {
+	near := bson.M{"$geometry": n.point()}
+	if n.MaxDistance > 0 {
+		near["$maxDistance"] = n.MaxDistance
+	}
+	if n.MinDistance > 0 {
+		near["$minDistance"] = n.MinDistance
+	}
+	return bson.M{locationField: bson.M{"$nearSphere": near}}
+}
+
+// condition finds the entities near the point, in any order
+func (n *Near) condition() bson.M {
+	var conditions = []bson.M{{locationField: bson.M{"$exists": true}}}
+	within := func(d float64) bson.M {
+		return bson.M{"$geoWithin": bson.M{"$centerSphere": []interface{}{
+			[]float64{n.Lon, n.Lat}, d / earthRadius}}}
+	}
+	if n.MaxDistance > 0 {
+		conditions = append(conditions, bson.M{locationField: within(n.MaxDistance)})
+	}
+	if n.MinDistance > 0 {
+		conditions = append(conditions, bson.M{locationField: bson.M{"$not": within(n.MinDistance)}})
+	}
+	return bson.M{"$and": conditions}
+}
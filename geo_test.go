@@ -0,0 +1,72 @@
+package gorrion
+
+import (
+	"fmt"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseNear(t *testing.T) {
+	var cases = []struct {
+		georel, geometry, coords string
+		wanted                   Near
+	}{
+		{"near", "point", "41.3763726, 2.1864475", Near{Lat: 41.3763726, Lon: 2.1864475}},
+		{"near;maxDistance:1000", "point", "41,2", Near{Lat: 41, Lon: 2, MaxDistance: 1000}},
+		{"near;minDistance:10;maxDistance:1000", "point", "-41,-2",
+			Near{Lat: -41, Lon: -2, MaxDistance: 1000, MinDistance: 10}},
+	}
+	for _, c := range cases {
+		got, err := ParseNear(c.georel, c.geometry, c.coords)
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf("(%s)", c.georel))
+		}
+		if *got != c.wanted {
+			t.Error(gotWanted(*got, c.wanted))
+		}
+	}
+}
+
+func TestParseNear_Invalid(t *testing.T) {
+	var cases = [][3]string{
+		{"coveredBy", "point", "41,2"},
+		{"near", "polygon", "41,2"},
+		{"near", "point", "41"},
+		{"near", "point", "91,2"},
+		{"near", "point", "41,181"},
+		{"near", "point", "a,b"},
+		{"near;maxDistance", "point", "41,2"},
+		{"near;maxDistance:-1", "point", "41,2"},
+		{"near;farAway:1", "point", "41,2"},
+	}
+	for _, c := range cases {
+		if _, err := ParseNear(c[0], c[1], c[2]); err != ErrInvalidGeoQuery {
+			t.Error(gotWanted(err, ErrInvalidGeoQuery) + fmt.Sprintf("(%v)", c))
+		}
+	}
+}
+
+func TestLocationOf(t *testing.T) {
+	attrs := map[string]Attribute{
+		"temperature": {Value: 21.7},
+		"position":    {Value: "41.3763726, 2.1864475", Type: attrTypeGeoPoint},
+		"location":    {Value: "not a point", Type: attrTypeGeoPoint},
+	}
+	wanted := bson.M{"type": "Point", "coordinates": []float64{2.1864475, 41.3763726}}
+	if got := locationOf(attrs); !equalObjects(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+
+	delete(attrs, "position")
+	attrs["geometry"] = Attribute{Type: attrTypeGeoJSON,
+		Value: map[string]interface{}{"type": "Point", "coordinates": []interface{}{2.1864475, 41.3763726}}}
+	if got := locationOf(attrs); !equalObjects(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+
+	delete(attrs, "geometry")
+	if got := locationOf(attrs); got != nil {
+		t.Error(gotWanted(got, nil))
+	}
+}
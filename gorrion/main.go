@@ -1,35 +1,88 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/crbrox/gorrion"
-	"net/http"
 )
 
 func main() {
-	var err error
-
-	err = gorrion.StartStore()
+	cfg, err := gorrion.LoadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ei := gorrion.EntityID{ID: "E1", Type: "T", Service: "S", ServicePath: "SP"}
-	e := gorrion.NewEntity(ei)
-	e.Attrs["temperature"] = gorrion.Attribute{Value: 23.45, Type: "celsius", Md: map[string]interface{}{
-		"location": "12,67",
-		"date":     "12-12-1999",
-	}}
-	gorrion.CreateEntity(e)
+	broker, err := gorrion.NewServer(gorrion.WithConfig(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	e2, err := gorrion.GetEntity(ei)
+	tlsConfig, err := broker.TLSConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("e2 %#v\n", e2)
 
-	log.Fatal(http.ListenAndServe(":9090", gorrion.AddHandlers()))
+	// canceled to stop the requests still running when the shutdown times out
+	base, cancelRequests := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        cfg.Listen,
+		Handler:     broker.Handler(),
+		BaseContext: func(net.Listener) context.Context { return base },
+		TLSConfig:   tlsConfig,
+	}
 
+	if tlsConfig != nil {
+		broker.EnableFeature("tls")
+	}
+	if cfg.TLSClientCAFile != "" {
+		broker.EnableFeature("mtls")
+	}
+	errc := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// the certificates come from the configuration, reloaded on change
+			errc <- server.ListenAndServeTLS("", "")
+		} else {
+			errc <- server.ListenAndServe()
+		}
+	}()
+
+	logger := broker.Logger()
+	logger.Info("listening", "address", cfg.Listen, "tls", tlsConfig != nil, "clientCerts", cfg.TLSClientCAFile != "", "traces", cfg.TraceExporter)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errc:
+		logger.Error("serving", "error", err)
+		os.Exit(1)
+	case sig := <-stop:
+		logger.Info("shutting down", "signal", sig.String(), "drainPeriod", cfg.DrainPeriod)
+	}
+
+	// not ready any more, but still serving until load balancers notice
+	broker.Drain()
+	time.Sleep(cfg.DrainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		logger.Warn("requests still running, canceled", "timeout", cfg.ShutdownTimeout, "error", err)
+		cancelRequests()
+		server.Close()
+	}
+	if err = broker.Close(); err != nil {
+		logger.Warn("spans not exported", "error", err)
+	}
 }
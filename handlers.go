@@ -1,11 +1,16 @@
 package gorrion
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -13,61 +18,245 @@ import (
 type object map[string]interface{}
 
 const (
-	paramType    = "type"
-	paramOptions = "options"
-	paramAttrs   = "attrs"
+	paramType        = "type"
+	paramOptions     = "options"
+	paramAttrs       = "attrs"
+	paramID          = "id"
+	paramIDPattern   = "idPattern"
+	paramTypePattern = "typePattern"
+	paramQ           = "q"
+	paramOrderBy     = "orderBy"
+	paramLimit       = "limit"
+	paramOffset      = "offset"
+	paramCursor      = "cursor"
+	paramGeorel      = "georel"
+	paramGeometry    = "geometry"
+	paramCoords      = "coords"
+	paramFromDate    = "fromDate"
+	paramToDate      = "toDate"
+	paramLastN       = "lastN"
+	paramHLimit      = "hLimit"
+	paramHOffset     = "hOffset"
+	paramAggrMethod  = "aggrMethod"
+	paramAggrPeriod  = "aggrPeriod"
+	paramTimezone    = "timezone"
+	paramAsOf        = "asOf"
 )
 
-func AddHandlers() http.Handler {
+const (
+	headerTotalCount  = "Fiware-Total-Count"
+	headerNextPage    = "Fiware-Next-Page"
+	headerCorrelator  = "Fiware-Correlator"
+	headerService     = "Fiware-Service"
+	headerServicePath = "Fiware-ServicePath"
+)
+
+// page size for listings
+const (
+	defaultLimit = 20
+	maxLimit     = 1000
+)
+
+const (
+	contentTypeJSON       = "application/json"
+	contentTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	contentTypeJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// Route names, to configure the routes by name, as in RouteTimeouts
+const (
+	RouteListEntities   = "listEntities"
+	RouteCreateEntity   = "createEntity"
+	RouteDeleteEntities = "deleteEntities"
+	RouteUpdateEntities = "updateEntities"
+	RouteGetEntity      = "getEntity"
+	RouteDeleteEntity   = "deleteEntity"
+	RoutePatchEntity    = "patchEntity"
+	RouteGetAttrs       = "getAttrs"
+	RouteAppendAttrs    = "appendAttrs"
+	RouteUpdateAttrs    = "updateAttrs"
+	RouteReplaceAttrs   = "replaceAttrs"
+	RouteGetAttr        = "getAttr"
+	RouteDeleteAttr     = "deleteAttr"
+	RouteSetAttr        = "setAttr"
+	RouteGetAttrValue   = "getAttrValue"
+	RouteSetAttrValue   = "setAttrValue"
+	RouteLive           = "live"
+	RouteReady          = "ready"
+	RouteVersion        = "version"
+	RouteGetLogLevel    = "getLogLevel"
+	RouteSetLogLevel    = "setLogLevel"
+	RouteMetrics        = "metrics"
+	RouteGetUsage       = "getUsage"
+	RouteGetAttrHistory = "getAttrHistory"
+
+	RouteListEntityVersions   = "listEntityVersions"
+	RouteGetEntityVersion     = "getEntityVersion"
+	RouteRestoreEntityVersion = "restoreEntityVersion"
+
+	RouteListRegistrations  = "listRegistrations"
+	RouteCreateRegistration = "createRegistration"
+	RouteGetRegistration    = "getRegistration"
+	RouteDeleteRegistration = "deleteRegistration"
+
+	RouteLDListEntities = "ldListEntities"
+	RouteLDCreateEntity = "ldCreateEntity"
+	RouteLDGetEntity    = "ldGetEntity"
+	RouteLDDeleteEntity = "ldDeleteEntity"
+	RouteLDAppendAttrs  = "ldAppendAttrs"
+	RouteLDUpdateAttrs  = "ldUpdateAttrs"
+	RouteLDUpdateAttr   = "ldUpdateAttr"
+	RouteLDDeleteAttr   = "ldDeleteAttr"
+
+	RouteV1UpdateContext       = "v1UpdateContext"
+	RouteV1QueryContext        = "v1QueryContext"
+	RouteV1GetContextEntity    = "v1GetContextEntity"
+	RouteV1AppendContextEntity = "v1AppendContextEntity"
+	RouteV1UpdateContextEntity = "v1UpdateContextEntity"
+	RouteV1DeleteContextEntity = "v1DeleteContextEntity"
+)
+
+// bulkRoutes work on many entities, so they get Config.BulkTimeout
+var bulkRoutes = []string{RouteListEntities, RouteDeleteEntities, RouteUpdateEntities, RouteLDListEntities,
+	RouteV1UpdateContext, RouteV1QueryContext}
+
+// DefaultTimeout is the deadline for the work of a request in the handler of
+// AddHandlers, unless its route has its own in RouteTimeouts. Zero means no
+// deadline.
+var DefaultTimeout = 30 * time.Second
+
+// RouteTimeouts are the deadlines for the routes that differ from DefaultTimeout
+var RouteTimeouts = map[string]time.Duration{
+	RouteListEntities:   5 * time.Minute,
+	RouteDeleteEntities: 5 * time.Minute,
+	RouteUpdateEntities: 5 * time.Minute,
+	RouteLDListEntities: 5 * time.Minute,
+
+	RouteV1UpdateContext: 5 * time.Minute,
+	RouteV1QueryContext:  5 * time.Minute,
+}
+
+func (srv *Server) routeTimeout(req *http.Request) time.Duration {
+	if r := mux.CurrentRoute(req); r != nil {
+		if t, ok := srv.routeTimeouts[r.GetName()]; ok {
+			return t
+		}
+	}
+	return srv.defaultTimeout
+}
+
+// routes returns the handler of all the routes of srv
+func (srv *Server) routes() http.Handler {
 	const (
 		entitiesPrefix = "/v2/entities" // root router
 		entity         = "/{id}"
 		attributes     = entity + "/attrs"
 		attribute      = attributes + "/{name}"
 		attributeValue = attribute + "/value"
+		versions       = entity + "/versions"
+		version        = versions + "/{version}"
+
+		registrationsPrefix = "/v2/registrations"
+		registration        = "/{regId}"
+
+		ldEntitiesPrefix = "/ngsi-ld/v1/entities"
+
+		historyPrefix = "/v2/history/entities"
+
+		v1Prefix        = "/v1"
+		v1ContextEntity = "/contextEntities/{id}"
 	)
 	r := mux.NewRouter()
 	r.StrictSlash(true)
 	entR := r.PathPrefix(entitiesPrefix).Subrouter()
+	regR := r.PathPrefix(registrationsPrefix).Subrouter()
+	ldR := r.PathPrefix(ldEntitiesPrefix).Subrouter()
+	ldR.Use(ldTenant)
+	v1R := r.PathPrefix(v1Prefix).Subrouter()
+	histR := r.PathPrefix(historyPrefix).Subrouter()
 
 	// entities
-	entR.HandleFunc("/", cH(getEntitiesHandleF)).Methods("GET")
-	entR.HandleFunc("/", cH(postEntitiesHandleF)).Methods("POST")
+	entR.HandleFunc("/", srv.cH(getEntitiesHandleF)).Methods("GET").Name(RouteListEntities)
+	entR.HandleFunc("/", srv.cH(postEntitiesHandleF)).Methods("POST").Name(RouteCreateEntity)
+	entR.HandleFunc("/", srv.cH(deleteEntitiesHandleF)).Methods("DELETE").Name(RouteDeleteEntities)
+	entR.HandleFunc("/", srv.cH(patchEntitiesHandleF)).Methods("PATCH").Name(RouteUpdateEntities)
 
 	// entity
-	entR.HandleFunc(entity, cH(getEntityHandleF)).Methods("GET")
-	entR.HandleFunc(entity, cH(deleteEntityHandleF)).Methods("DELETE")
+	entR.HandleFunc(entity, srv.cH(getEntityHandleF)).Methods("GET").Name(RouteGetEntity)
+	entR.HandleFunc(entity, srv.cH(deleteEntityHandleF)).Methods("DELETE").Name(RouteDeleteEntity)
+	entR.HandleFunc(entity, srv.cH(patchEntityHandleF)).Methods("PATCH").Name(RoutePatchEntity)
 
 	// attrs
-	entR.HandleFunc(attributes, cH(getAttrsHandleF)).Methods("GET")
-	entR.HandleFunc(attributes, cH(postAttrsHandleF)).Methods("POST")
-	entR.HandleFunc(attributes, cH(patchAttrsHandleF)).Methods("PATCH")
-	entR.HandleFunc(attributes, cH(putAttrsHandleF)).Methods("PUT")
+	entR.HandleFunc(attributes, srv.cH(getAttrsHandleF)).Methods("GET").Name(RouteGetAttrs)
+	entR.HandleFunc(attributes, srv.cH(postAttrsHandleF)).Methods("POST").Name(RouteAppendAttrs)
+	entR.HandleFunc(attributes, srv.cH(patchAttrsHandleF)).Methods("PATCH").Name(RouteUpdateAttrs)
+	entR.HandleFunc(attributes, srv.cH(putAttrsHandleF)).Methods("PUT").Name(RouteReplaceAttrs)
 
 	// attr
-	entR.HandleFunc(attribute, cH(getAttrHandleF)).Methods("GET")
-	entR.HandleFunc(attribute, cH(deleteAttrHandleF)).Methods("DELETE")
-	entR.HandleFunc(attribute, cH(putAttrHandleF)).Methods("PUT")
+	entR.HandleFunc(attribute, srv.cH(getAttrHandleF)).Methods("GET").Name(RouteGetAttr)
+	entR.HandleFunc(attribute, srv.cH(deleteAttrHandleF)).Methods("DELETE").Name(RouteDeleteAttr)
+	entR.HandleFunc(attribute, srv.cH(putAttrHandleF)).Methods("PUT").Name(RouteSetAttr)
 
 	// attrValue
-	entR.HandleFunc(attributeValue, cH(getAttrValueHandleF)).Methods("GET")
-	entR.HandleFunc(attributeValue, cH(putAttrValueHandleF)).Methods("PUT")
-
-	return entR
+	entR.HandleFunc(attributeValue, srv.cH(getAttrValueHandleF)).Methods("GET").Name(RouteGetAttrValue)
+	entR.HandleFunc(attributeValue, srv.cH(putAttrValueHandleF)).Methods("PUT").Name(RouteSetAttrValue)
+
+	// versions
+	entR.HandleFunc(versions, srv.cH(getEntityVersionsHandleF)).Methods("GET").Name(RouteListEntityVersions)
+	entR.HandleFunc(version, srv.cH(getEntityVersionHandleF)).Methods("GET").Name(RouteGetEntityVersion)
+	entR.HandleFunc(version+"/restore", srv.cH(restoreEntityVersionHandleF)).Methods("POST").Name(RouteRestoreEntityVersion)
+
+	// registrations
+	regR.HandleFunc("/", srv.cH(getRegistrationsHandleF)).Methods("GET").Name(RouteListRegistrations)
+	regR.HandleFunc("/", srv.cH(postRegistrationsHandleF)).Methods("POST").Name(RouteCreateRegistration)
+	regR.HandleFunc(registration, srv.cH(getRegistrationHandleF)).Methods("GET").Name(RouteGetRegistration)
+	regR.HandleFunc(registration, srv.cH(deleteRegistrationHandleF)).Methods("DELETE").Name(RouteDeleteRegistration)
+
+	// NGSI-LD
+	ldR.HandleFunc("/", srv.ldH(ldGetEntitiesHandleF)).Methods("GET").Name(RouteLDListEntities)
+	ldR.HandleFunc("/", srv.ldH(ldPostEntitiesHandleF)).Methods("POST").Name(RouteLDCreateEntity)
+	ldR.HandleFunc(entity, srv.ldH(ldGetEntityHandleF)).Methods("GET").Name(RouteLDGetEntity)
+	ldR.HandleFunc(entity, srv.ldH(ldDeleteEntityHandleF)).Methods("DELETE").Name(RouteLDDeleteEntity)
+	ldR.HandleFunc(attributes, srv.ldH(ldPostAttrsHandleF)).Methods("POST").Name(RouteLDAppendAttrs)
+	ldR.HandleFunc(attributes, srv.ldH(ldPatchAttrsHandleF)).Methods("PATCH").Name(RouteLDUpdateAttrs)
+	ldR.HandleFunc(attribute, srv.ldH(ldPatchAttrHandleF)).Methods("PATCH").Name(RouteLDUpdateAttr)
+	ldR.HandleFunc(attribute, srv.ldH(ldDeleteAttrHandleF)).Methods("DELETE").Name(RouteLDDeleteAttr)
+
+	// history
+	histR.HandleFunc(attribute, srv.cH(getAttrHistoryHandleF)).Methods("GET").Name(RouteGetAttrHistory)
+
+	// NGSIv1
+	v1R.HandleFunc("/updateContext", srv.v1H(v1UpdateContextHandleF)).Methods("POST").Name(RouteV1UpdateContext)
+	v1R.HandleFunc("/queryContext", srv.v1H(v1QueryContextHandleF)).Methods("POST").Name(RouteV1QueryContext)
+	v1R.HandleFunc(v1ContextEntity, srv.v1H(v1GetContextEntityHandleF)).Methods("GET").Name(RouteV1GetContextEntity)
+	v1R.HandleFunc(v1ContextEntity, srv.v1H(v1AppendContextEntityHandleF)).Methods("POST").Name(RouteV1AppendContextEntity)
+	v1R.HandleFunc(v1ContextEntity, srv.v1H(v1UpdateContextEntityHandleF)).Methods("PUT").Name(RouteV1UpdateContextEntity)
+	v1R.HandleFunc(v1ContextEntity, srv.v1H(v1DeleteContextEntityHandleF)).Methods("DELETE").Name(RouteV1DeleteContextEntity)
+
+	// operation
+	r.HandleFunc("/health/live", srv.cH(liveHandleF)).Methods("GET").Name(RouteLive)
+	r.HandleFunc("/health/ready", srv.cH(readyHandleF)).Methods("GET").Name(RouteReady)
+	r.HandleFunc("/version", srv.cH(versionHandleF)).Methods("GET").Name(RouteVersion)
+	r.HandleFunc("/admin/log", srv.cH(getLogLevelHandleF)).Methods("GET").Name(RouteGetLogLevel)
+	r.HandleFunc("/admin/log", srv.cH(setLogLevelHandleF)).Methods("PUT").Name(RouteSetLogLevel)
+	r.HandleFunc("/admin/usage", srv.cH(usageHandleF)).Methods("GET").Name(RouteGetUsage)
+	r.HandleFunc("/metrics", srv.cH(metricsHandleF)).Methods("GET").Name(RouteMetrics)
+
+	return srv.withCORS(r)
 
 }
 
 func respondErr(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/json")
-	if err, ok := err.(gorrionErr); ok {
-		w.WriteHeader(err.Status())
-	} else {
-		w.WriteHeader(500)
-	}
+	w.WriteHeader(errStatus(err))
 	fmt.Fprint(w, ErrToJSON(err))
 }
 
 type handlerArgs struct {
+	srv     *Server
+	store   *Store
+	log     *slog.Logger
+	caller  principal
 	ID      EntityID
 	vars    map[string]string
 	options OptionSet
@@ -78,18 +267,86 @@ type handlerArgs struct {
 	req     *http.Request
 }
 
-func cH(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http.HandlerFunc {
+func (srv *Server) cH(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http.HandlerFunc {
 
-	return func(w http.ResponseWriter, req *http.Request) {
+	return func(rw http.ResponseWriter, req *http.Request) {
 		defer req.Body.Close()
+		srv.limitBody(rw, req)
+
+		start := time.Now()
+		srv.metrics.inFlight.Inc()
+		corr := correlator(req)
+		rw.Header().Set(headerCorrelator, corr)
+		var route string
+		if r := mux.CurrentRoute(req); r != nil {
+			route = r.GetName()
+		}
+		ctx, span := srv.startSpan(rw, req, route, corr)
+		w := &statusWriter{ResponseWriter: rw}
+		log := srv.logger.With(
+			"correlator", corr,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"tenant", req.Header.Get(headerService),
+			"servicePath", req.Header.Get(headerServicePath),
+		)
+		if sc := span.SpanContext(); sc.IsValid() {
+			log = log.With("traceID", sc.TraceID().String())
+		}
+		var err error
+		// known once the credentials are checked
+		tenant := otherTenants
+		defer func() {
+			srv.metrics.inFlight.Dec()
+			status := w.status
+			if status == 0 {
+				// nothing written, net/http answers 200
+				status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if status >= 500 {
+				level = slog.LevelError
+			}
+			latency := time.Since(start)
+			log.Log(req.Context(), level, "request", "status", status, "latency", latency)
+			endSpan(span, status, err)
+			srv.metrics.observe(route, req.Method, tenant, status, latency, err)
+		}()
+
+		caller, err := srv.checkAuth(w, req, route)
+		if err == nil {
+			tenant = req.Header.Get(headerService)
+		}
+		if caller.name != "" {
+			log = log.With("principal", caller.name)
+			span.SetAttributes(attrEndUser.String(caller.name))
+		}
+		if err == nil {
+			err = srv.checkRate(w, req, route, caller)
+		}
+		if err != nil {
+			respondErr(w, err)
+			return
+		}
 
 		args := handlerArgs{
-			vars: mux.Vars(req),
-			req:  req,
-			w:    w,
+			srv:    srv,
+			store:  srv.store,
+			log:    log,
+			caller: caller,
+			vars:   mux.Vars(req),
+			req:    req,
+			w:      w,
 		}
 
-		ctx := req.Context()
+		if timeout := srv.routeTimeout(req); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// one session for all the store operations of the request
+		ctx, release := srv.store.withSession(ctx)
+		defer release()
 
 		// options param
 		optParam := req.FormValue(paramOptions)
@@ -99,17 +356,22 @@ func cH(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http
 		attrsParam := req.FormValue(paramAttrs)
 		args.attrs = strings.Split(attrsParam, ",")
 
-		// incomming object
-		if req.ContentLength > 0 {
-			// use prefix, allow "; charset=utf-8", be liberal with input
-			if !strings.HasPrefix(req.Header.Get("content-type"), "application/json") {
-				respondErr(w, ErrContentTypeNotJSON)
+		// incomming object, of any length
+		body, err := srv.readBody(req)
+		if err != nil {
+			respondErr(w, err)
+			return
+		}
+		if len(body) > 0 {
+			if !isJSONContentType(req) {
+				err = ErrContentTypeNotJSON
+				respondErr(w, err)
 				return
 			}
 			var any interface{}
-			err := json.NewDecoder(req.Body).Decode(&any)
-			if err != nil {
-				respondErr(w, ErrParsingJSON)
+			if json.Unmarshal(body, &any) != nil {
+				err = ErrParsingJSON
+				respondErr(w, err)
 				return
 			}
 			if obj, ok := any.(map[string]interface{}); ok {
@@ -125,10 +387,23 @@ func cH(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http
 			args.vars[paramType] = t
 		}
 
-		args.ID = EntityID{ID: args.vars["id"], Type: args.vars[paramType]}
+		args.ID = EntityID{ID: args.vars["id"], Type: args.vars[paramType], Service: req.Header.Get(headerService)}
+		// the store is scoped by the same service path the caller was
+		// authorized for
+		if args.ID.ServicePath, err = parseServicePath(req.Header.Get(headerServicePath), queryRoutes[route]); err != nil {
+			respondErr(w, err)
+			return
+		}
+		if args.ID.ID != "" {
+			span.SetAttributes(attrEntityType.String(args.ID.Type))
+		}
 
-		result, err := f(ctx, args)
+		var result interface{}
+		result, err = f(ctx, args)
 		if err != nil {
+			if _, ok := asGorrionErr(err); !ok {
+				log.Error("request failed", "error", err)
+			}
 			respondErr(w, err)
 			return
 		}
@@ -140,16 +415,168 @@ func cH(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http
 			}
 			errJ := encoder.Encode(result)
 			if errJ != nil {
-				// loggear error, esto sí es más grave
+				// too late to tell the client
+				log.Error("encoding response", "error", errJ)
 			}
 			return
 		}
 	}
 }
 
+// hasContentType uses prefix, allow "; charset=utf-8", be liberal with input
+func hasContentType(req *http.Request, ct string) bool {
+	return strings.HasPrefix(req.Header.Get("content-type"), ct)
+}
+
+func isJSONContentType(req *http.Request) bool {
+	return hasContentType(req, contentTypeJSON) ||
+		hasContentType(req, contentTypeLDJSON) ||
+		hasContentType(req, contentTypeMergePatch) ||
+		hasContentType(req, contentTypeJSONPatch)
+}
+
+// splitParam returns nil for an empty parameter, instead of [""]
+func splitParam(req *http.Request, name string) []string {
+	if p := req.FormValue(name); p != "" {
+		return strings.Split(p, ",")
+	}
+	return nil
+}
+
+// queryRoutes are the routes running a query over the entities, the only ones
+// taking a list of service paths or a subtree
+var queryRoutes = map[string]bool{
+	RouteListEntities:   true,
+	RouteLDListEntities: true,
+	RouteV1QueryContext: true,
+}
+
+// servicePathRE is a service path as stored, the root being ""
+var servicePathRE = regexp.MustCompile(`^(/[^/#,]+)*$`)
+
+// parseServicePath checks the Fiware-ServicePath header h and returns it as
+// the store keeps it: the root, "/" or no header, is "", as in the entities
+// stored before service paths, and a trailing "/" is dropped. Only a query may
+// have a list of paths, and subtrees ending in "/#".
+func parseServicePath(h string, query bool) (string, error) {
+	if strings.TrimSpace(h) == "" {
+		return "", nil
+	}
+	paths := strings.Split(h, ",")
+	if len(paths) > 1 && !query {
+		return "", ErrInvalidServicePath
+	}
+	for i, sp := range paths {
+		sp = strings.TrimSpace(sp)
+		subtree := strings.HasSuffix(sp, "/#")
+		if subtree && !query {
+			return "", ErrInvalidServicePath
+		}
+		sp = strings.TrimSuffix(strings.TrimSuffix(sp, "#"), "/")
+		if !servicePathRE.MatchString(sp) {
+			return "", ErrInvalidServicePath
+		}
+		if subtree {
+			sp += "/#"
+		}
+		paths[i] = sp
+	}
+	return strings.Join(paths, ","), nil
+}
+
+// queryFromRequest takes the listing filters from the URL parameters
+func queryFromRequest(req *http.Request) (q *Query, err error) {
+	q = &Query{
+		ID:          splitParam(req, paramID),
+		IDPattern:   req.FormValue(paramIDPattern),
+		Type:        splitParam(req, paramType),
+		TypePattern: req.FormValue(paramTypePattern),
+		Q:           req.FormValue(paramQ),
+		Attrs:       splitParam(req, paramAttrs),
+		OrderBy:     splitParam(req, paramOrderBy),
+		Cursor:      req.FormValue(paramCursor),
+	}
+	if georel := req.FormValue(paramGeorel); georel != "" {
+		q.Near, err = ParseNear(georel, req.FormValue(paramGeometry), req.FormValue(paramCoords))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.Limit, q.Offset, err = pageFromRequest(req); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// pageFromRequest takes the limit and offset parameters, zero if missing
+func pageFromRequest(req *http.Request) (limit, offset int, err error) {
+	if l := req.FormValue(paramLimit); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return 0, 0, ErrInvalidLimit
+		}
+	}
+	if o := req.FormValue(paramOffset); o != "" {
+		if offset, err = strconv.Atoi(o); err != nil || offset < 0 {
+			return 0, 0, ErrInvalidOffset
+		}
+	}
+	return limit, offset, nil
+}
+
+// formatEntity renders e as asked for in options
+func formatEntity(e *Entity, options OptionSet, attrs []string) (interface{}, error) {
+	if options.Get(OptKeyValues) {
+		return e.ToKeyValues(), nil // map
+	} else if options.Get(OptValues) {
+		return e.ToValues(attrs) // slice
+	}
+	return e.ToObject(), nil
+}
+
+// nextPageLink is the URL of req with the cursor for the next page
+func nextPageLink(req *http.Request, cursor string) string {
+	u := *req.URL
+	params := u.Query()
+	params.Set(paramCursor, cursor)
+	params.Del(paramOffset)
+	u.RawQuery = params.Encode()
+	return u.RequestURI()
+}
+
 func getEntitiesHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
-	args.w.Write([]byte("GET entities"))
-	return nil, nil
+	q, err := queryFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultLimit
+	} else if q.Limit > maxLimit {
+		return nil, ErrInvalidLimit
+	}
+	if args.req.FormValue(paramAsOf) != "" {
+		return getEntitiesAsOfHandleF(ctx, args, q)
+	}
+
+	if args.options.Get(OptCount) {
+		n, err := args.store.CountEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+		if err != nil {
+			return nil, err
+		}
+		args.w.Header().Set(headerTotalCount, strconv.Itoa(n))
+	}
+
+	eIter, err := args.store.GetEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+	if err != nil {
+		return nil, err
+	}
+	if next := eIter.NextCursor(); next != "" {
+		args.w.Header().Set(headerNextPage, next)
+		args.w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextPageLink(args.req, next)))
+	}
+	format := func(e *Entity) (interface{}, error) {
+		return formatEntity(e, args.options, q.Attrs)
+	}
+	return nil, streamEntities(args.log, args.w, eIter, format, args.req.FormValue("pretty") == "on")
 }
 
 func postEntitiesHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
@@ -170,36 +597,147 @@ func postEntitiesHandleF(ctx context.Context, args handlerArgs) (interface{}, er
 	if err != nil {
 		return nil, err
 	}
-	if err := CreateEntity(e); err != nil {
+	if err = args.srv.checkAttrs(e.Attrs); err != nil {
+		return nil, err
+	}
+	e.ID.Service = args.ID.Service
+	e.ID.ServicePath = args.ID.ServicePath
+	if args.options.Get(OptUpsert) {
+		// it may change the attributes of an entity already there
+		if err = args.srv.authorizeAlso(args, opUpdate); err != nil {
+			return nil, err
+		}
+		if err = args.srv.checkWrite(ctx, args.store, e.ID, e.Attrs, false); err != nil {
+			return nil, err
+		}
+		var created bool
+		created, err = args.store.UpsertEntity(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			args.w.WriteHeader(201)
+		} else {
+			args.w.WriteHeader(204)
+		}
+		return nil, nil
+	}
+	if err = args.srv.checkNewEntity(ctx, args.store, e); err != nil {
+		return nil, err
+	}
+	if err = args.store.CreateEntity(ctx, e); err != nil {
 		return nil, err
 	}
 	args.w.WriteHeader(201)
 	return nil, nil
 }
 
-func getEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
-	var result interface{} // object or []interface{}
-	entity, err := GetEntityAttrs(args.ID, args.attrs)
+func deleteEntitiesHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	q, err := queryFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if !q.HasFilter() && !args.options.Get(OptConfirm) {
+		return nil, ErrMissingConfirmation
+	}
+	n, err := args.store.DeleteEntities(ctx, q, args.ID.Service, args.ID.ServicePath, args.options.Get(OptDryRun))
 	if err != nil {
 		return nil, err
 	}
+	return object{"count": n}, nil
+}
 
+func patchEntitiesHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	var (
+		m   map[string]Attribute
+		err error
+	)
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
 	if args.options.Get(OptKeyValues) {
-		result = entity.ToKeyValues() // map
-	} else if args.options.Get(OptValues) {
-		result, err = entity.ToValues(args.attrs) // slice
-		if err != nil {
-			return nil, err
-		}
+		m = AttrsFromKeyValue(args.obj)
 	} else {
-		result = entity.ToObject()
+		m, err = AttrsMapFromObject(args.obj)
+	}
+	if err != nil {
+		return nil, err
 	}
+	if err = args.srv.checkAttrs(m); err != nil {
+		return nil, err
+	}
+	q, err := queryFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if !q.HasFilter() && !args.options.Get(OptConfirm) {
+		return nil, ErrMissingConfirmation
+	}
+	n, err := args.store.UpdateEntities(ctx, q, args.ID.Service, args.ID.ServicePath, m, args.options.Get(OptDryRun))
+	if err != nil {
+		return nil, err
+	}
+	return object{"count": n}, nil
+}
 
-	return result, nil
+func getEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if args.req.FormValue(paramAsOf) != "" {
+		return getEntityAsOfHandleF(ctx, args)
+	}
+	entity, err := args.store.GetEntityAttrs(ctx, args.ID, args.attrs)
+	if err == ErrNotFoundEntity {
+		// maybe provided by someone else
+		entity, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entity, _, err = args.srv.withForwarded(ctx, args, entity, splitParam(args.req, paramAttrs))
+	if err != nil {
+		return nil, err
+	}
+	return formatEntity(entity, args.options, args.attrs)
 }
 
 func deleteEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
-	err := DeleteEntity(args.ID)
+	err := args.store.DeleteEntity(ctx, args.ID)
+	if err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
+
+func patchEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	var apply func(doc interface{}) (interface{}, error)
+
+	switch {
+	case hasContentType(args.req, contentTypeMergePatch):
+		if args.obj == nil {
+			return nil, ErrEmptyObject
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return MergePatch(doc, args.obj), nil
+		}
+	case hasContentType(args.req, contentTypeJSONPatch):
+		ops, err := ParseJSONPatch(args.any)
+		if err != nil {
+			return nil, err
+		}
+		apply = ops.Apply
+	default:
+		return nil, ErrContentTypeNotPatch
+	}
+
+	_, err := args.store.PatchEntity(ctx, args.ID, func(e *Entity) error {
+		if err := e.PatchWith(apply); err != nil {
+			return err
+		}
+		if err := args.srv.checkAttrs(e.Attrs); err != nil {
+			return err
+		}
+		return args.srv.checkEntity(e)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -208,7 +746,18 @@ func deleteEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, er
 }
 
 func getAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
-	return GetAllAttrs(args.ID)
+	entity, err := args.store.GetEntity(ctx, args.ID)
+	if err == ErrNotFoundEntity {
+		entity, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entity, _, err = args.srv.withForwarded(ctx, args, entity, nil)
+	if err != nil {
+		return nil, err
+	}
+	return entity.Attrs, nil
 }
 
 func postAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
@@ -224,13 +773,25 @@ func postAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error
 	if err != nil {
 		return nil, err
 	}
+	if err = args.srv.checkAttrs(m); err != nil {
+		return nil, err
+	}
+	action := actionAppend
 	if args.options.Get(OptAppend) {
-		// strict append
-		_, err = AddAttrs(args.ID, m)
-	} else {
-		_, err = AddOrUpdateAttrs(args.ID, m)
+		action = actionAppendStrict
 	}
-	return nil, err
+	return nil, args.srv.forwardingWrite(ctx, args, action, m, func(local map[string]Attribute) (err error) {
+		if err = args.srv.checkWrite(ctx, args.store, args.ID, local, false); err != nil {
+			return err
+		}
+		if args.options.Get(OptAppend) {
+			// strict append
+			_, err = args.store.AddAttrs(ctx, args.ID, local)
+		} else {
+			_, err = args.store.AddOrUpdateAttrs(ctx, args.ID, local)
+		}
+		return err
+	})
 }
 
 func patchAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
@@ -246,8 +807,16 @@ func patchAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, erro
 	if err != nil {
 		return nil, err
 	}
-	_, err = UpdateAttrs(args.ID, m)
-	return nil, err
+	if err = args.srv.checkAttrs(m); err != nil {
+		return nil, err
+	}
+	return nil, args.srv.forwardingWrite(ctx, args, actionUpdate, m, func(local map[string]Attribute) error {
+		if err := args.srv.checkWrite(ctx, args.store, args.ID, local, false); err != nil {
+			return err
+		}
+		_, err := args.store.UpdateAttrs(ctx, args.ID, local)
+		return err
+	})
 }
 
 func putAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
@@ -263,13 +832,19 @@ func putAttrsHandleF(ctx context.Context, args handlerArgs) (interface{}, error)
 	if err != nil {
 		return nil, err
 	}
-	_, err = SetAllAttrs(args.ID, m)
+	if err = args.srv.checkAttrs(m); err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkWrite(ctx, args.store, args.ID, m, true); err != nil {
+		return nil, err
+	}
+	_, err = args.store.SetAllAttrs(ctx, args.ID, m)
 	return nil, err
 }
 
 func getAttrHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
 	name := args.vars["name"]
-	attr, err := GetAttr(args.ID, name)
+	attr, err := args.srv.getAttr(ctx, args, name)
 	if err != nil {
 		return nil, err
 	}
@@ -278,23 +853,26 @@ func getAttrHandleF(ctx context.Context, args handlerArgs) (interface{}, error)
 
 func putAttrHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
 	name := args.vars["name"]
-	attr, err := AttrValueFromObject(args.obj)
+	// the body as decoded, args.obj is not taken as a map by AttrValueFromObject
+	attr, err := AttrValueFromObject(args.any)
 	if err != nil {
 		return nil, err
 	}
-	_, err = SetAttr(args.ID, name, attr)
-	return nil, err
+	if err = args.srv.checkAttr(attr); err != nil {
+		return nil, err
+	}
+	return nil, args.srv.setAttr(ctx, args, name, attr)
 }
 
 func deleteAttrHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
 	name := args.vars["name"]
-	_, err := DeleteAttr(args.ID, name)
+	_, err := args.store.DeleteAttr(ctx, args.ID, name)
 	return nil, err
 }
 
 func getAttrValueHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
 	name := args.vars["name"]
-	attr, err := GetAttr(args.ID, name)
+	attr, err := args.srv.getAttr(ctx, args, name)
 	if err != nil {
 		return nil, err
 	}
@@ -303,6 +881,143 @@ func getAttrValueHandleF(ctx context.Context, args handlerArgs) (interface{}, er
 
 func putAttrValueHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
 	name := args.vars["name"]
-	_, err := SetAttr(args.ID, name, &Attribute{Value: args.any})
-	return nil, err
+	attr := &Attribute{Value: args.any}
+	return nil, args.srv.setAttr(ctx, args, name, attr)
+}
+
+// findByID returns the entity id of the service of the request, with the
+// attrs, all if empty, whatever its type. The first one found is returned if
+// there is more than one.
+func findByID(ctx context.Context, args handlerArgs, id string, attrs []string) (*Entity, error) {
+	q := &Query{ID: []string{id}, Attrs: attrs, Limit: 1}
+	eIter, err := args.store.GetEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer eIter.Close()
+	e := &Entity{}
+	if !eIter.Next(e) {
+		if err := eIter.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFoundEntity
+	}
+	return e, nil
+}
+
+// decodeBody decodes the body of the request again, as v, rejecting unknown
+// fields if strict
+func decodeBody(args handlerArgs, v interface{}, strict bool) error {
+	data, err := json.Marshal(args.any)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// getAttr returns the attribute name of the entity of the request, from its
+// context provider if it is not stored locally
+func (srv *Server) getAttr(ctx context.Context, args handlerArgs, name string) (Attribute, error) {
+	attr, err := args.store.GetAttr(ctx, args.ID, name)
+	if err != ErrNotFoundAttr && err != ErrNotFoundEntity {
+		return attr, err
+	}
+	var stored *Entity
+	if err == ErrNotFoundAttr {
+		// stored, but without it
+		stored = NewEntity(args.ID)
+	}
+	e, failed, err := srv.withForwarded(ctx, args, stored, []string{name})
+	if err != nil {
+		return attr, err
+	}
+	if a, ok := e.Attrs[name]; ok {
+		return a, nil
+	}
+	if len(failed) > 0 {
+		return attr, ErrProviderUnavailable
+	}
+	return attr, ErrNotFoundAttr
+}
+
+// setAttr sets the attribute name of the entity of the request, or sends it
+// to its context provider if it is not stored locally
+func (srv *Server) setAttr(ctx context.Context, args handlerArgs, name string, attr *Attribute) error {
+	attrs := map[string]Attribute{name: *attr}
+	return srv.forwardingWrite(ctx, args, actionUpdate, attrs, func(local map[string]Attribute) error {
+		if err := srv.checkWrite(ctx, args.store, args.ID, local, false); err != nil {
+			return err
+		}
+		_, err := args.store.SetAttr(ctx, args.ID, name, attr)
+		return err
+	})
+}
+
+// forwardingWrite sends the attributes in attrs owned by context providers to
+// them, and lets write store the rest, if any. Attributes not updated by a
+// failing provider make a partial update.
+func (srv *Server) forwardingWrite(ctx context.Context, args handlerArgs, action string, attrs map[string]Attribute, write func(local map[string]Attribute) error) error {
+	local, failed, err := srv.forwardUpdate(ctx, args, action, attrs)
+	if err != nil {
+		return err
+	}
+	if len(local) > 0 || len(attrs) == 0 {
+		if err = write(local); err != nil {
+			return err
+		}
+	}
+	return partialUpdate(failed)
+}
+
+func getRegistrationsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	q, err := queryFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultLimit
+	} else if q.Limit > maxLimit {
+		return nil, ErrInvalidLimit
+	}
+	if args.options.Get(OptCount) {
+		n, err := args.store.CountRegistrations(ctx, args.ID.Service)
+		if err != nil {
+			return nil, err
+		}
+		args.w.Header().Set(headerTotalCount, strconv.Itoa(n))
+	}
+	return args.store.ListRegistrations(ctx, args.ID.Service, q.Limit, q.Offset)
+}
+
+func postRegistrationsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	r := &Registration{}
+	if err := decodeBody(args, r, true); err != nil {
+		return nil, ErrInvalidRegistration
+	}
+	r.Service = args.ID.Service
+	if err := args.store.CreateRegistration(ctx, r); err != nil {
+		return nil, err
+	}
+	args.w.Header().Set("Location", "/v2/registrations/"+r.ID)
+	args.w.WriteHeader(201)
+	return nil, nil
+}
+
+func getRegistrationHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	return args.store.GetRegistration(ctx, args.ID.Service, args.vars["regId"])
+}
+
+func deleteRegistrationHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if err := args.store.DeleteRegistration(ctx, args.ID.Service, args.vars["regId"]); err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
 }
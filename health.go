@@ -0,0 +1,57 @@
+package gorrion
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version is the version of gorrion, set when building with
+//
+//	-ldflags "-X github.com/crbrox/gorrion.Version=1.2.3"
+var Version = "dev"
+
+// readyTimeout bounds the ping to MongoDB of the readiness check
+const readyTimeout = 2 * time.Second
+
+func liveHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	return map[string]string{"status": "alive"}, nil
+}
+
+// readyHandleF answers whether the server can take requests, which needs
+// MongoDB to be reachable
+func readyHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if args.srv.isDraining() {
+		return nil, ErrShuttingDown
+	}
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	if err := args.store.Ping(ctx); err != nil {
+		args.log.Warn("readiness check failed", "error", err)
+		return nil, ErrStoreUnavailable
+	}
+	return map[string]string{"status": "ready"}, nil
+}
+
+func versionHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	uptime := time.Since(args.srv.started)
+	v := map[string]interface{}{
+		"version":       Version,
+		"goVersion":     runtime.Version(),
+		"uptime":        uptime.Truncate(time.Second).String(),
+		"uptimeSeconds": int64(uptime / time.Second),
+		"features":      args.srv.Features(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				v["revision"] = s.Value
+			case "vcs.time":
+				v["buildTime"] = s.Value
+			}
+		}
+	}
+	return v, nil
+}
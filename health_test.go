@@ -0,0 +1,102 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// get does a GET request to the routes of the broker and returns the status
+// and decoded body of the response
+func get(t *testing.T, path string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	AddHandlers().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return w.Code, body
+}
+
+func TestLive(t *testing.T) {
+	code, body := get(t, "/health/live")
+	if code != http.StatusOK {
+		t.Error(gotWanted(code, http.StatusOK))
+	}
+	if body["status"] != "alive" {
+		t.Error(gotWanted(body["status"], "alive"))
+	}
+}
+
+func TestReady(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	code, body := get(t, "/health/ready")
+	if code != http.StatusOK {
+		t.Error(gotWanted(code, http.StatusOK))
+	}
+	if body["status"] != "ready" {
+		t.Error(gotWanted(body["status"], "ready"))
+	}
+}
+
+func TestReady_StoreStopped(t *testing.T) {
+	if defaultStore != nil {
+		t.Skip("store started")
+	}
+	code, body := get(t, "/health/ready")
+	if code != http.StatusServiceUnavailable {
+		t.Error(gotWanted(code, http.StatusServiceUnavailable))
+	}
+	if body["error"] != ErrStoreUnavailable.Error() {
+		t.Error(gotWanted(body["error"], ErrStoreUnavailable.Error()))
+	}
+}
+
+func TestReady_Draining(t *testing.T) {
+	Drain()
+	defer atomic.StoreInt32(&defaultServer.draining, 0)
+
+	code, body := get(t, "/health/ready")
+	if code != http.StatusServiceUnavailable {
+		t.Error(gotWanted(code, http.StatusServiceUnavailable))
+	}
+	if body["error"] != ErrShuttingDown.Error() {
+		t.Error(gotWanted(body["error"], ErrShuttingDown.Error()))
+	}
+	// still alive, though
+	if code, _ := get(t, "/health/live"); code != http.StatusOK {
+		t.Error(gotWanted(code, http.StatusOK))
+	}
+}
+
+func TestVersion(t *testing.T) {
+	EnableFeature("testFeature")
+	defer func() {
+		defaultServer.featuresMu.Lock()
+		delete(defaultServer.features, "testFeature")
+		defaultServer.featuresMu.Unlock()
+	}()
+
+	code, body := get(t, "/version")
+	if code != http.StatusOK {
+		t.Error(gotWanted(code, http.StatusOK))
+	}
+	if body["version"] != Version {
+		t.Error(gotWanted(body["version"], Version))
+	}
+	if _, ok := body["uptimeSeconds"].(float64); !ok {
+		t.Errorf("missing uptime in %v", body)
+	}
+	found := false
+	for _, f := range body["features"].([]interface{}) {
+		found = found || f == "testFeature"
+	}
+	if !found {
+		t.Errorf("missing enabled feature in %v", body["features"])
+	}
+}
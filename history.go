@@ -0,0 +1,296 @@
+package gorrion
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The values written to the attributes whose history is recorded, all of
+// those of the entities of StoreConfig.HistoryTypes and those named as in
+// StoreConfig.HistoryAttrs whatever their entity, are kept as points in the
+// history collection by the same operation writing them, and added up in its
+// rollups. Failing to keep them does not fail the operation, whose write is
+// done already, see recordFailed.
+
+// recvTimeField is when a value was written, the time axis of the history
+const recvTimeField = "recvTime"
+
+// HistoryPoint is a value given to an attribute, at the time it was written.
+// An entity keeps only the last one, its history keeps them all.
+type HistoryPoint struct {
+	Entity   EntityID               `bson:"entity" json:"-"`
+	Attr     string                 `bson:"attr" json:"-"`
+	Type     string                 `bson:"type,omitempty" json:"type,omitempty"`
+	Value    interface{}            `bson:"value" json:"value"`
+	Md       map[string]interface{} `bson:"metadata,omitempty" json:"metadata,omitempty"`
+	RecvTime time.Time              `bson:"recvTime" json:"recvTime"`
+}
+
+// HistoryQuery selects the points of an attribute, in the order they were
+// written
+type HistoryQuery struct {
+	// bounds of the recvTime of the points, both included, none if zero
+	From, To time.Time
+	// only the last LastN points, if not zero, instead of a page of Limit
+	// points after the first Offset ones
+	LastN  int
+	Limit  int
+	Offset int
+}
+
+// recordsHistory tells whether the values of the attribute name of the
+// entities of type entityType are recorded
+func (c StoreConfig) recordsHistory(entityType, name string) bool {
+	for _, t := range c.HistoryTypes {
+		if t == entityType {
+			return true
+		}
+	}
+	for _, a := range c.HistoryAttrs {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// recordsAnyHistory tells whether the values of some of attrs may be
+// recorded, for entities of some type
+func (c StoreConfig) recordsAnyHistory(attrs map[string]Attribute) bool {
+	if len(c.HistoryTypes) > 0 {
+		return true
+	}
+	for name := range attrs {
+		if c.recordsHistory("", name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *Store) withHistCol(ctx context.Context, retry bool, f func(col *mgo.Collection) error) error {
+	return st.runCol(ctx, func() string { return st.config.HistoryColl }, retry, f)
+}
+
+// ensureHistoryIndexes indexes the history and its rollups by attribute and
+// time, and makes MongoDB remove the points and rollups older than their
+// retention, if there is one
+func (st *Store) ensureHistoryIndexes(sess *mgo.Session) error {
+	db := sess.DB(st.config.DB)
+	err := db.C(st.config.HistoryColl).EnsureIndex(mgo.Index{Key: []string{"entity", "attr", recvTimeField}})
+	if err != nil {
+		return err
+	}
+	if err = ensureExpiration(db, st.config.HistoryColl, recvTimeField, st.config.HistoryRetention); err != nil {
+		return err
+	}
+	for _, r := range rollupPeriods {
+		name := st.rollupColl(r.period)
+		err = db.C(name).EnsureIndex(mgo.Index{Key: []string{"entity", "attr", startField}, Unique: true})
+		if err != nil {
+			return err
+		}
+		if err = ensureExpiration(db, name, startField, st.config.HistoryRollupRetention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureExpiration makes MongoDB remove the documents of the collection name
+// once the time in field is older than retention, never if zero. A retention
+// changed since the index was built is applied to it.
+func ensureExpiration(db *mgo.Database, name, field string, retention time.Duration) error {
+	col := db.C(name)
+	if retention == 0 {
+		// kept forever, dropping the expiration of a former retention
+		err := col.DropIndex(field)
+		if qErr, ok := err.(*mgo.QueryError); ok && (qErr.Code == 26 || qErr.Code == 27) {
+			// no such collection or index
+			return nil
+		}
+		return err
+	}
+	err := col.EnsureIndex(mgo.Index{Key: []string{field}, ExpireAfter: retention})
+	if qErr, ok := err.(*mgo.QueryError); ok && qErr.Code == 85 {
+		// IndexOptionsConflict, built with another retention
+		seconds := int(retention / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		return db.Run(bson.D{
+			{Name: "collMod", Value: name},
+			{Name: "index", Value: bson.M{"keyPattern": bson.M{field: 1}, "expireAfterSeconds": seconds}},
+		}, nil)
+	}
+	return err
+}
+
+// recordHistory keeps the values in attrs of the attributes of the entity ei
+// whose history is recorded, as written at now, telling recordFailed if it
+// cannot
+func (st *Store) recordHistory(ctx context.Context, ei EntityID, attrs map[string]Attribute, now time.Time) {
+	if err := st.insertHistory(ctx, ei, attrs, now); err != nil {
+		st.recordFailed(ctx, "history", ei, err)
+	}
+}
+
+// insertHistory adds the points of recordHistory to the history and its
+// rollups
+func (st *Store) insertHistory(ctx context.Context, ei EntityID, attrs map[string]Attribute, now time.Time) error {
+	var points []interface{}
+	for name, attr := range attrs {
+		if st.config.recordsHistory(ei.Type, name) {
+			points = append(points, &HistoryPoint{Entity: ei, Attr: name, Type: attr.Type,
+				Value: attr.Value, Md: attr.Md, RecvTime: now})
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	err := st.withHistCol(ctx, false, func(col *mgo.Collection) error {
+		return col.Insert(points...)
+	})
+	if err != nil {
+		return err
+	}
+	return st.rollUp(ctx, points)
+}
+
+// recordFailed tells that the record of a write to ei, done already, could not
+// be kept. The write does not fail for it: the client would try it again, and
+// the points recorded would be there twice.
+func (st *Store) recordFailed(ctx context.Context, record string, ei EntityID, err error) {
+	if st.recordFailures != nil {
+		st.recordFailures.WithLabelValues(record).Inc()
+	}
+	logger := st.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.ErrorContext(ctx, "recording write", "record", record, "entity", ei.ID, "type", ei.Type,
+		"tenant", ei.Service, "servicePath", ei.ServicePath, "error", err)
+}
+
+// recordChanges records the attributes of e that differ from those of old
+func (st *Store) recordChanges(ctx context.Context, old, e *Entity, now time.Time) {
+	changed := map[string]Attribute{}
+	for name, attr := range e.Attrs {
+		if oldAttr, ok := old.Attrs[name]; !ok || !sameAttribute(oldAttr, attr) {
+			changed[name] = attr
+		}
+	}
+	st.recordHistory(ctx, e.ID, changed, now)
+}
+
+// sameAttribute compares attributes as a client sees them, by their JSON
+// encoding, which has the keys of the objects sorted
+func sameAttribute(a, b Attribute) bool {
+	da, errA := json.Marshal(a)
+	db, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(da) == string(db)
+}
+
+// GetHistory returns the points of the attribute name of the entity ei
+// selected by hq, oldest first
+func (st *Store) GetHistory(ctx context.Context, ei EntityID, name string, hq *HistoryQuery) (points []HistoryPoint, err error) {
+	ctx, op := st.startOp(ctx, "GetHistory", ei)
+	defer op.end(&err)
+	op.setCollection(st.config.HistoryColl)
+	condition := bson.M{"entity": ei, "attr": name}
+	recvTime := bson.M{}
+	if !hq.From.IsZero() {
+		recvTime["$gte"] = hq.From
+	}
+	if !hq.To.IsZero() {
+		recvTime["$lte"] = hq.To
+	}
+	if len(recvTime) > 0 {
+		condition[recvTimeField] = recvTime
+	}
+	points = []HistoryPoint{}
+	err = st.withHistCol(ctx, true, func(col *mgo.Collection) error {
+		q := col.Find(condition)
+		// by _id as well, for the points written in the same millisecond
+		if hq.LastN > 0 {
+			q = q.Sort("-"+recvTimeField, "-_id").Limit(hq.LastN)
+		} else {
+			q = q.Sort(recvTimeField, "_id").Skip(hq.Offset).Limit(hq.Limit)
+		}
+		return withMaxTime(ctx, q).All(&points)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if hq.LastN > 0 {
+		// taken newest first
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	op.setResultSize(len(points))
+	return points, nil
+}
+
+// historyQueryFromRequest takes the history query from the URL parameters,
+// with dates as in RFC 3339
+func historyQueryFromRequest(req *http.Request) (hq *HistoryQuery, err error) {
+	hq = &HistoryQuery{}
+	for param, t := range map[string]*time.Time{paramFromDate: &hq.From, paramToDate: &hq.To} {
+		if v := req.FormValue(param); v != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return nil, ErrInvalidDate
+			}
+		}
+	}
+	if v := req.FormValue(paramLastN); v != "" {
+		if hq.LastN, err = strconv.Atoi(v); err != nil || hq.LastN <= 0 || hq.LastN > maxLimit {
+			return nil, ErrInvalidLastN
+		}
+	}
+	if v := req.FormValue(paramHLimit); v != "" {
+		if hq.Limit, err = strconv.Atoi(v); err != nil || hq.Limit <= 0 || hq.Limit > maxLimit {
+			return nil, ErrInvalidLimit
+		}
+	}
+	if v := req.FormValue(paramHOffset); v != "" {
+		if hq.Offset, err = strconv.Atoi(v); err != nil || hq.Offset < 0 {
+			return nil, ErrInvalidOffset
+		}
+	}
+	if hq.Limit == 0 {
+		hq.Limit = defaultLimit
+	}
+	return hq, nil
+}
+
+// attrHistory is the series of values of an attribute
+type attrHistory struct {
+	EntityID   string         `json:"entityId"`
+	EntityType string         `json:"entityType"`
+	AttrName   string         `json:"attrName"`
+	Values     []HistoryPoint `json:"values"`
+}
+
+func getAttrHistoryHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	hq, err := historyQueryFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if args.req.FormValue(paramAggrMethod) != "" || args.req.FormValue(paramAggrPeriod) != "" {
+		return aggregateAttrHistory(ctx, args, hq)
+	}
+	name := args.vars["name"]
+	points, err := args.store.GetHistory(ctx, args.ID, name, hq)
+	if err != nil {
+		return nil, err
+	}
+	return attrHistory{EntityID: args.ID.ID, EntityType: args.ID.Type, AttrName: name, Values: points}, nil
+}
@@ -0,0 +1,198 @@
+package gorrion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestStoreConfig_RecordsHistory(t *testing.T) {
+	c := StoreConfig{HistoryTypes: []string{"Room"}, HistoryAttrs: []string{"status"}}
+	var cases = []struct {
+		entityType, name string
+		wanted           bool
+	}{
+		{"Room", "temperature", true},
+		{"Car", "status", true},
+		{"Car", "speed", false},
+	}
+	for _, cs := range cases {
+		if got := c.recordsHistory(cs.entityType, cs.name); got != cs.wanted {
+			t.Errorf("%s %s: %s", cs.entityType, cs.name, gotWanted(got, cs.wanted))
+		}
+	}
+	if c.recordsAnyHistory(map[string]Attribute{"speed": {}}) != true {
+		t.Error("wanted any history with types recorded")
+	}
+	c.HistoryTypes = nil
+	if c.recordsAnyHistory(map[string]Attribute{"speed": {}}) != false {
+		t.Error("wanted no history of speed")
+	}
+}
+
+func TestSameAttribute(t *testing.T) {
+	// as read from MongoDB and as patched through JSON
+	stored := Attribute{Type: "Number", Value: bson.M{"a": 1, "b": "x"}}
+	patched := Attribute{Type: "Number", Value: map[string]interface{}{"b": "x", "a": 1.0}}
+	if !sameAttribute(stored, patched) {
+		t.Error(gotWanted(patched, stored))
+	}
+	patched.Value.(map[string]interface{})["a"] = 2.0
+	if sameAttribute(stored, patched) {
+		t.Error("wanted different attributes")
+	}
+}
+
+func TestRecordHistory_Failed(t *testing.T) {
+	var logged bytes.Buffer
+	st := &Store{config: StoreConfig{HistoryTypes: []string{"Room"}}, recordFailures: newRecordFailures(),
+		logger: slog.New(slog.NewTextHandler(&logged, nil))}
+	// the write is done, but there is no time left to record it
+	ctx, cancel := context.WithCancel(testCtx)
+	cancel()
+	st.recordHistory(ctx, EntityID{ID: "Room1", Type: "Room"}, map[string]Attribute{"temperature": {Value: 20.0}}, time.Now())
+	if got := testutil.ToFloat64(st.recordFailures.WithLabelValues("history")); got != 1 {
+		t.Error(gotWanted(got, 1))
+	}
+	if !strings.Contains(logged.String(), "entity=Room1") {
+		t.Error(gotWanted(logged.String(), "the failure logged"))
+	}
+}
+
+func TestHistoryQueryFromRequest(t *testing.T) {
+	req := httptest.NewRequest("GET", "/?fromDate=2024-01-01T00:00:00Z&toDate=2024-01-02T00:00:00.5%2B01:00&hOffset=3", nil)
+	hq, err := historyQueryFromRequest(req)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := &HistoryQuery{
+		From:   time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:     time.Date(2024, 1, 1, 23, 0, 0, 500000000, time.UTC),
+		Limit:  defaultLimit,
+		Offset: 3,
+	}
+	if !hq.From.Equal(wanted.From) || !hq.To.Equal(wanted.To) || hq.Limit != wanted.Limit || hq.Offset != wanted.Offset {
+		t.Error(gotWanted(hq, wanted))
+	}
+
+	var invalid = map[string]error{
+		"fromDate=yesterday": ErrInvalidDate,
+		"toDate=2024-01-01":  ErrInvalidDate,
+		"lastN=0":            ErrInvalidLastN,
+		"lastN=100000":       ErrInvalidLastN,
+		"hLimit=-1":          ErrInvalidLimit,
+		"hOffset=x":          ErrInvalidOffset,
+	}
+	for params, wantedErr := range invalid {
+		_, err := historyQueryFromRequest(httptest.NewRequest("GET", "/?"+params, nil))
+		if err != wantedErr {
+			t.Errorf("%s: %s", params, gotWanted(err, wantedErr))
+		}
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.Store.HistoryTypes = []string{"Room"}
+	c.Store.HistoryAttrs = []string{"status"}
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	st := srv.Store()
+	dropTestCollection(t, st)
+
+	room := EntityID{ID: "Room1", Type: "Room", Service: "S"}
+	car := EntityID{ID: "Car1", Type: "Car", Service: "S"}
+	e := NewEntity(room)
+	e.Attrs["temperature"] = Attribute{Type: "Number", Value: 20.0}
+	if err = st.CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	for _, v := range []float64{21, 22, 23} {
+		if _, err = st.UpdateAttrs(testCtx, room, map[string]Attribute{"temperature": {Type: "Number", Value: v}}); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+	// only the attributes changed by a patch
+	_, err = st.PatchEntity(testCtx, room, func(e *Entity) error {
+		e.Attrs["pressure"] = Attribute{Type: "Number", Value: 720.0}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	e = NewEntity(car)
+	e.Attrs["speed"] = Attribute{Type: "Number", Value: 50.0}
+	e.Attrs["status"] = Attribute{Type: "Text", Value: "moving"}
+	if err = st.CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	values := func(points []HistoryPoint) []interface{} {
+		var vs []interface{}
+		for _, p := range points {
+			vs = append(vs, p.Value)
+		}
+		return vs
+	}
+	var cases = []struct {
+		ei     EntityID
+		name   string
+		hq     HistoryQuery
+		wanted []interface{}
+	}{
+		{room, "temperature", HistoryQuery{Limit: 10}, []interface{}{20.0, 21.0, 22.0, 23.0}},
+		{room, "temperature", HistoryQuery{LastN: 2}, []interface{}{22.0, 23.0}},
+		{room, "temperature", HistoryQuery{Limit: 2, Offset: 1}, []interface{}{21.0, 22.0}},
+		{room, "pressure", HistoryQuery{Limit: 10}, []interface{}{720.0}},
+		{car, "status", HistoryQuery{Limit: 10}, []interface{}{"moving"}},
+		{car, "speed", HistoryQuery{Limit: 10}, nil},
+		{room, "temperature", HistoryQuery{From: time.Now().Add(time.Hour), Limit: 10}, nil},
+	}
+	for _, cs := range cases {
+		points, err := st.GetHistory(testCtx, cs.ei, cs.name, &cs.hq)
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if got := values(points); !equalObjects(got, cs.wanted) {
+			t.Errorf("%s %s %+v: %s", cs.ei.ID, cs.name, cs.hq, gotWanted(got, cs.wanted))
+		}
+	}
+
+	// through the API
+	req := httptest.NewRequest("GET", "/v2/history/entities/Room1/attrs/temperature?type=Room&lastN=1", nil)
+	req.Header.Set(headerService, "S")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatal(gotWanted(w.Code, http.StatusOK))
+	}
+	var h struct {
+		EntityID string `json:"entityId"`
+		AttrName string `json:"attrName"`
+		Values   []struct {
+			RecvTime time.Time   `json:"recvTime"`
+			Value    interface{} `json:"value"`
+		} `json:"values"`
+	}
+	json.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode(&h)
+	if h.EntityID != "Room1" || h.AttrName != "temperature" || len(h.Values) != 1 ||
+		h.Values[0].Value != 23.0 || h.Values[0].RecvTime.IsZero() {
+		t.Error(gotWanted(w.Body.String(), "the last temperature"))
+	}
+}
@@ -0,0 +1,193 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	// URL of the NGSI-LD core context, always known, never fetched
+	ldCoreContextURL = "https://uri.etsi.org/ngsi-ld/v1/ngsi-ld-core-context.jsonld"
+	ldCoreBase       = "https://uri.etsi.org/ngsi-ld/"
+	// where the terms not in any context go, as the core context says
+	ldDefaultVocab = "https://uri.etsi.org/ngsi-ld/default-context/"
+)
+
+// ldCoreTerms are the names of attributes in the core context, which every
+// context includes
+var ldCoreTerms = map[string]string{
+	"location":         ldCoreBase + "location",
+	"observationSpace": ldCoreBase + "observationSpace",
+	"operationSpace":   ldCoreBase + "operationSpace",
+	"name":             ldCoreBase + "name",
+	"description":      ldCoreBase + "description",
+}
+
+// ldContext resolves the terms of a JSON-LD @context to the IRIs they stand
+// for, expanding them, and back, compacting them
+type ldContext struct {
+	terms map[string]string
+	iris  map[string]string
+}
+
+func newLDContext() *ldContext {
+	c := &ldContext{terms: map[string]string{}}
+	for term, iri := range ldCoreTerms {
+		c.terms[term] = iri
+	}
+	c.index()
+	return c
+}
+
+// index builds iris from terms. The shortest term, or the first in order if
+// more than one, is the one an IRI compacts to.
+func (c *ldContext) index() {
+	names := make([]string, 0, len(c.terms))
+	for term := range c.terms {
+		names = append(names, term)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	c.iris = map[string]string{}
+	for _, term := range names {
+		if _, ok := c.iris[c.terms[term]]; !ok {
+			c.iris[c.terms[term]] = term
+		}
+	}
+}
+
+// expand returns the IRI of name, which may be a term, a compact IRI, as in
+// ngsi-ld:name, or an IRI already
+func (c *ldContext) expand(name string) string {
+	if iri, ok := c.terms[name]; ok {
+		return iri
+	}
+	if i := strings.Index(name, ":"); i > 0 {
+		if prefix, ok := c.terms[name[:i]]; ok && !strings.HasPrefix(name[i+1:], "//") {
+			return prefix + name[i+1:]
+		}
+		return name
+	}
+	return ldDefaultVocab + name
+}
+
+// compact returns the term of iri, the IRI itself if it has none
+func (c *ldContext) compact(iri string) string {
+	if term, ok := c.iris[iri]; ok {
+		return term
+	}
+	if strings.HasPrefix(iri, ldDefaultVocab) {
+		return strings.TrimPrefix(iri, ldDefaultVocab)
+	}
+	return iri
+}
+
+// ldContexts resolves @context values, with the URLs of the contexts known
+// locally. No context is ever fetched.
+type ldContexts struct {
+	// the context of the server, the one stored entities use
+	server *ldContext
+	// URL the server context is known by, if any
+	serverURL string
+}
+
+// loadLDContexts reads the context of the server from file, known as url,
+// the core context alone if file is empty
+func loadLDContexts(file, url string) (*ldContexts, error) {
+	lc := &ldContexts{server: newLDContext()}
+	if file == "" {
+		return lc, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	v, ok := doc["@context"]
+	if !ok {
+		return nil, ErrInvalidLDContext
+	}
+	if lc.server, err = lc.resolve(v); err != nil {
+		return nil, err
+	}
+	lc.serverURL = url
+	return lc, nil
+}
+
+// resolve returns the context for the @context value v: the URL of a context
+// known locally, the definitions of the terms, or an array of them, which
+// are added in order to the core context
+func (lc *ldContexts) resolve(v interface{}) (*ldContext, error) {
+	c := newLDContext()
+	if err := lc.add(c, v); err != nil {
+		return nil, err
+	}
+	c.index()
+	return c, nil
+}
+
+func (lc *ldContexts) add(c *ldContext, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		switch {
+		case strings.HasPrefix(v, ldCoreBase+"v1/ngsi-ld-core-context"):
+			return nil
+		case lc.serverURL != "" && v == lc.serverURL:
+			for term, iri := range lc.server.terms {
+				c.terms[term] = iri
+			}
+			return nil
+		}
+		return ErrLDContextNotAvailable
+	case []interface{}:
+		for _, item := range v {
+			if err := lc.add(c, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		// definitions may use the prefixes defined along with them
+		defs := map[string]string{}
+		for term, def := range v {
+			if strings.HasPrefix(term, "@") {
+				continue
+			}
+			switch def := def.(type) {
+			case string:
+				defs[term] = def
+			case map[string]interface{}:
+				id, ok := def["@id"].(string)
+				if !ok {
+					return ErrInvalidLDContext
+				}
+				defs[term] = id
+			default:
+				return ErrInvalidLDContext
+			}
+		}
+		for term, iri := range defs {
+			if i := strings.Index(iri, ":"); i > 0 && !strings.HasPrefix(iri[i+1:], "//") {
+				if prefix, ok := defs[iri[:i]]; ok {
+					iri = prefix + iri[i+1:]
+				} else if prefix, ok := c.terms[iri[:i]]; ok {
+					iri = prefix + iri[i+1:]
+				}
+			}
+			c.terms[term] = iri
+		}
+		return nil
+	}
+	return ErrInvalidLDContext
+}
@@ -0,0 +1,92 @@
+package gorrion
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// limitBody makes reading the body of req fail past the largest size allowed.
+// rw is the writer of net/http, to close the connection after the response.
+func (srv *Server) limitBody(rw http.ResponseWriter, req *http.Request) {
+	if max := srv.config.MaxBodySize; max > 0 {
+		req.Body = http.MaxBytesReader(rw, req.Body, int64(max))
+	}
+}
+
+// readBody returns the body of req, which may be empty even with an unknown
+// length, as chunked bodies have
+func (srv *Server) readBody(req *http.Request) ([]byte, error) {
+	if req.ContentLength == 0 {
+		return nil, nil
+	}
+	if max := srv.config.MaxBodySize; max > 0 && req.ContentLength > int64(max) {
+		// not worth reading
+		return nil, ErrBodyTooLarge
+	}
+	data, err := io.ReadAll(req.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, ErrBodyTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if max := srv.config.MaxJSONDepth; max > 0 && jsonTooDeep(data, max) {
+		return nil, ErrJSONTooDeep
+	}
+	return data, nil
+}
+
+// jsonTooDeep tells whether objects and arrays are nested in data deeper than
+// max, without decoding it. Malformed JSON is left for the decoder to reject.
+func jsonTooDeep(data []byte, max int) bool {
+	depth := 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch c {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			if depth > max {
+				return true
+			}
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// checkAttrs checks the attributes of an entity sent in a request are within
+// the limits of the server
+func (srv *Server) checkAttrs(m map[string]Attribute) error {
+	if max := srv.config.MaxAttrs; max > 0 && len(m) > max {
+		return ErrTooManyAttrs
+	}
+	for _, a := range m {
+		if err := srv.checkAttr(&a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAttr checks an attribute sent in a request is within the limits of the
+// server
+func (srv *Server) checkAttr(a *Attribute) error {
+	if max := srv.config.MaxMetadata; max > 0 && len(a.Md) > max {
+		return ErrTooManyMetadata
+	}
+	return nil
+}
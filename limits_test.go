@@ -0,0 +1,92 @@
+package gorrion
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONTooDeep(t *testing.T) {
+	var cases = []struct {
+		data   string
+		wanted bool
+	}{
+		{`{"a": 1}`, false},
+		{`{"a": {"b": [1]}}`, false},
+		{`{"a": {"b": [[1]]}}`, true},
+		{`[[[]]]`, false},
+		{`[[[[]]]]`, true},
+		// brackets in strings do not nest
+		{`{"a": "[[[[{{{{"}`, false},
+		{`{"a": "\"[[[["}`, false},
+		{`{"a": "\\", "b": [[[1]]]}`, true},
+	}
+	for _, c := range cases {
+		if got := jsonTooDeep([]byte(c.data), 3); got != c.wanted {
+			t.Error(gotWanted(got, c.wanted) + " (" + c.data + ")")
+		}
+	}
+}
+
+// limitedServer answers requests with small limits and no store connected
+func limitedServer(t *testing.T) *Server {
+	c := DefaultConfig()
+	c.MaxBodySize = 100
+	c.MaxJSONDepth = 3
+	c.MaxAttrs = 2
+	c.MaxMetadata = 1
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return srv
+}
+
+// chunked hides the length of r, as in a chunked request
+type chunked struct{ io.Reader }
+
+func TestLimits(t *testing.T) {
+	srv := limitedServer(t)
+	var cases = []struct {
+		method, path, body string
+		unknownLength      bool
+		wanted             int
+		err                error
+	}{
+		{"POST", "/v2/entities/", `{"id": "E1", "a": "` + strings.Repeat("x", 100) + `"}`, false,
+			http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+		{"POST", "/v2/entities/", `{"id": "E1", "a": "` + strings.Repeat("x", 100) + `"}`, true,
+			http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+		{"POST", "/v2/entities/", `{"id": "E1", "a": {"value": [[[1]]]}}`, true,
+			http.StatusBadRequest, ErrJSONTooDeep},
+		{"POST", "/v2/entities/", `{"id": "E1", "a": {"value": 1}, "b": {"value": 2}, "c": {"value": 3}}`, false,
+			http.StatusBadRequest, ErrTooManyAttrs},
+		{"POST", "/v2/entities/E1/attrs", `{"a": {"value": 1, "metadata": {"m1": 1, "m2": 2}}}`, false,
+			http.StatusBadRequest, ErrTooManyMetadata},
+		{"PUT", "/v2/entities/E1/attrs/a", `{"value": 1, "metadata": {"m1": 1, "m2": 2}}`, false,
+			http.StatusBadRequest, ErrTooManyMetadata},
+		// chunked bodies are read, not skipped
+		{"PUT", "/admin/log", `{"level": "warn"}`, true, http.StatusOK, nil},
+		{"GET", "/health/live", ``, true, http.StatusOK, nil},
+	}
+	for _, c := range cases {
+		var body io.Reader = strings.NewReader(c.body)
+		if c.unknownLength {
+			body = chunked{body}
+		}
+		req := httptest.NewRequest(c.method, c.path, body)
+		req.Header.Set("Content-Type", contentTypeJSON)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != c.wanted {
+			t.Error(gotWanted(w.Code, c.wanted) + " (" + c.method + " " + c.path + ")")
+		}
+		if c.err != nil {
+			if got := strings.TrimSpace(w.Body.String()); got != ErrToJSON(c.err) {
+				t.Error(gotWanted(got, ErrToJSON(c.err)) + " (" + c.method + " " + c.path + ")")
+			}
+		}
+	}
+}
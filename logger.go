@@ -1,3 +1,125 @@
 package gorrion
 
-var logger loggerT
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// ParseLogLevel returns the level for its name: debug, info, warn or error
+func ParseLogLevel(s string) (slog.Level, error) {
+	l, ok := logLevels[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+func logLevelName(l slog.Level) string {
+	return strings.ToLower(l.String())
+}
+
+// newLogHandler writes every record to w, as text or JSON
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// levelHandler drops the records below a level that can change at runtime
+type levelHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h levelHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return l >= h.level.Level() && h.Handler.Enabled(ctx, l)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{h.Handler.WithAttrs(attrs), h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{h.Handler.WithGroup(name), h.level}
+}
+
+// the longest correlator taken from a request, anything longer is replaced
+const maxCorrelatorLen = 128
+
+// correlator returns the Fiware-Correlator of req or, if it has none, a new one
+func correlator(req *http.Request) string {
+	if c := req.Header.Get(headerCorrelator); c != "" && len(c) <= maxCorrelatorLen {
+		return c
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	// as a random UUID
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// statusWriter keeps the status of the response, for the log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func getLogLevelHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	return map[string]string{"level": logLevelName(args.srv.LogLevel())}, nil
+}
+
+// setLogLevelHandleF changes the level of the log of the server, as in
+// {"level": "debug"}
+func setLogLevelHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	name, ok := args.obj["level"].(string)
+	if !ok {
+		return nil, ErrInvalidLogLevel
+	}
+	l, err := ParseLogLevel(name)
+	if err != nil {
+		return nil, ErrInvalidLogLevel
+	}
+	args.srv.SetLogLevel(l)
+	args.log.Info("log level changed", "level", name)
+	return map[string]string{"level": name}, nil
+}
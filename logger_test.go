@@ -0,0 +1,139 @@
+package gorrion
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for name, wanted := range logLevels {
+		got, err := ParseLogLevel(name)
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if got != wanted {
+			t.Error(gotWanted(got, wanted))
+		}
+		if got := logLevelName(wanted); got != name {
+			t.Error(gotWanted(got, name))
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("wanted error for unknown level")
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	log := slog.New(levelHandler{newLogHandler(&buf, logFormatText), level}).With("a", 1)
+
+	log.Debug("hidden")
+	level.Set(slog.LevelDebug)
+	log.Debug("shown")
+	if got := buf.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown a=1") {
+		t.Errorf("unexpected log %q", got)
+	}
+}
+
+func TestCorrelator(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	c1, c2 := correlator(req), correlator(req)
+	if !uuid.MatchString(c1) || c1 == c2 {
+		t.Errorf("wanted new random ids, got %q and %q", c1, c2)
+	}
+
+	req.Header.Set(headerCorrelator, "from-gateway")
+	if got := correlator(req); got != "from-gateway" {
+		t.Error(gotWanted(got, "from-gateway"))
+	}
+
+	req.Header.Set(headerCorrelator, strings.Repeat("x", maxCorrelatorLen+1))
+	if got := correlator(req); !uuid.MatchString(got) {
+		t.Errorf("wanted new id for a too long one, got %q", got)
+	}
+}
+
+// logTo makes the default server log to buf, as JSON, until the function
+// returned is called
+func logTo(buf *bytes.Buffer) func() {
+	old := defaultServer.logger
+	defaultServer.logger = slog.New(levelHandler{newLogHandler(buf, logFormatJSON), defaultServer.logLevel})
+	return func() { defaultServer.logger = old }
+}
+
+func TestRequestLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer logTo(&buf)()
+
+	req := httptest.NewRequest("GET", "/health/live", nil)
+	req.Header.Set(headerCorrelator, "C1")
+	req.Header.Set(headerService, "tenant1")
+	req.Header.Set(headerServicePath, "/sp")
+	w := httptest.NewRecorder()
+	AddHandlers().ServeHTTP(w, req)
+
+	if got := w.Header().Get(headerCorrelator); got != "C1" {
+		t.Error(gotWanted(got, "C1"))
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := map[string]interface{}{
+		"level":       "INFO",
+		"msg":         "request",
+		"correlator":  "C1",
+		"method":      "GET",
+		"path":        "/health/live",
+		"tenant":      "tenant1",
+		"servicePath": "/sp",
+		"status":      200.0,
+	}
+	for k, v := range wanted {
+		if entry[k] != v {
+			t.Error(gotWanted(entry[k], v) + " (" + k + ")")
+		}
+	}
+	if _, ok := entry["latency"].(float64); !ok {
+		t.Errorf("missing latency in %v", entry)
+	}
+}
+
+func TestLogLevelEndpoint(t *testing.T) {
+	defer defaultServer.SetLogLevel(defaultServer.LogLevel())
+
+	put := func(body string) int {
+		req := httptest.NewRequest("PUT", "/admin/log", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		w := httptest.NewRecorder()
+		AddHandlers().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := put(`{"level": "debug"}`); code != http.StatusOK {
+		t.Error(gotWanted(code, http.StatusOK))
+	}
+	if got := defaultServer.LogLevel(); got != slog.LevelDebug {
+		t.Error(gotWanted(got, slog.LevelDebug))
+	}
+	if code, body := get(t, "/admin/log"); code != http.StatusOK || body["level"] != "debug" {
+		t.Error(gotWanted(body["level"], "debug"))
+	}
+
+	for _, body := range []string{`{"level": "verbose"}`, `{"level": 1}`, `{}`} {
+		if code := put(body); code != http.StatusBadRequest {
+			t.Error(gotWanted(code, http.StatusBadRequest) + " (" + body + ")")
+		}
+	}
+	if got := defaultServer.LogLevel(); got != slog.LevelDebug {
+		t.Error(gotWanted(got, slog.LevelDebug))
+	}
+}
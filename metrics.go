@@ -0,0 +1,194 @@
+package gorrion
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/mgo.v2"
+)
+
+const metricsNamespace = "gorrion"
+
+// newStoreOps is the histogram of the time taken by each store operation
+func newStoreOps() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "operation_duration_seconds",
+		Help:      "Time taken by store operations. Listings are timed until their iterator is closed.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+}
+
+// newRecordFailures is the count of the writes whose history or versions
+// could not be kept
+func newRecordFailures() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "store",
+		Name:      "record_failures_total",
+		Help:      "Writes done whose history or prior versions could not be kept, by record.",
+	}, []string{"record"})
+}
+
+// timeOp records the time since start taken by the store operation op
+func (st *Store) timeOp(op string, start time.Time) {
+	if st == nil || st.ops == nil {
+		return
+	}
+	st.ops.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+// The driver counts its sockets for the whole process once told to, which is
+// done when the first store is opened, before its first socket.
+var (
+	driverStatsOnce sync.Once
+	driverStatsOn   atomic.Bool
+)
+
+func enableDriverStats() {
+	driverStatsOnce.Do(func() {
+		mgo.SetStats(true)
+		driverStatsOn.Store(true)
+	})
+}
+
+// driverStats returns the counts of the driver, all zero before any store is
+// opened
+func driverStats() mgo.Stats {
+	if !driverStatsOn.Load() {
+		return mgo.Stats{}
+	}
+	return mgo.GetStats()
+}
+
+// serverMetrics are the metrics of a server, in a registry of its own so that
+// several servers can be in the same process
+type serverMetrics struct {
+	registry  *prometheus.Registry
+	duration  *prometheus.HistogramVec
+	responses *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	tenants   *prometheus.CounterVec
+	inFlight  prometheus.Gauge
+
+	mu sync.Mutex
+	// tenants labeled by name so far
+	tenantLabels map[string]bool
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry:     prometheus.NewRegistry(),
+		tenantLabels: map[string]bool{},
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to answer requests, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "responses_total",
+			Help:      "Responses sent, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "errors_total",
+			Help:      "Errors answered, by error and status code. Unexpected errors count as internal.",
+		}, []string{"error", "code"}),
+		tenants: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "tenant_requests_total",
+			Help:      "Requests received, by Fiware-Service, once past the credentials check.",
+		}, []string{"tenant"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "requests_in_flight",
+			Help:      "Requests being served.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.duration, m.responses, m.errors, m.tenants, m.inFlight,
+		// the driver keeps the count of sockets for the whole process
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "mongo",
+			Name:      "sockets_in_use",
+			Help:      "Sockets to MongoDB in use, in the whole process.",
+		}, func() float64 { return float64(driverStats().SocketsInUse) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "mongo",
+			Name:      "sockets_alive",
+			Help:      "Sockets to MongoDB open, in use or idle in the pool, in the whole process.",
+		}, func() float64 { return float64(driverStats().SocketsAlive) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// registerStore adds the metrics of st, which may be shared with other servers
+func (m *serverMetrics) registerStore(st *Store) {
+	if st == nil || st.ops == nil {
+		return
+	}
+	for _, c := range []prometheus.Collector{st.ops, st.recordFailures} {
+		err := m.registry.Register(c)
+		var already prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &already) {
+			panic(err)
+		}
+	}
+}
+
+// observe records a request answered, to route with status after duration.
+// err is the error answered, if any.
+func (m *serverMetrics) observe(route, method, tenant string, status int, duration time.Duration, err error) {
+	code := strconv.Itoa(status)
+	m.duration.WithLabelValues(route, method).Observe(duration.Seconds())
+	m.responses.WithLabelValues(route, method, code).Inc()
+	m.tenants.WithLabelValues(m.tenantLabel(tenant)).Inc()
+	if err != nil {
+		m.errors.WithLabelValues(errorType(err), code).Inc()
+	}
+}
+
+// tenantLabel is the label of tenant, which is told by a header, so only the
+// first maxTenantCounts tenants are labeled by name, the rest as otherTenants
+func (m *serverMetrics) tenantLabel(tenant string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.tenantLabels[tenant] {
+		if len(m.tenantLabels) >= maxTenantCounts {
+			return otherTenants
+		}
+		m.tenantLabels[tenant] = true
+	}
+	return tenant
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// metricsHandleF serves the metrics, to the same credentials and limits as
+// the other server-wide routes
+func metricsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	args.srv.metrics.handler().ServeHTTP(args.w, args.req)
+	return nil, nil
+}
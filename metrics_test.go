@@ -0,0 +1,55 @@
+package gorrion
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerMetrics_TenantLabel(t *testing.T) {
+	m := newServerMetrics()
+	for i := 0; i < maxTenantCounts; i++ {
+		m.tenantLabel(fmt.Sprintf("t%d", i))
+	}
+	if got := m.tenantLabel("t0"); got != "t0" {
+		t.Error(gotWanted(got, "t0"))
+	}
+	if got := m.tenantLabel("one-too-many"); got != otherTenants {
+		t.Error(gotWanted(got, otherTenants))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := AddHandlers()
+	req := httptest.NewRequest("GET", "/health/live", nil)
+	req.Header.Set(headerService, "tenant1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("PUT", "/admin/log", strings.NewReader(`{"level": "verbose"}`))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal(gotWanted(w.Code, http.StatusOK))
+	}
+	body, _ := io.ReadAll(w.Body)
+	for _, wanted := range []string{
+		`gorrion_http_request_duration_seconds_count{method="GET",route="live"}`,
+		`gorrion_http_responses_total{code="200",method="GET",route="live"}`,
+		`gorrion_http_responses_total{code="400",method="PUT",route="setLogLevel"}`,
+		`gorrion_http_errors_total{code="400",error="invalid log level"}`,
+		`gorrion_http_tenant_requests_total{tenant="tenant1"}`,
+		// the scrape itself
+		`gorrion_http_requests_in_flight 1`,
+		`gorrion_mongo_sockets_in_use`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), wanted) {
+			t.Errorf("missing %s", wanted)
+		}
+	}
+}
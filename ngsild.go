@@ -0,0 +1,553 @@
+package gorrion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The NGSI-LD API works on the same entities as NGSIv2, so entities created
+// through either of them can be read and updated through the other.
+//
+// Names of types, attributes and sub-attributes are stored as the terms of the
+// context of the server, set in Config.NGSILDContextFile, those of the default
+// vocabulary as they are. NGSI-LD requests use their own @context, which is
+// resolved locally: the core context, the server context by the URL in
+// Config.NGSILDContextURL, or the definitions sent inline. Names a client
+// sends that the server context has no term for are rejected, names stored
+// that the context of a client has no term for are answered as IRIs.
+//
+// An NGSI-LD attribute is stored as an Attribute with:
+//
+//	Property      Type from its value, as in keyValues, DateTime for an
+//	              {"@type": "DateTime", "@value": ...} value, and the value
+//	Relationship  Type Relationship and the object as the value
+//	GeoProperty   Type geo:json and the GeoJSON geometry as the value
+//
+// observedAt, unitCode and datasetId are kept in the metadata of the same
+// names, of type DateTime, Text and Text. Sub-properties and
+// sub-relationships are kept as metadata too, with the type and the value
+// their attribute would have. Attributes stored through NGSIv2 are rendered
+// the other way round: Relationship as a Relationship, geo:json and geo:point
+// as a GeoProperty and anything else as a Property. NGSIv2 ids are not
+// required to be URIs and are answered as they are.
+
+const (
+	contentTypeLDJSON = "application/ld+json"
+	// rel of the Link header with the @context of a request or a response
+	ldContextRel = "http://www.w3.org/ns/json-ld#context"
+
+	headerLDTenant       = "NGSILD-Tenant"
+	headerLDResultsCount = "NGSILD-Results-Count"
+
+	ldContextField = "@context"
+	ldObjectField  = "object"
+
+	ldProperty     = "Property"
+	ldRelationship = "Relationship"
+	ldGeoProperty  = "GeoProperty"
+
+	attrTypeRelationship = "Relationship"
+	attrTypeDateTime     = "DateTime"
+
+	mdObservedAt = "observedAt"
+	mdUnitCode   = "unitCode"
+	mdDatasetID  = "datasetId"
+)
+
+// ldTenant takes the tenant of an NGSI-LD request, in NGSILD-Tenant, as its
+// service for the rest of the server
+func ldTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if t := req.Header.Get(headerLDTenant); t != "" && req.Header.Get(headerService) == "" {
+			req.Header.Set(headerService, t)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// ldMapping turns entities as stored into NGSI-LD ones, with the terms of the
+// context of a request, and back
+type ldMapping struct {
+	req, server *ldContext
+}
+
+// storedName returns how the name sent is stored, failing if the server
+// context has no term for it
+func (m ldMapping) storedName(name string) (string, error) {
+	iri := m.req.expand(name)
+	stored := m.server.compact(iri)
+	if stored == iri && strings.Contains(iri, ":") {
+		return "", ErrUnknownLDTerm
+	}
+	return stored, nil
+}
+
+// queryNames returns how the names sent are stored, those with no term as
+// they are, as nothing stored will match them
+func (m ldMapping) queryNames(names []string) []string {
+	var stored []string
+	for _, name := range names {
+		stored = append(stored, m.server.compact(m.req.expand(name)))
+	}
+	return stored
+}
+
+// ldName returns how the name stored is sent
+func (m ldMapping) ldName(stored string) string {
+	return m.req.compact(m.server.expand(stored))
+}
+
+// fromLD returns the entity of the NGSI-LD object o
+func (m ldMapping) fromLD(o object) (*Entity, error) {
+	id, ok := o[idField]
+	if !ok {
+		return nil, ErrMissingEntityId
+	}
+	eID := EntityID{}
+	if eID.ID, ok = id.(string); !ok {
+		return nil, ErrIdNotAString
+	}
+	if u, err := url.Parse(eID.ID); err != nil || u.Scheme == "" {
+		return nil, ErrInvalidLDID
+	}
+	t, ok := o[typeField]
+	if !ok {
+		return nil, ErrEmptyEntityType
+	}
+	typ, ok := t.(string)
+	if !ok {
+		return nil, ErrTypeNotAString
+	}
+	var err error
+	if eID.Type, err = m.storedName(typ); err != nil {
+		return nil, err
+	}
+	e := NewEntity(eID)
+	if e.Attrs, err = m.attrsFromLD(o); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// attrsFromLD returns the attributes of the NGSI-LD object o, an entity or a
+// fragment of one
+func (m ldMapping) attrsFromLD(o object) (map[string]Attribute, error) {
+	attrs := map[string]Attribute{}
+	for name, v := range o {
+		switch name {
+		case idField, typeField, ldContextField, "createdAt", "modifiedAt", "scope":
+			continue
+		}
+		stored, err := m.storedName(name)
+		if err != nil {
+			return nil, err
+		}
+		a, err := m.attrFromLD(v)
+		if err != nil {
+			return nil, err
+		}
+		attrs[stored] = *a
+	}
+	return attrs, nil
+}
+
+// attrFromLD returns the attribute of the NGSI-LD attribute v
+func (m ldMapping) attrFromLD(v interface{}) (*Attribute, error) {
+	o, ok := v.(map[string]interface{})
+	if !ok {
+		// as a single instance only
+		return nil, ErrInvalidLDAttr
+	}
+	a := &Attribute{Md: map[string]interface{}{}}
+	switch o[attrTypeField] {
+	case ldProperty:
+		value, ok := o[attrValueField]
+		if !ok {
+			return nil, ErrMissingValueField
+		}
+		if dt, ok := value.(map[string]interface{}); ok && dt["@type"] == attrTypeDateTime {
+			a.Type, a.Value = attrTypeDateTime, dt["@value"]
+		} else {
+			a.Type, a.Value = AttributeFromKeyValue(value).Type, value
+		}
+	case ldRelationship:
+		obj, ok := o[ldObjectField].(string)
+		if !ok {
+			return nil, ErrInvalidLDAttr
+		}
+		a.Type, a.Value = attrTypeRelationship, obj
+	case ldGeoProperty:
+		value, ok := o[attrValueField].(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidLDAttr
+		}
+		a.Type, a.Value = attrTypeGeoJSON, value
+	default:
+		return nil, ErrInvalidLDAttr
+	}
+	for name, v := range o {
+		switch name {
+		case attrTypeField, attrValueField, ldObjectField, "createdAt", "modifiedAt", "instanceId":
+		case mdObservedAt:
+			a.Md[name] = map[string]interface{}{attrTypeField: attrTypeDateTime, attrValueField: v}
+		case mdUnitCode, mdDatasetID:
+			a.Md[name] = map[string]interface{}{attrTypeField: "Text", attrValueField: v}
+		default:
+			stored, err := m.storedName(name)
+			if err != nil {
+				return nil, err
+			}
+			sub, err := m.attrFromLD(v)
+			if err != nil {
+				return nil, err
+			}
+			a.Md[stored] = map[string]interface{}{attrTypeField: sub.Type, attrValueField: sub.Value}
+		}
+	}
+	return a, nil
+}
+
+// toLD returns the NGSI-LD object of e, simplified to the values of its
+// attributes if keyValues is set
+func (m ldMapping) toLD(e *Entity, keyValues bool) (object, error) {
+	attrs, err := normalizedAttrs(e.Attrs)
+	if err != nil {
+		return nil, err
+	}
+	o := object{idField: e.ID.ID, typeField: m.ldName(e.ID.Type)}
+	for name, a := range attrs {
+		la := m.attrToLD(a)
+		if !keyValues {
+			o[m.ldName(name)] = la
+		} else if la[attrTypeField] == ldRelationship {
+			o[m.ldName(name)] = la[ldObjectField]
+		} else {
+			o[m.ldName(name)] = la[attrValueField]
+		}
+	}
+	return o, nil
+}
+
+// attrToLD returns the NGSI-LD attribute of a
+func (m ldMapping) attrToLD(a Attribute) object {
+	la := object{}
+	switch a.Type {
+	case attrTypeRelationship:
+		la[attrTypeField], la[ldObjectField] = ldRelationship, a.Value
+	case attrTypeGeoJSON:
+		la[attrTypeField], la[attrValueField] = ldGeoProperty, a.Value
+	case attrTypeGeoPoint:
+		la[attrTypeField], la[attrValueField] = ldGeoProperty, a.Value
+		if p, ok := geoPoint(a.Value); ok {
+			la[attrValueField] = p
+		}
+	case attrTypeDateTime:
+		la[attrTypeField] = ldProperty
+		la[attrValueField] = object{"@type": attrTypeDateTime, "@value": a.Value}
+	default:
+		la[attrTypeField], la[attrValueField] = ldProperty, a.Value
+	}
+	for name, md := range a.Md {
+		sub := mdAttribute(md)
+		switch name {
+		case mdObservedAt, mdUnitCode, mdDatasetID:
+			la[name] = sub.Value
+		default:
+			la[m.ldName(name)] = m.attrToLD(sub)
+		}
+	}
+	return la
+}
+
+// ldRequest is what an NGSI-LD request adds to handlerArgs: the terms it
+// uses and how it wants its answer
+type ldRequest struct {
+	ldMapping
+	// the @context of the request, as sent, to answer with it
+	ref interface{}
+	// the client takes JSON-LD, otherwise the context goes in a Link header
+	ld bool
+}
+
+// newLDRequest takes the @context of a request from its body, from its Link
+// header otherwise, the core context if it has none
+func (srv *Server) newLDRequest(args handlerArgs) (*ldRequest, error) {
+	var ref interface{} = ldCoreContextURL
+	if v, ok := args.obj[ldContextField]; ok {
+		ref = v
+	} else if link := ldContextLink(args.req.Header.Get("Link")); link != "" {
+		ref = link
+	}
+	c, err := srv.ldContexts.resolve(ref)
+	if err != nil {
+		return nil, err
+	}
+	return &ldRequest{
+		ldMapping: ldMapping{req: c, server: srv.ldContexts.server},
+		ref:       ref,
+		ld:        strings.Contains(args.req.Header.Get("Accept"), contentTypeLDJSON),
+	}, nil
+}
+
+// ldContextLink returns the URL of the @context in the Link header h, if any
+func ldContextLink(h string) string {
+	for _, link := range strings.Split(h, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) == `rel="`+ldContextRel+`"` {
+				return target[1 : len(target)-1]
+			}
+		}
+	}
+	return ""
+}
+
+// respond writes v, an entity or a list of them, with the @context of the
+// request
+func (lr *ldRequest) respond(args handlerArgs, v interface{}) {
+	h := args.w.Header()
+	if lr.ld {
+		h.Set("Content-Type", contentTypeLDJSON)
+		switch v := v.(type) {
+		case object:
+			v[ldContextField] = lr.ref
+		case []object:
+			for _, o := range v {
+				o[ldContextField] = lr.ref
+			}
+		}
+	} else {
+		h.Set("Content-Type", contentTypeJSON)
+		// an inline context cannot be linked to
+		link, ok := lr.ref.(string)
+		if !ok {
+			link = ldCoreContextURL
+		}
+		h.Set("Link", fmt.Sprintf(`<%s>; rel="%s"; type="%s"`, link, ldContextRel, contentTypeLDJSON))
+	}
+	encoder := json.NewEncoder(args.w)
+	if args.req.FormValue("pretty") == "on" {
+		encoder.SetIndent("", "\t")
+	}
+	if err := encoder.Encode(v); err != nil {
+		// too late to tell the client
+		args.log.Error("encoding response", "error", err)
+	}
+}
+
+// ldH is cH for the NGSI-LD handlers, which answer errors as problem details
+func (srv *Server) ldH(f func(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error)) http.HandlerFunc {
+	return srv.cH(func(ctx context.Context, args handlerArgs) (interface{}, error) {
+		lr, err := srv.newLDRequest(args)
+		if err == nil {
+			var result interface{}
+			if result, err = f(ctx, args, lr); err == nil {
+				if result != nil {
+					lr.respond(args, result)
+				}
+				return nil, nil
+			}
+		}
+		return nil, &ldError{err}
+	})
+}
+
+// ldOption tells whether the options parameter of req has any of names
+func ldOption(req *http.Request, names ...string) bool {
+	for _, o := range splitParam(req, paramOptions) {
+		for _, name := range names {
+			if strings.TrimSpace(o) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ldGetEntitiesHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	q := &Query{
+		ID:        splitParam(args.req, paramID),
+		IDPattern: args.req.FormValue(paramIDPattern),
+		Type:      lr.queryNames(splitParam(args.req, paramType)),
+		Attrs:     lr.queryNames(splitParam(args.req, paramAttrs)),
+	}
+	var err error
+	if q.Limit, q.Offset, err = pageFromRequest(args.req); err != nil {
+		return nil, err
+	}
+	if q.Limit == 0 {
+		q.Limit = defaultLimit
+	} else if q.Limit > maxLimit {
+		return nil, ErrInvalidLimit
+	}
+	if args.req.FormValue("count") == "true" {
+		n, err := args.store.CountEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+		if err != nil {
+			return nil, err
+		}
+		args.w.Header().Set(headerLDResultsCount, strconv.Itoa(n))
+	}
+
+	eIter, err := args.store.GetEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer eIter.Close()
+	keyValues := ldOption(args.req, "keyValues", "simplified")
+	entities := []object{}
+	for e := (&Entity{}); eIter.Next(e); e = (&Entity{}) {
+		o, err := lr.toLD(e, keyValues)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, o)
+	}
+	if err = eIter.Err(); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+func ldPostEntitiesHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	e, err := lr.fromLD(args.obj)
+	if err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkAttrs(e.Attrs); err != nil {
+		return nil, err
+	}
+	e.ID.Service = args.ID.Service
+	e.ID.ServicePath = args.ID.ServicePath
+	// unique whatever the type
+	if _, err = findByID(ctx, args, e.ID.ID, nil); err == nil {
+		return nil, ErrExistentEntity
+	} else if err != ErrNotFoundEntity {
+		return nil, err
+	}
+	if err = args.srv.checkNewEntity(ctx, args.store, e); err != nil {
+		return nil, err
+	}
+	if err = args.store.CreateEntity(ctx, e); err != nil {
+		return nil, err
+	}
+	args.w.Header().Set("Location", "/ngsi-ld/v1/entities/"+e.ID.ID)
+	args.w.WriteHeader(201)
+	return nil, nil
+}
+
+func ldGetEntityHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	e, err := findByID(ctx, args, args.vars["id"], lr.queryNames(splitParam(args.req, paramAttrs)))
+	if err != nil {
+		return nil, err
+	}
+	return lr.toLD(e, ldOption(args.req, "keyValues", "simplified"))
+}
+
+func ldDeleteEntityHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	e, err := findByID(ctx, args, args.vars["id"], nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = args.store.DeleteEntity(ctx, e.ID); err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
+
+// ldWriteAttrs writes the attributes in the body of the request to its
+// entity with write
+func ldWriteAttrs(ctx context.Context, args handlerArgs, lr *ldRequest,
+	write func(ei EntityID, attrs map[string]Attribute) (*Entity, error)) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	attrs, err := lr.attrsFromLD(args.obj)
+	if err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkAttrs(attrs); err != nil {
+		return nil, err
+	}
+	e, err := findByID(ctx, args, args.vars["id"], nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkWrite(ctx, args.store, e.ID, attrs, false); err != nil {
+		return nil, err
+	}
+	if _, err = write(e.ID, attrs); err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
+
+func ldPostAttrsHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	return ldWriteAttrs(ctx, args, lr, func(ei EntityID, attrs map[string]Attribute) (*Entity, error) {
+		if ldOption(args.req, "noOverwrite") {
+			return args.store.AddAttrs(ctx, ei, attrs)
+		}
+		return args.store.AddOrUpdateAttrs(ctx, ei, attrs)
+	})
+}
+
+func ldPatchAttrsHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	return ldWriteAttrs(ctx, args, lr, func(ei EntityID, attrs map[string]Attribute) (*Entity, error) {
+		return args.store.UpdateAttrs(ctx, ei, attrs)
+	})
+}
+
+func ldPatchAttrHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	name, err := lr.storedName(args.vars["name"])
+	if err != nil {
+		return nil, err
+	}
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	a, err := lr.attrFromLD(map[string]interface{}(args.obj))
+	if err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkAttr(a); err != nil {
+		return nil, err
+	}
+	e, err := findByID(ctx, args, args.vars["id"], nil)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]Attribute{name: *a}
+	if err = args.srv.checkWrite(ctx, args.store, e.ID, attrs, false); err != nil {
+		return nil, err
+	}
+	if _, err = args.store.UpdateAttrs(ctx, e.ID, attrs); err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
+
+func ldDeleteAttrHandleF(ctx context.Context, args handlerArgs, lr *ldRequest) (interface{}, error) {
+	e, err := findByID(ctx, args, args.vars["id"], nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = args.store.DeleteAttr(ctx, e.ID, lr.queryNames([]string{args.vars["name"]})[0]); err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
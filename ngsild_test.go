@@ -0,0 +1,367 @@
+package gorrion
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testLDContextURL = "https://example.com/context.jsonld"
+
+func testLDContexts(t *testing.T) *ldContexts {
+	lc, err := loadLDContexts("testdata/context.jsonld", testLDContextURL)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return lc
+}
+
+func TestLDContext_Terms(t *testing.T) {
+	c := testLDContexts(t).server
+	var cases = []struct{ name, iri string }{
+		{"speed", "https://smartdatamodels.org/speed"},
+		{"brandName", "https://schema.org/brand"},
+		{"location", ldCoreBase + "location"},
+		{"temperature", ldDefaultVocab + "temperature"},
+		{"https://example.com/other", "https://example.com/other"},
+	}
+	for _, cs := range cases {
+		if got := c.expand(cs.name); got != cs.iri {
+			t.Error(gotWanted(got, cs.iri))
+		}
+		if got := c.compact(cs.iri); got != cs.name {
+			t.Error(gotWanted(got, cs.name))
+		}
+	}
+	// compact IRIs too
+	if got := c.expand("schema:color"); got != "https://schema.org/color" {
+		t.Error(gotWanted(got, "https://schema.org/color"))
+	}
+}
+
+func TestLDContexts_Resolve(t *testing.T) {
+	lc := testLDContexts(t)
+	var cases = []struct {
+		ref    interface{}
+		term   string
+		iri    string
+		wanted error
+	}{
+		{ldCoreContextURL, "speed", ldDefaultVocab + "speed", nil},
+		{testLDContextURL, "speed", "https://smartdatamodels.org/speed", nil},
+		{map[string]interface{}{"speed": "https://example.com/speed"}, "speed", "https://example.com/speed", nil},
+		{[]interface{}{testLDContextURL, map[string]interface{}{"velocity": "sdm:speed"}},
+			"velocity", "https://smartdatamodels.org/speed", nil},
+		{"https://example.com/unknown.jsonld", "", "", ErrLDContextNotAvailable},
+		{map[string]interface{}{"speed": 1.0}, "", "", ErrInvalidLDContext},
+		{1.0, "", "", ErrInvalidLDContext},
+	}
+	for _, cs := range cases {
+		c, err := lc.resolve(cs.ref)
+		if err != cs.wanted {
+			t.Errorf("%v: %s", cs.ref, gotWanted(err, cs.wanted))
+			continue
+		}
+		if err == nil {
+			if got := c.expand(cs.term); got != cs.iri {
+				t.Errorf("%v: %s", cs.ref, gotWanted(got, cs.iri))
+			}
+		}
+	}
+}
+
+func TestLDContextLink(t *testing.T) {
+	var cases = []struct{ header, wanted string }{
+		{"", ""},
+		{`<https://example.com/context.jsonld>; rel="http://www.w3.org/ns/json-ld#context"; type="application/ld+json"`,
+			"https://example.com/context.jsonld"},
+		{`<https://example.com/next>; rel="next", <https://example.com/c.jsonld>; rel="http://www.w3.org/ns/json-ld#context"`,
+			"https://example.com/c.jsonld"},
+		{`<https://example.com/next>; rel="next"`, ""},
+	}
+	for _, c := range cases {
+		if got := ldContextLink(c.header); got != c.wanted {
+			t.Error(gotWanted(got, c.wanted))
+		}
+	}
+}
+
+func testLDMapping(t *testing.T, ref interface{}) ldMapping {
+	lc := testLDContexts(t)
+	c, err := lc.resolve(ref)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return ldMapping{req: c, server: lc.server}
+}
+
+func TestLDMapping_RoundTrip(t *testing.T) {
+	m := testLDMapping(t, map[string]interface{}{"velocity": "https://smartdatamodels.org/speed"})
+	var o object
+	json.Unmarshal([]byte(`{
+		"id": "urn:ngsi-ld:Vehicle:A4567",
+		"type": "https://smartdatamodels.org/Vehicle",
+		"velocity": {"type": "Property", "value": 55, "unitCode": "KMH",
+			"observedAt": "2026-10-19T08:00:00Z",
+			"reliability": {"type": "Property", "value": 0.9}},
+		"parkedIn": {"type": "Relationship", "object": "urn:ngsi-ld:Parking:P1"},
+		"location": {"type": "GeoProperty", "value": {"type": "Point", "coordinates": [2.18, 41.37]}},
+		"serviced": {"type": "Property", "value": {"@type": "DateTime", "@value": "2026-01-01T00:00:00Z"}}
+	}`), &o)
+	e, err := m.fromLD(o)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if wanted := (EntityID{ID: "urn:ngsi-ld:Vehicle:A4567", Type: "Vehicle"}); e.ID != wanted {
+		t.Error(gotWanted(e.ID, wanted))
+	}
+	wanted := map[string]Attribute{
+		"speed": {Type: "Number", Value: 55.0, Md: map[string]interface{}{
+			"unitCode":    map[string]interface{}{"type": "Text", "value": "KMH"},
+			"observedAt":  map[string]interface{}{"type": "DateTime", "value": "2026-10-19T08:00:00Z"},
+			"reliability": map[string]interface{}{"type": "Number", "value": 0.9},
+		}},
+		"parkedIn": {Type: "Relationship", Value: "urn:ngsi-ld:Parking:P1", Md: map[string]interface{}{}},
+		"location": {Type: "geo:json", Value: map[string]interface{}{"type": "Point", "coordinates": []interface{}{2.18, 41.37}},
+			Md: map[string]interface{}{}},
+		"serviced": {Type: "DateTime", Value: "2026-01-01T00:00:00Z", Md: map[string]interface{}{}},
+	}
+	if !equalObjects(e.Attrs, wanted) {
+		t.Error(gotWanted(e.Attrs, wanted))
+	}
+
+	// and back, with the terms of the request
+	got, err := m.toLD(e, false)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	o[typeField] = "https://smartdatamodels.org/Vehicle"
+	if !equalObjects(got, o) {
+		t.Error(gotWanted(got, o))
+	}
+
+	kv, err := m.toLD(e, true)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if kv["velocity"] != 55.0 || kv["parkedIn"] != "urn:ngsi-ld:Parking:P1" {
+		t.Error(gotWanted(kv, "simplified values"))
+	}
+}
+
+func TestLDMapping_FromV2(t *testing.T) {
+	m := testLDMapping(t, testLDContextURL)
+	e := NewEntity(EntityID{ID: "Car1", Type: "Vehicle"})
+	e.Attrs["speed"] = Attribute{Type: "Number", Value: 55.0,
+		Md: map[string]interface{}{"accuracy": map[string]interface{}{"type": "Number", "value": 0.5}}}
+	e.Attrs["position"] = Attribute{Type: attrTypeGeoPoint, Value: "41.37, 2.18"}
+	e.Attrs["owner"] = Attribute{Type: attrTypeRelationship, Value: "urn:ngsi-ld:Person:P1"}
+	got, err := m.toLD(e, false)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := object{
+		"id":   "Car1",
+		"type": "Vehicle",
+		"speed": object{"type": "Property", "value": 55.0,
+			"accuracy": object{"type": "Property", "value": 0.5}},
+		"position": object{"type": "GeoProperty", "value": object{"type": "Point", "coordinates": []float64{2.18, 41.37}}},
+		"owner":    object{"type": "Relationship", "object": "urn:ngsi-ld:Person:P1"},
+	}
+	if !equalObjects(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+}
+
+func TestLDMapping_Invalid(t *testing.T) {
+	m := testLDMapping(t, ldCoreContextURL)
+	var cases = []struct {
+		entity string
+		wanted error
+	}{
+		{`{"type": "Vehicle"}`, ErrMissingEntityId},
+		{`{"id": "A4567", "type": "Vehicle"}`, ErrInvalidLDID},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567"}`, ErrEmptyEntityType},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": ["Vehicle"]}`, ErrTypeNotAString},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "https://example.com/Vehicle"}`, ErrUnknownLDTerm},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle", "speed": 55}`, ErrInvalidLDAttr},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle", "speed": [{"type": "Property", "value": 55}]}`,
+			ErrInvalidLDAttr},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle", "speed": {"type": "Property"}}`, ErrMissingValueField},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle", "owner": {"type": "Relationship", "value": "P1"}}`,
+			ErrInvalidLDAttr},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle", "location": {"type": "GeoProperty", "value": "41,2"}}`,
+			ErrInvalidLDAttr},
+	}
+	for _, c := range cases {
+		var o object
+		if err := json.Unmarshal([]byte(c.entity), &o); err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if _, err := m.fromLD(o); err != c.wanted {
+			t.Errorf("%s: %s", c.entity, gotWanted(err, c.wanted))
+		}
+	}
+}
+
+func TestNGSILD_Errors(t *testing.T) {
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var cases = []struct {
+		body, link string
+		status     int
+		problem    string
+	}{
+		{`{"id": "A4567", "type": "Vehicle"}`, "", http.StatusBadRequest, "BadRequestData"},
+		{`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle"}`,
+			`<https://example.com/unknown.jsonld>; rel="` + ldContextRel + `"`,
+			http.StatusServiceUnavailable, "LdContextNotAvailable"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/ngsi-ld/v1/entities/", bytes.NewReader([]byte(c.body)))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		if c.link != "" {
+			req.Header.Set("Link", c.link)
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Error(gotWanted(w.Code, c.status))
+		}
+		var problem map[string]string
+		json.Unmarshal(w.Body.Bytes(), &problem)
+		if wanted := ldErrorsBase + c.problem; problem["type"] != wanted {
+			t.Error(gotWanted(problem["type"], wanted))
+		}
+	}
+}
+
+func TestNGSILD_Entities(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.NGSILDContextFile = "testdata/context.jsonld"
+	c.NGSILDContextURL = testLDContextURL
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+
+	do := func(method, path, contentType, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if body != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+	link := `<` + testLDContextURL + `>; rel="` + ldContextRel + `"`
+
+	// created through NGSI-LD, read through NGSIv2
+	w := do("POST", "/ngsi-ld/v1/entities/", contentTypeLDJSON, `{
+		"@context": "`+testLDContextURL+`",
+		"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Vehicle",
+		"speed": {"type": "Property", "value": 55, "unitCode": "KMH"},
+		"brandName": {"type": "Property", "value": "Mercedes"}
+	}`, headerLDTenant, "smartcity")
+	if w.Code != http.StatusCreated {
+		t.Fatal(gotWanted(w.Code, http.StatusCreated), w.Body.String())
+	}
+	if got, wanted := w.Header().Get("Location"), "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567"; got != wanted {
+		t.Error(gotWanted(got, wanted))
+	}
+	w = do("GET", "/v2/entities/urn:ngsi-ld:Vehicle:A4567?type=Vehicle&options=keyValues", "", "",
+		headerService, "smartcity")
+	var kv object
+	json.Unmarshal(w.Body.Bytes(), &kv)
+	if kv["speed"] != 55.0 || kv["brandName"] != "Mercedes" {
+		t.Error(gotWanted(kv, "speed and brandName"))
+	}
+	// ids are unique whatever the type
+	w = do("POST", "/ngsi-ld/v1/entities/", contentTypeJSON,
+		`{"id": "urn:ngsi-ld:Vehicle:A4567", "type": "Car"}`, headerLDTenant, "smartcity")
+	if w.Code != http.StatusConflict {
+		t.Error(gotWanted(w.Code, http.StatusConflict))
+	}
+
+	// created through NGSIv2, read through NGSI-LD with the core context
+	w = do("POST", "/v2/entities/", contentTypeJSON, `{"id": "Room1", "type": "Room",
+		"temperature": {"value": 21, "type": "Number"}}`, headerService, "smartcity")
+	if w.Code != http.StatusCreated {
+		t.Fatal(gotWanted(w.Code, http.StatusCreated))
+	}
+	w = do("GET", "/ngsi-ld/v1/entities/Room1", "", "", headerLDTenant, "smartcity", "Accept", contentTypeLDJSON)
+	if got := w.Header().Get("Content-Type"); got != contentTypeLDJSON {
+		t.Error(gotWanted(got, contentTypeLDJSON))
+	}
+	var o object
+	json.Unmarshal(w.Body.Bytes(), &o)
+	wanted := object{"@context": ldCoreContextURL, "id": "Room1", "type": "Room",
+		"temperature": object{"type": "Property", "value": 21.0}}
+	if !equalObjects(o, wanted) {
+		t.Error(gotWanted(o, wanted))
+	}
+
+	// terms of the server context, as IRIs for a client without them
+	w = do("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567?options=keyValues", "", "",
+		headerLDTenant, "smartcity")
+	json.Unmarshal(w.Body.Bytes(), &o)
+	if o["type"] != "https://smartdatamodels.org/Vehicle" || o["https://schema.org/brand"] != "Mercedes" {
+		t.Error(gotWanted(o, "expanded names"))
+	}
+	if got := w.Header().Get("Link"); !strings.Contains(got, ldCoreContextURL) {
+		t.Error(gotWanted(got, ldCoreContextURL))
+	}
+
+	// listed by type, with the terms of the client
+	w = do("GET", "/ngsi-ld/v1/entities/?type=Vehicle&count=true", "", "",
+		headerLDTenant, "smartcity", "Link", link)
+	var list []object
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 1 || list[0]["id"] != "urn:ngsi-ld:Vehicle:A4567" || w.Header().Get(headerLDResultsCount) != "1" {
+		t.Error(gotWanted(list, "the vehicle"))
+	}
+
+	// updated and deleted
+	w = do("PATCH", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567/attrs/speed", contentTypeJSON,
+		`{"type": "Property", "value": 60}`, headerLDTenant, "smartcity", "Link", link)
+	if w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	w = do("POST", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567/attrs", contentTypeJSON,
+		`{"isParked": {"type": "Relationship", "object": "urn:ngsi-ld:Parking:P1"}}`,
+		headerLDTenant, "smartcity", "Link", link)
+	if w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	attr, err := srv.Store().GetAttr(testCtx, EntityID{ID: "urn:ngsi-ld:Vehicle:A4567", Type: "Vehicle",
+		Service: "smartcity"}, "isParked")
+	if err != nil || attr.Type != attrTypeRelationship {
+		t.Error(gotWanted(attr, attrTypeRelationship), unexpected(err))
+	}
+	w = do("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567/attrs/brandName", "", "",
+		headerLDTenant, "smartcity", "Link", link)
+	if w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	w = do("DELETE", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567", "", "", headerLDTenant, "smartcity")
+	if w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	w = do("GET", "/ngsi-ld/v1/entities/urn:ngsi-ld:Vehicle:A4567", "", "", headerLDTenant, "smartcity")
+	if w.Code != http.StatusNotFound {
+		t.Error(gotWanted(w.Code, http.StatusNotFound))
+	}
+}
@@ -0,0 +1,421 @@
+package gorrion
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The NGSIv1 endpoints are kept for the clients that have not moved to
+// NGSIv2, over the same entities. Attributes are stored as they are sent,
+// with their metadatas as metadata of the same names, so they read the same
+// through both APIs. As in NGSIv1 brokers, the errors of each context element
+// are told in its statusCode, and those of the whole request in an errorCode.
+
+// update actions of /v1/updateContext
+const (
+	v1Append       = "APPEND"
+	v1AppendStrict = "APPEND_STRICT"
+	v1Update       = "UPDATE"
+	v1Delete       = "DELETE"
+)
+
+// reasonPhrase of the entities that are not found, as NGSIv1 has it
+const v1NotFound = "No context element found"
+
+// v1Bool is true or false, sent as a string, as in "isPattern": "true"
+type v1Bool bool
+
+func (b v1Bool) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatBool(bool(b)))
+}
+
+func (b *v1Bool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v {
+	case true, "true":
+		*b = true
+	case false, "false", nil, "":
+		*b = false
+	default:
+		return ErrInvalidV1Request
+	}
+	return nil
+}
+
+type v1Metadata struct {
+	Name  string      `json:"name"`
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+type v1Attribute struct {
+	Name      string       `json:"name"`
+	Type      string       `json:"type,omitempty"`
+	Value     interface{}  `json:"value"`
+	Metadatas []v1Metadata `json:"metadatas,omitempty"`
+}
+
+type v1ContextElement struct {
+	Type       string        `json:"type"`
+	IsPattern  v1Bool        `json:"isPattern"`
+	ID         string        `json:"id"`
+	Attributes []v1Attribute `json:"attributes,omitempty"`
+}
+
+type v1StatusCode struct {
+	Code         string `json:"code"`
+	ReasonPhrase string `json:"reasonPhrase"`
+	Details      string `json:"details,omitempty"`
+}
+
+type v1ContextResponse struct {
+	ContextElement v1ContextElement `json:"contextElement"`
+	StatusCode     v1StatusCode     `json:"statusCode"`
+}
+
+type v1UpdateContextRequest struct {
+	ContextElements []v1ContextElement `json:"contextElements"`
+	UpdateAction    string             `json:"updateAction"`
+}
+
+type v1QueryContextRequest struct {
+	Entities   []v1ContextElement `json:"entities"`
+	Attributes []string           `json:"attributes"`
+}
+
+// v1Status returns the statusCode of err, OK if nil
+func v1Status(err error) v1StatusCode {
+	if err == nil {
+		return v1StatusCode{Code: "200", ReasonPhrase: "OK"}
+	}
+	status := errStatus(err)
+	sc := v1StatusCode{Code: strconv.Itoa(status), ReasonPhrase: http.StatusText(status), Details: err.Error()}
+	if err == ErrNotFoundEntity {
+		sc.ReasonPhrase = v1NotFound
+	}
+	return sc
+}
+
+// v1NotFoundResponse is the answer to a query that found nothing
+func v1NotFoundResponse() object {
+	return object{"errorCode": v1StatusCode{Code: "404", ReasonPhrase: v1NotFound}}
+}
+
+// attrs returns the attributes of ce, with their metadatas as metadata
+func (ce *v1ContextElement) attrs() map[string]Attribute {
+	m := map[string]Attribute{}
+	for _, a := range ce.Attributes {
+		attr := Attribute{Type: a.Type, Value: a.Value}
+		if len(a.Metadatas) > 0 {
+			attr.Md = map[string]interface{}{}
+			for _, md := range a.Metadatas {
+				attr.Md[md.Name] = map[string]interface{}{attrTypeField: md.Type, attrValueField: md.Value}
+			}
+		}
+		m[a.Name] = attr
+	}
+	return m
+}
+
+// entityID returns the id of the entity of ce, of the service of the request,
+// with the default type if it has none
+func (ce *v1ContextElement) entityID(args handlerArgs) EntityID {
+	ei := EntityID{ID: ce.ID, Type: ce.Type, Service: args.ID.Service, ServicePath: args.ID.ServicePath}
+	if ei.Type == "" {
+		ei.Type = defaultEntityType
+	}
+	return ei
+}
+
+// v1Element returns the context element of e, with its attributes by name
+func v1Element(e *Entity) (v1ContextElement, error) {
+	ce := v1ContextElement{Type: e.ID.Type, ID: e.ID.ID}
+	attrs, err := normalizedAttrs(e.Attrs)
+	if err != nil {
+		return ce, err
+	}
+	for name, a := range attrs {
+		va := v1Attribute{Name: name, Type: a.Type, Value: a.Value}
+		for mdName, md := range a.Md {
+			m := mdAttribute(md)
+			va.Metadatas = append(va.Metadatas, v1Metadata{Name: mdName, Type: m.Type, Value: m.Value})
+		}
+		sort.Slice(va.Metadatas, func(i, j int) bool { return va.Metadatas[i].Name < va.Metadatas[j].Name })
+		ce.Attributes = append(ce.Attributes, va)
+	}
+	sort.Slice(ce.Attributes, func(i, j int) bool { return ce.Attributes[i].Name < ce.Attributes[j].Name })
+	return ce, nil
+}
+
+// v1H is cH for the NGSIv1 handlers, which answer errors with an errorCode
+func (srv *Server) v1H(f func(ctx context.Context, args handlerArgs) (interface{}, error)) http.HandlerFunc {
+	return srv.cH(func(ctx context.Context, args handlerArgs) (interface{}, error) {
+		result, err := f(ctx, args)
+		if err != nil {
+			return nil, &v1Error{err}
+		}
+		return result, nil
+	})
+}
+
+// v1UpdateElement applies action to the entity of ce, returning how it went
+func (srv *Server) v1UpdateElement(ctx context.Context, args handlerArgs, ce v1ContextElement, action string) v1ContextResponse {
+	err := srv.v1UpdateEntity(ctx, args, ce, action)
+	// the attributes are echoed, without their values
+	echo := v1ContextElement{Type: ce.Type, ID: ce.ID}
+	for _, a := range ce.Attributes {
+		echo.Attributes = append(echo.Attributes, v1Attribute{Name: a.Name, Type: a.Type, Value: ""})
+	}
+	if err != nil {
+		if _, ok := asGorrionErr(err); !ok {
+			args.log.Error("updating context element", "error", err, "id", ce.ID)
+		}
+	}
+	return v1ContextResponse{ContextElement: echo, StatusCode: v1Status(err)}
+}
+
+func (srv *Server) v1UpdateEntity(ctx context.Context, args handlerArgs, ce v1ContextElement, action string) error {
+	if ce.ID == "" {
+		return ErrEmptyEntityID
+	}
+	if ce.IsPattern {
+		return ErrPatternUpdate
+	}
+	ei := ce.entityID(args)
+	attrs := ce.attrs()
+	if err := srv.checkAttrs(attrs); err != nil {
+		return err
+	}
+	switch action {
+	case v1Append, v1AppendStrict:
+		if err := srv.checkWrite(ctx, args.store, ei, attrs, false); err != nil {
+			return err
+		}
+		var err error
+		if action == v1AppendStrict {
+			_, err = args.store.AddAttrs(ctx, ei, attrs)
+		} else {
+			_, err = args.store.AddOrUpdateAttrs(ctx, ei, attrs)
+		}
+		if err != ErrNotFoundEntity {
+			return err
+		}
+		// appending to an entity that is not there creates it
+		if err = srv.authorizeAlso(args, opCreate); err != nil {
+			return err
+		}
+		e := NewEntity(ei)
+		e.Attrs = attrs
+		if err = srv.checkNewEntity(ctx, args.store, e); err != nil {
+			return err
+		}
+		return args.store.CreateEntity(ctx, e)
+	case v1Update:
+		if err := srv.checkWrite(ctx, args.store, ei, attrs, false); err != nil {
+			return err
+		}
+		_, err := args.store.UpdateAttrs(ctx, ei, attrs)
+		return err
+	case v1Delete:
+		if err := srv.authorizeAlso(args, opDelete); err != nil {
+			return err
+		}
+		if len(attrs) == 0 {
+			return args.store.DeleteEntity(ctx, ei)
+		}
+		for name := range attrs {
+			if _, err := args.store.DeleteAttr(ctx, ei, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrInvalidUpdateAction
+}
+
+func v1UpdateContextHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	r := &v1UpdateContextRequest{}
+	if err := decodeBody(args, r, false); err != nil {
+		return nil, ErrInvalidV1Request
+	}
+	switch r.UpdateAction {
+	case v1Append, v1AppendStrict, v1Update, v1Delete:
+	default:
+		return nil, ErrInvalidUpdateAction
+	}
+	responses := []v1ContextResponse{}
+	for _, ce := range r.ContextElements {
+		responses = append(responses, args.srv.v1UpdateElement(ctx, args, ce, r.UpdateAction))
+	}
+	return object{"contextResponses": responses}, nil
+}
+
+func v1QueryContextHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	r := &v1QueryContextRequest{}
+	if err := decodeBody(args, r, false); err != nil {
+		return nil, ErrInvalidV1Request
+	}
+	if len(r.Entities) == 0 {
+		return nil, ErrInvalidV1Request
+	}
+	limit, offset, err := pageFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = defaultLimit
+	} else if limit > maxLimit {
+		return nil, ErrInvalidLimit
+	}
+
+	// the entities of all the selectors, each once, in order
+	var found []*Entity
+	seen := map[EntityID]bool{}
+	add := func(e *Entity) {
+		if !seen[e.ID] {
+			seen[e.ID] = true
+			found = append(found, e)
+		}
+	}
+	for _, sel := range r.Entities {
+		if len(found) >= offset+limit {
+			break
+		}
+		if !sel.IsPattern && sel.Type != "" {
+			e, err := args.store.GetEntityAttrs(ctx, sel.entityID(args), r.Attributes)
+			if err == ErrNotFoundEntity {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(e)
+			continue
+		}
+		q := &Query{Attrs: r.Attributes, Limit: offset + limit - len(found)}
+		if sel.IsPattern {
+			q.IDPattern = sel.ID
+		} else {
+			q.ID = []string{sel.ID}
+		}
+		if sel.Type != "" {
+			q.Type = []string{sel.Type}
+		}
+		eIter, err := args.store.GetEntities(ctx, q, args.ID.Service, args.ID.ServicePath)
+		if err != nil {
+			return nil, err
+		}
+		for e := (&Entity{}); eIter.Next(e); e = (&Entity{}) {
+			add(e)
+		}
+		if err = eIter.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if offset >= len(found) {
+		return v1NotFoundResponse(), nil
+	}
+	found = found[offset:]
+	if len(found) > limit {
+		found = found[:limit]
+	}
+	responses := []v1ContextResponse{}
+	for _, e := range found {
+		ce, err := v1Element(e)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, v1ContextResponse{ContextElement: ce, StatusCode: v1Status(nil)})
+	}
+	return object{"contextResponses": responses}, nil
+}
+
+// v1GetContextEntityHandleF answers the entity, of the type parameter of the
+// request if any, with the status code of its statusCode
+func v1GetContextEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	id := args.vars["id"]
+	var (
+		e   *Entity
+		err error
+	)
+	if t := args.req.FormValue(paramType); t != "" {
+		e, err = args.store.GetEntityAttrs(ctx, EntityID{ID: id, Type: t, Service: args.ID.Service, ServicePath: args.ID.ServicePath}, nil)
+	} else {
+		e, err = findByID(ctx, args, id, nil)
+	}
+	if err == ErrNotFoundEntity {
+		args.w.WriteHeader(http.StatusNotFound)
+		return v1ContextResponse{ContextElement: v1ContextElement{ID: id}, StatusCode: v1Status(err)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ce, err := v1Element(e)
+	if err != nil {
+		return nil, err
+	}
+	return v1ContextResponse{ContextElement: ce, StatusCode: v1Status(nil)}, nil
+}
+
+// v1WriteContextEntity applies action to the entity of the request, of the
+// type parameter if any, the stored one otherwise, with the attributes in ce
+func v1WriteContextEntity(ctx context.Context, args handlerArgs, ce v1ContextElement, action string) (v1ContextResponse, error) {
+	ce.ID, ce.IsPattern = args.vars["id"], false
+	if t := args.req.FormValue(paramType); t != "" {
+		ce.Type = t
+	} else {
+		e, err := findByID(ctx, args, ce.ID, nil)
+		if err != nil && err != ErrNotFoundEntity {
+			return v1ContextResponse{}, err
+		}
+		if e != nil {
+			ce.Type = e.ID.Type
+		}
+	}
+	return args.srv.v1UpdateElement(ctx, args, ce, action), nil
+}
+
+// v1AttrsContextEntity applies action to the entity of the request with the
+// attributes in its body
+func v1AttrsContextEntity(ctx context.Context, args handlerArgs, action string) (interface{}, error) {
+	if args.obj == nil {
+		return nil, ErrEmptyObject
+	}
+	ce := v1ContextElement{}
+	if err := decodeBody(args, &ce, false); err != nil {
+		return nil, ErrInvalidV1Request
+	}
+	r, err := v1WriteContextEntity(ctx, args, ce, action)
+	if err != nil {
+		return nil, err
+	}
+	return object{"contextResponses": []v1ContextResponse{r}}, nil
+}
+
+func v1AppendContextEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	return v1AttrsContextEntity(ctx, args, v1Append)
+}
+
+func v1UpdateContextEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	return v1AttrsContextEntity(ctx, args, v1Update)
+}
+
+func v1DeleteContextEntityHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	r, err := v1WriteContextEntity(ctx, args, v1ContextElement{}, v1Delete)
+	if err != nil {
+		return nil, err
+	}
+	return r.StatusCode, nil
+}
@@ -0,0 +1,220 @@
+package gorrion
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestV1Bool(t *testing.T) {
+	var cases = []struct {
+		data   string
+		wanted v1Bool
+		err    bool
+	}{
+		{`"true"`, true, false},
+		{`true`, true, false},
+		{`"false"`, false, false},
+		{`""`, false, false},
+		{`null`, false, false},
+		{`"yes"`, false, true},
+		{`1`, false, true},
+	}
+	for _, c := range cases {
+		var b v1Bool
+		err := json.Unmarshal([]byte(c.data), &b)
+		if (err != nil) != c.err {
+			t.Errorf("%s: %s", c.data, unexpected(err))
+		}
+		if b != c.wanted {
+			t.Errorf("%s: %s", c.data, gotWanted(b, c.wanted))
+		}
+	}
+	data, err := json.Marshal(v1ContextElement{IsPattern: true})
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if wanted := `{"type":"","isPattern":"true","id":""}`; string(data) != wanted {
+		t.Error(gotWanted(string(data), wanted))
+	}
+}
+
+func TestV1Element_RoundTrip(t *testing.T) {
+	ce := v1ContextElement{Type: "Room", ID: "Room1", Attributes: []v1Attribute{
+		{Name: "pressure", Type: "integer", Value: "720"},
+		{Name: "temperature", Type: "float", Value: "23", Metadatas: []v1Metadata{
+			{Name: "accuracy", Type: "float", Value: "0.8"},
+			{Name: "unit", Type: "string", Value: "celsius"},
+		}},
+	}}
+	attrs := ce.attrs()
+	if md, ok := attrs["temperature"].Md["unit"].(map[string]interface{}); !ok || md[attrValueField] != "celsius" {
+		t.Error(gotWanted(attrs["temperature"].Md, "unit as metadata"))
+	}
+	e := NewEntity(EntityID{ID: "Room1", Type: "Room"})
+	e.Attrs = attrs
+	got, err := v1Element(e)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !reflect.DeepEqual(got, ce) {
+		t.Error(gotWanted(got, ce))
+	}
+}
+
+func TestV1Status(t *testing.T) {
+	var cases = []struct {
+		err    error
+		wanted v1StatusCode
+	}{
+		{nil, v1StatusCode{Code: "200", ReasonPhrase: "OK"}},
+		{ErrNotFoundEntity, v1StatusCode{Code: "404", ReasonPhrase: v1NotFound, Details: ErrNotFoundEntity.Error()}},
+		{ErrPatternUpdate, v1StatusCode{Code: "400", ReasonPhrase: "Bad Request", Details: ErrPatternUpdate.Error()}},
+	}
+	for _, c := range cases {
+		if got := v1Status(c.err); got != c.wanted {
+			t.Error(gotWanted(got, c.wanted))
+		}
+	}
+}
+
+func TestNGSIv1_Errors(t *testing.T) {
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var cases = []struct {
+		path, body string
+		status     int
+	}{
+		{"/v1/updateContext", `{"contextElements": [], "updateAction": "REPLACE"}`, http.StatusBadRequest},
+		{"/v1/updateContext", `{"contextElements": {}, "updateAction": "APPEND"}`, http.StatusBadRequest},
+		{"/v1/queryContext", `{"entities": []}`, http.StatusBadRequest},
+		{"/v1/queryContext", `{"entities": [{"id": "Room1", "isPattern": "maybe"}]}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.path, bytes.NewReader([]byte(c.body)))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: %s", c.body, gotWanted(w.Code, c.status))
+		}
+		var o struct {
+			ErrorCode v1StatusCode `json:"errorCode"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &o)
+		if o.ErrorCode.Code != "400" {
+			t.Errorf("%s: %s", c.body, gotWanted(o.ErrorCode, "errorCode 400"))
+		}
+	}
+}
+
+func TestNGSIv1_Context(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if body != "" {
+			req.Header.Set("Content-Type", contentTypeJSON)
+		}
+		req.Header.Set(headerService, "gateways")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+	type responses struct {
+		ContextResponses []v1ContextResponse `json:"contextResponses"`
+		ErrorCode        *v1StatusCode       `json:"errorCode"`
+	}
+	codes := func(w *httptest.ResponseRecorder) []string {
+		var r responses
+		json.Unmarshal(w.Body.Bytes(), &r)
+		var codes []string
+		for _, cr := range r.ContextResponses {
+			codes = append(codes, cr.StatusCode.Code)
+		}
+		return codes
+	}
+
+	// appended, which creates them, read through NGSIv2
+	w := do("POST", "/v1/updateContext", `{"contextElements": [
+		{"type": "Room", "isPattern": "false", "id": "Room1", "attributes": [
+			{"name": "temperature", "type": "float", "value": "23"}]},
+		{"type": "Room", "isPattern": "true", "id": "Room.*"}
+	], "updateAction": "APPEND"}`)
+	if w.Code != http.StatusOK {
+		t.Fatal(gotWanted(w.Code, http.StatusOK), w.Body.String())
+	}
+	if got, wanted := codes(w), []string{"200", "400"}; !reflect.DeepEqual(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+	w = do("GET", "/v2/entities/Room1?type=Room&options=keyValues", "")
+	var kv object
+	json.Unmarshal(w.Body.Bytes(), &kv)
+	if kv["temperature"] != "23" {
+		t.Error(gotWanted(kv, "temperature 23"))
+	}
+
+	// strict appends do not overwrite, updates do not add
+	w = do("POST", "/v1/updateContext", `{"contextElements": [
+		{"type": "Room", "id": "Room1", "attributes": [{"name": "temperature", "type": "float", "value": "24"}]}
+	], "updateAction": "APPEND_STRICT"}`)
+	if got, wanted := codes(w), []string{"400"}; !reflect.DeepEqual(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+	w = do("POST", "/v1/updateContext", `{"contextElements": [
+		{"type": "Room", "id": "Room2", "attributes": [{"name": "temperature", "type": "float", "value": "24"}]}
+	], "updateAction": "UPDATE"}`)
+	if got, wanted := codes(w), []string{"404"}; !reflect.DeepEqual(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+
+	// queried by pattern and by id
+	w = do("POST", "/v1/queryContext", `{"entities": [{"type": "Room", "isPattern": "true", "id": "Room.*"}]}`)
+	var r responses
+	json.Unmarshal(w.Body.Bytes(), &r)
+	if len(r.ContextResponses) != 1 || r.ContextResponses[0].ContextElement.ID != "Room1" {
+		t.Error(gotWanted(r, "Room1"))
+	}
+	w = do("POST", "/v1/queryContext", `{"entities": [{"type": "Room", "id": "Room9"}]}`)
+	r = responses{}
+	json.Unmarshal(w.Body.Bytes(), &r)
+	if w.Code != http.StatusOK || r.ErrorCode == nil || r.ErrorCode.Code != "404" {
+		t.Error(gotWanted(w.Body.String(), "errorCode 404"))
+	}
+
+	// by context entity, of the type stored
+	w = do("PUT", "/v1/contextEntities/Room1", `{"attributes": [{"name": "temperature", "type": "float", "value": "25"}]}`)
+	if got, wanted := codes(w), []string{"200"}; !reflect.DeepEqual(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+	w = do("GET", "/v1/contextEntities/Room1", "")
+	var cr v1ContextResponse
+	json.Unmarshal(w.Body.Bytes(), &cr)
+	if len(cr.ContextElement.Attributes) != 1 || cr.ContextElement.Attributes[0].Value != "25" {
+		t.Error(gotWanted(cr, "temperature 25"))
+	}
+	w = do("DELETE", "/v1/contextEntities/Room1", "")
+	var sc v1StatusCode
+	json.Unmarshal(w.Body.Bytes(), &sc)
+	if sc.Code != "200" {
+		t.Error(gotWanted(sc, "200"))
+	}
+	w = do("GET", "/v1/contextEntities/Room1", "")
+	if w.Code != http.StatusNotFound {
+		t.Error(gotWanted(w.Code, http.StatusNotFound))
+	}
+}
@@ -15,6 +15,9 @@ const (
 	OptCount
 	OptUnique
 	OptAppend
+	OptUpsert
+	OptDryRun
+	OptConfirm
 	OptMaxValue
 	OptInvalid = OptMaxValue
 )
@@ -31,6 +34,12 @@ func (o Option) String() string {
 		return "unique"
 	case OptAppend:
 		return "append"
+	case OptUpsert:
+		return "upsert"
+	case OptDryRun:
+		return "dryRun"
+	case OptConfirm:
+		return "confirm"
 	default:
 		return "invalidOption"
 	}
@@ -47,6 +56,12 @@ func ParseOpt(s string) Option {
 		return OptUnique
 	case "append":
 		return OptAppend
+	case "upsert":
+		return OptUpsert
+	case "dryRun":
+		return OptDryRun
+	case "confirm":
+		return OptConfirm
 	default:
 		return OptInvalid
 	}
@@ -12,6 +12,9 @@ func TestParseOpt(t *testing.T) {
 		{"count", OptCount},
 		{"unique", OptUnique},
 		{"append", OptAppend},
+		{"upsert", OptUpsert},
+		{"dryRun", OptDryRun},
+		{"confirm", OptConfirm},
 		{"", OptInvalid},
 		{"x", OptInvalid},
 	}
@@ -33,6 +36,9 @@ func TestOption_String(t *testing.T) {
 		{"count", OptCount},
 		{"unique", OptUnique},
 		{"append", OptAppend},
+		{"upsert", OptUpsert},
+		{"dryRun", OptDryRun},
+		{"confirm", OptConfirm},
 		{"invalidOption", OptInvalid},
 	}
 	for _, c := range cases {
@@ -74,6 +80,8 @@ func TestParseOptSet(t *testing.T) {
 		"count":                               {OptCount: true},
 		"unique":                              {OptUnique: true},
 		"append":                              {OptAppend: true},
+		"upsert, keyValues":                   {OptUpsert: true, OptKeyValues: true},
+		"dryRun,confirm":                      {OptDryRun: true, OptConfirm: true},
 		"append, unique":                      {OptAppend: true, OptUnique: true},
 		"unique, append":                      {OptAppend: true, OptUnique: true},
 		"unique, count, append":               {OptAppend: true, OptUnique: true, OptCount: true},
@@ -98,6 +106,7 @@ func TestOptionSet_String(t *testing.T) {
 		{OptAppend: true, OptUnique: true}:                 "[append unique]",
 		{OptAppend: true, OptUnique: true, OptCount: true}: "[append count unique]",
 		{OptValues: true, OptKeyValues: true}:              "[keyValues values]",
+		{OptUpsert: true, OptKeyValues: true}:              "[keyValues upsert]",
 	}
 
 	for optS, str := range cases {
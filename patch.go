@@ -0,0 +1,330 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to target and returns the result.
+// Objects in target are modified in place; a null member in patch deletes it.
+func MergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = MergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+type PatchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// JSONPatch is a sequence of RFC 6902 operations
+type JSONPatch []PatchOp
+
+func ParseJSONPatch(any interface{}) (JSONPatch, error) {
+	list, ok := any.([]interface{})
+	if !ok {
+		return nil, ErrPatchNotAnArray
+	}
+	patch := JSONPatch{}
+	for _, item := range list {
+		o, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidPatchOp
+		}
+		op := PatchOp{}
+		if op.Op, ok = o["op"].(string); !ok {
+			return nil, ErrInvalidPatchOp
+		}
+		if op.Path, ok = o["path"].(string); !ok {
+			return nil, ErrInvalidPatchOp
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value, ok = o["value"]; !ok {
+				return nil, ErrInvalidPatchOp
+			}
+		case "move", "copy":
+			if op.From, ok = o["from"].(string); !ok {
+				return nil, ErrInvalidPatchOp
+			}
+		case "remove":
+		default:
+			return nil, ErrInvalidPatchOp
+		}
+		patch = append(patch, op)
+	}
+	return patch, nil
+}
+
+// Apply runs the operations in order over doc. doc may be modified even when an
+// error is returned, so callers wanting all-or-nothing must pass a copy.
+func (p JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	for _, op := range p {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, path, deepCopy(op.Value))
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "replace":
+			if _, err = pointerGet(doc, path); err == nil {
+				doc, _, err = pointerRemove(doc, path)
+			}
+			if err == nil {
+				doc, err = pointerAdd(doc, path, deepCopy(op.Value))
+			}
+		case "move":
+			var from []string
+			var v interface{}
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+			if isProperPrefix(from, path) {
+				return nil, ErrInvalidPatchOp
+			}
+			if doc, v, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, v)
+			}
+		case "copy":
+			var from []string
+			var v interface{}
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+			if v, err = pointerGet(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, deepCopy(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = pointerGet(doc, path); err == nil && !reflect.DeepEqual(v, op.Value) {
+				err = ErrPatchTestFailed
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its unescaped reference tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, ErrInvalidPatchPath
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func isProperPrefix(prefix, path []string) bool {
+	if len(prefix) >= len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	// leading zeros are not allowed, "-" only makes sense for add
+	if len(token) > 1 && token[0] == '0' {
+		return 0, ErrInvalidPatchPath
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max {
+		return 0, ErrPatchPathNotFound
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[token]
+			if !ok {
+				return nil, ErrPatchPathNotFound
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, ErrPatchPathNotFound
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	token, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			c[token] = value
+			return c, nil
+		}
+		child, ok := c[token]
+		if !ok {
+			return nil, ErrPatchPathNotFound
+		}
+		child, err := pointerAdd(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		c[token] = child
+		return c, nil
+	case []interface{}:
+		if len(rest) == 0 {
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		i, err := arrayIndex(token, len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		child, err := pointerAdd(c[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = child
+		return c, nil
+	}
+	return nil, ErrPatchPathNotFound
+}
+
+func pointerRemove(doc interface{}, path []string) (result, removed interface{}, err error) {
+	if len(path) == 0 {
+		// the whole document cannot be removed
+		return nil, nil, ErrInvalidPatchPath
+	}
+	token, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[token]
+		if !ok {
+			return nil, nil, ErrPatchPathNotFound
+		}
+		if len(rest) == 0 {
+			delete(c, token)
+			return c, child, nil
+		}
+		child, removed, err = pointerRemove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[token] = child
+		return c, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(c)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), removed, nil
+		}
+		child, removed, err := pointerRemove(c[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = child
+		return c, removed, nil
+	}
+	return nil, nil, ErrPatchPathNotFound
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(c))
+		for k, e := range c {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(c))
+		for i, e := range c {
+			s[i] = deepCopy(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// PatchWith replaces the attributes of e with the result of applying patch to
+// its normalized representation. The id and type of the entity cannot be changed.
+func (e *Entity) PatchWith(patch func(doc interface{}) (interface{}, error)) error {
+	// round trip through JSON, so the patch sees the same values a client would
+	raw, err := json.Marshal(e.ToObject())
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	doc, err = patch(doc)
+	if err != nil {
+		return err
+	}
+	o, ok := doc.(map[string]interface{})
+	if !ok {
+		return ErrPatchNotAnObject
+	}
+	patched, err := FromObject(o)
+	if err != nil {
+		return err
+	}
+	if patched.ID.ID != e.ID.ID || patched.ID.Type != e.ID.Type {
+		return ErrPatchEntityID
+	}
+	e.Attrs = patched.Attrs
+	return nil
+}
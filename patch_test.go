@@ -0,0 +1,158 @@
+package gorrion
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func mustUnmarshal(t *testing.T, s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return v
+}
+
+func TestMergePatch(t *testing.T) {
+	// examples from RFC 7396, appendix A
+	var cases = []struct {
+		target, patch, wanted string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for i, c := range cases {
+		got := MergePatch(mustUnmarshal(t, c.target), mustUnmarshal(t, c.patch))
+		if wanted := mustUnmarshal(t, c.wanted); !equalObjects(got, wanted) {
+			t.Error(gotWanted(got, wanted) + fmt.Sprintf(" (%d)", i))
+		}
+	}
+}
+
+func TestJSONPatch_Apply(t *testing.T) {
+	// mostly examples from RFC 6902, appendix A
+	var cases = []struct {
+		doc, patch, wanted string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"}]`, `{"foo":{"bar":1},"baz":{"bar":1}}`},
+		{`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"/":9,"~1":10}`, `[{"op":"remove","path":"/~01"},{"op":"replace","path":"/~1","value":0}]`, `{"/":0}`},
+	}
+	for i, c := range cases {
+		p, err := ParseJSONPatch(mustUnmarshal(t, c.patch))
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf(" (%d)", i))
+		}
+		got, err := p.Apply(mustUnmarshal(t, c.doc))
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf(" (%d)", i))
+		}
+		if wanted := mustUnmarshal(t, c.wanted); !equalObjects(got, wanted) {
+			t.Error(gotWanted(got, wanted) + fmt.Sprintf(" (%d)", i))
+		}
+	}
+}
+
+func TestJSONPatch_ApplyErrors(t *testing.T) {
+	var cases = []struct {
+		doc, patch string
+		wanted     error
+	}{
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ErrPatchTestFailed},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ErrPatchPathNotFound},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, ErrPatchPathNotFound},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, ErrPatchPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":1}]`, ErrPatchPathNotFound},
+		{`{"foo":[1]}`, `[{"op":"remove","path":"/foo/01"}]`, ErrInvalidPatchPath},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, ErrInvalidPatchPath},
+		{`{"foo":{"a":1}}`, `[{"op":"move","from":"/foo","path":"/foo/a/b"}]`, ErrInvalidPatchOp},
+	}
+	for i, c := range cases {
+		p, err := ParseJSONPatch(mustUnmarshal(t, c.patch))
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf(" (%d)", i))
+		}
+		_, err = p.Apply(mustUnmarshal(t, c.doc))
+		if err != c.wanted {
+			t.Error(gotWanted(err, c.wanted) + fmt.Sprintf(" (%d)", i))
+		}
+	}
+}
+
+func TestParseJSONPatch_Invalid(t *testing.T) {
+	var cases = map[string]error{
+		`{"op":"add","path":"/a","value":1}`: ErrPatchNotAnArray,
+		`[1]`:                                ErrInvalidPatchOp,
+		`[{"path":"/a","value":1}]`:          ErrInvalidPatchOp,
+		`[{"op":"add","value":1}]`:           ErrInvalidPatchOp,
+		`[{"op":"add","path":"/a"}]`:         ErrInvalidPatchOp,
+		`[{"op":"move","path":"/a"}]`:        ErrInvalidPatchOp,
+		`[{"op":"frobnicate","path":"/a"}]`:  ErrInvalidPatchOp,
+	}
+	for patch, wanted := range cases {
+		_, err := ParseJSONPatch(mustUnmarshal(t, patch))
+		if err != wanted {
+			t.Error(gotWanted(err, wanted) + fmt.Sprintf(" (%s)", patch))
+		}
+	}
+}
+
+func TestEntity_PatchWith(t *testing.T) {
+	e := NewEntity(EntityID{ID: "ID", Type: "T"})
+	e.Attrs["temperature"] = Attribute{Value: 21.5, Type: "celsius"}
+	e.Attrs["status"] = Attribute{Value: "ON"}
+
+	patch := mustUnmarshal(t, `{"temperature":{"value":22.5,"type":"celsius"},"status":null,"humidity":{"value":60}}`)
+	err := e.PatchWith(func(doc interface{}) (interface{}, error) {
+		return MergePatch(doc, patch), nil
+	})
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := map[string]Attribute{
+		"temperature": {Value: 22.5, Type: "celsius"},
+		"humidity":    {Value: 60.0},
+	}
+	if !equalObjects(e.Attrs, wanted) {
+		t.Error(gotWanted(e.Attrs, wanted))
+	}
+}
+
+func TestEntity_PatchWith_ChangeID(t *testing.T) {
+	e := NewEntity(EntityID{ID: "ID", Type: "T"})
+
+	p, err := ParseJSONPatch(mustUnmarshal(t, `[{"op":"replace","path":"/id","value":"other"}]`))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if err = e.PatchWith(p.Apply); err != ErrPatchEntityID {
+		t.Error(gotWanted(err, ErrPatchEntityID))
+	}
+}
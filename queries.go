@@ -1,7 +1,13 @@
 package gorrion
 
 import (
+	"context"
 	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -11,33 +17,145 @@ type Query struct {
 	IDPattern   string
 	Type        []string
 	TypePattern string
+	Q           string // simple query language, see ParseSimpleQuery
+	Near        *Near
 	Limit       int
 	Offset      int
 	Attrs       []string
 	OrderBy     []string
 	Options     []Option
+	// Cursor resumes a listing after the entity it was taken from, see
+	// EntityIter.NextCursor. It cannot be used together with Offset.
+	Cursor string
 	//mainly for debugging
 	condition bson.M
 	attrs     bson.M
 	sort      []string
+	sortKeys  []sortKey
 }
 
 type EntityIter struct {
-	iter *mgo.Iter
+	ctx context.Context
+	// the listing, timed and traced until closed
+	op      *storeOp
+	session *mgo.Session
+	iter    *mgo.Iter
+	err     error
+	n       int
+	// the token of the position to resume from, empty on the last page
+	next string
 }
 
+// Next decodes the next entity into e. It returns false at the end of the
+// results, on error or when the context of the query is done, closing the
+// iterator in all cases.
 func (ei *EntityIter) Next(e *Entity) bool {
-	return ei.iter.Next(e)
+	if ei.err != nil {
+		return false
+	}
+	if err := ei.ctx.Err(); err != nil {
+		ei.err = contextErr(err)
+		ei.Close()
+		return false
+	}
+	if !ei.iter.Next(e) {
+		ei.Close()
+		return false
+	}
+	ei.n++
+	return true
+}
+
+// NextCursor returns the token to get the page after the one listed by the
+// iterator, or an empty string if there are no more pages. Only a query with a
+// Limit has more than one page. It is known before reading the page, so it can
+// be sent in the headers of a response.
+func (ei *EntityIter) NextCursor() string {
+	return ei.next
 }
 
 func (ei *EntityIter) Err() error {
+	if ei.err != nil {
+		return ei.err
+	}
 	return ei.iter.Err()
 }
 
-func (q *Query) Get(service, servicepath string) (eIter *EntityIter, err error) {
+// Close releases the iterator before reaching the end of the results.
+// It is safe to call it more than once.
+func (ei *EntityIter) Close() error {
+	if ei.session == nil {
+		return nil
+	}
+	err := ei.iter.Close()
+	ei.session.Close()
+	ei.session = nil
+	if ei.err == nil && ei.ctx.Err() != nil {
+		// a socket timeout, most likely
+		ei.err = contextErr(ei.ctx.Err())
+	}
+	opErr := ei.err
+	if opErr == nil {
+		opErr = err
+	}
+	ei.op.setResultSize(ei.n)
+	ei.op.end(&opErr)
+	return err
+}
 
-	// Build
-	var conditions = []bson.M{{"_id.service": service}, {"_id.servicepath": servicepath}}
+// nextPage returns the cursor after the last entity of the page listed by q, or
+// nil if there are no more entities after it. It reads the sort keys of that
+// entity and of the next one only.
+func nextPage(ctx context.Context, col *mgo.Collection, q *Query) (*cursor, error) {
+	fields := bson.M{"_id": 1}
+	for _, k := range q.sortKeys {
+		if !strings.HasPrefix(k.field, "_id") {
+			fields[k.field] = 1
+		}
+	}
+	var edge []Entity
+	err := withMaxTime(ctx, col.Find(q.condition)).Sort(q.sort...).Select(fields).
+		Skip(q.Offset + q.Limit - 1).Limit(2).All(&edge)
+	if ctx.Err() != nil {
+		// a socket timeout, most likely
+		return nil, contextErr(ctx.Err())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(edge) < 2 {
+		return nil, nil
+	}
+	return newCursor(q.sortKeys, &edge[0]), nil
+}
+
+// servicePathCondition matches the entities under servicepath, as given by
+// parseServicePath: a list of paths, any of them a subtree ending in "/#"
+func servicePathCondition(servicepath string) bson.M {
+	var or []bson.M
+	for _, sp := range strings.Split(servicepath, ",") {
+		root, subtree := strings.CutSuffix(sp, "/#")
+		switch {
+		case !subtree:
+			or = append(or, bson.M{"_id.servicepath": sp})
+		case root == "":
+			// the whole service
+			return bson.M{}
+		default:
+			or = append(or, bson.M{"_id.servicepath": root},
+				bson.M{"_id.servicepath": bson.M{"$regex": "^" + regexp.QuoteMeta(root) + "/"}})
+		}
+	}
+	if len(or) == 1 {
+		return or[0]
+	}
+	return bson.M{"$or": or}
+}
+
+// build fills condition, attrs and sort from the query fields. Only a listing
+// can be sorted by distance, other operations do not accept $nearSphere.
+func (q *Query) build(service, servicepath string, listing bool) error {
+	var conditions = []bson.M{{"_id.service": service}, servicePathCondition(servicepath)}
 
 	if len(q.ID) > 0 {
 		conditions = append(conditions, bson.M{"_id.id": bson.M{"$in": q.ID}})
@@ -54,6 +172,30 @@ func (q *Query) Get(service, servicepath string) (eIter *EntityIter, err error)
 		conditions = append(conditions, bson.M{"_id.type": bson.M{"$regex": q.TypePattern}})
 	}
 
+	if q.Q != "" {
+		qConds, err := ParseSimpleQuery(q.Q)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, qConds...)
+	}
+
+	keys, byDistance, err := parseOrderBy(q.OrderBy)
+	if err != nil {
+		return err
+	}
+	if byDistance && q.Near == nil {
+		return ErrInvalidOrderBy
+	}
+
+	if q.Near != nil {
+		if byDistance && listing {
+			conditions = append(conditions, q.Near.sortedCondition())
+		} else {
+			conditions = append(conditions, q.Near.condition())
+		}
+	}
+
 	q.condition = bson.M{"$and": conditions}
 
 	// Select attributes asked for
@@ -62,20 +204,139 @@ func (q *Query) Get(service, servicepath string) (eIter *EntityIter, err error)
 		q.attrs["attrs."+s] = 1
 	}
 
-	// Change ! to - in sort fields
-	for _, s := range q.OrderBy {
-		if s[0] == '!' {
-			// desc order
-			q.sort = append(q.sort, "-attrs."+s[1:]+".value")
+	q.sort = nil
+	q.sortKeys = nil
+	if byDistance {
+		// $nearSphere sorts already, any other sort would replace it
+		return nil
+	}
+	// _id breaks ties, so pages are always in the same order
+	q.sortKeys = append(keys, sortKey{field: "_id"})
+	for _, k := range q.sortKeys {
+		q.sort = append(q.sort, k.String())
+	}
+	return nil
+}
+
+const orderByDistance = "geo:distance"
+
+// builtinSortFields are the names in orderBy that are not attributes
+var builtinSortFields = map[string]string{
+	idField:           "_id.id",
+	typeField:         "_id.type",
+	dateCreatedField:  dateCreatedField,
+	dateModifiedField: dateModifiedField,
+}
+
+// parseOrderBy translates the items of orderBy into the fields to sort by.
+// Each item is an attribute name or a builtin field, descending when prefixed
+// with '!'. geo:distance, only ascending and alone, asks for the nearest first.
+func parseOrderBy(items []string) (keys []sortKey, byDistance bool, err error) {
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		desc := strings.HasPrefix(item, "!")
+		name := strings.TrimPrefix(item, "!")
+		if name == orderByDistance {
+			if desc || len(items) > 1 {
+				return nil, false, ErrInvalidOrderBy
+			}
+			return nil, true, nil
+		}
+		if field, ok := builtinSortFields[name]; ok {
+			keys = append(keys, sortKey{field: field, desc: desc})
+		} else if validQueryAttr(name) {
+			keys = append(keys, sortKey{field: "attrs." + name + "." + attrValueField, desc: desc})
 		} else {
-			q.sort = append(q.sort, "attrs."+s+".value")
+			return nil, false, ErrInvalidOrderBy
 		}
 	}
+	return keys, false, nil
+}
+
+// HasFilter tells whether the query restricts the entities it applies to,
+// beyond the service and service path
+func (q *Query) HasFilter() bool {
+	return len(q.ID) > 0 || q.IDPattern != "" || len(q.Type) > 0 || q.TypePattern != "" || q.Q != "" ||
+		q.Near != nil
+}
 
-	//  Get iterator
-	col := initialSession.DB(db).C(getCol(EntityID{Service: service, ServicePath: servicepath}))
-	mgoQ := col.Find(q.condition)
+// GetEntities runs the query q. The iterator returned is bound to ctx, and must
+// be closed if not consumed until Next returns false.
+func (st *Store) GetEntities(ctx context.Context, q *Query, service, servicepath string) (eIter *EntityIter, err error) {
+	ctx, op := st.startOp(ctx, "GetEntities", EntityID{Service: service, ServicePath: servicepath})
+	op.setQuery(q)
+	defer func() {
+		// otherwise ended when the iterator is closed
+		if err != nil {
+			op.end(&err)
+		}
+	}()
 
+	// Build
+	if err = q.build(service, servicepath, true); err != nil {
+		return nil, err
+	}
+
+	if err = ctx.Err(); err != nil {
+		return nil, contextErr(err)
+	}
+	eIter = &EntityIter{ctx: ctx, op: op}
+
+	if q.Cursor != "" {
+		if q.Offset > 0 {
+			return nil, ErrCursorAndOffset
+		}
+		if len(q.sortKeys) == 0 {
+			// sorted by distance, not stored anywhere to resume from
+			return nil, ErrInvalidCursor
+		}
+		c, err := parseCursor(q.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after, err := c.condition(q.sortKeys)
+		if err != nil {
+			return nil, err
+		}
+		q.condition = bson.M{"$and": []bson.M{q.condition, after}}
+	}
+
+	// Get iterator, its session lives as long as it, with the read preference
+	// of listings
+	sess, release := st.sessionFor(ctx)
+	eIter.session = sess.Copy()
+	release()
+	eIter.session.SetMode(st.listingMode, true)
+	if d, ok := ctx.Deadline(); ok {
+		eIter.session.SetSocketTimeout(time.Until(d))
+	}
+	col := eIter.session.DB(st.config.DB).C(st.getCol(EntityID{Service: service, ServicePath: servicepath}))
+
+	var next *cursor
+	if q.Limit > 0 && len(q.sortKeys) > 0 {
+		if next, err = nextPage(ctx, col, q); err != nil {
+			eIter.session.Close()
+			return nil, err
+		}
+	}
+	if next != nil {
+		// The page ends at the cursor, so the next one starts right after the
+		// last entity listed, and an entity written meanwhile after it is not
+		// listed twice. The limit is kept: one written meanwhile before it
+		// pushes the last ones to no page at all rather than making the page
+		// longer than asked for.
+		after, err := next.condition(q.sortKeys)
+		if err == nil {
+			eIter.next, err = next.Token()
+		}
+		if err != nil {
+			eIter.session.Close()
+			return nil, err
+		}
+		q.condition = bson.M{"$and": []bson.M{q.condition, {"$nor": []bson.M{after}}}}
+	}
+
+	mgoQ := withMaxTime(ctx, col.Find(q.condition))
 	if q.Limit > 0 {
 		mgoQ = mgoQ.Limit(q.Limit)
 	}
@@ -91,11 +352,311 @@ func (q *Query) Get(service, servicepath string) (eIter *EntityIter, err error)
 		mgoQ = mgoQ.Sort(q.sort...)
 	}
 
-	eIter = &EntityIter{iter: mgoQ.Iter()}
+	eIter.iter = mgoQ.Iter()
 
 	return eIter, nil
 }
 
+// CountEntities returns how many entities match the query q, ignoring Limit
+// and Offset
+func (st *Store) CountEntities(ctx context.Context, q *Query, service, servicepath string) (n int, err error) {
+	ctx, op := st.startOp(ctx, "CountEntities", EntityID{Service: service, ServicePath: servicepath})
+	defer op.end(&err)
+	op.setQuery(q)
+	if err = q.build(service, servicepath, false); err != nil {
+		return 0, err
+	}
+	err = st.withColRead(ctx, EntityID{Service: service, ServicePath: servicepath}, func(col *mgo.Collection) error {
+		n, err = withMaxTime(ctx, col.Find(q.condition)).Count()
+		return err
+	})
+	op.setResultSize(n)
+	return n, err
+}
+
+// CountServiceEntities returns how many entities there are in service, in any
+// of its service paths
+func (st *Store) CountServiceEntities(ctx context.Context, service string) (n int, err error) {
+	ctx, op := st.startOp(ctx, "CountServiceEntities", EntityID{Service: service})
+	defer op.end(&err)
+	err = st.withColRead(ctx, EntityID{Service: service}, func(col *mgo.Collection) error {
+		n, err = withMaxTime(ctx, col.Find(bson.M{"_id.service": service})).Count()
+		return err
+	})
+	op.setResultSize(n)
+	return n, err
+}
+
+// EntitiesPerService returns how many entities there are in every service
+// with any
+func (st *Store) EntitiesPerService(ctx context.Context) (counts map[string]int, err error) {
+	ctx, op := st.startOp(ctx, "EntitiesPerService", EntityID{})
+	defer op.end(&err)
+	err = st.withColRead(ctx, EntityID{}, func(col *mgo.Collection) error {
+		var groups []struct {
+			Service string `bson:"_id"`
+			Count   int    `bson:"count"`
+		}
+		pipe := col.Pipe([]bson.M{{"$group": bson.M{"_id": "$_id.service", "count": bson.M{"$sum": 1}}}})
+		if err := pipe.All(&groups); err != nil {
+			return err
+		}
+		counts = make(map[string]int, len(groups))
+		for _, g := range groups {
+			counts[g.Service] = g.Count
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// DeleteEntities removes every entity matching the query q and returns how many
+// were removed or, with dryRun, how many would have been. Limit and Offset are
+// ignored. It is a single operation, but for the entities of the types with
+// versions, which are removed one by one, see applyEach.
+func (st *Store) DeleteEntities(ctx context.Context, q *Query, service, servicepath string, dryRun bool) (n int, err error) {
+	ctx, op := st.startOp(ctx, "DeleteEntities", EntityID{Service: service, ServicePath: servicepath})
+	defer op.end(&err)
+	op.setQuery(q)
+	if err = q.build(service, servicepath, false); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	err = st.withCol(ctx, EntityID{Service: service, ServicePath: servicepath}, func(col *mgo.Collection) error {
+		if dryRun {
+			n, err = withMaxTime(ctx, col.Find(q.condition)).Count()
+			return err
+		}
+		rest := q.condition
+		if types := st.config.VersionTypes; len(types) > 0 {
+			// the entities removed, as they were, for their versions
+			versioned := bson.M{"$and": []bson.M{q.condition, {"_id.type": bson.M{"$in": types}}}}
+			removed, err := applyEach(ctx, col, versioned, mgo.Change{Remove: true}, nil, func(old *Entity) {
+				st.recordVersion(ctx, old, now, true)
+			})
+			n += removed
+			if err != nil {
+				return err
+			}
+			rest = bson.M{"$and": []bson.M{q.condition, {"_id.type": bson.M{"$nin": types}}}}
+		}
+		info, err := col.RemoveAll(rest)
+		if err == nil {
+			n += info.Removed
+		}
+		return err
+	})
+	op.setResultSize(n)
+	return n, err
+}
+
+// UpdateEntities sets attrs in every entity matching the query q that already
+// has all of them and returns how many were updated or, with dryRun, how many
+// would have been. Limit and Offset are ignored. It is a single operation, but
+// for the entities with versions or history kept, which are updated one by one,
+// see applyEach.
+func (st *Store) UpdateEntities(ctx context.Context, q *Query, service, servicepath string, attrs map[string]Attribute, dryRun bool) (n int, err error) {
+	ctx, op := st.startOp(ctx, "UpdateEntities", EntityID{Service: service, ServicePath: servicepath})
+	defer op.end(&err)
+	op.setQuery(q)
+	op.setAttrCount(len(attrs))
+	if len(attrs) == 0 {
+		return 0, ErrEmptyObject
+	}
+	if err = ValidateAttrsMap(attrs); err != nil {
+		return 0, err
+	}
+	if err = q.build(service, servicepath, false); err != nil {
+		return 0, err
+	}
+	// attributes must exist, as in UpdateAttrs
+	conditions := q.condition["$and"].([]bson.M)
+	for name := range attrs {
+		conditions = append(conditions, bson.M{"attrs." + name: bson.M{"$exists": true}})
+	}
+	history := st.config.recordsAnyHistory(attrs)
+	now := time.Now()
+	if history || len(st.config.VersionTypes) > 0 {
+		// not the ones already updated, if seen again while reading them
+		conditions = append(conditions, bson.M{dateModifiedField: bson.M{"$ne": now}})
+	}
+	all := bson.M{"$and": conditions}
+	err = st.withCol(ctx, EntityID{Service: service, ServicePath: servicepath}, func(col *mgo.Collection) error {
+		if dryRun {
+			n, err = withMaxTime(ctx, col.Find(all)).Count()
+			return err
+		}
+		change := mgo.Change{Update: setAttrsUpdate(attrs, now)}
+		rest := all
+		if types := st.config.VersionTypes; len(types) > 0 {
+			// the entities updated of the types with versions, as they were
+			versioned := bson.M{"$and": []bson.M{all, {"_id.type": bson.M{"$in": types}}}}
+			updated, err := applyEach(ctx, col, versioned, change, nil, func(old *Entity) {
+				st.recordVersion(ctx, old, now, false)
+				if history {
+					st.recordHistory(ctx, old.ID, attrs, now)
+				}
+			})
+			n += updated
+			if err != nil {
+				return err
+			}
+			rest = bson.M{"$and": []bson.M{all, {"_id.type": bson.M{"$nin": types}}}}
+		}
+		if history {
+			// the rest, by their ids, for their history
+			updated, err := applyEach(ctx, col, rest, change, bson.M{"_id": true}, func(old *Entity) {
+				st.recordHistory(ctx, old.ID, attrs, now)
+			})
+			n += updated
+			return err
+		}
+		info, err := col.UpdateAll(rest, change.Update)
+		if err == nil {
+			n += info.Updated
+		}
+		return err
+	})
+	op.setResultSize(n)
+	return n, err
+}
+
+// bulkBatch is how many ids of the entities to record a bulk operation reads
+// at a time
+const bulkBatch = 100
+
+// applyEach reads the ids of the entities matching cond, in batches, and applies
+// change to each of them still matching it, passing the entity as it was before
+// to record, with the fields selected or whole for nil. It returns how many were
+// changed. Changing them one by one, instead of in a single write, gives their
+// exact former state, even if someone else writes them meanwhile. As with a
+// single write, an entity coming to match cond meanwhile may be missed.
+func applyEach(ctx context.Context, col *mgo.Collection, cond bson.M, change mgo.Change, fields bson.M,
+	record func(old *Entity)) (n int, err error) {
+	iter := withMaxTime(ctx, col.Find(cond)).Select(bson.M{"_id": true}).Batch(bulkBatch).Iter()
+	defer iter.Close()
+	for e := (Entity{}); iter.Next(&e); e = (Entity{}) {
+		q := col.Find(bson.M{"$and": []bson.M{cond, {"_id": e.ID}}})
+		if fields != nil {
+			q = q.Select(fields)
+		}
+		old := &Entity{}
+		if _, err = q.Apply(change, old); err == mgo.ErrNotFound {
+			// written by someone else, no longer matching
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+		record(old)
+	}
+	return n, iter.Close()
+}
+
+// ParseSimpleQuery translates a "q" expression into MongoDB conditions over the
+// attribute values. Statements are separated by ';' and all of them must hold:
+//
+//	temperature>20;status==ON,STANDBY;humidity==40..60;location;!broken
+//
+// Operators are ==, !=, >, >=, < and <=. A comma separated list with == or !=
+// means any (or none) of them, and a..b is an inclusive range. A bare attribute
+// name asks for the attribute to exist, and !name for it to be missing.
+func ParseSimpleQuery(q string) ([]bson.M, error) {
+	var conditions []bson.M
+	for _, st := range strings.Split(q, ";") {
+		cond, err := parseStatement(strings.TrimSpace(st))
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, cond)
+	}
+	return conditions, nil
+}
+
+// two char operators first, so ">=" is not taken as ">"
+var simpleQueryOps = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+func parseStatement(st string) (bson.M, error) {
+	for i := range st {
+		for _, op := range simpleQueryOps {
+			if strings.HasPrefix(st[i:], op) {
+				return binaryStatement(st[:i], op, st[i+len(op):])
+			}
+		}
+	}
+	if strings.HasPrefix(st, "!") {
+		name := st[1:]
+		if !validQueryAttr(name) {
+			return nil, ErrInvalidQuery
+		}
+		return bson.M{"attrs." + name: bson.M{"$exists": false}}, nil
+	}
+	if !validQueryAttr(st) {
+		return nil, ErrInvalidQuery
+	}
+	return bson.M{"attrs." + st: bson.M{"$exists": true}}, nil
+}
+
+func binaryStatement(name, op, value string) (bson.M, error) {
+	if !validQueryAttr(name) || value == "" {
+		return nil, ErrInvalidQuery
+	}
+	field := "attrs." + name + "." + attrValueField
+	switch op {
+	case "==", "!=":
+		var eq, ne bson.M
+		if bounds := strings.SplitN(value, "..", 2); len(bounds) == 2 {
+			if bounds[0] == "" || bounds[1] == "" {
+				return nil, ErrInvalidQuery
+			}
+			eq = bson.M{"$gte": queryValue(bounds[0]), "$lte": queryValue(bounds[1])}
+			ne = bson.M{"$not": eq}
+		} else if items := strings.Split(value, ","); len(items) > 1 {
+			values := make([]interface{}, len(items))
+			for i, item := range items {
+				values[i] = queryValue(item)
+			}
+			eq = bson.M{"$in": values}
+			ne = bson.M{"$nin": values}
+		} else {
+			eq = bson.M{"$eq": queryValue(value)}
+			ne = bson.M{"$ne": queryValue(value)}
+		}
+		if op == "!=" {
+			return bson.M{field: ne}, nil
+		}
+		return bson.M{field: eq}, nil
+	case ">":
+		return bson.M{field: bson.M{"$gt": queryValue(value)}}, nil
+	case ">=":
+		return bson.M{field: bson.M{"$gte": queryValue(value)}}, nil
+	case "<":
+		return bson.M{field: bson.M{"$lt": queryValue(value)}}, nil
+	default: // "<="
+		return bson.M{field: bson.M{"$lte": queryValue(value)}}, nil
+	}
+}
+
+func validQueryAttr(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "$.!=<> ")
+}
+
+// queryValue guesses the type of a value in a query. Numbers and booleans
+// can be forced to be strings quoting them, as in status=='1'
+func queryValue(s string) interface{} {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if s == "true" || s == "false" {
+		return s == "true"
+	}
+	return s
+}
+
 // mainly for debugging
 func (q *Query) ToJSON() string {
 	var obj = map[string]interface{}{
@@ -1,7 +1,12 @@
 package gorrion
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
+
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestQuery_Get_SimpleOne(t *testing.T) {
@@ -23,7 +28,7 @@ func TestQuery_Get_SimpleOne(t *testing.T) {
 		err error
 	)
 
-	ei, err := q.Get("S", "SP")
+	ei, err := q.Get(testCtx, "S", "SP")
 
 	if err != nil {
 		t.Fatal(unexpected(err))
@@ -55,7 +60,7 @@ func TestQuery_Get_IDPattern(t *testing.T) {
 		err    error
 	)
 
-	eIter, err := q.Get("S", "SP")
+	eIter, err := q.Get(testCtx, "S", "SP")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -99,7 +104,7 @@ func TestQuery_Get_TypePattern(t *testing.T) {
 		err    error
 	)
 
-	eIter, err := q.Get("S", "SP")
+	eIter, err := q.Get(testCtx, "S", "SP")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -144,7 +149,7 @@ func TestQuery_Get_Limit(t *testing.T) {
 
 	for limit := 1; limit <= len(population); limit++ {
 		q.Limit = limit
-		ei, err := q.Get("S", "SP")
+		ei, err := q.Get(testCtx, "S", "SP")
 		if err != nil {
 			t.Fatal(unexpected(err))
 		}
@@ -166,7 +171,7 @@ func TestQuery_Get_Limit(t *testing.T) {
 	// now limit greater than size of population
 	for limit := len(population); limit <= len(population)*2; limit++ {
 		q.Limit = limit
-		ei, err := q.Get("S", "SP")
+		ei, err := q.Get(testCtx, "S", "SP")
 		if err != nil {
 			t.Fatal(unexpected(err))
 		}
@@ -202,7 +207,7 @@ func TestQuery_Get_Offset(t *testing.T) {
 		var result = []*Entity{}
 
 		q.Offset = offset
-		ei, err := q.Get("S", "SP")
+		ei, err := q.Get(testCtx, "S", "SP")
 		if err != nil {
 			t.Fatal(unexpected(err))
 		}
@@ -242,7 +247,7 @@ func TestQuery_Get_ReverseOrder(t *testing.T) {
 	}
 	var result = []*Entity{}
 
-	ei, err := q.Get("S", "SP")
+	ei, err := q.Get(testCtx, "S", "SP")
 	if err != nil {
 		t.Fatal(unexpected(err))
 	}
@@ -285,7 +290,7 @@ func TestQuery_Get_Attrs(t *testing.T) {
 		err error
 	)
 
-	eIter, err := q.Get("S", "SP")
+	eIter, err := q.Get(testCtx, "S", "SP")
 
 	if err != nil {
 		t.Fatal(unexpected(err))
@@ -306,3 +311,429 @@ func TestQuery_Get_Attrs(t *testing.T) {
 		t.Errorf("wanted %#v, got %#v", status, population[2].Attrs[attribute])
 	}
 }
+
+func TestParseSimpleQuery(t *testing.T) {
+	var cases = []struct {
+		q      string
+		wanted []bson.M
+	}{
+		{"temperature>20", []bson.M{{"attrs.temperature.value": bson.M{"$gt": 20.0}}}},
+		{"temperature>=20", []bson.M{{"attrs.temperature.value": bson.M{"$gte": 20.0}}}},
+		{"temperature<20", []bson.M{{"attrs.temperature.value": bson.M{"$lt": 20.0}}}},
+		{"temperature<=20", []bson.M{{"attrs.temperature.value": bson.M{"$lte": 20.0}}}},
+		{"status==ON", []bson.M{{"attrs.status.value": bson.M{"$eq": "ON"}}}},
+		{"status!=ON", []bson.M{{"attrs.status.value": bson.M{"$ne": "ON"}}}},
+		{"status=='1'", []bson.M{{"attrs.status.value": bson.M{"$eq": "1"}}}},
+		{"on==true", []bson.M{{"attrs.on.value": bson.M{"$eq": true}}}},
+		{"status==ON,OFF", []bson.M{{"attrs.status.value": bson.M{"$in": []interface{}{"ON", "OFF"}}}}},
+		{"status!=ON,OFF", []bson.M{{"attrs.status.value": bson.M{"$nin": []interface{}{"ON", "OFF"}}}}},
+		{"t==1..5", []bson.M{{"attrs.t.value": bson.M{"$gte": 1.0, "$lte": 5.0}}}},
+		{"t!=1..5", []bson.M{{"attrs.t.value": bson.M{"$not": bson.M{"$gte": 1.0, "$lte": 5.0}}}}},
+		{"location", []bson.M{{"attrs.location": bson.M{"$exists": true}}}},
+		{"!location", []bson.M{{"attrs.location": bson.M{"$exists": false}}}},
+		{"temperature>20; !broken", []bson.M{
+			{"attrs.temperature.value": bson.M{"$gt": 20.0}},
+			{"attrs.broken": bson.M{"$exists": false}}}},
+	}
+	for _, c := range cases {
+		got, err := ParseSimpleQuery(c.q)
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf("(%s)", c.q))
+		}
+		if !equalObjects(got, c.wanted) {
+			t.Error(gotWanted(got, c.wanted) + fmt.Sprintf("(%s)", c.q))
+		}
+	}
+}
+
+func TestParseSimpleQuery_Invalid(t *testing.T) {
+	for _, q := range []string{"", "a;;b", ">2", "a>", "a==..3", "a==3..", "!", "a.b==1", "$where"} {
+		if _, err := ParseSimpleQuery(q); err != ErrInvalidQuery {
+			t.Error(gotWanted(err, ErrInvalidQuery) + fmt.Sprintf("(%q)", q))
+		}
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	var cases = []struct {
+		orderBy    []string
+		wanted     []sortKey
+		byDistance bool
+	}{
+		{nil, nil, false},
+		{[]string{"temperature", "!status"}, []sortKey{
+			{field: "attrs.temperature.value"}, {field: "attrs.status.value", desc: true}}, false},
+		{[]string{"id", "!type", "dateCreated", "!dateModified"}, []sortKey{
+			{field: "_id.id"}, {field: "_id.type", desc: true},
+			{field: "dateCreated"}, {field: "dateModified", desc: true}}, false},
+		{[]string{" temperature "}, []sortKey{{field: "attrs.temperature.value"}}, false},
+		{[]string{"geo:distance"}, nil, true},
+	}
+	for _, c := range cases {
+		keys, byDistance, err := parseOrderBy(c.orderBy)
+		if err != nil {
+			t.Fatal(unexpected(err) + fmt.Sprintf("(%v)", c.orderBy))
+		}
+		if !reflect.DeepEqual(keys, c.wanted) || byDistance != c.byDistance {
+			t.Error(gotWanted(keys, c.wanted) + fmt.Sprintf("(%v)", c.orderBy))
+		}
+	}
+}
+
+func TestServicePathCondition(t *testing.T) {
+	var cases = map[string]bson.M{
+		"":         {"_id.servicepath": ""},
+		"/parking": {"_id.servicepath": "/parking"},
+		"/#":       {},
+		"/parking/#": {"$or": []bson.M{{"_id.servicepath": "/parking"},
+			{"_id.servicepath": bson.M{"$regex": "^/parking/"}}}},
+		"/parking,/lighting": {"$or": []bson.M{{"_id.servicepath": "/parking"},
+			{"_id.servicepath": "/lighting"}}},
+		"/lighting,/#": {},
+	}
+	for servicepath, wanted := range cases {
+		if got := servicePathCondition(servicepath); !reflect.DeepEqual(got, wanted) {
+			t.Error(gotWanted(got, wanted) + fmt.Sprintf("(%s)", servicepath))
+		}
+	}
+}
+
+func TestParseOrderBy_Invalid(t *testing.T) {
+	for _, orderBy := range [][]string{
+		{""}, {"a", "", "b"}, {"!"}, {"!!a"}, {"a.b"}, {"$a"},
+		{"!geo:distance"}, {"geo:distance", "temperature"},
+	} {
+		if _, _, err := parseOrderBy(orderBy); err != ErrInvalidOrderBy {
+			t.Error(gotWanted(err, ErrInvalidOrderBy) + fmt.Sprintf("(%q)", orderBy))
+		}
+	}
+}
+
+func TestQuery_Get_DistanceWithoutNear(t *testing.T) {
+	q := &Query{OrderBy: []string{"geo:distance"}}
+	if err := q.build("S", "SP", true); err != ErrInvalidOrderBy {
+		t.Error(gotWanted(err, ErrInvalidOrderBy))
+	}
+}
+
+func TestQuery_Get_Q(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	var (
+		result = []*Entity{}
+		q      = &Query{Q: "temperature>30;status==OFF", OrderBy: []string{"temperature"}}
+	)
+
+	ei, err := q.Get(testCtx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+		result = append(result, ent)
+	}
+	if ei.Err() != nil {
+		t.Fatal(unexpected(ei.Err()))
+	}
+	if !equalObjects(population[3:6], result) {
+		t.Error(gotWanted(result, population[3:6]))
+	}
+}
+
+func TestQuery_Delete(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	q := &Query{Type: []string{"T1"}}
+
+	n, err := q.Delete(testCtx, "S", "SP", true)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if n != 3 {
+		t.Errorf("wanted %d, got %d (dry run)", 3, n)
+	}
+	if n, _ = (&Query{}).Count(testCtx, "S", "SP"); n != len(population) {
+		t.Errorf("wanted %d, got %d (dry run removed entities)", len(population), n)
+	}
+
+	n, err = q.Delete(testCtx, "S", "SP", false)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if n != 3 {
+		t.Errorf("wanted %d, got %d", 3, n)
+	}
+	if n, _ = (&Query{}).Count(testCtx, "S", "SP"); n != len(population)-3 {
+		t.Errorf("wanted %d, got %d", len(population)-3, n)
+	}
+}
+
+func TestQuery_Update(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	var (
+		q     = &Query{Q: "temperature<40"}
+		attrs = map[string]Attribute{"status": {Value: "MAINTENANCE", Md: map[string]interface{}{}}}
+	)
+
+	n, err := q.Update(testCtx, "S", "SP", attrs, true)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if n != 3 {
+		t.Errorf("wanted %d, got %d (dry run)", 3, n)
+	}
+
+	n, err = q.Update(testCtx, "S", "SP", attrs, false)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if n != 3 {
+		t.Errorf("wanted %d, got %d", 3, n)
+	}
+	if n, _ = (&Query{Q: "status==MAINTENANCE"}).Count(testCtx, "S", "SP"); n != 3 {
+		t.Errorf("wanted %d, got %d", 3, n)
+	}
+
+	// no entity has the attribute
+	n, err = q.Update(testCtx, "S", "SP", map[string]Attribute{"x": {Value: 1}}, false)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if n != 0 {
+		t.Errorf("wanted %d, got %d", 0, n)
+	}
+}
+
+func TestQuery_Get_Cursor(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	for _, orderBy := range []string{"temperature", "!temperature", "status"} {
+		var (
+			result = []*Entity{}
+			q      = &Query{Limit: 4, OrderBy: []string{orderBy}, Attrs: []string{"temperature"}}
+			pages  = 0
+		)
+		for {
+			ei, err := q.Get(testCtx, "S", "SP")
+			if err != nil {
+				t.Fatal(unexpected(err))
+			}
+			for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+				if _, ok := ent.Attrs["status"]; ok {
+					t.Errorf("unexpected attribute status, only needed for sorting (%s)", orderBy)
+				}
+				result = append(result, ent)
+			}
+			if ei.Err() != nil {
+				t.Fatal(unexpected(ei.Err()))
+			}
+			pages++
+			if q.Cursor = ei.NextCursor(); q.Cursor == "" {
+				break
+			}
+		}
+		if pages != 2 {
+			t.Errorf("wanted %d pages, got %d (%s)", 2, pages, orderBy)
+		}
+		if len(result) != len(population) {
+			t.Fatalf("wanted %d entities, got %d (%s)", len(population), len(result), orderBy)
+		}
+		seen := map[EntityID]bool{}
+		for _, e := range result {
+			if seen[e.ID] {
+				t.Errorf("entity %v returned twice (%s)", e.ID, orderBy)
+			}
+			seen[e.ID] = true
+		}
+	}
+}
+
+func TestQuery_Get_CursorAndOffset(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	token, err := newCursor([]sortKey{{field: "_id"}}, NewEntity(EntityID{})).Token()
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	q := &Query{Limit: 2, Offset: 2, Cursor: token}
+	if _, err := q.Get(testCtx, "S", "SP"); err != ErrCursorAndOffset {
+		t.Error(gotWanted(err, ErrCursorAndOffset))
+	}
+}
+
+func TestQuery_Get_OrderByBuiltin(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	// type desc, then id asc: E4, E5, E6, I1, I2, I3
+	var (
+		result = []*Entity{}
+		q      = &Query{OrderBy: []string{"!type", "id"}}
+		wanted = append(append([]*Entity{}, population[3:6]...), population[0:3]...)
+	)
+
+	ei, err := q.Get(testCtx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+		result = append(result, ent)
+	}
+	if ei.Err() != nil {
+		t.Fatal(unexpected(ei.Err()))
+	}
+	if !equalObjects(wanted, result) {
+		t.Error(gotWanted(result, wanted))
+	}
+}
+
+func TestQuery_Get_CursorMixedTypes(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	// values of other types, null and missing
+	var emptyMap = map[string]interface{}{}
+	for i, v := range []interface{}{"warm", nil, true, map[string]interface{}{"x": 1}} {
+		e := NewEntity(EntityID{ID: fmt.Sprintf("M%d", i), Type: "T3", Service: "S", ServicePath: "SP"})
+		e.Attrs["temperature"] = Attribute{Value: v, Md: emptyMap}
+		if err := CreateEntity(testCtx, e); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+	e := NewEntity(EntityID{ID: "M4", Type: "T3", Service: "S", ServicePath: "SP"})
+	if err := CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	const total = 11
+
+	for _, orderBy := range []string{"temperature", "!temperature"} {
+		var (
+			all   = []*Entity{}
+			paged = []*Entity{}
+		)
+		ei, err := (&Query{OrderBy: []string{orderBy}}).Get(testCtx, "S", "SP")
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+			all = append(all, ent)
+		}
+
+		q := &Query{Limit: 2, OrderBy: []string{orderBy}}
+		for {
+			ei, err := q.Get(testCtx, "S", "SP")
+			if err != nil {
+				t.Fatal(unexpected(err))
+			}
+			for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+				paged = append(paged, ent)
+			}
+			if ei.Err() != nil {
+				t.Fatal(unexpected(ei.Err()))
+			}
+			if q.Cursor = ei.NextCursor(); q.Cursor == "" {
+				break
+			}
+		}
+		if len(all) != total {
+			t.Errorf("wanted %d, got %d (%s)", total, len(all), orderBy)
+		}
+		if !equalObjects(all, paged) {
+			t.Errorf("wanted %v, got %v (%s)", all, paged, orderBy)
+		}
+	}
+}
+
+func TestQuery_Get_Near(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	var emptyMap = map[string]interface{}{}
+	for _, d := range []struct{ id, coords string }{
+		{"Far", "41.40, 2.20"},
+		{"Near", "41.38, 2.18"},
+		{"Nearest", "41.3763, 2.1864"},
+	} {
+		e := NewEntity(EntityID{ID: d.id, Type: "Room", Service: "S", ServicePath: "SP"})
+		e.Attrs["location"] = Attribute{Value: d.coords, Type: attrTypeGeoPoint, Md: emptyMap}
+		if err := CreateEntity(testCtx, e); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+
+	near, err := ParseNear("near;maxDistance:2000", "point", "41.3763726, 2.1864475")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	q := &Query{Near: near, OrderBy: []string{"geo:distance"}}
+	ei, err := q.Get(testCtx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var ids []string
+	for ent := (&Entity{}); ei.Next(ent); ent = (&Entity{}) {
+		ids = append(ids, ent.ID.ID)
+	}
+	if ei.Err() != nil {
+		t.Fatal(unexpected(ei.Err()))
+	}
+	if wanted := []string{"Nearest", "Near"}; !reflect.DeepEqual(ids, wanted) {
+		t.Error(gotWanted(ids, wanted))
+	}
+
+	if n, err := (&Query{Near: near}).Count(testCtx, "S", "SP"); err != nil || n != 2 {
+		t.Errorf("wanted %d, got %d (%v)", 2, n, err)
+	}
+}
+
+func TestQuery_Get_ContextCanceled(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ei, err := (&Query{}).Get(ctx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if !ei.Next(&Entity{}) {
+		t.Fatalf("wanted true, got false (entity iter empty) %v", ei.Err())
+	}
+	// the client went away
+	cancel()
+	if ei.Next(&Entity{}) {
+		t.Errorf("wanted false, got true (entity iter not stopped)")
+	}
+	if err := ei.Err(); err != ErrCanceled {
+		t.Error(gotWanted(err, ErrCanceled))
+	}
+}
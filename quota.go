@@ -0,0 +1,141 @@
+package gorrion
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// the server codes of the documents beyond the size MongoDB allows
+var docTooLargeCodes = map[int]bool{
+	10334: true, // BSONObjectTooLarge
+	17419: true, // resulting document after update is larger than the limit
+	17420: true,
+}
+
+// isDocTooLarge tells whether err is MongoDB refusing a document too large
+func isDocTooLarge(err error) bool {
+	switch e := err.(type) {
+	case *mgo.LastError:
+		return docTooLargeCodes[e.Code]
+	case *mgo.QueryError:
+		return docTooLargeCodes[e.Code]
+	}
+	return false
+}
+
+// quotasSet tells whether any quota of the stored entities is set
+func (srv *Server) quotasSet() bool {
+	c := srv.config
+	return c.QuotaEntities > 0 || c.QuotaAttrs > 0 || c.QuotaDocumentSize > 0
+}
+
+// checkNewEntity checks there is room in its service for one more entity and
+// that e is within the quotas
+func (srv *Server) checkNewEntity(ctx context.Context, st *Store, e *Entity) error {
+	if max := srv.config.QuotaEntities; max > 0 {
+		n, err := st.CountServiceEntities(ctx, e.ID.Service)
+		if err != nil {
+			return err
+		}
+		if n >= max {
+			return ErrEntitiesQuota
+		}
+	}
+	return srv.checkEntity(e)
+}
+
+// checkWrite checks the entity ei is still within the quotas after writing
+// attrs to it, or replacing its attributes with them. A missing entity is
+// checked as new. The entity is read for it, so the quotas are not checked
+// atomically with the write: concurrent writes can go slightly beyond them.
+func (srv *Server) checkWrite(ctx context.Context, st *Store, ei EntityID, attrs map[string]Attribute, replace bool) error {
+	if !srv.quotasSet() {
+		return nil
+	}
+	e, err := st.GetEntity(ctx, ei)
+	if err == ErrNotFoundEntity {
+		e = NewEntity(ei)
+		e.Attrs = attrs
+		return srv.checkNewEntity(ctx, st, e)
+	}
+	if err != nil {
+		return err
+	}
+	if replace {
+		e.Attrs = map[string]Attribute{}
+	}
+	for name, a := range attrs {
+		e.Attrs[name] = a
+	}
+	return srv.checkEntity(e)
+}
+
+// checkEntity checks the attributes and the size of the document of e are
+// within the quotas
+func (srv *Server) checkEntity(e *Entity) error {
+	if max := srv.config.QuotaAttrs; max > 0 && len(e.Attrs) > max {
+		return ErrAttrsQuota
+	}
+	if max := srv.config.QuotaDocumentSize; max > 0 {
+		doc, err := bson.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if len(doc) > max {
+			return ErrDocumentTooLarge
+		}
+	}
+	return nil
+}
+
+type tenantUsage struct {
+	Entities  int   `json:"entities"`
+	Requests  int64 `json:"requests"`
+	Throttled int64 `json:"throttled"`
+}
+
+// usageHandleF reports the entities of every tenant and the requests admitted
+// and throttled since the server started, with the quotas and limits applied
+// to them. Being about every tenant, it needs a grant for all of them.
+func usageHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	entities, err := args.store.EntitiesPerService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admitted, throttled := args.srv.rateLimiter.tenantRequests()
+	tenants := map[string]*tenantUsage{}
+	get := func(tenant string) *tenantUsage {
+		u, ok := tenants[tenant]
+		if !ok {
+			u = &tenantUsage{}
+			tenants[tenant] = u
+		}
+		return u
+	}
+	for tenant, n := range entities {
+		get(tenant).Entities = n
+	}
+	for tenant, n := range admitted {
+		get(tenant).Requests = n
+	}
+	for tenant, n := range throttled {
+		get(tenant).Throttled = n
+	}
+	c := args.srv.config
+	return object{
+		"tenants": tenants,
+		"quotas": object{
+			"maxEntities":     c.QuotaEntities,
+			"maxAttrs":        c.QuotaAttrs,
+			"maxDocumentSize": c.QuotaDocumentSize,
+		},
+		"rates": object{
+			"tenant":      c.TenantRate,
+			"tenantBurst": c.TenantBurst,
+			"client":      c.ClientRate,
+			"clientBurst": c.ClientBurst,
+		},
+	}, nil
+}
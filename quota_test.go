@@ -0,0 +1,112 @@
+package gorrion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestCheckEntity(t *testing.T) {
+	srv := newServer()
+	srv.config.QuotaAttrs = 2
+	srv.config.QuotaDocumentSize = 200
+
+	e := NewEntity(EntityID{ID: "E1", Type: "T", Service: "s"})
+	e.Attrs["a"] = Attribute{Value: 1}
+	e.Attrs["b"] = Attribute{Value: "short"}
+	if err := srv.checkEntity(e); err != nil {
+		t.Error(unexpected(err))
+	}
+	e.Attrs["b"] = Attribute{Value: strings.Repeat("x", 200)}
+	if err := srv.checkEntity(e); err != ErrDocumentTooLarge {
+		t.Error(gotWanted(err, ErrDocumentTooLarge))
+	}
+	e.Attrs["c"] = Attribute{Value: 3}
+	if err := srv.checkEntity(e); err != ErrAttrsQuota {
+		t.Error(gotWanted(err, ErrAttrsQuota))
+	}
+}
+
+func TestIsDocTooLarge(t *testing.T) {
+	var cases = []struct {
+		err    error
+		wanted bool
+	}{
+		{&mgo.LastError{Code: 17419}, true},
+		{&mgo.QueryError{Code: 10334}, true},
+		{&mgo.LastError{Code: 11000}, false},
+		{mgo.ErrNotFound, false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := isDocTooLarge(c.err); got != c.wanted {
+			t.Error(gotWanted(got, c.wanted) + " (" + stringOf(c.err) + ")")
+		}
+	}
+}
+
+func stringOf(err error) string {
+	if err == nil {
+		return "nil"
+	}
+	return err.Error()
+}
+
+func TestQuota_Entities(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.QuotaEntities = 1
+	srv, err := NewServer(WithConfig(c), WithStore(defaultStore))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	create := func(tenant, id string) int {
+		body := []byte(`{"id": "` + id + `", "type": "T"}`)
+		req := httptest.NewRequest("POST", "/v2/entities/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		req.Header.Set(headerService, tenant)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := create("t1", "E1"); code != http.StatusCreated {
+		t.Fatal(gotWanted(code, http.StatusCreated))
+	}
+	if code := create("t1", "E2"); code != http.StatusForbidden {
+		t.Error(gotWanted(code, http.StatusForbidden))
+	}
+	if code := create("t2", "E1"); code != http.StatusCreated {
+		t.Error("tenants share their quota: " + gotWanted(code, http.StatusCreated))
+	}
+
+	counts, err := defaultStore.EntitiesPerService(context.Background())
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if counts["t1"] != 1 || counts["t2"] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/admin/usage", nil))
+	var usage struct {
+		Tenants map[string]tenantUsage
+	}
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if got := usage.Tenants["t1"]; got.Entities != 1 || got.Requests != 2 {
+		t.Errorf("unexpected usage %+v", got)
+	}
+}
@@ -0,0 +1,183 @@
+package gorrion
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// buckets forgotten after this long without requests
+const bucketIdle = 10 * time.Minute
+
+// The tenants are named by a header any client sets, so only the first
+// maxTenantCounts of them are counted and limited apart, the rest together as
+// otherTenants, which is not a valid service name.
+const (
+	maxTenantCounts = 1000
+	otherTenants    = "(other)"
+)
+
+// limiters is a token bucket for each key, as a tenant or a client
+type limiters struct {
+	rate  rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// newLimiters allows perSecond requests for each key, with bursts of burst,
+// perSecond if zero. It returns nil, allowing anything, for perSecond zero.
+func newLimiters(perSecond, burst int) *limiters {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = perSecond
+	}
+	return &limiters{rate: rate.Limit(perSecond), burst: burst, buckets: map[string]*bucket{}}
+}
+
+// reserve takes a token for key. If there is none, it returns how long to
+// wait for one and the reservation is canceled.
+func (l *limiters) reserve(key string, now time.Time) (*rate.Reservation, time.Duration) {
+	if l == nil {
+		return nil, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > bucketIdle {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > bucketIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+	r := b.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return nil, d
+	}
+	return r, 0
+}
+
+// rateLimiter throttles the requests of each tenant and of each client
+type rateLimiter struct {
+	tenants *limiters
+	clients *limiters
+
+	mu sync.Mutex
+	// requests of each tenant, admitted and throttled, for the usage report
+	admitted  map[string]int64
+	throttled map[string]int64
+}
+
+func newRateLimiter(c Config) *rateLimiter {
+	return &rateLimiter{
+		tenants:   newLimiters(c.TenantRate, c.TenantBurst),
+		clients:   newLimiters(c.ClientRate, c.ClientBurst),
+		admitted:  map[string]int64{},
+		throttled: map[string]int64{},
+	}
+}
+
+// allow takes a token of tenant and one of client, or none of them and
+// returns how long to wait before retrying
+func (rl *rateLimiter) allow(tenant, client string) time.Duration {
+	rl.mu.Lock()
+	key := rl.counterKey(tenant)
+	rl.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	r, d := rl.tenants.reserve(key, now)
+	if d > 0 {
+		wait = d
+	} else if _, d = rl.clients.reserve(client, now); d > 0 {
+		if r != nil {
+			// the tenant is not charged for a request not served
+			r.CancelAt(now)
+		}
+		wait = d
+	}
+
+	rl.mu.Lock()
+	if wait > 0 {
+		rl.throttled[key]++
+	} else {
+		rl.admitted[key]++
+	}
+	rl.mu.Unlock()
+	return wait
+}
+
+// counterKey is the key tenant is counted by, with rl.mu held
+func (rl *rateLimiter) counterKey(tenant string) string {
+	_, admitted := rl.admitted[tenant]
+	_, throttled := rl.throttled[tenant]
+	if admitted || throttled || len(rl.admitted)+len(rl.throttled) < maxTenantCounts {
+		return tenant
+	}
+	return otherTenants
+}
+
+// tenantRequests returns the requests of each tenant admitted and throttled
+// so far
+func (rl *rateLimiter) tenantRequests() (admitted, throttled map[string]int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	admitted, throttled = map[string]int64{}, map[string]int64{}
+	for k, v := range rl.admitted {
+		admitted[k] = v
+	}
+	for k, v := range rl.throttled {
+		throttled[k] = v
+	}
+	return admitted, throttled
+}
+
+// clientOf is the key of the caller of req for the rate limits: who it is if
+// authenticated, where it comes from otherwise
+func clientOf(req *http.Request, caller principal) string {
+	if caller.name != "" {
+		return caller.name
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// checkRate answers ErrTooManyRequests, telling when to retry, when the tenant
+// or the client of req has run out of requests. Only the routes that need
+// credentials are limited, not the health checks.
+func (srv *Server) checkRate(w http.ResponseWriter, req *http.Request, route string, caller principal) error {
+	if _, ok := routeOperations[route]; !ok {
+		return nil
+	}
+	wait := srv.rateLimiter.allow(req.Header.Get(headerService), clientOf(req, caller))
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return ErrTooManyRequests
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package gorrion
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiters(t *testing.T) {
+	if newLimiters(0, 10) != nil {
+		t.Error("wanted no limit for no rate")
+	}
+	l := newLimiters(1, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, wait := l.reserve("a", now); wait != 0 {
+			t.Fatalf("request %d of the burst: %s", i, gotWanted(wait, 0))
+		}
+	}
+	if _, wait := l.reserve("a", now); wait <= 0 || wait > time.Second {
+		t.Errorf("wanted to wait up to a second, got %v", wait)
+	}
+	// a throttled request takes no token
+	if _, wait := l.reserve("a", now.Add(time.Second)); wait != 0 {
+		t.Error(gotWanted(wait, 0))
+	}
+	if _, wait := l.reserve("b", now); wait != 0 {
+		t.Error("buckets are not shared: " + gotWanted(wait, 0))
+	}
+
+	if _, wait := l.reserve("c", now.Add(2*bucketIdle)); wait != 0 {
+		t.Error(gotWanted(wait, 0))
+	}
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle bucket not forgotten")
+	}
+}
+
+func TestRateLimiter_ClientNotChargedToTenant(t *testing.T) {
+	rl := newRateLimiter(Config{TenantRate: 1, TenantBurst: 2, ClientRate: 1})
+	if wait := rl.allow("t1", "c1"); wait != 0 {
+		t.Fatal(gotWanted(wait, 0))
+	}
+	if wait := rl.allow("t1", "c1"); wait == 0 {
+		t.Fatal("wanted the client throttled")
+	}
+	// the tenant still has the token the client could not use
+	if wait := rl.allow("t1", "c2"); wait != 0 {
+		t.Error(gotWanted(wait, 0))
+	}
+	admitted, throttled := rl.tenantRequests()
+	if admitted["t1"] != 2 || throttled["t1"] != 1 {
+		t.Errorf("unexpected counts %v %v", admitted, throttled)
+	}
+}
+
+func TestRateLimiter_TenantCounts(t *testing.T) {
+	rl := newRateLimiter(Config{})
+	for i := 0; i < maxTenantCounts+10; i++ {
+		rl.allow(fmt.Sprintf("t%d", i), "c1")
+	}
+	rl.allow("t0", "c1")
+	admitted, _ := rl.tenantRequests()
+	if len(admitted) != maxTenantCounts+1 || admitted["t0"] != 2 || admitted[otherTenants] != 10 {
+		t.Errorf("unexpected counts of %d tenants, t0 %d, other %d", len(admitted), admitted["t0"], admitted[otherTenants])
+	}
+}
+
+func TestRateLimiter_TenantBuckets(t *testing.T) {
+	rl := newRateLimiter(Config{TenantRate: 1})
+	for i := 0; i < maxTenantCounts+10; i++ {
+		rl.allow(fmt.Sprintf("t%d", i), "c1")
+	}
+	if n := len(rl.tenants.buckets); n != maxTenantCounts+1 {
+		t.Error(gotWanted(n, maxTenantCounts+1))
+	}
+	// the tenants beyond the first ones share a bucket
+	_, throttled := rl.tenantRequests()
+	if throttled[otherTenants] != 9 || rl.allow("t0", "c1") == 0 {
+		t.Error(gotWanted(throttled, "9 of the other tenants throttled, t0 too"))
+	}
+}
+
+func TestRateLimit_Routes(t *testing.T) {
+	c := DefaultConfig()
+	c.TenantRate = 1
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	do := func(path, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(headerService, tenant)
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("/admin/log", "t1"); w.Code != http.StatusOK {
+		t.Fatal(gotWanted(w.Code, http.StatusOK))
+	}
+	w := do("/admin/log", "t1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal(gotWanted(w.Code, http.StatusTooManyRequests))
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Error(gotWanted(got, "1"))
+	}
+	if w := do("/admin/log", "t2"); w.Code != http.StatusOK {
+		t.Error("tenants share their rate: " + gotWanted(w.Code, http.StatusOK))
+	}
+	if w := do("/health/live", "t1"); w.Code != http.StatusOK {
+		t.Error("health checks limited: " + gotWanted(w.Code, http.StatusOK))
+	}
+}
+
+func TestClientOf(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.7:51234"
+	if got := clientOf(req, principal{}); got != "10.0.0.7" {
+		t.Error(gotWanted(got, "10.0.0.7"))
+	}
+	if got := clientOf(req, principal{name: "gateway"}); got != "gateway" {
+		t.Error(gotWanted(got, "gateway"))
+	}
+}
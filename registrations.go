@@ -0,0 +1,251 @@
+package gorrion
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// forwarding modes of a provider, what is forwarded to it
+const (
+	ForwardAll    = "all"
+	ForwardQuery  = "query"
+	ForwardUpdate = "update"
+	ForwardNone   = "none"
+)
+
+// status of a registration, only active ones are forwarded to
+const (
+	RegistrationActive   = "active"
+	RegistrationInactive = "inactive"
+)
+
+// Registration tells gorrion that a context provider owns some attributes of
+// some entities, so queries and updates of them not stored locally are
+// forwarded to it
+type Registration struct {
+	ID          string `bson:"_id" json:"id"`
+	Service     string `bson:"service" json:"-"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	// the entities and attributes provided, all of them if Attrs is empty
+	DataProvided DataProvided `bson:"dataProvided" json:"dataProvided"`
+	Provider     Provider     `bson:"provider" json:"provider"`
+	// the registration is ignored from then on, never if nil
+	Expires *time.Time `bson:"expires,omitempty" json:"expires,omitempty"`
+	Status  string     `bson:"status,omitempty" json:"status,omitempty"`
+}
+
+type DataProvided struct {
+	Entities []EntityInfo `bson:"entities" json:"entities"`
+	Attrs    []string     `bson:"attrs,omitempty" json:"attrs,omitempty"`
+}
+
+// EntityInfo selects the entities with an id, or matching an id pattern, and
+// of a type, any if empty
+type EntityInfo struct {
+	ID        string `bson:"id,omitempty" json:"id,omitempty"`
+	IDPattern string `bson:"idPattern,omitempty" json:"idPattern,omitempty"`
+	Type      string `bson:"type,omitempty" json:"type,omitempty"`
+}
+
+type Provider struct {
+	HTTP struct {
+		// base of the NGSIv2 API of the provider, as in http://host/v2
+		URL string `bson:"url" json:"url"`
+	} `bson:"http" json:"http"`
+	// what is forwarded, all if empty
+	SupportedForwardingMode string `bson:"supportedForwardingMode,omitempty" json:"supportedForwardingMode,omitempty"`
+}
+
+// ValidateRegistration checks r can be stored and forwarded to
+func ValidateRegistration(r *Registration) error {
+	if len(r.DataProvided.Entities) == 0 {
+		return ErrInvalidRegistration
+	}
+	for _, e := range r.DataProvided.Entities {
+		if (e.ID == "") == (e.IDPattern == "") {
+			return ErrInvalidRegistration
+		}
+		if e.IDPattern != "" {
+			if _, err := regexp.Compile(e.IDPattern); err != nil {
+				return ErrInvalidRegistration
+			}
+		}
+	}
+	for _, a := range r.DataProvided.Attrs {
+		if a == "" || a == idField || a == typeField {
+			return ErrInvalidRegistration
+		}
+	}
+	u, err := url.Parse(r.Provider.HTTP.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidRegistration
+	}
+	switch r.Provider.SupportedForwardingMode {
+	case "", ForwardAll, ForwardQuery, ForwardUpdate, ForwardNone:
+	default:
+		return ErrInvalidRegistration
+	}
+	switch r.Status {
+	case "", RegistrationActive, RegistrationInactive:
+	default:
+		return ErrInvalidRegistration
+	}
+	return nil
+}
+
+// matches tells whether r is in force at now for the entity ei
+func (r *Registration) matches(ei EntityID, now time.Time) bool {
+	if r.Status == RegistrationInactive || (r.Expires != nil && !now.Before(*r.Expires)) {
+		return false
+	}
+	for _, e := range r.DataProvided.Entities {
+		if e.Type != "" && e.Type != ei.Type {
+			continue
+		}
+		if e.ID == ei.ID {
+			return true
+		}
+		if e.IDPattern != "" {
+			// validated when stored
+			if re, err := regexp.Compile(e.IDPattern); err == nil && re.MatchString(ei.ID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provides tells whether r provides the attribute name
+func (r *Registration) provides(name string) bool {
+	if len(r.DataProvided.Attrs) == 0 {
+		return true
+	}
+	for _, a := range r.DataProvided.Attrs {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// forwards tells whether queries, ForwardQuery, or updates, ForwardUpdate, are
+// forwarded to the provider of r
+func (r *Registration) forwards(mode string) bool {
+	m := r.Provider.SupportedForwardingMode
+	return m == "" || m == ForwardAll || m == mode
+}
+
+func (st *Store) withRegCol(ctx context.Context, retry bool, f func(col *mgo.Collection) error) error {
+	return st.runCol(ctx, func() string { return st.config.RegistrationsColl }, retry, f)
+}
+
+// CreateRegistration stores r, giving it a new ID
+func (st *Store) CreateRegistration(ctx context.Context, r *Registration) (err error) {
+	ctx, op := st.startOp(ctx, "CreateRegistration", EntityID{Service: r.Service})
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	if err = ValidateRegistration(r); err != nil {
+		return err
+	}
+	r.ID = bson.NewObjectId().Hex()
+	return st.withRegCol(ctx, false, func(col *mgo.Collection) error {
+		return col.Insert(r)
+	})
+}
+
+// GetRegistration returns the registration id of service
+func (st *Store) GetRegistration(ctx context.Context, service, id string) (r *Registration, err error) {
+	ctx, op := st.startOp(ctx, "GetRegistration", EntityID{Service: service})
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	r = &Registration{}
+	err = st.withRegCol(ctx, true, func(col *mgo.Collection) error {
+		return withMaxTime(ctx, col.Find(bson.M{"_id": id, "service": service})).One(r)
+	})
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFoundRegistration
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ListRegistrations returns a page of the registrations of service, in the
+// order they were created
+func (st *Store) ListRegistrations(ctx context.Context, service string, limit, offset int) (regs []Registration, err error) {
+	ctx, op := st.startOp(ctx, "ListRegistrations", EntityID{Service: service})
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	regs = []Registration{}
+	err = st.withRegCol(ctx, true, func(col *mgo.Collection) error {
+		q := col.Find(bson.M{"service": service}).Sort("_id").Skip(offset).Limit(limit)
+		return withMaxTime(ctx, q).All(&regs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	op.setResultSize(len(regs))
+	return regs, nil
+}
+
+// CountRegistrations returns how many registrations service has
+func (st *Store) CountRegistrations(ctx context.Context, service string) (n int, err error) {
+	ctx, op := st.startOp(ctx, "CountRegistrations", EntityID{Service: service})
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	err = st.withRegCol(ctx, true, func(col *mgo.Collection) error {
+		n, err = col.Find(bson.M{"service": service}).Count()
+		return err
+	})
+	return n, err
+}
+
+// DeleteRegistration removes the registration id of service
+func (st *Store) DeleteRegistration(ctx context.Context, service, id string) (err error) {
+	ctx, op := st.startOp(ctx, "DeleteRegistration", EntityID{Service: service})
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	err = st.withRegCol(ctx, false, func(col *mgo.Collection) error {
+		return col.Remove(bson.M{"_id": id, "service": service})
+	})
+	if err == mgo.ErrNotFound {
+		return ErrNotFoundRegistration
+	}
+	return err
+}
+
+// RegistrationsFor returns the registrations in force for the entity ei
+func (st *Store) RegistrationsFor(ctx context.Context, ei EntityID) (regs []Registration, err error) {
+	ctx, op := st.startOp(ctx, "RegistrationsFor", ei)
+	defer op.end(&err)
+	op.setCollection(st.config.RegistrationsColl)
+	var candidates []Registration
+	err = st.withRegCol(ctx, true, func(col *mgo.Collection) error {
+		// the patterns are matched here, not by MongoDB
+		q := col.Find(bson.M{
+			"service": ei.Service,
+			"$or": []bson.M{
+				{"dataProvided.entities.id": ei.ID},
+				{"dataProvided.entities.idPattern": bson.M{"$exists": true}},
+			},
+		})
+		return withMaxTime(ctx, q).All(&candidates)
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, r := range candidates {
+		if r.matches(ei, now) {
+			regs = append(regs, r)
+		}
+	}
+	op.setResultSize(len(regs))
+	return regs, nil
+}
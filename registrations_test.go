@@ -0,0 +1,336 @@
+package gorrion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRegistration(url string, attrs ...string) Registration {
+	r := Registration{ID: "R1"}
+	r.DataProvided.Entities = []EntityInfo{{ID: "E1", Type: "Room"}}
+	r.DataProvided.Attrs = attrs
+	r.Provider.HTTP.URL = url
+	return r
+}
+
+func TestValidateRegistration(t *testing.T) {
+	var cases = []struct {
+		change func(r *Registration)
+		valid  bool
+	}{
+		{func(r *Registration) {}, true},
+		{func(r *Registration) { r.DataProvided.Entities[0] = EntityInfo{IDPattern: "^E.*", Type: "Room"} }, true},
+		{func(r *Registration) { r.DataProvided.Entities = nil }, false},
+		{func(r *Registration) { r.DataProvided.Entities[0].IDPattern = "E.*" }, false},
+		{func(r *Registration) { r.DataProvided.Entities[0] = EntityInfo{IDPattern: "E("} }, false},
+		{func(r *Registration) { r.DataProvided.Attrs = []string{"id"} }, false},
+		{func(r *Registration) { r.Provider.HTTP.URL = "provider:8080/v2" }, false},
+		{func(r *Registration) { r.Provider.HTTP.URL = "ftp://provider/v2" }, false},
+		{func(r *Registration) { r.Provider.SupportedForwardingMode = ForwardQuery }, true},
+		{func(r *Registration) { r.Provider.SupportedForwardingMode = "sometimes" }, false},
+		{func(r *Registration) { r.Status = RegistrationInactive }, true},
+		{func(r *Registration) { r.Status = "paused" }, false},
+	}
+	for i, c := range cases {
+		r := testRegistration("http://provider:8080/v2", "pressure")
+		c.change(&r)
+		err := ValidateRegistration(&r)
+		if c.valid && err != nil {
+			t.Errorf("%d: %s", i, unexpected(err))
+		}
+		if !c.valid && err != ErrInvalidRegistration {
+			t.Errorf("%d: %s", i, gotWanted(err, ErrInvalidRegistration))
+		}
+	}
+}
+
+func TestRegistration_Matches(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	pattern := testRegistration("http://provider/v2")
+	pattern.DataProvided.Entities = []EntityInfo{{IDPattern: "^Room[0-9]+$"}}
+	var cases = []struct {
+		change func(r *Registration)
+		ei     EntityID
+		wanted bool
+	}{
+		{func(r *Registration) {}, EntityID{ID: "E1", Type: "Room"}, true},
+		{func(r *Registration) {}, EntityID{ID: "E1", Type: "Car"}, false},
+		{func(r *Registration) {}, EntityID{ID: "E2", Type: "Room"}, false},
+		{func(r *Registration) { *r = pattern }, EntityID{ID: "Room12", Type: "Any"}, true},
+		{func(r *Registration) { *r = pattern }, EntityID{ID: "Room12b", Type: "Any"}, false},
+		{func(r *Registration) { r.Status = RegistrationInactive }, EntityID{ID: "E1", Type: "Room"}, false},
+		{func(r *Registration) { r.Expires = &past }, EntityID{ID: "E1", Type: "Room"}, false},
+	}
+	for i, c := range cases {
+		r := testRegistration("http://provider/v2")
+		c.change(&r)
+		if got := r.matches(c.ei, now); got != c.wanted {
+			t.Errorf("%d: %s", i, gotWanted(got, c.wanted))
+		}
+	}
+}
+
+func TestSplitAttrs(t *testing.T) {
+	regs := []Registration{
+		testRegistration("http://a/v2", "pressure"),
+		testRegistration("http://b/v2"),
+	}
+	regs[0].Provider.SupportedForwardingMode = ForwardUpdate
+	stored := NewEntity(EntityID{ID: "E1", Type: "Room"})
+	stored.Attrs["temperature"] = Attribute{Value: 21}
+	attrs := map[string]Attribute{
+		"temperature": {Value: 22},
+		"pressure":    {Value: 1000},
+		"humidity":    {Value: 40},
+	}
+	local, byReg := splitAttrs(regs, stored, attrs)
+	if wanted := map[string]Attribute{"temperature": {Value: 22}}; !reflect.DeepEqual(local, wanted) {
+		t.Error(gotWanted(local, wanted))
+	}
+	wanted := map[int]map[string]Attribute{
+		0: {"pressure": {Value: 1000}},
+		1: {"humidity": {Value: 40}},
+	}
+	if !reflect.DeepEqual(byReg, wanted) {
+		t.Error(gotWanted(byReg, wanted))
+	}
+
+	// queries only
+	regs[1].Provider.SupportedForwardingMode = ForwardQuery
+	local, byReg = splitAttrs(regs, stored, attrs)
+	if _, ok := local["humidity"]; !ok || len(byReg) != 1 {
+		t.Error(gotWanted(local, "humidity written locally"))
+	}
+}
+
+// testProvider is a context provider answering for the entity E1 with attrs,
+// and taking the updates of it
+type testProvider struct {
+	*httptest.Server
+	attrs map[string]Attribute
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []object
+}
+
+func newTestProvider(attrs map[string]Attribute) *testProvider {
+	p := &testProvider{attrs: attrs}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body object
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.mu.Lock()
+		p.requests = append(p.requests, req)
+		p.bodies = append(p.bodies, body)
+		p.mu.Unlock()
+		switch req.URL.Path {
+		case "/v2/op/query":
+			e := NewEntity(EntityID{ID: "E1", Type: "Room"})
+			for name, a := range p.attrs {
+				e.Attrs[name] = a
+			}
+			json.NewEncoder(w).Encode([]object{e.ToObject()})
+		case "/v2/op/update":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	return p
+}
+
+func (p *testProvider) url() string {
+	return p.URL + "/v2"
+}
+
+func testProviderCall(t *testing.T) providerCall {
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	req := httptest.NewRequest("GET", "/v2/entities/E1", nil)
+	req.Header.Set(headerService, "smartcity")
+	req.Header.Set(headerServicePath, "/parking")
+	return providerCall{srv: srv, req: req, corr: "corr-1", ei: EntityID{ID: "E1", Type: "Room"}}
+}
+
+func TestQueryProviders(t *testing.T) {
+	p := newTestProvider(map[string]Attribute{
+		"temperature": {Value: 30.0, Type: "Number"},
+		"pressure":    {Value: 1000.0, Type: "Number"},
+		"owner":       {Value: "someone else", Type: "Text"},
+	})
+	defer p.Close()
+	down := newTestProvider(nil)
+	down.Close()
+
+	regs := []Registration{
+		testRegistration(p.url(), "temperature", "pressure"),
+		testRegistration(down.url(), "humidity"),
+	}
+	pc := testProviderCall(t)
+	stored := NewEntity(pc.ei)
+	stored.Attrs["temperature"] = Attribute{Value: 21.0, Type: "Number"}
+
+	e, failed := queryProviders(context.Background(), pc, stored, regs, nil)
+	wanted := map[string]Attribute{
+		"temperature": {Value: 21.0, Type: "Number"},
+		"pressure":    {Value: 1000.0, Type: "Number"},
+	}
+	if !reflect.DeepEqual(e.Attrs, wanted) {
+		t.Error(gotWanted(e.Attrs, wanted))
+	}
+	if len(failed) != 1 || !reflect.DeepEqual(failed[0].attrs, []string{"humidity"}) ||
+		!strings.HasPrefix(failed[0].warning, "199 gorrion ") {
+		t.Error(gotWanted(failed, "humidity failed"))
+	}
+
+	if len(p.requests) != 1 {
+		t.Fatal(gotWanted(len(p.requests), 1))
+	}
+	req, body := p.requests[0], p.bodies[0]
+	for h, v := range map[string]string{headerService: "smartcity", headerServicePath: "/parking", headerCorrelator: "corr-1"} {
+		if got := req.Header.Get(h); got != v {
+			t.Error(gotWanted(got, v) + " (" + h + ")")
+		}
+	}
+	// only what is not stored already
+	if got := body["attrs"]; !reflect.DeepEqual(got, []interface{}{"pressure"}) {
+		t.Error(gotWanted(got, []string{"pressure"}))
+	}
+
+	// nothing stored, nothing found
+	p.attrs = nil
+	e, failed = queryProviders(context.Background(), pc, nil, regs[:1], []string{"pressure"})
+	if e != nil || len(failed) != 0 {
+		t.Error(gotWanted(e, nil))
+	}
+}
+
+func TestProviderUpdate(t *testing.T) {
+	p := newTestProvider(nil)
+	defer p.Close()
+	reg := testRegistration(p.url())
+	pc := testProviderCall(t)
+	attrs := map[string]Attribute{"pressure": {Value: 990.0, Type: "Number"}}
+	if err := pc.update(context.Background(), &reg, actionUpdate, attrs); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := object{
+		"actionType": "update",
+		"entities": []interface{}{map[string]interface{}{
+			"id":       "E1",
+			"type":     "Room",
+			"pressure": map[string]interface{}{"type": "Number", "value": 990.0},
+		}},
+	}
+	if !equalObjects(p.bodies[0], wanted) {
+		t.Error(gotWanted(p.bodies[0], wanted))
+	}
+
+	p.Close()
+	if err := pc.update(context.Background(), &reg, actionUpdate, attrs); err == nil {
+		t.Error("wanted error from a provider down")
+	}
+}
+
+func TestRegistrations_Forwarding(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	p := newTestProvider(map[string]Attribute{"pressure": {Value: 1000.0, Type: "Number"}})
+	defer p.Close()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if body != "" {
+			req.Header.Set("Content-Type", contentTypeJSON)
+		}
+		req.Header.Set(headerService, "smartcity")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/v2/entities/", `{"id": "E1", "type": "Room", "temperature": {"value": 21}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatal(gotWanted(w.Code, http.StatusCreated))
+	}
+	reg := `{"dataProvided": {"entities": [{"id": "E1", "type": "Room"}], "attrs": ["pressure"]},
+		"provider": {"http": {"url": "` + p.url() + `"}}}`
+	w = do("POST", "/v2/registrations/", reg)
+	if w.Code != http.StatusCreated {
+		t.Fatal(gotWanted(w.Code, http.StatusCreated))
+	}
+	location := w.Header().Get("Location")
+	if w = do("GET", location, ""); w.Code != http.StatusOK {
+		t.Error(gotWanted(w.Code, http.StatusOK))
+	}
+
+	// stored and provided attributes together
+	w = do("GET", "/v2/entities/E1?type=Room&options=keyValues", "")
+	var kv object
+	json.Unmarshal(w.Body.Bytes(), &kv)
+	if kv["temperature"] != 21.0 || kv["pressure"] != 1000.0 {
+		t.Error(gotWanted(kv, "temperature and pressure"))
+	}
+	w = do("GET", "/v2/entities/E1/attrs/pressure/value?type=Room", "")
+	if got := strings.TrimSpace(w.Body.String()); got != "1000" {
+		t.Error(gotWanted(got, "1000"))
+	}
+
+	// the provided one goes to the provider, the stored one stays
+	w = do("PATCH", "/v2/entities/E1/attrs?type=Room", `{"temperature": {"value": 22}, "pressure": {"value": 990}}`)
+	if w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	last := p.bodies[len(p.bodies)-1]
+	if last["actionType"] != actionUpdate {
+		t.Error(gotWanted(last["actionType"], actionUpdate))
+	}
+	if a, err := srv.Store().GetAttr(testCtx, EntityID{ID: "E1", Type: "Room", Service: "smartcity"}, "temperature"); err != nil || a.Value != 22.0 {
+		t.Error(gotWanted(a.Value, 22.0), err)
+	}
+
+	// provider down
+	p.Close()
+	w = do("GET", "/v2/entities/E1?type=Room", "")
+	if w.Code != http.StatusOK || w.Header().Get("Warning") == "" {
+		t.Error(gotWanted(w.Code, "200 with a warning"))
+	}
+	w = do("GET", "/v2/entities/E1/attrs/pressure?type=Room", "")
+	if w.Code != http.StatusBadGateway {
+		t.Error(gotWanted(w.Code, http.StatusBadGateway))
+	}
+	w = do("PATCH", "/v2/entities/E1/attrs?type=Room", `{"temperature": {"value": 23}, "pressure": {"value": 980}}`)
+	if w.Code != 422 || !strings.Contains(w.Body.String(), `"attrs":["pressure"]`) {
+		t.Error(gotWanted(w.Code, 422), w.Body.String())
+	}
+
+	if w = do("DELETE", location, ""); w.Code != http.StatusNoContent {
+		t.Error(gotWanted(w.Code, http.StatusNoContent))
+	}
+	regs, err := srv.Store().ListRegistrations(testCtx, "smartcity", 10, 0)
+	if err != nil || len(regs) != 0 {
+		t.Error(gotWanted(regs, "none"), err)
+	}
+}
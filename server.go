@@ -0,0 +1,280 @@
+package gorrion
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Server is a broker, with its own store, configuration and logger. Several of
+// them can run in the same process.
+type Server struct {
+	config Config
+	store  *Store
+	// the store was opened by the server, which has to close it
+	ownStore bool
+
+	logger    *slog.Logger
+	logLevel  *slog.LevelVar
+	logOutput io.Writer
+
+	defaultTimeout time.Duration
+	routeTimeouts  map[string]time.Duration
+
+	started time.Time
+	// set once the server starts shutting down
+	draining int32
+
+	featuresMu sync.Mutex
+	features   map[string]bool
+
+	metrics *serverMetrics
+	// nil if anyone can do anything
+	auth        *authorizer
+	rateLimiter *rateLimiter
+	// nil if no browser client is allowed
+	cors *corsPolicy
+	// for the requests to the context providers
+	forwardClient *http.Client
+	// the JSON-LD contexts known to the NGSI-LD API
+	ldContexts *ldContexts
+
+	tracerProvider trace.TracerProvider
+	tracer         trace.Tracer
+	// W3C traceparent, in and out
+	propagator propagation.TextMapPropagator
+	// the exporter of the spans was set up by the server, which has to flush it
+	ownTracerProvider *sdktrace.TracerProvider
+
+	handler http.Handler
+}
+
+// ServerOption sets up a server built by NewServer
+type ServerOption func(srv *Server)
+
+// WithConfig sets the configuration of the server, DefaultConfig() if not
+// given. Only the settings about the store and the requests apply, listening
+// is left to the caller of Handler.
+func WithConfig(c Config) ServerOption {
+	return func(srv *Server) {
+		srv.config = c
+	}
+}
+
+// WithStore makes the server use st, instead of opening a store of its own
+// with the settings in its configuration. The store is not closed by Close, so
+// it can be shared.
+func WithStore(st *Store) ServerOption {
+	return func(srv *Server) {
+		srv.store = st
+	}
+}
+
+// WithLogger makes the server log to l, instead of to the output of
+// WithLogOutput in the format of its configuration. Its level is still the
+// one of the configuration, and can be raised at runtime.
+func WithLogger(l *slog.Logger) ServerOption {
+	return func(srv *Server) {
+		srv.logger = l
+	}
+}
+
+// WithLogOutput makes the server log to w, os.Stderr if not given
+func WithLogOutput(w io.Writer) ServerOption {
+	return func(srv *Server) {
+		srv.logOutput = w
+	}
+}
+
+// WithTracerProvider makes the server trace requests with tp, instead of the
+// exporter of its configuration
+func WithTracerProvider(tp trace.TracerProvider) ServerOption {
+	return func(srv *Server) {
+		srv.tracerProvider = tp
+	}
+}
+
+func newServer() *Server {
+	level := new(slog.LevelVar)
+	// the global provider, a no-op one unless set by the program
+	tp := otel.GetTracerProvider()
+	return &Server{
+		config:         DefaultConfig(),
+		logger:         slog.New(levelHandler{newLogHandler(os.Stderr, logFormatText), level}),
+		logLevel:       level,
+		logOutput:      os.Stderr,
+		defaultTimeout: DefaultTimeout,
+		routeTimeouts:  RouteTimeouts,
+		started:        time.Now(),
+		metrics:        newServerMetrics(),
+		rateLimiter:    newRateLimiter(Config{}),
+		forwardClient:  &http.Client{Timeout: DefaultConfig().ForwardTimeout},
+		ldContexts:     &ldContexts{server: newLDContext()},
+		tracerProvider: tp,
+		tracer:         tp.Tracer(tracerName),
+		propagator:     propagation.TraceContext{},
+		features: map[string]bool{
+			"bulkOperations":   true,
+			"cursorPagination": true,
+			"geoQueries":       true,
+			"jsonPatch":        true,
+			"mergePatch":       true,
+			"metrics":          true,
+			"ngsi-ld":          true,
+			"ngsiv1":           true,
+			"registrations":    true,
+			"streaming":        true,
+		},
+	}
+}
+
+// NewServer builds a server with opts, connecting to its store unless one is
+// given with WithStore
+func NewServer(opts ...ServerOption) (*Server, error) {
+	srv := newServer()
+	base := srv.logger
+	baseTP := srv.tracerProvider
+	for _, opt := range opts {
+		opt(srv)
+	}
+
+	level, err := ParseLogLevel(srv.config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	srv.logLevel.Set(level)
+	var h slog.Handler
+	if srv.logger != base {
+		h = srv.logger.Handler()
+	} else {
+		h = newLogHandler(srv.logOutput, srv.config.LogFormat)
+	}
+	srv.logger = slog.New(levelHandler{h, srv.logLevel})
+
+	srv.rateLimiter = newRateLimiter(srv.config)
+	srv.forwardClient = &http.Client{Timeout: srv.config.ForwardTimeout}
+	if srv.config.AuthFile != "" {
+		if srv.auth, err = loadAuthorizer(srv.config.AuthFile); err != nil {
+			return nil, err
+		}
+		srv.features["auth"] = true
+	}
+	if srv.ldContexts, err = loadLDContexts(srv.config.NGSILDContextFile, srv.config.NGSILDContextURL); err != nil {
+		return nil, err
+	}
+	if srv.cors = newCORSPolicy(srv.config); srv.cors != nil {
+		srv.features["cors"] = true
+	}
+
+	if srv.store == nil {
+		st, err := OpenStore(srv.config.Store)
+		if err != nil {
+			return nil, err
+		}
+		srv.store, srv.ownStore = st, true
+		st.logger = srv.logger
+	}
+	srv.metrics.registerStore(srv.store)
+	if c := srv.store.config; len(c.HistoryTypes) > 0 || len(c.HistoryAttrs) > 0 {
+		srv.features["history"] = true
+	}
+	if len(srv.store.config.VersionTypes) > 0 {
+		srv.features["versions"] = true
+	}
+	if srv.tracerProvider == baseTP && srv.config.TraceExporter != traceExporterNone {
+		tp, err := newTracerProvider(srv.config)
+		if err != nil {
+			srv.Close()
+			return nil, err
+		}
+		srv.tracerProvider, srv.ownTracerProvider = tp, tp
+	}
+	srv.tracer = srv.tracerProvider.Tracer(tracerName)
+	srv.defaultTimeout = srv.config.RequestTimeout
+	srv.routeTimeouts = map[string]time.Duration{}
+	for _, name := range bulkRoutes {
+		srv.routeTimeouts[name] = srv.config.BulkTimeout
+	}
+	srv.handler = srv.routes()
+	return srv, nil
+}
+
+// Handler returns the handler of all the routes of the server
+func (srv *Server) Handler() http.Handler {
+	return srv.handler
+}
+
+// Store returns the store of the server
+func (srv *Server) Store() *Store {
+	return srv.store
+}
+
+// Close releases the store, if it was opened by the server, and flushes the
+// spans not exported yet. The handler must not be used afterwards.
+func (srv *Server) Close() error {
+	if srv.ownStore {
+		srv.store.Close()
+	}
+	if srv.ownTracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), srv.config.ShutdownTimeout)
+		defer cancel()
+		return srv.ownTracerProvider.Shutdown(ctx)
+	}
+	return nil
+}
+
+// Logger returns the logger of the server
+func (srv *Server) Logger() *slog.Logger {
+	return srv.logger
+}
+
+// LogLevel returns the level of the log of the server
+func (srv *Server) LogLevel() slog.Level {
+	return srv.logLevel.Level()
+}
+
+// SetLogLevel changes the level of the log of the server
+func (srv *Server) SetLogLevel(l slog.Level) {
+	srv.logLevel.Set(l)
+}
+
+// Drain makes the readiness check fail from now on, so that load balancers
+// stop sending requests before the server shuts down. Requests are still
+// served as usual.
+func (srv *Server) Drain() {
+	atomic.StoreInt32(&srv.draining, 1)
+}
+
+func (srv *Server) isDraining() bool {
+	return atomic.LoadInt32(&srv.draining) == 1
+}
+
+// EnableFeature adds name to the features reported by /version
+func (srv *Server) EnableFeature(name string) {
+	srv.featuresMu.Lock()
+	defer srv.featuresMu.Unlock()
+	srv.features[name] = true
+}
+
+// Features returns the features enabled, sorted
+func (srv *Server) Features() []string {
+	srv.featuresMu.Lock()
+	defer srv.featuresMu.Unlock()
+	names := make([]string, 0, len(srv.features))
+	for name := range srv.features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
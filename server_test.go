@@ -0,0 +1,76 @@
+package gorrion
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewServer_InvalidConfig(t *testing.T) {
+	c := DefaultConfig()
+	c.Store.ReadMode = "any"
+	if _, err := NewServer(WithConfig(c)); err == nil {
+		t.Error("wanted error for invalid config")
+	}
+}
+
+func TestNewServer_Timeouts(t *testing.T) {
+	c := DefaultConfig()
+	c.RequestTimeout = time.Second
+	c.BulkTimeout = time.Hour
+	// a store given, so nothing to connect to
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if srv.defaultTimeout != time.Second {
+		t.Error(gotWanted(srv.defaultTimeout, time.Second))
+	}
+	for _, name := range bulkRoutes {
+		if got := srv.routeTimeouts[name]; got != time.Hour {
+			t.Error(gotWanted(got, time.Hour) + " (" + name + ")")
+		}
+	}
+	if got := RouteTimeouts[RouteListEntities]; got != 5*time.Minute {
+		t.Error("default deadlines changed: " + gotWanted(got, 5*time.Minute))
+	}
+}
+
+func TestServer_TwoBrokers(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	var brokers []*Server
+	for _, name := range []string{"TEST_ent_a", "TEST_ent_b"} {
+		c := DefaultConfig()
+		c.Store = testStoreConfig()
+		c.Store.EntitiesColl = name
+		srv, err := NewServer(WithConfig(c))
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		defer srv.Close()
+		dropTestCollection(t, srv.Store())
+		brokers = append(brokers, srv)
+	}
+
+	body := []byte(`{"id": "E1", "type": "T", "temperature": {"value": 21}}`)
+	req := httptest.NewRequest("POST", "/v2/entities", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	w := httptest.NewRecorder()
+	brokers[0].Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatal(gotWanted(w.Code, http.StatusCreated))
+	}
+
+	for i, wanted := range []int{http.StatusOK, http.StatusNotFound} {
+		w = httptest.NewRecorder()
+		brokers[i].Handler().ServeHTTP(w, httptest.NewRequest("GET", "/v2/entities/E1?type=T", nil))
+		if w.Code != wanted {
+			t.Errorf("broker %d: %s", i, gotWanted(w.Code, wanted))
+		}
+	}
+}
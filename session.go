@@ -0,0 +1,271 @@
+package gorrion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/mgo.v2"
+)
+
+// StoreConfig are the settings of the connection to MongoDB
+type StoreConfig struct {
+	URL               string
+	DB                string
+	EntitiesColl      string
+	RegistrationsColl string
+	HistoryColl       string
+	VersionsColl      string
+
+	// the values of all the attributes of the entities of HistoryTypes, and
+	// of the attributes in HistoryAttrs of any entity, are kept in
+	// HistoryColl for HistoryRetention, forever if zero, and added up by
+	// minute and hour for HistoryRollupRetention, forever if zero
+	HistoryTypes           []string
+	HistoryAttrs           []string
+	HistoryRetention       time.Duration
+	HistoryRollupRetention time.Duration
+
+	// the prior versions of the entities of VersionTypes are kept in
+	// VersionsColl, for reading them as they were at any time
+	VersionTypes []string
+
+	// most sockets open to a single server, 0 for the driver default (4096)
+	PoolLimit int
+	// for connecting and for finding a primary
+	DialTimeout time.Duration
+	// for every round trip, when the operation has no deadline of its own
+	SocketTimeout time.Duration
+
+	// Write concern. WMode, as in "majority", takes precedence over W.
+	W        int
+	WMode    string
+	J        bool
+	WTimeout time.Duration
+
+	// Read preference, one of primary, primaryPreferred, secondary,
+	// secondaryPreferred or nearest. ListingReadMode is for listings, which
+	// can be served by secondaries to spare the primary.
+	ReadMode        string
+	ListingReadMode string
+}
+
+// DefaultStoreConfig returns the settings used by StartStore
+func DefaultStoreConfig() StoreConfig {
+	return StoreConfig{
+		URL:               "localhost",
+		DB:                "gorrion",
+		EntitiesColl:      "ent",
+		RegistrationsColl: "reg",
+		HistoryColl:       "hist",
+		VersionsColl:      "ver",
+		DialTimeout:       10 * time.Second,
+		SocketTimeout:     time.Minute,
+		W:                 1,
+		ReadMode:          "primary",
+		ListingReadMode:   "primary",
+	}
+}
+
+var readModes = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// ParseReadMode returns the mode for a read preference name
+func ParseReadMode(s string) (mgo.Mode, error) {
+	mode, ok := readModes[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown read preference %q", s)
+	}
+	return mode, nil
+}
+
+// Validate checks the settings are usable, before connecting
+func (c StoreConfig) Validate() error {
+	switch {
+	case c.URL == "":
+		return errors.New("missing MongoDB URL")
+	case c.DB == "":
+		return errors.New("missing database name")
+	case c.EntitiesColl == "":
+		return errors.New("missing entities collection name")
+	case c.RegistrationsColl == "":
+		return errors.New("missing registrations collection name")
+	case c.HistoryColl == "":
+		return errors.New("missing history collection name")
+	case c.VersionsColl == "":
+		return errors.New("missing versions collection name")
+	case c.PoolLimit < 0:
+		return errors.New("pool limit cannot be negative")
+	case c.DialTimeout < 0 || c.SocketTimeout < 0 || c.WTimeout < 0 || c.HistoryRetention < 0 ||
+		c.HistoryRollupRetention < 0:
+		return errors.New("timeouts cannot be negative")
+	case c.W < 0:
+		return errors.New("write concern w cannot be negative")
+	case c.HistoryRollupRetention != 0 && (c.HistoryRetention == 0 || c.HistoryRollupRetention < c.HistoryRetention):
+		return errors.New("history rollups cannot be kept for less than the history")
+	}
+	if _, err := ParseReadMode(c.ReadMode); err != nil {
+		return err
+	}
+	if _, err := ParseReadMode(c.ListingReadMode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// safe is the write concern of the settings
+func (c StoreConfig) safe() *mgo.Safe {
+	return &mgo.Safe{
+		W:        c.W,
+		WMode:    c.WMode,
+		J:        c.J,
+		WTimeout: int(c.WTimeout / time.Millisecond),
+	}
+}
+
+// Store keeps the entities in MongoDB. It is safe for concurrent use.
+type Store struct {
+	config StoreConfig
+	// every session used is copied from this one
+	session *mgo.Session
+	// read preference of listings
+	listingMode mgo.Mode
+	// time taken by each operation
+	ops *prometheus.HistogramVec
+	// writes done but not recorded, see recordFailed
+	recordFailures *prometheus.CounterVec
+	logger         *slog.Logger
+}
+
+// OpenStore connects to MongoDB with the settings in c. Every session used
+// afterwards is copied from this first one, taking its sockets from the same
+// pool and inheriting its write concern, read preference and timeouts.
+func OpenStore(c StoreConfig) (*Store, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	info, err := mgo.ParseURL(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if c.DialTimeout > 0 {
+		info.Timeout = c.DialTimeout
+	}
+	info.PoolLimit = c.PoolLimit
+	enableDriverStats()
+	sess, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	if c.SocketTimeout > 0 {
+		sess.SetSocketTimeout(c.SocketTimeout)
+	}
+	sess.SetSafe(c.safe())
+	mode, _ := ParseReadMode(c.ReadMode)
+	sess.SetMode(mode, true)
+
+	st := &Store{config: c, session: sess, ops: newStoreOps(), recordFailures: newRecordFailures(),
+		logger: slog.Default()}
+	st.listingMode, _ = ParseReadMode(c.ListingReadMode)
+	if err = st.ensureIndexes(); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close disconnects from MongoDB. The sessions still in use are not affected.
+func (st *Store) Close() {
+	st.session.Close()
+}
+
+// Ping checks MongoDB answers, before the deadline of ctx if it has one
+func (st *Store) Ping(ctx context.Context) error {
+	if st == nil {
+		return ErrStoreUnavailable
+	}
+	if err := ctx.Err(); err != nil {
+		return contextErr(err)
+	}
+	sess := st.session.Copy()
+	defer sess.Close()
+	if d, ok := ctx.Deadline(); ok {
+		// finding a primary to talk to counts as well
+		sess.SetSyncTimeout(time.Until(d))
+		sess.SetSocketTimeout(time.Until(d))
+	}
+	return sess.Ping()
+}
+
+// requestSession is the session of a request, for the store it belongs to
+type requestSession struct {
+	store   *Store
+	session *mgo.Session
+}
+
+type sessionKey struct{}
+
+// withSession returns a context carrying a session of its own, for all the
+// store operations of a request, and the function to release it when the
+// request is done
+func (st *Store) withSession(ctx context.Context) (context.Context, func()) {
+	if st == nil || st.session == nil {
+		// no store connected, nothing to do with it
+		return ctx, func() {}
+	}
+	sess := st.session.Copy()
+	return context.WithValue(ctx, sessionKey{}, requestSession{st, sess}), sess.Close
+}
+
+// sessionFor returns the session of the request ctx belongs to or, out of a
+// request, a new one. The function returned releases it.
+func (st *Store) sessionFor(ctx context.Context) (*mgo.Session, func()) {
+	if rs, ok := ctx.Value(sessionKey{}).(requestSession); ok && rs.store == st {
+		return rs.session, func() {}
+	}
+	sess := st.session.Copy()
+	return sess, sess.Close
+}
+
+// server error codes meaning that the primary is gone or stepping down
+var notPrimaryCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isConnErr tells if err comes from losing the connection to the server, as
+// happens on a failover, so that the session has to be refreshed to pick a
+// new socket. Timeouts are not, another socket would time out as well.
+func isConnErr(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *mgo.QueryError:
+		return notPrimaryCodes[e.Code]
+	case *mgo.LastError:
+		return notPrimaryCodes[e.Code]
+	case net.Error:
+		return !e.Timeout()
+	}
+	if err == io.EOF {
+		return true
+	}
+	msg := err.Error()
+	return msg == "no reachable servers" || msg == "Closed explicitly" || strings.HasPrefix(msg, "not master")
+}
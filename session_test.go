@@ -0,0 +1,177 @@
+package gorrion
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+func TestParseReadMode(t *testing.T) {
+	for s, wanted := range readModes {
+		got, err := ParseReadMode(s)
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if got != wanted {
+			t.Error(gotWanted(got, wanted))
+		}
+	}
+	if _, err := ParseReadMode("secondaries"); err == nil {
+		t.Error("wanted error for unknown read preference")
+	}
+}
+
+func TestStoreConfig_Validate(t *testing.T) {
+	if err := DefaultStoreConfig().Validate(); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var invalid = []func(c *StoreConfig){
+		func(c *StoreConfig) { c.URL = "" },
+		func(c *StoreConfig) { c.DB = "" },
+		func(c *StoreConfig) { c.EntitiesColl = "" },
+		func(c *StoreConfig) { c.HistoryColl = "" },
+		func(c *StoreConfig) { c.VersionsColl = "" },
+		func(c *StoreConfig) { c.HistoryRetention = -time.Hour },
+		func(c *StoreConfig) { c.HistoryRetention, c.HistoryRollupRetention = 48*time.Hour, time.Hour },
+		func(c *StoreConfig) { c.HistoryRollupRetention = time.Hour },
+		func(c *StoreConfig) { c.PoolLimit = -1 },
+		func(c *StoreConfig) { c.SocketTimeout = -time.Second },
+		func(c *StoreConfig) { c.WTimeout = -time.Second },
+		func(c *StoreConfig) { c.W = -1 },
+		func(c *StoreConfig) { c.ReadMode = "any" },
+		func(c *StoreConfig) { c.ListingReadMode = "" },
+	}
+	for i, change := range invalid {
+		c := DefaultStoreConfig()
+		change(&c)
+		if err := c.Validate(); err == nil {
+			t.Errorf("wanted error for invalid config (%d)", i)
+		}
+	}
+}
+
+func TestStoreConfig_Safe(t *testing.T) {
+	c := StoreConfig{W: 2, WMode: "majority", J: true, WTimeout: 1500 * time.Millisecond}
+	wanted := &mgo.Safe{W: 2, WMode: "majority", J: true, WTimeout: 1500}
+	if got := c.safe(); *got != *wanted {
+		t.Error(gotWanted(got, wanted))
+	}
+}
+
+// timeoutErr is a net.Error for a timeout
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestIsConnErr(t *testing.T) {
+	var cases = map[error]bool{
+		nil:                                false,
+		io.EOF:                             true,
+		errors.New("no reachable servers"): true,
+		errors.New("not master"):           true,
+		&mgo.QueryError{Code: 10107}:       true,
+		&mgo.LastError{Code: 189}:          true,
+		&mgo.QueryError{Code: 11000}:       false,
+		&net.OpError{Op: "read", Err: io.ErrUnexpectedEOF}: true,
+		timeoutErr{}:      false,
+		mgo.ErrNotFound:   false,
+		ErrNotFoundEntity: false,
+	}
+	for err, wanted := range cases {
+		if got := isConnErr(err); got != wanted {
+			t.Errorf("%v: %s", err, gotWanted(got, wanted))
+		}
+	}
+}
+
+func TestWithSession(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	ctx, release := defaultStore.withSession(testCtx)
+	defer release()
+
+	s1, release1 := defaultStore.sessionFor(ctx)
+	s2, release2 := defaultStore.sessionFor(ctx)
+	if s1 != s2 {
+		t.Error("operations in a request should share its session")
+	}
+	release1()
+	release2()
+	if err := s1.Ping(); err != nil {
+		t.Error("session released before the request was done: " + unexpected(err))
+	}
+
+	s3, release3 := defaultStore.sessionFor(testCtx)
+	defer release3()
+	if s3 == s1 {
+		t.Error("operations out of a request should get a session of their own")
+	}
+
+	// works as well through the request session
+	if err := CreateEntity(ctx, NewEntity(EntityID{ID: "ID", Type: "T"})); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if _, err := GetEntity(ctx, EntityID{ID: "ID", Type: "T"}); err != nil {
+		t.Error(unexpected(err))
+	}
+}
+
+func TestStartStoreConfig(t *testing.T) {
+
+	setupTestDB(t)
+	StopStore()
+
+	c := testStoreConfig()
+	c.PoolLimit = 8
+	c.WMode = "majority"
+	c.J = true
+	c.WTimeout = 5 * time.Second
+	c.ListingReadMode = "secondaryPreferred"
+	if err := StartStoreConfig(c); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer teardownTestDB(t)
+
+	if got := defaultStore.session.Safe(); *got != *c.safe() {
+		t.Error(gotWanted(got, c.safe()))
+	}
+	if got := defaultStore.session.Mode(); got != mgo.Primary {
+		t.Error(gotWanted(got, mgo.Primary))
+	}
+	if got := defaultStore.listingMode; got != mgo.SecondaryPreferred {
+		t.Error(gotWanted(got, mgo.SecondaryPreferred))
+	}
+
+	e := NewEntity(EntityID{ID: "ID", Type: "T", Service: "S", ServicePath: "SP"})
+	if err := CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	ei, err := (&Query{}).Get(testCtx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer ei.Close()
+	if got := ei.session.Mode(); got != mgo.SecondaryPreferred {
+		t.Error(gotWanted(got, mgo.SecondaryPreferred))
+	}
+	var got Entity
+	if !ei.Next(&got) || got.ID != e.ID {
+		t.Error(gotWanted(got.ID, e.ID))
+	}
+}
+
+func TestStartStoreConfig_Invalid(t *testing.T) {
+	c := DefaultStoreConfig()
+	c.ReadMode = "any"
+	if err := StartStoreConfig(c); err == nil {
+		t.Error("wanted error for invalid config")
+	}
+}
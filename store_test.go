@@ -1,6 +1,7 @@
 package gorrion
 
 import (
+	"context"
 	"testing"
 
 	"gopkg.in/mgo.v2"
@@ -10,29 +11,53 @@ import (
 
 var population []*Entity
 
-func setupTestDB(t *testing.T) {
-	var err error
+// context for the store operations in tests
+var testCtx = context.Background()
 
-	url = "localhost"
-	db = "TEST_gorrion"
-	entitiesColl = "TEST_ent"
+// testStoreConfig is the configuration of the stores in tests
+func testStoreConfig() StoreConfig {
+	c := DefaultStoreConfig()
+	c.DB = "TEST_gorrion"
+	c.EntitiesColl = "TEST_ent"
+	c.RegistrationsColl = "TEST_reg"
+	c.HistoryColl = "TEST_hist"
+	c.VersionsColl = "TEST_ver"
+	return c
+}
 
-	err = StartStore()
+func setupTestDB(t *testing.T) {
+	err := StartStoreConfig(testStoreConfig())
 	if err != nil {
 		t.Fatal(err)
 	}
+	dropTestCollection(t, defaultStore)
+}
 
-	err = initialSession.DB(db).C(entitiesColl).DropCollection()
-	if err != nil {
-		if mgoErr, ok := err.(*mgo.QueryError); ok {
-			// 26 <-> ns not found => collection does not exist
-			if mgoErr.Code != 26 {
+// dropTestCollection leaves the collections of st empty, but indexed
+func dropTestCollection(t *testing.T, st *Store) {
+	names := []string{st.config.EntitiesColl, st.config.RegistrationsColl, st.config.HistoryColl,
+		st.config.VersionsColl}
+	for _, r := range rollupPeriods {
+		names = append(names, st.rollupColl(r.period))
+	}
+	for _, name := range names {
+		err := st.session.DB(st.config.DB).C(name).DropCollection()
+		if err != nil {
+			if mgoErr, ok := err.(*mgo.QueryError); ok {
+				// 26 <-> ns not found => collection does not exist
+				if mgoErr.Code != 26 {
+					t.Fatal(err)
+				}
+			} else { // not a mgo.QueryError
 				t.Fatal(err)
 			}
-		} else { // not a mgo.QueryError
-			t.Fatal(err)
 		}
 	}
+	// indexes went away with the collection
+	st.session.ResetIndexCache()
+	if err := st.ensureIndexes(); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func teardownTestDB(t *testing.T) {
@@ -65,7 +90,7 @@ func populateDB(t *testing.T) {
 				"status":      {Value: d.status, Md: emptyMap},
 			},
 		}
-		err := CreateEntity(e)
+		err := CreateEntity(testCtx, e)
 		if err != nil {
 			t.Fatal(err)
 		}
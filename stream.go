@@ -0,0 +1,111 @@
+package gorrion
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// trailerError tells the error that cut a streamed listing short, found once
+// its headers were sent
+const trailerError = "Fiware-Error"
+
+// entityFormatter renders an entity as it is sent to the client
+type entityFormatter func(e *Entity) (interface{}, error)
+
+// arrayWriter writes a JSON array element by element
+type arrayWriter struct {
+	w      *bufio.Writer
+	pretty bool
+	n      int
+}
+
+func (aw *arrayWriter) open() error {
+	_, err := aw.w.WriteString("[")
+	return err
+}
+
+func (aw *arrayWriter) write(v interface{}) error {
+	var (
+		data []byte
+		err  error
+	)
+	if aw.pretty {
+		data, err = json.MarshalIndent(v, "\t", "\t")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	if aw.n > 0 {
+		aw.w.WriteString(",")
+	}
+	if aw.pretty {
+		aw.w.WriteString("\n\t")
+	}
+	aw.n++
+	_, err = aw.w.Write(data)
+	return err
+}
+
+func (aw *arrayWriter) close() error {
+	if aw.pretty && aw.n > 0 {
+		aw.w.WriteString("\n")
+	}
+	aw.w.WriteString("]\n")
+	return aw.w.Flush()
+}
+
+// streamEntities writes the entities from eIter to w as a JSON array, encoding
+// each one when it is read, so memory use does not depend on how many there are.
+// An error before anything is written is returned, to be answered as usual.
+// Once the array has started, an error is sent as its last element, in the same
+// format as any other error, and in the Fiware-Error trailer.
+func streamEntities(log *slog.Logger, w http.ResponseWriter, eIter *EntityIter, format entityFormatter, pretty bool) error {
+	defer eIter.Close()
+
+	// the first entity decides whether there is something to stream
+	var first interface{}
+	e := &Entity{}
+	hasFirst := eIter.Next(e)
+	if err := eIter.Err(); err != nil {
+		return err
+	}
+	if hasFirst {
+		var err error
+		if first, err = format(e); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Add("Trailer", trailerError)
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+
+	aw := &arrayWriter{w: bufio.NewWriter(w), pretty: pretty}
+	err := aw.open()
+	if hasFirst && err == nil {
+		err = aw.write(first)
+		for e := (&Entity{}); err == nil && eIter.Next(e); e = (&Entity{}) {
+			var r interface{}
+			if r, err = format(e); err == nil {
+				err = aw.write(r)
+			}
+		}
+		if err == nil {
+			err = eIter.Err()
+		}
+	}
+	if err != nil {
+		if err != ErrCanceled {
+			// nobody to tell if the client is gone
+			log.Error("streaming entities", "error", err)
+		}
+		aw.write(json.RawMessage(ErrToJSON(err)))
+		w.Header().Set(trailerError, err.Error())
+	}
+	aw.close()
+	return nil
+}
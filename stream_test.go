@@ -0,0 +1,172 @@
+package gorrion
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestArrayWriter(t *testing.T) {
+	var cases = []struct {
+		elems  []interface{}
+		pretty bool
+		wanted string
+	}{
+		{nil, false, "[]\n"},
+		{[]interface{}{1}, false, "[1]\n"},
+		{[]interface{}{1, "a", map[string]int{"b": 2}}, false, `[1,"a",{"b":2}]` + "\n"},
+		{nil, true, "[]\n"},
+		{[]interface{}{1, map[string]int{"b": 2}}, true, "[\n\t1,\n\t{\n\t\t\"b\": 2\n\t}\n]\n"},
+	}
+	for i, c := range cases {
+		var buf bytes.Buffer
+		aw := &arrayWriter{w: bufio.NewWriter(&buf), pretty: c.pretty}
+		aw.open()
+		for _, e := range c.elems {
+			if err := aw.write(e); err != nil {
+				t.Fatal(unexpected(err))
+			}
+		}
+		if err := aw.close(); err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if got := buf.String(); got != c.wanted {
+			t.Errorf("wanted %q, got %q (%d)", c.wanted, got, i)
+		}
+	}
+}
+
+func TestStreamEntities(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	for _, options := range []OptionSet{{}, {OptKeyValues: true}, {OptValues: true}} {
+		q := &Query{Limit: 4, OrderBy: []string{"temperature"}}
+		ei, err := q.Get(testCtx, "S", "SP")
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		format := func(e *Entity) (interface{}, error) {
+			return formatEntity(e, options, []string{"temperature"})
+		}
+		w := httptest.NewRecorder()
+		if err = streamEntities(defaultServer.logger, w, ei, format, false); err != nil {
+			t.Fatal(unexpected(err))
+		}
+
+		var wanted []interface{}
+		for _, e := range population[:4] {
+			f, _ := formatEntity(e, options, []string{"temperature"})
+			wanted = append(wanted, f)
+		}
+		var got []interface{}
+		if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if !equalObjects(got, wanted) {
+			t.Error(gotWanted(got, wanted) + fmt.Sprintf("(%s)", options))
+		}
+		resp := w.Result()
+		if ei.NextCursor() == "" {
+			t.Errorf("missing next page cursor (%s)", options)
+		}
+		if e := resp.Trailer.Get(trailerError); e != "" {
+			t.Errorf("unexpected error trailer %s (%s)", e, options)
+		}
+	}
+}
+
+func TestStreamEntities_ErrorMidStream(t *testing.T) {
+
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	populateDB(t)
+
+	// the third entity cannot be rendered
+	e := NewEntity(EntityID{ID: "I2.5", Type: "T1", Service: "S", ServicePath: "SP"})
+	e.Attrs["temperature"] = Attribute{Value: 30.0}
+	if err := CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	ei, err := (&Query{OrderBy: []string{"temperature"}}).Get(testCtx, "S", "SP")
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	format := func(e *Entity) (interface{}, error) {
+		return formatEntity(e, OptionSet{OptValues: true}, []string{"status"})
+	}
+	w := httptest.NewRecorder()
+	if err = streamEntities(defaultServer.logger, w, ei, format, false); err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	var got []interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	wanted := []interface{}{
+		[]interface{}{"ON"},
+		[]interface{}{"ON"},
+		map[string]interface{}{"error": ErrNotFoundAttr.Error()},
+	}
+	if !equalObjects(got, wanted) {
+		t.Error(gotWanted(got, wanted))
+	}
+	if got := w.Result().Trailer.Get(trailerError); got != ErrNotFoundAttr.Error() {
+		t.Error(gotWanted(got, ErrNotFoundAttr.Error()))
+	}
+}
+
+func TestGetEntities_NextPage(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(defaultStore))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	for _, id := range []string{"E1", "E2", "E3", "E4", "E5"} {
+		if err = CreateEntity(testCtx, NewEntity(EntityID{ID: id, Type: "T", Service: "S"})); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+
+	var ids []interface{}
+	path := "/v2/entities/?limit=2&orderBy=id&options=keyValues"
+	for pages := 1; ; pages++ {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(headerService, "S")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		var page []map[string]interface{}
+		if err = json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(unexpected(err), w.Body.String())
+		}
+		for _, e := range page {
+			ids = append(ids, e["id"])
+		}
+		next, link := w.Header().Get(headerNextPage), w.Header().Get("Link")
+		if pages == 3 {
+			if next != "" || link != "" {
+				t.Error(gotWanted(next+" "+link, "no next page"))
+			}
+			break
+		}
+		if next == "" || !strings.Contains(link, "cursor="+next) {
+			t.Fatal(gotWanted(next+" "+link, "the next page"), pages)
+		}
+		path = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+	}
+	if wanted := []interface{}{"E1", "E2", "E3", "E4", "E5"}; !equalObjects(ids, wanted) {
+		t.Error(gotWanted(ids, wanted))
+	}
+}
@@ -0,0 +1,125 @@
+package gorrion
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// client certificates asked for when a CA to verify them is configured
+const (
+	tlsClientAuthRequire  = "require"
+	tlsClientAuthOptional = "optional"
+)
+
+// how often the files of the certificates are checked for changes, at most
+var tlsCheckEvery = time.Second
+
+// tlsFiles is the certificate and key of the server, and the CA bundle of the
+// clients, reloaded when they change on disk
+type tlsFiles struct {
+	certFile, keyFile, caFile string
+	clientAuth                tls.ClientAuthType
+	log                       *slog.Logger
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	config   *tls.Config
+}
+
+// TLSConfig returns the TLS configuration of the server, nil if it is not
+// configured to serve HTTPS. The certificates are reloaded when their files
+// change, without restarting.
+func (srv *Server) TLSConfig() (*tls.Config, error) {
+	c := srv.config
+	if c.TLSCertFile == "" {
+		return nil, nil
+	}
+	f := &tlsFiles{
+		certFile: c.TLSCertFile,
+		keyFile:  c.TLSKeyFile,
+		caFile:   c.TLSClientCAFile,
+		log:      srv.logger,
+	}
+	if f.caFile != "" {
+		f.clientAuth = tls.RequireAndVerifyClientCert
+		if c.TLSClientAuth == tlsClientAuthOptional {
+			f.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: f.configForClient,
+	}, nil
+}
+
+// configForClient is the configuration of a new connection, with the
+// certificates in the files as they are now
+func (f *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.checked) >= tlsCheckEvery {
+		f.checked = time.Now()
+		reloaded, err := f.reload()
+		if err != nil {
+			// maybe halfway through replacing them, the old ones are still good
+			f.log.Warn("reloading TLS certificates", "error", err)
+		} else if reloaded {
+			f.log.Info("TLS certificates reloaded", "certFile", f.certFile)
+		}
+	}
+	return f.config, nil
+}
+
+// reload reads the files again if any of them changed, telling whether it did.
+// On error the configuration is kept as it was.
+func (f *tlsFiles) reload() (bool, error) {
+	var modTimes [3]time.Time
+	for i, name := range []string{f.certFile, f.keyFile, f.caFile} {
+		if name == "" {
+			continue
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if f.config != nil && modTimes == f.modTimes {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return false, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		// as net/http sets them up for its own configuration
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("%s: no certificates", f.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = f.clientAuth
+	}
+	f.config, f.modTimes = config, modTimes
+	return true, nil
+}
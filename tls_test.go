@@ -0,0 +1,228 @@
+package gorrion
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue returns a certificate for tmpl signed by ca, self-signed if nil
+func issue(t *testing.T, tmpl *x509.Certificate, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func testCA(t *testing.T) *testCert {
+	return issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func serverCert(t *testing.T, ca *testCert) *testCert {
+	return issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func clientCert(t *testing.T, ca *testCert, name string, dnsNames ...string) *testCert {
+	return issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    dnsNames,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+// write writes the certificate and the key of c in dir, as cert.pem and
+// key.pem, returning their names
+func (c *testCert) write(t *testing.T, dir string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	writePEM(t, certFile, "CERTIFICATE", c.cert.Raw)
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+func writePEM(t *testing.T, name, typ string, der []byte) {
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(unexpected(err))
+	}
+}
+
+func TestTLSConfig_None(t *testing.T) {
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	config, err := srv.TLSConfig()
+	if err != nil || config != nil {
+		t.Error(gotWanted(config, nil), unexpected(err))
+	}
+}
+
+func TestTLSConfig_Reload(t *testing.T) {
+	defer func(d time.Duration) { tlsCheckEvery = d }(tlsCheckEvery)
+	tlsCheckEvery = 0
+
+	ca := testCA(t)
+	first := serverCert(t, ca)
+	dir := t.TempDir()
+	c := DefaultConfig()
+	c.TLSCertFile, c.TLSKeyFile = first.write(t, dir)
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	config, err := srv.TLSConfig()
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	served := func() *x509.Certificate {
+		t.Helper()
+		forClient, err := config.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		cert, err := x509.ParseCertificate(forClient.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		return cert
+	}
+	if got := served(); !got.Equal(first.cert) {
+		t.Error(gotWanted(got.SerialNumber, first.cert.SerialNumber))
+	}
+
+	second := serverCert(t, ca)
+	second.write(t, dir)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{c.TLSCertFile, c.TLSKeyFile} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+	if got := served(); !got.Equal(second.cert) {
+		t.Error(gotWanted(got.SerialNumber, second.cert.SerialNumber))
+	}
+
+	// halfway through replacing it, the last good one is kept
+	if err := os.WriteFile(c.TLSKeyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if got := served(); !got.Equal(second.cert) {
+		t.Error(gotWanted(got.SerialNumber, second.cert.SerialNumber))
+	}
+}
+
+func TestTLS_ClientCerts(t *testing.T) {
+	ca := testCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	c := DefaultConfig()
+	c.TLSCertFile, c.TLSKeyFile = serverCert(t, ca).write(t, dir)
+	c.TLSClientCAFile = caFile
+	c.TLSClientAuth = tlsClientAuthOptional
+	c.AuthFile = "testdata/auth.yaml"
+	srv, err := NewServer(WithConfig(c), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	config, err := srv.TLSConfig()
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	ts := httptest.NewUnstartedServer(srv.Handler())
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	other := testCA(t)
+	var cases = []struct {
+		name   string
+		cert   *testCert
+		wanted int
+	}{
+		{"none", nil, http.StatusUnauthorized},
+		{"admin by DNS name", clientCert(t, ca, "ops", "ops.example.com"), http.StatusOK},
+		{"operator by common name", clientCert(t, ca, "parking-sensors"), http.StatusForbidden},
+		{"unknown", clientCert(t, ca, "someone"), http.StatusUnauthorized},
+	}
+	for _, cs := range cases {
+		tc := &tls.Config{RootCAs: roots}
+		if cs.cert != nil {
+			tc.Certificates = []tls.Certificate{cs.cert.tlsCertificate()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		resp, err := client.Get(ts.URL + "/admin/log")
+		if err != nil {
+			t.Errorf("%s: %s", cs.name, unexpected(err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != cs.wanted {
+			t.Errorf("%s: %s", cs.name, gotWanted(resp.StatusCode, cs.wanted))
+		}
+	}
+
+	// not signed by the CA of the clients
+	tc := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert(t, other, "ops", "ops.example.com").tlsCertificate()}}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	if resp, err := client.Get(ts.URL + "/admin/log"); err == nil {
+		resp.Body.Close()
+		t.Error("certificate of another CA accepted")
+	}
+}
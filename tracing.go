@@ -0,0 +1,181 @@
+package gorrion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// name of the tracer of the spans of gorrion
+const tracerName = "github.com/crbrox/gorrion"
+
+// where the spans are exported to
+const (
+	traceExporterNone   = "none"
+	traceExporterStdout = "stdout"
+	traceExporterOTLP   = "otlp"
+)
+
+// attributes of the spans, beyond the OpenTelemetry conventions
+const (
+	attrTenant      = attribute.Key("gorrion.tenant")
+	attrServicePath = attribute.Key("gorrion.service_path")
+	attrCorrelator  = attribute.Key("gorrion.correlator")
+	attrEntityType  = attribute.Key("gorrion.entity.type")
+	attrAttrCount   = attribute.Key("gorrion.attrs.count")
+	attrResultSize  = attribute.Key("gorrion.result.size")
+	attrEndUser     = attribute.Key("enduser.id")
+)
+
+// newTracerProvider exports the spans as set by c.TraceExporter, to stdout or
+// to an OTLP collector over HTTP at c.TraceEndpoint. With an empty endpoint the
+// OTEL_EXPORTER_OTLP_* environment variables apply.
+func newTracerProvider(c Config) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch c.TraceExporter {
+	case traceExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case traceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if c.TraceEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.TraceEndpoint))
+		}
+		exp, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", c.TraceExporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "gorrion"),
+		attribute.String("service.version", Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res)), nil
+}
+
+// startSpan starts the span of a request to route, as a child of the one in
+// its traceparent header, if any. The trace is propagated back in the headers
+// of the response.
+func (srv *Server) startSpan(rw http.ResponseWriter, req *http.Request, route, corr string) (context.Context, trace.Span) {
+	ctx := srv.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	name := route
+	if name == "" {
+		name = req.Method
+	}
+	ctx, span := srv.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", req.URL.Path),
+			attrTenant.String(req.Header.Get(headerService)),
+			attrServicePath.String(req.Header.Get(headerServicePath)),
+			attrCorrelator.String(corr),
+		))
+	srv.propagator.Inject(ctx, propagation.HeaderCarrier(rw.Header()))
+	return ctx, span
+}
+
+// endSpan ends the span of a request answered with status, after err if any
+func endSpan(span trace.Span, status int, err error) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if err != nil {
+		span.SetAttributes(attribute.String("error.type", errorType(err)))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// errorType names err for metrics and spans, the unexpected ones as internal
+func errorType(err error) string {
+	if gErr, ok := asGorrionErr(err); ok {
+		return string(gErr)
+	}
+	return "internal"
+}
+
+// storeOp is a store operation in progress, timed and traced as a child of
+// the span of the request
+type storeOp struct {
+	store *Store
+	name  string
+	start time.Time
+	span  trace.Span
+}
+
+func (st *Store) startOp(ctx context.Context, name string, ei EntityID) (context.Context, *storeOp) {
+	// the tracer of the request, if any, a no-op one otherwise
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	ctx, span := tracer.Start(ctx, "store."+name, trace.WithSpanKind(trace.SpanKindClient))
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("db.system.name", "mongodb"),
+			attribute.String("db.operation.name", name),
+		)
+		if st != nil {
+			span.SetAttributes(
+				attribute.String("db.namespace", st.config.DB),
+				attribute.String("db.collection.name", st.getCol(ei)),
+			)
+		}
+		if ei.Type != "" {
+			span.SetAttributes(attrEntityType.String(ei.Type))
+		}
+	}
+	return ctx, &storeOp{store: st, name: name, start: time.Now(), span: span}
+}
+
+// setAttrCount records how many attributes are written
+func (op *storeOp) setAttrCount(n int) {
+	op.span.SetAttributes(attrAttrCount.Int(n))
+}
+
+// setResultSize records how many entities are returned or affected
+func (op *storeOp) setResultSize(n int) {
+	op.span.SetAttributes(attrResultSize.Int(n))
+}
+
+// end finishes the operation, failed with *err if not nil. The errors known
+// to the API are expected outcomes, only the rest mark the span as failed.
+func (op *storeOp) end(err *error) {
+	op.store.timeOp(op.name, op.start)
+	if e := *err; e != nil {
+		op.span.SetAttributes(attribute.String("error.type", errorType(e)))
+		if _, ok := e.(gorrionErr); !ok {
+			op.span.RecordError(e)
+			op.span.SetStatus(codes.Error, e.Error())
+		}
+	}
+	op.span.End()
+}
+
+// setCollection records the collection of an operation not on the entities
+func (op *storeOp) setCollection(name string) {
+	op.span.SetAttributes(attribute.String("db.collection.name", name))
+}
+
+// setQuery records the types the query q is restricted to, if any
+func (op *storeOp) setQuery(q *Query) {
+	if len(q.Type) > 0 {
+		op.span.SetAttributes(attrEntityType.String(strings.Join(q.Type, ",")))
+	}
+}
@@ -0,0 +1,116 @@
+package gorrion
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing_Request(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	srv, err := NewServer(WithStore(&Store{}), WithTracerProvider(tp))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parent  = "00f067aa0ba902b7"
+	)
+	req := httptest.NewRequest("GET", "/health/live", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parent+"-01")
+	req.Header.Set(headerService, "tenant1")
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatal(gotWanted(len(spans), 1))
+	}
+	s := spans[0]
+	if got := s.SpanContext.TraceID().String(); got != traceID {
+		t.Error(gotWanted(got, traceID))
+	}
+	if got := s.Parent.SpanID().String(); got != parent {
+		t.Error(gotWanted(got, parent))
+	}
+	if s.Name != RouteLive {
+		t.Error(gotWanted(s.Name, RouteLive))
+	}
+	if got := spanAttr(s, attrTenant).AsString(); got != "tenant1" {
+		t.Error(gotWanted(got, "tenant1"))
+	}
+	if got := spanAttr(s, "http.response.status_code").AsInt64(); got != http.StatusOK {
+		t.Error(gotWanted(got, http.StatusOK))
+	}
+	wanted := "00-" + traceID + "-" + s.SpanContext.SpanID().String() + "-01"
+	if got := w.Header().Get("traceparent"); got != wanted {
+		t.Error(gotWanted(got, wanted))
+	}
+}
+
+func TestTracing_StoreOp(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+
+	st := &Store{config: DefaultStoreConfig()}
+	_, op := st.startOp(ctx, "SetAllAttrs", EntityID{ID: "E1", Type: "T"})
+	op.setAttrCount(3)
+	err := error(ErrNotFoundEntity)
+	op.end(&err)
+	_, op = st.startOp(ctx, "CountEntities", EntityID{})
+	op.setResultSize(7)
+	err = context.DeadlineExceeded
+	op.end(&err)
+	parent.End()
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatal(gotWanted(len(spans), 3))
+	}
+	set, count := spans[0], spans[1]
+	for _, s := range []tracetest.SpanStub{set, count} {
+		if s.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s: not a child of the request", s.Name)
+		}
+	}
+	if set.Name != "store.SetAllAttrs" {
+		t.Error(gotWanted(set.Name, "store.SetAllAttrs"))
+	}
+	if got := spanAttr(set, attrEntityType).AsString(); got != "T" {
+		t.Error(gotWanted(got, "T"))
+	}
+	if got := spanAttr(set, attrAttrCount).AsInt64(); got != 3 {
+		t.Error(gotWanted(got, 3))
+	}
+	if got := spanAttr(set, "db.collection.name").AsString(); got != "ent" {
+		t.Error(gotWanted(got, "ent"))
+	}
+	// an expected outcome, not a failure
+	if set.Status.Code == codes.Error {
+		t.Error("span failed for a not found entity")
+	}
+	if got := spanAttr(count, attrResultSize).AsInt64(); got != 7 {
+		t.Error(gotWanted(got, 7))
+	}
+	if count.Status.Code != codes.Error {
+		t.Error(gotWanted(count.Status.Code, codes.Error))
+	}
+}
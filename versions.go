@@ -0,0 +1,448 @@
+package gorrion
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The entities of StoreConfig.VersionTypes keep their prior versions: the
+// operation changing or deleting one of them saves it, as it was, in the
+// versions collection. A version is stored as the entity was, with its number
+// in the _id, so the conditions of a Query select versions as well, and holds
+// from its dateModified until it was replaced. Failing to save it does not fail
+// the operation, whose write is done already, see recordFailed.
+
+const (
+	versionField = "version"
+	// when a version was replaced, or deleted
+	untilField = "until"
+)
+
+// versionID identifies a version as EntityID does an entity, with the same
+// fields and the number of the version
+type versionID struct {
+	ID          string
+	Type        string
+	Service     string
+	ServicePath string
+	Version     int
+}
+
+// versionDoc is a version as stored
+type versionDoc struct {
+	ID           versionID            `bson:"_id"`
+	Attrs        map[string]Attribute `bson:"attrs"`
+	DateCreated  time.Time            `bson:"dateCreated,omitempty"`
+	DateModified time.Time            `bson:"dateModified"`
+	Location     interface{}          `bson:"location,omitempty"`
+	Until        time.Time            `bson:"until"`
+	Deleted      bool                 `bson:"deleted,omitempty"`
+}
+
+// entity returns the entity as it was in the version
+func (v *versionDoc) entity() *Entity {
+	return &Entity{
+		ID:           EntityID{ID: v.ID.ID, Type: v.ID.Type, Service: v.ID.Service, ServicePath: v.ID.ServicePath},
+		Attrs:        v.Attrs,
+		DateCreated:  v.DateCreated,
+		DateModified: v.DateModified,
+		Location:     v.Location,
+		Version:      v.ID.Version,
+	}
+}
+
+// EntityVersion describes a prior version of an entity, the entity as it was
+// from From until Until
+type EntityVersion struct {
+	Version int       `json:"version"`
+	From    time.Time `json:"from"`
+	Until   time.Time `json:"until"`
+	// replaced by deleting the entity
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// keepsVersions tells whether the prior versions of the entities of type
+// entityType are kept
+func (c StoreConfig) keepsVersions(entityType string) bool {
+	for _, t := range c.VersionTypes {
+		if t == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *Store) withVerCol(ctx context.Context, retry bool, f func(col *mgo.Collection) error) error {
+	return st.runCol(ctx, func() string { return st.config.VersionsColl }, retry, f)
+}
+
+// ensureVersionIndexes indexes the versions by entity, as queries select them
+func (st *Store) ensureVersionIndexes(sess *mgo.Session) error {
+	return sess.DB(st.config.DB).C(st.config.VersionsColl).EnsureIndex(mgo.Index{
+		Key: []string{"_id.service", "_id.servicepath", "_id.id", "_id.type", "_id." + versionField},
+	})
+}
+
+// versionsOf is the condition selecting the versions of the entity ei
+func versionsOf(ei EntityID) bson.M {
+	return bson.M{"_id.id": ei.ID, "_id.type": ei.Type, "_id.service": ei.Service, "_id.servicepath": ei.ServicePath}
+}
+
+// recordVersion keeps old, an entity as it was until it was replaced at until,
+// or deleted, if its versions are kept, telling recordFailed if it cannot.
+// Nothing is kept for a nil old.
+func (st *Store) recordVersion(ctx context.Context, old *Entity, until time.Time, deleted bool) {
+	if old == nil || !st.config.keepsVersions(old.ID.Type) {
+		return
+	}
+	from := old.DateModified
+	if from.IsZero() {
+		from = old.DateCreated
+	}
+	v := &versionDoc{
+		ID: versionID{ID: old.ID.ID, Type: old.ID.Type, Service: old.ID.Service, ServicePath: old.ID.ServicePath,
+			Version: old.Version},
+		Attrs:        old.Attrs,
+		DateCreated:  old.DateCreated,
+		DateModified: from,
+		Location:     old.Location,
+		Until:        until,
+		Deleted:      deleted,
+	}
+	err := st.withVerCol(ctx, false, func(col *mgo.Collection) error {
+		return col.Insert(v)
+	})
+	// a duplicate is a version kept already
+	if err != nil && !mgo.IsDup(err) {
+		st.recordFailed(ctx, "version", old.ID, err)
+	}
+}
+
+// firstVersion is the number of the first version of a new entity ei, after
+// those kept of a former entity with its id
+func (st *Store) firstVersion(ctx context.Context, ei EntityID) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, contextErr(err)
+	}
+	if !st.config.keepsVersions(ei.Type) {
+		return 1, nil
+	}
+	var last versionDoc
+	err := st.withVerCol(ctx, true, func(col *mgo.Collection) error {
+		q := col.Find(versionsOf(ei)).Select(bson.M{"_id": true}).Sort("-_id." + versionField)
+		return withMaxTime(ctx, q).One(&last)
+	})
+	if err == mgo.ErrNotFound {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return last.ID.Version + 1, nil
+}
+
+// GetEntityVersions returns a page of the prior versions of the entity ei,
+// oldest first. The entity itself is not in them, even if deleted.
+func (st *Store) GetEntityVersions(ctx context.Context, ei EntityID, limit, offset int) (versions []EntityVersion, err error) {
+	ctx, op := st.startOp(ctx, "GetEntityVersions", ei)
+	defer op.end(&err)
+	op.setCollection(st.config.VersionsColl)
+	if !st.config.keepsVersions(ei.Type) {
+		return nil, ErrVersionsNotKept
+	}
+	var docs []versionDoc
+	err = st.withVerCol(ctx, true, func(col *mgo.Collection) error {
+		q := col.Find(versionsOf(ei)).Select(bson.M{"attrs": false, locationField: false}).
+			Sort("_id." + versionField).Skip(offset).Limit(limit)
+		return withMaxTime(ctx, q).All(&docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions = make([]EntityVersion, 0, len(docs))
+	for _, d := range docs {
+		versions = append(versions, EntityVersion{Version: d.ID.Version, From: d.DateModified, Until: d.Until,
+			Deleted: d.Deleted})
+	}
+	op.setResultSize(len(versions))
+	return versions, nil
+}
+
+// GetEntityVersion returns the entity ei as it was in the version numbered
+// version, which may be the current one. Entity.Version numbers them, from 0
+// for the entities stored before there were versions.
+func (st *Store) GetEntityVersion(ctx context.Context, ei EntityID, version int) (e *Entity, err error) {
+	ctx, op := st.startOp(ctx, "GetEntityVersion", ei)
+	defer op.end(&err)
+	if !st.config.keepsVersions(ei.Type) {
+		return nil, ErrVersionsNotKept
+	}
+	var v versionDoc
+	condition := versionsOf(ei)
+	condition["_id."+versionField] = version
+	err = st.withVerCol(ctx, true, func(col *mgo.Collection) error {
+		return withMaxTime(ctx, col.Find(condition)).One(&v)
+	})
+	if err == nil {
+		return v.entity(), nil
+	}
+	if err != mgo.ErrNotFound {
+		return nil, err
+	}
+	e, err = st.getEntityAttrs(ctx, ei, nil)
+	if err == ErrNotFoundEntity || (err == nil && e.Version != version) {
+		return nil, ErrNotFoundVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// RestoreEntity makes the entity as it was in v, a version returned by
+// GetEntityVersion, replacing its attributes or, if it was deleted and
+// recreate is true, creating it again. The entity replaced is kept as another
+// version. It returns ErrNotFoundEntity for a deleted entity not recreated.
+func (st *Store) RestoreEntity(ctx context.Context, v *Entity, recreate bool) (err error) {
+	ctx, op := st.startOp(ctx, "RestoreEntity", v.ID)
+	defer op.end(&err)
+	op.setAttrCount(len(v.Attrs))
+	_, err = st.setAllAttrs(ctx, v.ID, v.Attrs)
+	if err == ErrNotFoundEntity && recreate {
+		e := NewEntity(v.ID)
+		e.Attrs = v.Attrs
+		err = st.createEntity(ctx, e)
+	}
+	return err
+}
+
+// GetEntityAsOf returns the entity ei as it was at asOf
+func (st *Store) GetEntityAsOf(ctx context.Context, ei EntityID, asOf time.Time) (e *Entity, err error) {
+	ctx, op := st.startOp(ctx, "GetEntityAsOf", ei)
+	defer op.end(&err)
+	if !st.config.keepsVersions(ei.Type) {
+		return nil, ErrVersionsNotKept
+	}
+	e, err = st.getEntityAttrs(ctx, ei, nil)
+	if err == nil && !e.DateModified.After(asOf) {
+		return e, nil
+	}
+	if err != nil && err != ErrNotFoundEntity {
+		return nil, err
+	}
+	var v versionDoc
+	condition := versionsOf(ei)
+	condition[dateModifiedField] = bson.M{"$lte": asOf}
+	condition[untilField] = bson.M{"$gt": asOf}
+	err = st.withVerCol(ctx, true, func(col *mgo.Collection) error {
+		return withMaxTime(ctx, col.Find(condition)).One(&v)
+	})
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFoundEntity
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.entity(), nil
+}
+
+// GetEntitiesAsOf runs the query q over the entities as they were at asOf,
+// sorted by id and type. The entities whose versions are not kept are there
+// only if they have not changed since. The results cannot be sorted otherwise
+// nor resumed by a cursor.
+func (st *Store) GetEntitiesAsOf(ctx context.Context, q *Query, service, servicepath string, asOf time.Time) (entities []Entity, err error) {
+	ctx, op := st.startOp(ctx, "GetEntitiesAsOf", EntityID{Service: service, ServicePath: servicepath})
+	defer op.end(&err)
+	op.setQuery(q)
+	if len(q.OrderBy) > 0 || q.Cursor != "" {
+		return nil, ErrInvalidAsOfQuery
+	}
+	if err = q.build(service, servicepath, false); err != nil {
+		return nil, err
+	}
+	// the page can only be among the first entities of each collection
+	n := 0
+	if q.Limit > 0 {
+		n = q.Offset + q.Limit
+	}
+	find := func(col *mgo.Collection, condition bson.M, result interface{}) error {
+		mgoQ := withMaxTime(ctx, col.Find(condition)).Sort("_id.id", "_id.type").Limit(n)
+		if len(q.attrs) > 0 {
+			mgoQ = mgoQ.Select(q.attrs)
+		}
+		return mgoQ.All(result)
+	}
+	modified := bson.M{dateModifiedField: bson.M{"$lte": asOf}}
+	var current []Entity
+	err = st.withColRead(ctx, EntityID{Service: service, ServicePath: servicepath}, func(col *mgo.Collection) error {
+		return find(col, bson.M{"$and": []bson.M{q.condition, modified}}, &current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var versions []versionDoc
+	err = st.withVerCol(ctx, true, func(col *mgo.Collection) error {
+		replaced := bson.M{untilField: bson.M{"$gt": asOf}}
+		return find(col, bson.M{"$and": []bson.M{q.condition, modified, replaced}}, &versions)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	all := current
+	for i := range versions {
+		all = append(all, *versions[i].entity())
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i].ID, all[j].ID
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Type < b.Type
+	})
+	entities = []Entity{}
+	for i, e := range all {
+		// changed just at asOf, in both, the entity first
+		if i > 0 && all[i-1].ID == e.ID {
+			continue
+		}
+		entities = append(entities, e)
+	}
+	if q.Offset >= len(entities) {
+		entities = entities[:0]
+	} else {
+		entities = entities[q.Offset:]
+	}
+	if q.Limit > 0 && len(entities) > q.Limit {
+		entities = entities[:q.Limit]
+	}
+	op.setResultSize(len(entities))
+	return entities, nil
+}
+
+// asOfFromRequest takes the time of the asOf parameter, as in RFC 3339
+func asOfFromRequest(req *http.Request) (time.Time, error) {
+	asOf, err := time.Parse(time.RFC3339Nano, req.FormValue(paramAsOf))
+	if err != nil {
+		return time.Time{}, ErrInvalidAsOf
+	}
+	return asOf, nil
+}
+
+// versionFromRequest takes the number of the version in the URL
+func versionFromRequest(args handlerArgs) (int, error) {
+	version, err := strconv.Atoi(args.vars[versionField])
+	if err != nil || version < 0 {
+		return 0, ErrInvalidVersion
+	}
+	return version, nil
+}
+
+// onlyAttrs leaves in e the attributes in attrs, all if empty
+func onlyAttrs(e *Entity, attrs []string) {
+	if len(attrs) == 0 {
+		return
+	}
+	selected := make(map[string]Attribute, len(attrs))
+	for _, name := range attrs {
+		if a, ok := e.Attrs[name]; ok {
+			selected[name] = a
+		}
+	}
+	e.Attrs = selected
+}
+
+func getEntityAsOfHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	asOf, err := asOfFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	e, err := args.store.GetEntityAsOf(ctx, args.ID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	attrs := splitParam(args.req, paramAttrs)
+	onlyAttrs(e, attrs)
+	return formatEntity(e, args.options, attrs)
+}
+
+func getEntitiesAsOfHandleF(ctx context.Context, args handlerArgs, q *Query) (interface{}, error) {
+	asOf, err := asOfFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if args.options.Get(OptCount) {
+		return nil, ErrInvalidAsOfQuery
+	}
+	entities, err := args.store.GetEntitiesAsOf(ctx, q, args.ID.Service, args.ID.ServicePath, asOf)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, len(entities))
+	for i := range entities {
+		r, err := formatEntity(&entities[i], args.options, q.Attrs)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+func getEntityVersionsHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	limit, offset, err := pageFromRequest(args.req)
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		limit = defaultLimit
+	} else if limit > maxLimit {
+		return nil, ErrInvalidLimit
+	}
+	return args.store.GetEntityVersions(ctx, args.ID, limit, offset)
+}
+
+func getEntityVersionHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	version, err := versionFromRequest(args)
+	if err != nil {
+		return nil, err
+	}
+	e, err := args.store.GetEntityVersion(ctx, args.ID, version)
+	if err != nil {
+		return nil, err
+	}
+	attrs := splitParam(args.req, paramAttrs)
+	onlyAttrs(e, attrs)
+	return formatEntity(e, args.options, attrs)
+}
+
+func restoreEntityVersionHandleF(ctx context.Context, args handlerArgs) (interface{}, error) {
+	version, err := versionFromRequest(args)
+	if err != nil {
+		return nil, err
+	}
+	v, err := args.store.GetEntityVersion(ctx, args.ID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err = args.srv.checkWrite(ctx, args.store, args.ID, v.Attrs, true); err != nil {
+		return nil, err
+	}
+	// creating it again, if it was deleted, needs a grant to create
+	denied := args.srv.authorizeAlso(args, opCreate)
+	err = args.store.RestoreEntity(ctx, v, denied == nil)
+	if err == ErrNotFoundEntity && denied != nil {
+		return nil, denied
+	}
+	if err != nil {
+		return nil, err
+	}
+	args.w.WriteHeader(204)
+	return nil, nil
+}
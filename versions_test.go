@@ -0,0 +1,312 @@
+package gorrion
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOnlyAttrs(t *testing.T) {
+	e := NewEntity(EntityID{ID: "Room1", Type: "Room"})
+	e.Attrs = map[string]Attribute{"temperature": {Value: 20.0}, "pressure": {Value: 720.0}}
+	onlyAttrs(e, nil)
+	if len(e.Attrs) != 2 {
+		t.Error(gotWanted(e.Attrs, "all the attributes"))
+	}
+	onlyAttrs(e, []string{"pressure", "humidity"})
+	if _, ok := e.Attrs["pressure"]; !ok || len(e.Attrs) != 1 {
+		t.Error(gotWanted(e.Attrs, "pressure"))
+	}
+}
+
+func TestRecordVersion_Failed(t *testing.T) {
+	st := &Store{config: StoreConfig{VersionTypes: []string{"Room"}}, recordFailures: newRecordFailures(),
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	ctx, cancel := context.WithCancel(testCtx)
+	cancel()
+	st.recordVersion(ctx, NewEntity(EntityID{ID: "Room1", Type: "Room"}), time.Now(), false)
+	if got := testutil.ToFloat64(st.recordFailures.WithLabelValues("version")); got != 1 {
+		t.Error(gotWanted(got, 1))
+	}
+}
+
+func TestVersions_InvalidRequests(t *testing.T) {
+	srv, err := NewServer(WithConfig(DefaultConfig()), WithStore(&Store{}))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	var cases = map[string]int{
+		"/v2/entities/Room1?asOf=yesterday":                     http.StatusBadRequest,
+		"/v2/entities/?asOf=2024-01-01":                         http.StatusBadRequest,
+		"/v2/entities/Room1/versions/last":                      http.StatusBadRequest,
+		"/v2/entities/Room1/versions/-1":                        http.StatusBadRequest,
+		"/v2/entities/Room1/versions?limit=0":                   http.StatusBadRequest,
+		"/v2/entities/?asOf=2024-01-01T00:00:00Z&options=count": http.StatusBadRequest,
+	}
+	for path, status := range cases {
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: %s", path, gotWanted(w.Code, status))
+		}
+	}
+}
+
+func TestEntityVersions(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.Store.VersionTypes = []string{"Room"}
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	st := srv.Store()
+	dropTestCollection(t, st)
+
+	room := EntityID{ID: "Room1", Type: "Room", Service: "S"}
+	// the times between the writes, at[i] while the temperature was 20+i
+	var at []time.Time
+	pause := func() {
+		time.Sleep(10 * time.Millisecond)
+		at = append(at, time.Now())
+		time.Sleep(10 * time.Millisecond)
+	}
+	e := NewEntity(room)
+	e.Attrs["temperature"] = Attribute{Type: "Number", Value: 20.0}
+	if err = st.CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	pause()
+	for _, v := range []float64{21, 22} {
+		if _, err = st.UpdateAttrs(testCtx, room, map[string]Attribute{"temperature": {Type: "Number", Value: v}}); err != nil {
+			t.Fatal(unexpected(err))
+		}
+		pause()
+	}
+	car := NewEntity(EntityID{ID: "Car1", Type: "Car", Service: "S"})
+	if err = st.CreateEntity(testCtx, car); err != nil {
+		t.Fatal(unexpected(err))
+	}
+
+	versions, err := st.GetEntityVersions(testCtx, room, 10, 0)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 || versions[0].Deleted {
+		t.Fatal(gotWanted(versions, "versions 1 and 2"))
+	}
+	temperature := func(e *Entity) interface{} {
+		return e.Attrs["temperature"].Value
+	}
+	for version, wanted := range []float64{20, 21, 22} {
+		e, err := st.GetEntityVersion(testCtx, room, version+1)
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if temperature(e) != wanted {
+			t.Errorf("version %d: %s", version+1, gotWanted(temperature(e), wanted))
+		}
+	}
+	if _, err = st.GetEntityVersion(testCtx, room, 4); err != ErrNotFoundVersion {
+		t.Error(gotWanted(err, ErrNotFoundVersion))
+	}
+	if _, err = st.GetEntityVersions(testCtx, car.ID, 10, 0); err != ErrVersionsNotKept {
+		t.Error(gotWanted(err, ErrVersionsNotKept))
+	}
+
+	// as they were
+	for i, wanted := range []float64{20, 21, 22} {
+		e, err := st.GetEntityAsOf(testCtx, room, at[i])
+		if err != nil {
+			t.Fatal(unexpected(err))
+		}
+		if temperature(e) != wanted {
+			t.Errorf("as of %s: %s", at[i], gotWanted(temperature(e), wanted))
+		}
+	}
+	if _, err = st.GetEntityAsOf(testCtx, room, at[0].Add(-time.Hour)); err != ErrNotFoundEntity {
+		t.Error(gotWanted(err, ErrNotFoundEntity))
+	}
+	// the car did not exist yet, the room had the temperature of then
+	entities, err := st.GetEntitiesAsOf(testCtx, &Query{}, "S", "", at[1])
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(entities) != 1 || entities[0].ID.ID != "Room1" || temperature(&entities[0]) != 21.0 {
+		t.Error(gotWanted(entities, "Room1 at 21"))
+	}
+	entities, err = st.GetEntitiesAsOf(testCtx, &Query{Q: "temperature>21"}, "S", "", at[1])
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(entities) != 0 {
+		t.Error(gotWanted(entities, "none"))
+	}
+	if _, err = st.GetEntitiesAsOf(testCtx, &Query{OrderBy: []string{"temperature"}}, "S", "", at[1]); err != ErrInvalidAsOfQuery {
+		t.Error(gotWanted(err, ErrInvalidAsOfQuery))
+	}
+
+	// deleted, and created again, numbered after the versions kept
+	if err = st.DeleteEntity(testCtx, room); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	e = NewEntity(room)
+	e.Attrs["temperature"] = Attribute{Type: "Number", Value: 30.0}
+	if err = st.CreateEntity(testCtx, e); err != nil {
+		t.Fatal(unexpected(err))
+	}
+	versions, err = st.GetEntityVersions(testCtx, room, 10, 0)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	if len(versions) != 3 || !versions[2].Deleted {
+		t.Fatal(gotWanted(versions, "version 3 deleted"))
+	}
+	if e, err = st.GetEntity(testCtx, room); err != nil || e.Version != 4 {
+		t.Fatal(gotWanted(e, "version 4"), unexpected(err))
+	}
+
+	// restored through the API, and read as of before
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set(headerService, "S")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w
+	}
+	w := do("POST", "/v2/entities/Room1/versions/2/restore?type=Room")
+	if w.Code != http.StatusNoContent {
+		t.Fatal(gotWanted(w.Code, http.StatusNoContent), w.Body.String())
+	}
+	if e, err = st.GetEntity(testCtx, room); err != nil || temperature(e) != 21.0 {
+		t.Error(gotWanted(e, "temperature 21"), unexpected(err))
+	}
+	w = do("GET", "/v2/entities/Room1/versions?type=Room&limit=2&offset=2")
+	var page []EntityVersion
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page) != 2 || page[0].Version != 3 || page[1].Version != 4 {
+		t.Error(gotWanted(page, "versions 3 and 4"))
+	}
+	w = do("GET", "/v2/entities/Room1/versions/4?type=Room&options=keyValues")
+	var kv object
+	json.Unmarshal(w.Body.Bytes(), &kv)
+	if kv["temperature"] != 30.0 {
+		t.Error(gotWanted(kv, "temperature 30"))
+	}
+	w = do("GET", "/v2/entities/Room1?type=Room&options=keyValues&asOf="+at[0].Format(time.RFC3339Nano))
+	kv = nil
+	json.Unmarshal(w.Body.Bytes(), &kv)
+	if kv["temperature"] != 20.0 {
+		t.Error(gotWanted(kv, "temperature 20"))
+	}
+	w = do("GET", "/v2/entities/?options=keyValues&asOf="+at[2].Format(time.RFC3339Nano))
+	var list []object
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 1 || list[0]["temperature"] != 22.0 {
+		t.Error(gotWanted(list, "Room1 at 22"))
+	}
+	w = do("GET", "/v2/entities/?options=keyValues&asOf="+time.Now().Format(time.RFC3339Nano))
+	list = nil
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 2 || list[0]["id"] != "Car1" || list[1]["temperature"] != 21.0 {
+		t.Error(gotWanted(list, "Car1 and Room1 at 21"))
+	}
+}
+
+func TestEntityVersions_Bulk(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := testStoreConfig()
+	c.VersionTypes = []string{"Room"}
+	st, err := OpenStore(c)
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer st.Close()
+	dropTestCollection(t, st)
+
+	for _, ei := range []EntityID{{ID: "Room1", Type: "Room"}, {ID: "Room2", Type: "Room"}, {ID: "Car1", Type: "Car"}} {
+		e := NewEntity(ei)
+		e.Attrs["temperature"] = Attribute{Type: "Number", Value: 20.0}
+		if err = st.CreateEntity(testCtx, e); err != nil {
+			t.Fatal(unexpected(err))
+		}
+	}
+	attrs := map[string]Attribute{"temperature": {Type: "Number", Value: 21.0}}
+	if n, err := st.UpdateEntities(testCtx, &Query{}, "", "", attrs, false); err != nil || n != 3 {
+		t.Fatal(gotWanted(n, 3), unexpected(err))
+	}
+	for _, id := range []string{"Room1", "Room2"} {
+		e, err := st.GetEntityVersion(testCtx, EntityID{ID: id, Type: "Room"}, 1)
+		if err != nil || e.Attrs["temperature"].Value != 20.0 {
+			t.Error(id, gotWanted(e, "version 1 at 20"), unexpected(err))
+		}
+	}
+	if n, err := st.DeleteEntities(testCtx, &Query{Type: []string{"Room", "Car"}}, "", "", false); err != nil || n != 3 {
+		t.Fatal(gotWanted(n, 3), unexpected(err))
+	}
+	versions, err := st.GetEntityVersions(testCtx, EntityID{ID: "Room1", Type: "Room"}, 10, 0)
+	if err != nil || len(versions) != 2 || !versions[1].Deleted {
+		t.Error(gotWanted(versions, "version 2 deleted"), unexpected(err))
+	}
+}
+
+func TestEntityVersions_RestoreAuth(t *testing.T) {
+	setupTestDB(t)
+	defer teardownTestDB(t)
+
+	c := DefaultConfig()
+	c.Store = testStoreConfig()
+	c.Store.VersionTypes = []string{"Room"}
+	c.AuthFile = "testdata/auth.yaml"
+	srv, err := NewServer(WithConfig(c))
+	if err != nil {
+		t.Fatal(unexpected(err))
+	}
+	defer srv.Close()
+	dropTestCollection(t, srv.Store())
+
+	do := func(method, path, key, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(headerService, "smartcity")
+		req.Header.Set(headerServicePath, "/parking")
+		req.Header.Set("Authorization", "Bearer "+key)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		return w.Code
+	}
+	var steps = []struct {
+		method, path, key, body string
+		wanted                  int
+	}{
+		{"POST", "/v2/entities", "root-key", `{"id": "Room1", "type": "Room", "temperature": {"value": 20}}`, http.StatusCreated},
+		{"PATCH", "/v2/entities/Room1/attrs?type=Room", "root-key", `{"temperature": {"value": 21}}`, http.StatusNoContent},
+		// the gateway may update it
+		{"POST", "/v2/entities/Room1/versions/1/restore?type=Room", "gateway-key", "", http.StatusNoContent},
+		{"DELETE", "/v2/entities/Room1?type=Room", "root-key", "", http.StatusNoContent},
+		// but not create it again
+		{"POST", "/v2/entities/Room1/versions/1/restore?type=Room", "gateway-key", "", http.StatusForbidden},
+		{"POST", "/v2/entities/Room1/versions/1/restore?type=Room", "root-key", "", http.StatusNoContent},
+	}
+	for _, s := range steps {
+		if code := do(s.method, s.path, s.key, s.body); code != s.wanted {
+			t.Fatal(gotWanted(code, s.wanted) + " (" + s.method + " " + s.path + " " + s.key + ")")
+		}
+	}
+}